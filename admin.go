@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Password for the admin pages (user "admin"); they are off without it
+var adminPassword string
+
+// AdminPage holds data for the admin dashboard
+type AdminPage struct {
+	Workers int
+	Queued  int
+	Tasks   []Task
+
+	Slots      int            // Ollama generation slots; 0 is unlimited
+	Generating int            // generations holding a slot
+	Waiting    map[string]int // generations waiting, by priority class
+
+	TTFTMean, TTFTLast time.Duration // time to first streamed token
+	TTFTCount          int
+	Unavailable        []CircuitStatus // Ollama hosts whose circuit is open
+	Hosts              []HostStatus    // every Ollama host, when there are several
+	Balance            string          // how chats are spread over them
+
+	Pulls []ScheduledPull // newest first
+	Disks []DiskStatus    // when disk limits are configured
+
+	Schedules []ScheduledPrompt // every session's, newest first
+
+	Maintenance         *MaintenanceReport // last store maintenance run, if any
+	MaintenanceInterval time.Duration      // between scheduled runs; 0 when off
+
+	Memory SessionMemory
+
+	L Localizer
+}
+
+// Check HTTP basic credentials for the admin pages, answering the request
+// itself when they are missing or wrong. Requests that change something
+// are refused when a browser says another site sent them, since it would
+// send the cached credentials along.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminPassword == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if crossSiteRequest(r) {
+		http.Error(w, "Cross-site request refused", http.StatusForbidden)
+		return false
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if !loginAllowed(w, r, user) {
+		return false
+	}
+	if user != "admin" || subtle.ConstantTimeCompare([]byte(pass), []byte(adminPassword)) != 1 {
+		loginFailed(r, user)
+		w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	loginSucceeded(r, user)
+	return true
+}
+
+// Whether a request other than GET or HEAD came from another site, going
+// by the Sec-Fetch-Site header browsers send, or by Origin in those that
+// do not. Clients such as curl send neither and are let through.
+func crossSiteRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
+
+// Admin dashboard: the background worker pool and its recent tasks
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tasks, queued := taskSnapshot()
+	generating, waiting := generations.stats()
+	page := AdminPage{Workers: workerCount, Queued: queued, Tasks: tasks,
+		Slots: ollamaSlots, Generating: generating, Waiting: waiting, Pulls: pullSnapshot(), Schedules: scheduleSnapshot(""), Maintenance: lastMaintenanceReport(), MaintenanceInterval: maintenanceInterval, Memory: sessionMemory(), Unavailable: openCircuits(), Hosts: hostStatuses(), Balance: ollamaBalance, L: requestLocalizer(r)}
+	page.TTFTMean, page.TTFTLast, page.TTFTCount = ttftStats()
+	page.TTFTMean, page.TTFTLast = page.TTFTMean.Round(time.Millisecond), page.TTFTLast.Round(time.Millisecond)
+	if modelsDir != "" || modelsQuota > 0 {
+		for _, host := range upstreams() {
+			st, err := diskStatus(withUpstream(r.Context(), host))
+			if err != nil {
+				st.Warning = "disk status unavailable: " + err.Error()
+			}
+			page.Disks = append(page.Disks, st)
+		}
+	}
+	renderPage(w, r, "admin.html", page)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAgentTurns = 6
+	maxAgentTurns     = 30
+)
+
+// Agent is one participant in a multi-agent conversation
+type Agent struct {
+	Name   string
+	Model  string
+	Prompt string
+}
+
+// AgentConversation is a discussion between agents on a topic. Each stored
+// message carries the speaking agent's name.
+type AgentConversation struct {
+	ID       int
+	Topic    string
+	Agents   []Agent
+	Turns    int
+	Messages []Message
+	Created  time.Time
+	Error    string
+}
+
+// Copy of a conversation that is safe to read while runAgents keeps
+// appending to the original. Callers must hold sessionMut.
+func (c *AgentConversation) snapshot() *AgentConversation {
+	copied := *c
+	copied.Messages = append([]Message(nil), c.Messages...)
+	return &copied
+}
+
+// AgentsPage holds data for the agents templates
+type AgentsPage struct {
+	Conversations []*AgentConversation
+	Conversation  *AgentConversation
+	DefaultModel  string
+	DefaultTurns  int
+}
+
+// Agent routes: GET /agents shows the setup form and past conversations,
+// POST /agents runs a new one and streams it, GET /agents/<n> replays one.
+func agentsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/agents"), "/")
+
+	switch {
+	case r.Method == http.MethodPost && path == "":
+		runAgents(w, r, sessionID)
+	case r.Method != http.MethodGet:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case path == "":
+		sessionMut.Lock()
+		var convs []*AgentConversation
+		for _, conv := range getSession(sessionID).Agents {
+			convs = append(convs, conv.snapshot())
+		}
+		sessionMut.Unlock()
+		renderPage(w, r, "agents.html", AgentsPage{Conversations: convs, DefaultModel: defaultModelFor(r.Context()), DefaultTurns: defaultAgentTurns})
+	default:
+		id, err := strconv.Atoi(path)
+		sessionMut.Lock()
+		convs := getSession(sessionID).Agents
+		var conv *AgentConversation
+		if err == nil && id >= 1 && id <= len(convs) {
+			conv = convs[id-1].snapshot()
+		}
+		sessionMut.Unlock()
+		if conv == nil {
+			http.NotFound(w, r)
+			return
+		}
+		renderPage(w, r, "agent_conversation.html", AgentsPage{Conversation: conv})
+	}
+}
+
+// Parse the setup form: repeated agent_name/agent_model/agent_prompt fields
+func parseAgents(r *http.Request) []Agent {
+	names := r.Form["agent_name"]
+	models := r.Form["agent_model"]
+	prompts := r.Form["agent_prompt"]
+
+	var agents []Agent
+	for i := range names {
+		a := Agent{Name: strings.TrimSpace(names[i])}
+		if i < len(models) {
+			a.Model = strings.TrimSpace(models[i])
+		}
+		if i < len(prompts) {
+			a.Prompt = strings.TrimSpace(prompts[i])
+		}
+		if a.Name == "" || a.Prompt == "" {
+			continue
+		}
+		if a.Model == "" {
+			a.Model = defaultModelFor(r.Context())
+		}
+		agents = append(agents, a)
+	}
+	return agents
+}
+
+// Run the agents round-robin for the requested number of turns, sending
+// each reply to the browser as it is finished
+func runAgents(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Malformed form submission", http.StatusBadRequest)
+		return
+	}
+	agents := parseAgents(r)
+	topic := strings.TrimSpace(r.FormValue("topic"))
+	turns, err := strconv.Atoi(r.FormValue("turns"))
+	if err != nil || turns < 1 {
+		turns = defaultAgentTurns
+	}
+	if turns > maxAgentTurns {
+		turns = maxAgentTurns
+	}
+	if len(agents) < 2 || topic == "" {
+		http.Error(w, "At least two agents with a name and system prompt, and a topic, are required", http.StatusBadRequest)
+		return
+	}
+	for _, a := range agents {
+		if err := checkModelAllowed(r.Context(), a.Model); err != nil {
+			http.Error(w, fmt.Sprintf("Agent %s: %v", a.Name, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	conv := &AgentConversation{Topic: topic, Agents: agents, Turns: turns, Created: time.Now()}
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	conv.ID = len(sess.Agents) + 1
+	sess.Agents = append(sess.Agents, conv)
+	sessionMut.Unlock()
+
+	tmpl, err := loadedTemplates(basePath(r.Context()))
+	if err != nil {
+		http.Error(w, "Page could not be rendered", http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+
+	// Each part of the page is sent as soon as it is ready, so every reply
+	// shows up when its agent finishes speaking
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fw := &flushingWriter{w: w, status: http.StatusOK}
+	render := func(name string, data interface{}) {
+		if err := tmpl.ExecuteTemplate(fw, name, data); err != nil {
+			log.Printf("Template error: %v", err)
+		}
+	}
+	render("agents_run_start", conv)
+
+	var transcript []Message
+	for turn := 0; turn < turns; turn++ {
+		agent := agents[turn%len(agents)]
+		reply, err := ollamaStream(r.Context(), OllamaChatRequest{
+			Model:    agent.Model,
+			Messages: agentView(agent, agents, topic, transcript),
+		}, nil)
+		if err != nil {
+			log.Printf("Agent %s error: %v", agent.Name, err)
+			render("agents_run_error", struct{ Name, Error string }{agent.Name, err.Error()})
+			sessionMut.Lock()
+			conv.Error = err.Error()
+			sessionMut.Unlock()
+			break
+		}
+
+		msg := Message{Role: "assistant", Name: agent.Name, Content: reply}
+		transcript = append(transcript, msg)
+		sessionMut.Lock()
+		conv.Messages = append(conv.Messages, msg)
+		sessionMut.Unlock()
+		render("agents_run_message", msg)
+	}
+
+	render("agents_run_end", conv)
+}
+
+// Build the message list one agent sees: its own system prompt, the topic,
+// its earlier turns as assistant messages, and everyone else's as
+// attributed user messages
+func agentView(self Agent, agents []Agent, topic string, transcript []Message) []Message {
+	var others []string
+	for _, a := range agents {
+		if a.Name != self.Name {
+			others = append(others, a.Name)
+		}
+	}
+
+	msgs := []Message{
+		{Role: "system", Content: fmt.Sprintf("%s\n\nYou are %s, taking part in a discussion with %s. "+
+			"Reply with your next contribution only, without prefixing your name.",
+			self.Prompt, self.Name, strings.Join(others, ", "))},
+		{Role: "user", Content: "Topic: " + topic},
+	}
+	for _, m := range transcript {
+		if m.Name == self.Name {
+			msgs = append(msgs, Message{Role: "assistant", Content: m.Content})
+		} else {
+			msgs = append(msgs, Message{Role: "user", Content: m.Name + ": " + m.Content})
+		}
+	}
+	return msgs
+}
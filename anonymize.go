@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Optional YAML file with extra names and patterns for the anonymizer
+var anonymizeConfigPath string
+
+// AnonymizeConfig lists extra things to anonymize beyond emails, IPs and
+// self-introduced names
+type AnonymizeConfig struct {
+	Names    []string `yaml:"names"`
+	Patterns []struct {
+		Label   string `yaml:"label"`
+		Pattern string `yaml:"pattern"`
+	} `yaml:"patterns"`
+}
+
+type anonymizeRule struct {
+	label   string
+	pattern *regexp.Regexp
+	// Produces the n'th pseudonym for this kind of value
+	pseudonym func(n int) string
+}
+
+var (
+	anonymizeConfig AnonymizeConfig
+	anonymizeRules  []anonymizeRule
+)
+
+// Phrases people use to introduce themselves or others; the captured name is
+// then replaced everywhere it appears
+var introducedName = regexp.MustCompile(`\b(?:[Mm]y name is|[Ii]'m|[Ii] am|[Cc]all me|[Tt]his is|[Nn]ame:)\s+([A-Z][a-z]+(?:\s+[A-Z][a-z]+)?)`)
+
+// Words that follow "I'm" without being names
+var notNames = map[string]bool{"Sorry": true, "Not": true, "Just": true, "Here": true, "Happy": true, "Glad": true, "Also": true}
+
+// Runs of capitalised words, such as "Bob Smith" or "Dear Bob", which are
+// taken as names even when nobody introduced them
+var capitalizedRun = regexp.MustCompile(`\b[A-Z][a-z]+(?:[ \t]+[A-Z][a-z]+)+\b`)
+
+// Words that can start a capitalised run without being part of the name.
+// After a greeting or title, a single remaining word is still a name.
+var (
+	nameGreetings = map[string]bool{"Hi": true, "Hello": true, "Hey": true, "Dear": true, "Thanks": true,
+		"Mr": true, "Mrs": true, "Ms": true, "Dr": true, "Prof": true}
+	nameFillers = map[string]bool{"The": true, "This": true, "That": true, "And": true, "But": true, "So": true,
+		"Also": true, "Then": true, "Ask": true, "Tell": true, "Cc": true}
+)
+
+// Load the anonymizer configuration, if one was given
+func loadAnonymizer() error {
+	anonymizeRules = []anonymizeRule{
+		{"email", emailPattern, func(n int) string { return fmt.Sprintf("user%d@example.com", n) }},
+		{"ip", ipPattern, func(n int) string { return fmt.Sprintf("192.0.2.%d", (n-1)%254+1) }},
+	}
+	anonymizeConfig = AnonymizeConfig{}
+	if anonymizeConfigPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(anonymizeConfigPath)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, &anonymizeConfig); err != nil {
+		return fmt.Errorf("%s: %w", anonymizeConfigPath, err)
+	}
+	for _, p := range anonymizeConfig.Patterns {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: pattern %q: %w", anonymizeConfigPath, p.Label, err)
+		}
+		label := p.Label
+		anonymizeRules = append(anonymizeRules, anonymizeRule{label, re, func(n int) string { return fmt.Sprintf("%s-%d", label, n) }})
+	}
+	return nil
+}
+
+// anonymizer replaces identifying values with pseudonyms that stay the same
+// for the same value throughout one export, so conversations still read
+// coherently
+type anonymizer struct {
+	// Name as written -> the full name it refers to
+	names map[string]string
+	// Matches any known name, longest first; nil if there are none
+	namePattern *regexp.Regexp
+	replaced    map[string]string
+	counts      map[string]int
+}
+
+// Build an anonymizer for a set of texts, learning the names introduced in
+// any of them so earlier mentions are caught too
+func newAnonymizer(texts []string) *anonymizer {
+	a := &anonymizer{names: make(map[string]string), replaced: make(map[string]string), counts: make(map[string]int)}
+	var order []string
+	add := func(name, full string) {
+		if _, ok := a.names[name]; ok || name == "" || notNames[name] {
+			return
+		}
+		a.names[name] = full
+		order = append(order, name)
+	}
+	learn := func(full string, withFirst bool) {
+		full = strings.Join(strings.Fields(full), " ")
+		add(full, full)
+		// "Jane Doe" also shows up as plain "Jane"
+		if parts := strings.Fields(full); withFirst && len(parts) > 1 {
+			add(parts[0], full)
+		}
+	}
+
+	for _, name := range anonymizeConfig.Names {
+		learn(name, true)
+	}
+	for _, text := range texts {
+		for _, m := range introducedName.FindAllStringSubmatch(text, -1) {
+			learn(m[1], true)
+		}
+	}
+	// Guessed names are matched only as written, since their first word
+	// alone is too often an ordinary word
+	for _, text := range texts {
+		for _, run := range capitalizedRun.FindAllString(text, -1) {
+			words, greeted := strings.Fields(run), false
+			for len(words) > 0 && (nameGreetings[words[0]] || nameFillers[words[0]]) {
+				greeted = greeted || nameGreetings[words[0]]
+				words = words[1:]
+			}
+			if len(words) > 1 || greeted && len(words) == 1 {
+				learn(strings.Join(words, " "), false)
+			}
+		}
+	}
+
+	if len(order) > 0 {
+		// Longer names first so "Jane Doe" wins over "Jane"
+		sort.SliceStable(order, func(i, j int) bool { return len(order[i]) > len(order[j]) })
+		quoted := make([]string, len(order))
+		for i, name := range order {
+			quoted[i] = regexp.QuoteMeta(name)
+		}
+		a.namePattern = regexp.MustCompile(`\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	}
+	return a
+}
+
+func (a *anonymizer) pseudonym(kind, value string, gen func(int) string) string {
+	key := kind + "\x00" + value
+	if p, ok := a.replaced[key]; ok {
+		return p
+	}
+	a.counts[kind]++
+	p := gen(a.counts[kind])
+	a.replaced[key] = p
+	return p
+}
+
+// Anonymize replaces names, emails, IPs and configured patterns in s
+func (a *anonymizer) Anonymize(s string) string {
+	for _, rule := range anonymizeRules {
+		rule := rule
+		s = rule.pattern.ReplaceAllStringFunc(s, func(v string) string {
+			return a.pseudonym(rule.label, v, rule.pseudonym)
+		})
+	}
+	if a.namePattern != nil {
+		s = a.namePattern.ReplaceAllStringFunc(s, func(name string) string {
+			return a.pseudonym("name", a.names[name], func(n int) string { return fmt.Sprintf("Person %d", n) })
+		})
+	}
+	return s
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// APIError is the body of every JSON API error response
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// Write v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("JSON response error: %v", err)
+	}
+}
+
+// Write a JSON API error
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, APIError{Error: msg})
+}
+
+const maxAPIRequestBytes = 8 << 20
+
+// APIChatRequest is the body of POST /api/v1/chat
+type APIChatRequest struct {
+	Model    string                 `json:"model"`
+	Messages []Message              `json:"messages"`
+	Options  map[string]interface{} `json:"options"`
+	Stream   bool                   `json:"stream"`
+	// Continue the session's chat: the messages follow its history, and
+	// they and the reply are added to it
+	Session bool `json:"session"`
+	// Send the chat to the fallback backend even when its estimated cost
+	// needs confirming
+	ConfirmCost bool `json:"confirm_cost"`
+}
+
+// APIMessage is a history message with the ID edits and deletes refer to
+type APIMessage struct {
+	ID int `json:"id"`
+	Message
+}
+
+// APIHistoryRequest is the body of POST /api/v1/history, the JSON form of
+// the /history actions
+type APIHistoryRequest struct {
+	Action  string `json:"action"` // edit, resubmit, delete, regenerate, undo or fork
+	ID      int    `json:"id"`     // for regenerate, 0 is the last reply
+	Content string `json:"content"`
+	// Regenerate with another model or temperature than the default
+	Model       string   `json:"model"`
+	Temperature *float64 `json:"temperature"`
+}
+
+// APIConversation is one of the session's conversations
+type APIConversation struct {
+	ID           int                    `json:"id"`
+	Title        string                 `json:"title"`
+	SystemPrompt string                 `json:"system_prompt,omitempty"`
+	Options      map[string]interface{} `json:"options,omitempty"`
+	Summary      string                 `json:"summary,omitempty"` // sent in place of its older turns
+	Share        string                 `json:"share,omitempty"`   // token of its read-only link
+	Active       bool                   `json:"active"`
+}
+
+// APIConversationsRequest is the body of POST /api/v1/conversations, the
+// JSON form of the /conversations actions
+type APIConversationsRequest struct {
+	Action       string                 `json:"action"` // new, rename, prompt, options, switch, delete, share or unshare
+	ID           int                    `json:"id"`
+	Title        string                 `json:"title"`
+	SystemPrompt string                 `json:"system_prompt"`
+	Options      map[string]interface{} `json:"options"`
+}
+
+// APIChatChunk is one streamed piece of a reply: its answer, or what a
+// reasoning model thought before answering. The last one, with Done set,
+// carries any notices about changed options.
+type APIChatChunk struct {
+	Content   string   `json:"content"`
+	Reasoning string   `json:"reasoning,omitempty"`
+	Done      bool     `json:"done"`
+	Stopped   bool     `json:"stopped,omitempty"` // cut short by /chat/stop
+	Backend   string   `json:"backend,omitempty"` // fallback backend that answered, on the last chunk
+	Cost      float64  `json:"cost,omitempty"`    // estimated dollars the fallback charges, on the last chunk
+	Pending   bool     `json:"pending,omitempty"` // the prompt was queued until Ollama is back
+	Status    string   `json:"status,omitempty"`  // progress before the reply starts, such as a model download
+	Notices   []string `json:"notices,omitempty"`
+}
+
+// APIEmbeddingsRequest is the body of POST /api/v1/embeddings
+type APIEmbeddingsRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// Status for a service layer error
+func apiErrorStatus(err error) int {
+	if errors.Is(err, errInvalidRequest) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errBackendUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, errSessionFull) {
+		return http.StatusInsufficientStorage
+	}
+	var costErr *CostError
+	if errors.As(err, &costErr) {
+		return http.StatusPaymentRequired
+	}
+	return http.StatusBadGateway
+}
+
+// Tell API callers how the configured option limits changed their request,
+// one X-Option-Notice header each
+func writeOptionNotices(w http.ResponseWriter, notices []string) {
+	for _, n := range notices {
+		w.Header().Add("X-Option-Notice", n)
+	}
+}
+
+// Decode a JSON request body, answering 400 itself on failure
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestBytes)).Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return false
+	}
+	return true
+}
+
+// POST /api/v1/chat: chat over the given messages, statelessly unless
+// "session" is set. With "stream": true the reply arrives one APIChatChunk
+// at a time, as server-sent events or NDJSON (see streamEncoder). Either
+// way a reasoning model's <think> section comes in "reasoning", apart from
+// the answer in "content".
+func apiChatHandler(w http.ResponseWriter, r *http.Request) {
+	var req APIChatRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	params := ChatParams{Model: req.Model, Messages: req.Messages, Options: req.Options}
+	var sessionID string
+	if req.Session {
+		if len(req.Messages) == 0 {
+			writeAPIError(w, http.StatusBadRequest, "messages are required")
+			return
+		}
+		sessionID = getSessionID(w, r)
+		sessionMut.Lock()
+		sess := getSession(sessionID)
+		if err := sess.checkMessageLimit(len(req.Messages)); err != nil {
+			sessionMut.Unlock()
+			writeAPIError(w, apiErrorStatus(err), err.Error())
+			return
+		}
+		params.Messages = sess.conversationMessages(sess.Active, append(append([]Message(nil), sess.History...), req.Messages...))
+		params.Options = sess.withConversationOptions(sess.Active, params.Options)
+		sessionMut.Unlock()
+	}
+	// The new messages and the reply join the history together, once the
+	// reply is complete
+	remember := func(reply Message) {
+		if !req.Session {
+			return
+		}
+		sessionMut.Lock()
+		sess := getSession(sessionID)
+		defer sessionMut.Unlock()
+		for _, m := range req.Messages {
+			if err := sess.append(m); err != nil {
+				log.Printf("API chat not kept in session %s: %v", sessionHash(sessionID), err)
+				return
+			}
+		}
+		sess.append(reply)
+	}
+
+	if err := params.validate(r.Context()); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeOptionNotices(w, params.Notices)
+
+	ctx := withAnswerLabel(r.Context())
+	if req.ConfirmCost {
+		ctx = withCostConfirmed(ctx)
+	}
+	if !req.Stream {
+		msg, err := serviceChat(ctx, params)
+		if err != nil {
+			log.Printf("API chat error: %v", err)
+			writeAPIError(w, apiErrorStatus(err), err.Error())
+			return
+		}
+		remember(msg)
+		msg = withReasoning(msg)
+		resp := map[string]interface{}{"model": params.Model, "message": msg}
+		if len(params.Notices) > 0 {
+			resp["notices"] = params.Notices
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	send := streamEncoder(w, r)
+	ctx = withPullProgress(ctx, func(u PullUpdate) { send(APIChatChunk{Status: u.String()}) })
+	var split reasoningStream
+	reply, err := serviceStreamChat(ctx, params, func(chunk string) {
+		if reasoning, answer := split.next(chunk); reasoning != "" || answer != "" {
+			send(APIChatChunk{Content: answer, Reasoning: reasoning})
+		}
+	})
+	if err != nil {
+		log.Printf("API chat stream error: %v", err)
+		send(APIError{Error: err.Error()})
+		return
+	}
+	msg := assistantReply(ctx, reply)
+	remember(msg)
+	reasoning, answer := split.flush()
+	send(APIChatChunk{Content: answer, Reasoning: reasoning, Done: true, Notices: params.Notices, Backend: msg.Backend, Cost: msg.Cost})
+}
+
+// /api/v1/history: GET returns the session's chat history, and POST
+// changes it with an APIHistoryRequest and returns the result
+func apiHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	if r.Method != http.MethodGet {
+		var req APIHistoryRequest
+		if !decodeAPIRequest(w, r, &req) {
+			return
+		}
+		if err := apiHistoryAction(r, sessionID, req); err != nil {
+			status := http.StatusConflict
+			switch {
+			case errors.Is(err, errInvalidRequest):
+				status = http.StatusBadRequest
+			case errors.Is(err, errUnknownMessage):
+				status = http.StatusNotFound
+			case req.Action == "regenerate" || req.Action == "resubmit":
+				log.Printf("API history error: %v", err)
+				status = http.StatusBadGateway
+			}
+			writeAPIError(w, status, err.Error())
+			return
+		}
+	}
+
+	sessionMut.Lock()
+	history := getSession(sessionID).History
+	messages := make([]APIMessage, len(history))
+	for i, m := range history {
+		messages[i] = APIMessage{ID: m.ID, Message: m}
+	}
+	sessionMut.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"messages": messages})
+}
+
+// The session's conversations as the JSON API lists them. Callers must
+// hold sessionMut.
+func (s *session) apiConversations() []APIConversation {
+	convs := make([]APIConversation, len(s.Conversations))
+	for i, c := range s.Conversations {
+		convs[i] = APIConversation{ID: c.ID, Title: c.Title, SystemPrompt: c.SystemPrompt, Options: c.Options,
+			Share: s.Shared[c.ID], Active: c.ID == s.Active}
+		if sum := s.currentSummary(c.ID, projectHistory(s.Events, c.ID)); sum != nil {
+			convs[i].Summary = sum.Text
+		}
+	}
+	return convs
+}
+
+// /api/v1/conversations: GET lists the session's conversations, and POST
+// changes them with an APIConversationsRequest and returns the new list
+func apiConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	var req APIConversationsRequest
+	if r.Method != http.MethodGet && !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	var err error
+	if r.Method != http.MethodGet {
+		err = sess.conversationAction(req.Action, req.ID, req.Title, req.SystemPrompt, req.Options)
+	}
+	convs := sess.apiConversations()
+	sessionMut.Unlock()
+
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"conversations": convs})
+	case errors.Is(err, errUnknownConversation):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvalidRequest):
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeAPIError(w, http.StatusConflict, err.Error())
+	}
+}
+
+// POST /api/v1/import: start conversations from an export file sent as the
+// body, such as ChatGPT's export archive or its conversations.json.
+// Answers with the IDs imported and the session's conversations.
+func apiImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sessionID := getSessionID(w, r)
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "export file too large")
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "could not read the export file")
+		return
+	}
+	convs, err := prepareImport(data)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	ids, err := sess.importConversations(convs)
+	list := sess.apiConversations()
+	sessionMut.Unlock()
+	if err != nil {
+		writeAPIError(w, apiErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"imported": ids, "conversations": list})
+}
+
+func apiHistoryAction(r *http.Request, sessionID string, req APIHistoryRequest) error {
+	if req.Action == "regenerate" {
+		if req.ID == 0 {
+			sessionMut.Lock()
+			req.ID = getSession(sessionID).lastReplyID()
+			sessionMut.Unlock()
+		}
+		return regenerateReply(r, sessionID, req.ID, req.Model, req.Temperature)
+	}
+	content := strings.TrimSpace(req.Content)
+	if (req.Action == "edit" || req.Action == "resubmit") && content == "" {
+		return fmt.Errorf("%w: content is required", errInvalidRequest)
+	}
+	if req.Action == "resubmit" {
+		return resubmitMessage(r, sessionID, req.ID, content)
+	}
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	sess := getSession(sessionID)
+	switch req.Action {
+	case "edit":
+		return sess.editMessage(req.ID, content)
+	case "delete":
+		return sess.deleteMessage(req.ID)
+	case "undo":
+		return sess.undo()
+	case "fork":
+		return sess.forkConversation(req.ID)
+	}
+	return fmt.Errorf("%w: unknown action %q", errInvalidRequest, req.Action)
+}
+
+// Start a streamed response and return a function that sends one value.
+// Clients asking for application/x-ndjson (or ?format=ndjson) get one JSON
+// object per line, like Ollama's own API; everyone else gets server-sent
+// events.
+func streamEncoder(w http.ResponseWriter, r *http.Request) func(v interface{}) {
+	ndjson := r.URL.Query().Get("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+
+	return func(v interface{}) {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if !ndjson {
+			buf.WriteString("data: ")
+		}
+		json.NewEncoder(buf).Encode(v) // ends the line
+		if !ndjson {
+			buf.WriteByte('\n')
+		}
+		w.Write(buf.Bytes())
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// GET /api/v1/models: the models installed in Ollama
+func apiModelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	models, err := serviceListModels(r.Context())
+	if err != nil {
+		log.Printf("API models error: %v", err)
+		writeAPIError(w, apiErrorStatus(err), err.Error())
+		return
+	}
+	if models == nil {
+		models = []OllamaModel{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"models": models})
+}
+
+// POST /api/v1/embeddings: one vector per input string
+func apiEmbeddingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req APIEmbeddingsRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	embeddings, err := serviceEmbeddings(r.Context(), req.Model, req.Input)
+	if err != nil {
+		log.Printf("API embeddings error: %v", err)
+		writeAPIError(w, apiErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"embeddings": embeddings})
+}
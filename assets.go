@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Directory holding static assets served under /static/
+var staticDir = "static"
+
+// Fingerprinted asset names, computed once at startup
+var (
+	assetNames = map[string]string{} // "style.css" -> "style.3f2a1b9c.css"
+	assetFiles = map[string]string{} // "style.3f2a1b9c.css" -> "style.css"
+)
+
+// Hash every file under the static directory so templates can link to
+// content-addressed URLs that are safe to cache forever.
+func loadAssets() error {
+	names := map[string]string{}
+	files := map[string]string{}
+
+	err := filepath.WalkDir(staticDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(staticDir, p)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		ext := path.Ext(rel)
+		fingerprinted := strings.TrimSuffix(rel, ext) + "." + sum[:8] + ext
+		names[rel] = fingerprinted
+		files[fingerprinted] = rel
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	assetNames, assetFiles = names, files
+	return nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// URL for a static asset, fingerprinted unless running in dev mode
+func assetURL(name string) string {
+	if fingerprinted, ok := assetNames[name]; ok && !devMode {
+		return "/static/" + fingerprinted
+	}
+	return "/static/" + name
+}
+
+// Whether an optional asset (e.g. a vendored library) is installed
+func hasAsset(name string) bool {
+	_, ok := assetNames[name]
+	return ok
+}
+
+// Serve static files; fingerprinted names get far-future caching, plain
+// names must be revalidated.
+func staticHandler() http.Handler {
+	files := http.FileServer(http.Dir(staticDir))
+	return http.StripPrefix("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if original, ok := assetFiles[r.URL.Path]; ok {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			r.URL.Path = original
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How chats are spread over several Ollama hosts, set by -ollama-balance
+const (
+	// Each conversation hashed to a host, so it returns to the same KV
+	// cache even after a restart
+	balanceAffinity = "affinity"
+	// New conversations go to each host in turn
+	balanceRoundRobin = "round-robin"
+	// New conversations go to the host with the fewest requests in flight
+	balanceLeastLoaded = "least-loaded"
+)
+
+var ollamaBalance = balanceAffinity
+
+// How often every Ollama host is checked, so one that went down has its
+// circuit opened before a chat is sent to it; set by
+// -ollama-health-interval, 0 for no checks
+var ollamaHealthInterval = 30 * time.Second
+
+// How long a round-robin or least-loaded conversation stays on the host it
+// was sent to after its last request, about as long as the host keeps its
+// prompt cache with the default keep-alive
+var stickyFor = 30 * time.Minute
+
+// Validate an -ollama-balance value
+func setBalance(s string) error {
+	switch s {
+	case balanceAffinity, balanceRoundRobin, balanceLeastLoaded:
+		ollamaBalance = s
+		return nil
+	}
+	return fmt.Errorf("unknown balancing %q: want %s, %s or %s", s, balanceAffinity, balanceRoundRobin, balanceLeastLoaded)
+}
+
+// Requests in flight to each Ollama host, by host:port, counted from
+// sending until the response body is closed
+var hostLoads = struct {
+	sync.Mutex
+	byHost map[string]*atomic.Int64
+}{byHost: map[string]*atomic.Int64{}}
+
+func loadOf(host string) *atomic.Int64 {
+	hostLoads.Lock()
+	defer hostLoads.Unlock()
+	n, ok := hostLoads.byHost[host]
+	if !ok {
+		n = new(atomic.Int64)
+		hostLoads.byHost[host] = n
+	}
+	return n
+}
+
+// Count a request to host as in flight until the returned func is called
+func trackLoad(host string) func() {
+	n := loadOf(host)
+	n.Add(1)
+	var once sync.Once
+	return func() { once.Do(func() { n.Add(-1) }) }
+}
+
+// loadBody ends its request's load when it is closed
+type loadBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *loadBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+// Conversations sent to a host under round-robin or least-loaded
+// balancing, by conversation key, with their last use
+var sticky = struct {
+	sync.Mutex
+	byKey map[string]stickyHost
+	swept time.Time
+}{byKey: map[string]stickyHost{}}
+
+type stickyHost struct {
+	host string
+	used time.Time
+}
+
+var nextHost atomic.Uint64
+
+// Choose among hosts for a request of the conversation key, which may be
+// empty. Hosts whose circuit is open are passed over while any other is
+// left.
+func pickHost(hosts []string, key string) string {
+	up := healthyHosts(hosts)
+	if ollamaBalance == balanceAffinity {
+		return rendezvousHost(up, key)
+	}
+	if key == "" {
+		return balancedHost(up)
+	}
+	sticky.Lock()
+	defer sticky.Unlock()
+	now := time.Now()
+	if s, ok := sticky.byKey[key]; ok && containsString(up, s.host) {
+		sticky.byKey[key] = stickyHost{s.host, now}
+		return s.host
+	}
+	if now.Sub(sticky.swept) > time.Minute {
+		for k, s := range sticky.byKey {
+			if now.Sub(s.used) > stickyFor {
+				delete(sticky.byKey, k)
+			}
+		}
+		sticky.swept = now
+	}
+	host := balancedHost(up)
+	sticky.byKey[key] = stickyHost{host, now}
+	return host
+}
+
+// The hosts whose circuit is closed, or all of them when none is
+func healthyHosts(hosts []string) []string {
+	var up []string
+	for _, h := range hosts {
+		if u, err := url.Parse(h); err == nil && circuitFor(u).allow() == nil {
+			up = append(up, h)
+		}
+	}
+	if len(up) == 0 {
+		return hosts
+	}
+	return up
+}
+
+// Rendezvous hashing on the key, so adding or removing a host only moves
+// the conversations that were on it
+func rendezvousHost(hosts []string, key string) string {
+	best, bestScore := hosts[0], uint64(0)
+	for _, host := range hosts {
+		h := fnv.New64a()
+		h.Write([]byte(host))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := h.Sum64(); score >= bestScore {
+			best, bestScore = host, score
+		}
+	}
+	return best
+}
+
+// The next host in turn or, balancing by load, the one with the fewest
+// requests in flight, ties going to the next in turn
+func balancedHost(hosts []string) string {
+	start := int(nextHost.Add(1) % uint64(len(hosts)))
+	if ollamaBalance != balanceLeastLoaded {
+		return hosts[start]
+	}
+	best, bestLoad := "", int64(-1)
+	for i := range hosts {
+		h := hosts[(start+i)%len(hosts)]
+		if n := hostLoad(h); bestLoad < 0 || n < bestLoad {
+			best, bestLoad = h, n
+		}
+	}
+	return best
+}
+
+// Requests in flight to a host given by base URL
+func hostLoad(base string) int64 {
+	u, err := url.Parse(base)
+	if err != nil {
+		return 0
+	}
+	return loadOf(u.Host).Load()
+}
+
+// HostStatus is an Ollama host's share of the work, for the admin page
+type HostStatus struct {
+	Host     string
+	InFlight int64
+	Up       bool
+}
+
+// Every Ollama host with its load, when there are several
+func hostStatuses() []HostStatus {
+	hosts := upstreams()
+	if len(hosts) < 2 {
+		return nil
+	}
+	out := make([]HostStatus, 0, len(hosts))
+	for _, h := range hosts {
+		st := HostStatus{Host: h, InFlight: hostLoad(h)}
+		if u, err := url.Parse(h); err == nil {
+			st.Up = circuitFor(u).allow() == nil
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// Probe every Ollama host, opening the circuit of any that fails
+func checkHosts() {
+	for _, h := range upstreams() {
+		u, err := url.Parse(h)
+		if err != nil {
+			continue
+		}
+		c := circuitFor(u)
+		if c.allow() == nil && !probeOllama(ollamaClient.HTTP, c.base, breakerProbeInterval) {
+			c.trip("failed its health check", ollamaClient.HTTP)
+		}
+	}
+}
+
+// Check the Ollama hosts every interval
+func startHealthChecks(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			checkHosts()
+		}
+	}()
+	log.Printf("Checking %d Ollama host(s) every %v, balancing by %s", len(upstreams()), interval, ollamaBalance)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
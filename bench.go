@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// benchResult is the outcome of one synthetic chat request
+type benchResult struct {
+	latency time.Duration
+	status  int
+	err     error
+}
+
+// Run a benchmark subcommand, e.g. "bench serve -c 20 -n 5", writing the
+// report to out
+func runBench(out io.Writer, args []string) error {
+	if len(args) == 0 || args[0] != "serve" {
+		return fmt.Errorf("usage: %s bench serve [flags]", os.Args[0])
+	}
+
+	fs := flag.NewFlagSet("bench serve", flag.ExitOnError)
+	target := fs.String("url", "http://localhost:8080", "base URL of the running server")
+	concurrency := fs.Int("c", 10, "number of concurrent chat sessions")
+	perSession := fs.Int("n", 5, "prompts sent by each session")
+	prompt := fs.String("prompt", "Reply with a single short sentence.", "prompt text sent on every turn")
+	timeout := fs.Duration("timeout", 5*time.Minute, "per-request timeout")
+	fs.Parse(args[1:])
+
+	if *concurrency < 1 || *perSession < 1 {
+		return fmt.Errorf("-c and -n must be at least 1")
+	}
+
+	results := make(chan benchResult, *concurrency**perSession)
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			benchSession(*target, fmt.Sprintf("%s (session %d)", *prompt, id), *perSession, *timeout, results)
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	elapsed := time.Since(start)
+
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	errors := 0
+	for res := range results {
+		if res.err != nil {
+			errors++
+			continue
+		}
+		statuses[res.status]++
+		if res.status < 400 {
+			latencies = append(latencies, res.latency)
+		}
+	}
+
+	total := *concurrency * *perSession
+	fmt.Fprintf(out, "Requests:    %d (%d sessions x %d prompts)\n", total, *concurrency, *perSession)
+	fmt.Fprintf(out, "Duration:    %s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(out, "Throughput:  %.2f req/s\n", float64(total)/elapsed.Seconds())
+	fmt.Fprintf(out, "Errors:      %d transport errors\n", errors)
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(out, "Status %d:  %d\n", code, statuses[code])
+	}
+
+	if len(latencies) == 0 {
+		fmt.Fprintln(out, "No successful requests; latency percentiles unavailable")
+		return nil
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Fprintf(out, "Latency min: %s\n", latencies[0].Round(time.Millisecond))
+	fmt.Fprintf(out, "Latency p50: %s\n", percentile(latencies, 50).Round(time.Millisecond))
+	fmt.Fprintf(out, "Latency p95: %s\n", percentile(latencies, 95).Round(time.Millisecond))
+	fmt.Fprintf(out, "Latency p99: %s\n", percentile(latencies, 99).Round(time.Millisecond))
+	fmt.Fprintf(out, "Latency max: %s\n", latencies[len(latencies)-1].Round(time.Millisecond))
+	return nil
+}
+
+// Drive one cookie-bound session through a series of chat turns
+func benchSession(target, prompt string, turns int, timeout time.Duration, results chan<- benchResult) {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar:     jar,
+		Timeout: timeout,
+		// The chat POST finishes only after the model replies; don't time the redirect.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for i := 0; i < turns; i++ {
+		start := time.Now()
+		resp, err := client.PostForm(target+"/chat", url.Values{"prompt": {prompt}})
+		if err != nil {
+			results <- benchResult{err: err}
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		results <- benchResult{latency: time.Since(start), status: resp.StatusCode}
+	}
+}
+
+// Nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	idx := (p*len(sorted)+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Calls to an Ollama host failing in a row before its circuit opens, and
+// how often a host with an open circuit is probed; set by
+// -breaker-failures, 0 to never open, and -breaker-probe
+var (
+	breakerFailures      = 5
+	breakerProbeInterval = 10 * time.Second
+)
+
+var errBackendUnavailable = errors.New("model backend unavailable")
+
+// circuit tracks failures of one Ollama host. Once open, calls to the host
+// fail at once with errBackendUnavailable, rather than each waiting out
+// its own timeouts and retries, until a probe finds the host answering.
+type circuit struct {
+	mu       sync.Mutex
+	base     string // the host's base URL, for probes
+	failures int
+	open     bool
+	since    time.Time // when the circuit opened
+}
+
+var circuits = struct {
+	sync.Mutex
+	byHost map[string]*circuit
+}{byHost: map[string]*circuit{}}
+
+// The circuit of the host a request goes to
+func circuitFor(u *url.URL) *circuit {
+	circuits.Lock()
+	defer circuits.Unlock()
+	c, ok := circuits.byHost[u.Host]
+	if !ok {
+		c = &circuit{base: u.Scheme + "://" + u.Host}
+		circuits.byHost[u.Host] = c
+	}
+	return c
+}
+
+// An errBackendUnavailable error while the circuit is open
+func (c *circuit) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open {
+		return fmt.Errorf("%w: Ollama at %s is not answering; try again in a few seconds", errBackendUnavailable, c.base)
+	}
+	return nil
+}
+
+// Count a call's outcome, opening the circuit after breakerFailures
+// failures in a row and probing the host until it recovers
+func (c *circuit) record(ok bool, client *http.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if breakerFailures <= 0 || c.failures < breakerFailures {
+		return
+	}
+	c.openLocked(fmt.Sprintf("failed %d times in a row", c.failures), client)
+}
+
+// Open the circuit at once, as when the host fails a health check
+func (c *circuit) trip(reason string, client *http.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.openLocked(reason, client)
+}
+
+func (c *circuit) openLocked(reason string, client *http.Client) {
+	if c.open {
+		return
+	}
+	c.open, c.since = true, time.Now()
+	log.Printf("Ollama at %s %s; refusing calls to it until it answers again", c.base, reason)
+	go c.probe(client, breakerProbeInterval)
+}
+
+// List the host's models every interval until that succeeds, then close
+// the circuit
+func (c *circuit) probe(client *http.Client, every time.Duration) {
+	for {
+		time.Sleep(every)
+		if probeOllama(client, c.base, every) {
+			c.mu.Lock()
+			c.open, c.failures = false, 0
+			down := time.Since(c.since)
+			c.mu.Unlock()
+			log.Printf("Ollama at %s is answering again after %v", c.base, down.Round(time.Second))
+			resumePendingPrompts()
+			return
+		}
+	}
+}
+
+// Whether a host lists its models within timeout
+func probeOllama(client *http.Client, base string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/api/tags", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// CircuitStatus is an Ollama host whose circuit is open, for the admin page
+type CircuitStatus struct {
+	Host  string
+	Since time.Time
+}
+
+func openCircuits() []CircuitStatus {
+	circuits.Lock()
+	defer circuits.Unlock()
+	var out []CircuitStatus
+	for _, c := range circuits.byHost {
+		c.mu.Lock()
+		if c.open {
+			out = append(out, CircuitStatus{Host: c.base, Since: c.since})
+		}
+		c.mu.Unlock()
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// UnavailablePage is the data for unavailable.html
+type UnavailablePage struct {
+	Retry int // seconds until the next probe, at most
+}
+
+// Answer a page request whose call to Ollama failed: while the host's
+// circuit is open, with a page saying so and when to try again; for a
+// fallback chat whose cost needs confirming, with a page asking for it;
+// otherwise with a plain error of the given status
+func writeOllamaError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if confirmCost(w, r, err, "/chat/confirm", nil) {
+		return
+	}
+	if !errors.Is(err, errBackendUnavailable) {
+		http.Error(w, ollamaErrorText(err), status)
+		return
+	}
+	retry := retrySeconds(breakerProbeInterval)
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	renderPageStatus(w, r, http.StatusServiceUnavailable, "unavailable.html", UnavailablePage{Retry: retry})
+}
+
+// The error shown in chat streams and pages for a failed call to Ollama
+func ollamaErrorText(err error) string {
+	if errors.Is(err, errBackendUnavailable) {
+		return "The model backend is unavailable; try again in a few seconds"
+	}
+	var costErr *CostError
+	if errors.Is(err, errModelPull) || errors.As(err, &costErr) {
+		return err.Error()
+	}
+	return "Error communicating with Ollama"
+}
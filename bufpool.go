@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Buffers larger than this are left for the GC rather than pooled, so one
+// huge request (say, a chat full of images) does not pin its memory
+const maxPooledBufferBytes = 1 << 20
+
+// Scratch buffers for request bodies and stream frames
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferBytes {
+		bufferPool.Put(buf)
+	}
+}
+
+var errBodyClosed = errors.New("request body already closed")
+
+// pooledBody is a request body that returns its buffer to the pool once
+// the transport closes it. The transport may close it from another
+// goroutine while its writer is still reading, so reads and the close are
+// serialised and reads after the close fail instead of seeing a buffer
+// that has been reused.
+type pooledBody struct {
+	mu     sync.Mutex
+	reader *bytes.Reader
+	buf    *bytes.Buffer // nil once returned to the pool
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf == nil {
+		return 0, errBodyClosed
+	}
+	return b.reader.Read(p)
+}
+
+func (b *pooledBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf != nil {
+		putBuffer(b.buf)
+		b.buf, b.reader = nil, nil
+	}
+	return nil
+}
+
+// Build a POST to Ollama with v encoded as JSON into a pooled buffer. The
+// host is the replica for the context's conversation, if any.
+func newOllamaRequest(ctx context.Context, path string, v interface{}) (*http.Request, error) {
+	buf := getBuffer()
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	body := &pooledBody{reader: bytes.NewReader(buf.Bytes()), buf: buf}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstreamFor(ctx)+path, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	// A custom body hides the length from net/http; set it so the request
+	// is not sent chunked
+	req.ContentLength = int64(buf.Len())
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Days ahead the calendar feed lists runs for
+const calendarDays = 14
+
+const icsTimeLayout = "20060102T150405Z"
+
+// Escapes for text values in iCalendar
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// Write one content line, folded so no line is longer than 75 octets as
+// iCalendar requires: the first holds 75, and each continuation a leading
+// space and 74
+func writeICSLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut-- // not inside a UTF-8 sequence
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// The runs of a schedule before end
+func (p *ScheduledPrompt) runsBefore(end time.Time) []time.Time {
+	var out []time.Time
+	for next := p.Next; !next.IsZero() && next.Before(end); next = nextScheduledRun(next, p.At, p.Days, p.zone) {
+		out = append(out, next)
+		if p.Once {
+			break
+		}
+	}
+	return out
+}
+
+// An iCalendar feed of the scheduled prompts' runs in the next
+// calendarDays days, one event per run. Times are given in UTC, each
+// worked out on its schedule's own wall clock.
+func schedulesCalendar(schedules []ScheduledPrompt, now time.Time) string {
+	var b strings.Builder
+	for _, line := range []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//deepseek-app//Scheduled prompts//EN",
+		"CALSCALE:GREGORIAN", "X-WR-CALNAME:Scheduled prompts"} {
+		writeICSLine(&b, line)
+	}
+	stamp := now.UTC().Format(icsTimeLayout)
+	for _, p := range schedules {
+		if !p.Finished.IsZero() {
+			continue
+		}
+		when := p.At + " " + p.TimeZone
+		if p.TimeZone == "" {
+			when = p.At + " server time"
+		}
+		for _, run := range p.runsBefore(now.AddDate(0, 0, calendarDays)) {
+			writeICSLine(&b, "BEGIN:VEVENT")
+			writeICSLine(&b, fmt.Sprintf("UID:schedule-%d-%s@deepseek-app", p.ID, run.UTC().Format(icsTimeLayout)))
+			writeICSLine(&b, "DTSTAMP:"+stamp)
+			writeICSLine(&b, "DTSTART:"+run.UTC().Format(icsTimeLayout))
+			writeICSLine(&b, "SUMMARY:"+icsEscaper.Replace(fmt.Sprintf("Scheduled prompt %d", p.ID)))
+			writeICSLine(&b, "DESCRIPTION:"+icsEscaper.Replace(fmt.Sprintf("%s, %s, session %s, conversation %d:\n%s",
+				when, p.DayNames(), p.SessionHash(), p.Conversation, p.Prompt)))
+			writeICSLine(&b, "END:VEVENT")
+		}
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// GET /admin/schedules.ics: the scheduled prompts' coming runs as a
+// calendar feed to subscribe to, with the admin credentials
+func adminSchedulesCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="scheduled-prompts.ics"`)
+	fmt.Fprint(w, schedulesCalendar(scheduleSnapshot(""), time.Now()))
+}
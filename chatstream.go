@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// Like chatHandler, but forwards the reply to the browser as it is
+// generated, one APIChatChunk per server-sent event, instead of waiting for
+// the whole completion and redirecting. The page's script reloads once the
+// final {"done": true} event arrives, with "stopped" set when /chat/stop
+// cut the reply short. Events with "status" report a model download the
+// reply waits for.
+func chatStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	userMessage, err := readUserMessage(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), submissionStatus(err))
+		return
+	}
+
+	// Finish and save the reply even if the browser goes away, unless
+	// stopped through /chat/stop
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	if sess.queueIfOffline(userMessage) {
+		sessionMut.Unlock()
+		streamEncoder(w, r)(APIChatChunk{Done: true, Pending: true})
+		return
+	}
+	if err := sess.append(userMessage); err != nil {
+		sessionMut.Unlock()
+		http.Error(w, err.Error(), submissionStatus(err))
+		return
+	}
+	chatReq, conv := sess.conversationRequest(sess.Active, sess.History), sess.Active
+	ctx, done := sess.trackGeneration(withPriority(context.Background(), priorityFrom(r.Context())))
+	sessionMut.Unlock()
+	defer done()
+	send := streamEncoder(w, r)
+	ctx = withPullProgress(ctx, func(u PullUpdate) { send(APIChatChunk{Status: u.String()}) })
+
+	var reply string
+	if tools := mcpTools(); len(tools) > 0 {
+		// Tool calls need the whole reply, so it arrives as one chunk
+		var run toolRunner
+		chatReq.Messages, run = toolChat(sessionID, chatReq.Messages)
+		chatReq.Tools = tools
+		reply, err = completeWithTools(ctx, chatReq, run)
+		if err == nil {
+			reasoning, answer := splitReasoning(reply)
+			send(APIChatChunk{Content: answer, Reasoning: reasoning})
+		}
+	} else {
+		var split reasoningStream
+		reply, err = ollamaStream(ctx, chatReq, func(chunk string) {
+			if reasoning, answer := split.next(chunk); reasoning != "" || answer != "" {
+				send(APIChatChunk{Content: answer, Reasoning: reasoning})
+			}
+		})
+		if reasoning, answer := split.flush(); reasoning != "" || answer != "" {
+			send(APIChatChunk{Content: answer, Reasoning: reasoning})
+		}
+	}
+	stopped := ctx.Err() != nil
+	if err != nil && !stopped {
+		log.Printf("Ollama API error: %v", err)
+		send(APIError{Error: ollamaErrorText(err)})
+		return
+	}
+
+	// A stopped reply keeps what was generated
+	if reply != "" {
+		sessionMut.Lock()
+		getSession(sessionID).appendTo(conv, assistantReply(ctx, reply))
+		sessionMut.Unlock()
+	}
+
+	send(APIChatChunk{Done: true, Stopped: stopped})
+}
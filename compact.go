@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Messages kept word for word after a compaction, unless the config says
+// otherwise
+const defaultKeepRecent = 6
+
+// Share of its budget a chat may fill before older turns are summarized
+const compactAt = 0.75
+
+// Instructions given to the model when it condenses older turns
+const compactionPrompt = "You condense chat histories. Write a compact summary of the conversation below for the " +
+	"assistant to continue from: keep names, facts, decisions, open questions and anything the user asked to " +
+	"remember. Write it as notes, not as a reply, and add nothing that was not said."
+
+// ConversationSummary stands in for a conversation's older messages in
+// chats sent to the model. Digest fingerprints the messages it covers, so
+// editing or removing one sets the summary aside until it is redone.
+type ConversationSummary struct {
+	UpTo   int    `json:"up_to"` // ID of the newest message covered
+	Digest string `json:"digest"`
+	Text   string `json:"text"`
+}
+
+// Fingerprint of the history messages up to and including upTo
+func historyDigest(messages []Message, upTo int) string {
+	h := sha256.New()
+	for _, m := range messages {
+		if m.ID > 0 && m.ID <= upTo && m.Role != "system" {
+			fmt.Fprintf(h, "%d\x00%s\x00%s\x00", m.ID, m.Role, m.Content)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// The summary that applies to these messages of a conversation, if any.
+// Callers must hold sessionMut.
+func (s *session) currentSummary(conv int, messages []Message) *ConversationSummary {
+	i := s.conversationIndex(conv)
+	if i < 0 || s.Conversations[i].Summary == nil {
+		return nil
+	}
+	sum := s.Conversations[i].Summary
+	if historyDigest(messages, sum.UpTo) != sum.Digest {
+		return nil
+	}
+	return sum
+}
+
+// Messages of a conversation to send to the model: led by its system
+// prompt, with the turns its summary covers replaced by the summary.
+// Callers must hold sessionMut.
+func (s *session) conversationMessages(conv int, messages []Message) []Message {
+	messages = s.withConversationPrompt(conv, messages)
+	sum := s.currentSummary(conv, messages)
+	if sum == nil {
+		return messages
+	}
+	lead := 0
+	for lead < len(messages) && messages[lead].Role == "system" {
+		lead++
+	}
+	out := append([]Message(nil), messages[:lead]...)
+	out = append(out, Message{Role: "system", Content: "Summary of the conversation so far:\n\n" + sum.Text})
+	for _, m := range messages[lead:] {
+		if m.ID == 0 || m.ID > sum.UpTo {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Whether a conversation has outgrown the configured share of its window
+// with turns old enough to summarize. Callers must hold sessionMut.
+func (s *session) needsCompaction(conv int, history []Message) bool {
+	cfg := currentFileConfig().Context
+	if !cfg.Summarize || len(history) <= keepRecent() {
+		return false
+	}
+	opts, _ := limitOptions(s.withConversationOptions(conv, nil))
+	window, budget := contextWindow(opts)
+	if window <= 0 {
+		return false
+	}
+	if sum := s.currentSummary(conv, history); sum != nil && history[len(history)-keepRecent()-1].ID <= sum.UpTo {
+		return false // nothing older to fold in yet
+	}
+	return float64(estimateTotalTokens(s.conversationMessages(conv, history))) > compactAt*float64(budget)
+}
+
+func keepRecent() int {
+	if n := currentFileConfig().Context.KeepRecent; n > 0 {
+		return n
+	}
+	return defaultKeepRecent
+}
+
+// Summarize a conversation's older turns, folding in its previous summary,
+// so chats carry the summary and the newest messages instead of the whole
+// history. The messages themselves stay in the history.
+func compactConversation(ctx context.Context, sessionID string, conv int) error {
+	ctx = withTenant(ctx, sessionTenant(sessionID))
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	history := projectHistory(sess.Events, conv)
+	if len(history) <= keepRecent() {
+		sessionMut.Unlock()
+		return nil
+	}
+	upTo := history[len(history)-keepRecent()-1].ID
+	digest := historyDigest(history, upTo)
+	prev := sess.currentSummary(conv, history)
+	sessionMut.Unlock()
+	if prev != nil && prev.UpTo >= upTo {
+		return nil
+	}
+
+	var transcript strings.Builder
+	if prev != nil {
+		fmt.Fprintf(&transcript, "Summary of the earlier conversation:\n%s\n\n", prev.Text)
+	}
+	for _, m := range history {
+		if m.Role == "system" || m.ID > upTo || (prev != nil && m.ID <= prev.UpTo) {
+			continue
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", titleCase(m.Role), m.Content)
+	}
+	summary, err := ollamaComplete(ctx, OllamaChatRequest{
+		Model: defaultModelFor(ctx),
+		Messages: []Message{
+			{Role: "system", Content: compactionPrompt},
+			{Role: "user", Content: transcript.String()},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	summary = strings.TrimSpace(summary)
+	if summary == "" {
+		return nil
+	}
+
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	sess = getSession(sessionID)
+	// The conversation may have gone, or the covered messages changed or
+	// been summarized again, while the model was working
+	history = projectHistory(sess.Events, conv)
+	if sess.conversationIndex(conv) < 0 || historyDigest(history, upTo) != digest {
+		return nil
+	}
+	if cur := sess.currentSummary(conv, history); cur != nil && cur.UpTo >= upTo {
+		return nil
+	}
+	b, _ := json.Marshal(ConversationSummary{UpTo: upTo, Digest: digest, Text: summary})
+	sess.recordIn(conv, MessageEvent{Type: EventConversationSummary, Content: string(b)})
+	return nil
+}
+
+// Periodically summarize the older turns of conversations in use that are
+// close to filling their context window
+func startCompactionWatcher(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			type due struct {
+				session string
+				conv    int
+			}
+			var found []due
+			sessionMut.Lock()
+			for id, sess := range sessions {
+				locked := sess.Transcript != nil && sess.Transcript.key == nil
+				if !locked && sess.needsCompaction(sess.Active, sess.History) {
+					found = append(found, due{id, sess.Active})
+				}
+			}
+			sessionMut.Unlock()
+
+			for _, d := range found {
+				d := d
+				err := submitTask("compaction", fmt.Sprintf("conversation %d of session %s", d.conv, sessionHash(d.session)),
+					func(ctx context.Context) error { return compactConversation(ctx, d.session, d.conv) }, nil)
+				if err != nil {
+					log.Printf("Compaction error: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config is the server's basic setup. Each setting comes from its flag,
+// else its environment variable, else the default. The other flags are
+// read from the environment by setFlagsFromEnv.
+type Config struct {
+	ListenAddr      string        // -listen, LISTEN_ADDR
+	OllamaURL       string        // -ollama-url, OLLAMA_URL
+	DefaultModel    string        // -model, DEFAULT_MODEL
+	TemplateDir     string        // -templates, TEMPLATE_DIR
+	TemplateOverlay string        // -template-overlay, TEMPLATE_OVERLAY
+	StaticDir       string        // -static, STATIC_DIR
+	CookieLifetime  time.Duration // -cookie-lifetime, COOKIE_LIFETIME
+	SessionIdle     time.Duration // -session-idle, SESSION_IDLE
+	SessionEvict    string        // -session-evict, SESSION_EVICT
+}
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:      ":8080",
+		OllamaURL:       ollamaURL,
+		DefaultModel:    defaultModel,
+		TemplateDir:     templateDir,
+		TemplateOverlay: templateOverlayDir,
+		StaticDir:       staticDir,
+		CookieLifetime:  sessionLifetime,
+		SessionIdle:     sessionIdleTimeout,
+		SessionEvict:    "persist",
+	}
+}
+
+// Register the config's flags, with defaults taken from the environment
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", envString("LISTEN_ADDR", c.ListenAddr), "address to serve HTTP on (env LISTEN_ADDR)")
+	fs.StringVar(&c.OllamaURL, "ollama-url", envString("OLLAMA_URL", c.OllamaURL), "Ollama base URL (env OLLAMA_URL)")
+	fs.StringVar(&c.DefaultModel, "model", envString("DEFAULT_MODEL", c.DefaultModel), "model used for chat (env DEFAULT_MODEL)")
+	fs.StringVar(&c.TemplateDir, "templates", envString("TEMPLATE_DIR", c.TemplateDir), "directory of HTML templates (env TEMPLATE_DIR)")
+	fs.StringVar(&c.TemplateOverlay, "template-overlay", envString("TEMPLATE_OVERLAY", c.TemplateOverlay),
+		"directory of templates that take precedence over those in -templates (env TEMPLATE_OVERLAY)")
+	fs.StringVar(&c.StaticDir, "static", envString("STATIC_DIR", c.StaticDir), "directory of static assets (env STATIC_DIR)")
+	fs.DurationVar(&c.CookieLifetime, "cookie-lifetime", envDuration("COOKIE_LIFETIME", c.CookieLifetime),
+		"how long session cookies, and idle sessions, last (env COOKIE_LIFETIME)")
+	fs.DurationVar(&c.SessionIdle, "session-idle", envDuration("SESSION_IDLE", c.SessionIdle),
+		"how long a session may go unused before it leaves memory; 0 for -cookie-lifetime (env SESSION_IDLE)")
+	fs.StringVar(&c.SessionEvict, "session-evict", envString("SESSION_EVICT", c.SessionEvict),
+		"what happens to the stored log of a session leaving memory: persist, until -cookie-lifetime, or discard (env SESSION_EVICT)")
+}
+
+// Put the config into effect for the handlers
+func (c Config) apply() {
+	ollamaURL = c.OllamaURL
+	defaultModel = c.DefaultModel
+	templateDir = c.TemplateDir
+	templateOverlayDir = c.TemplateOverlay
+	staticDir = c.StaticDir
+	sessionLifetime = c.CookieLifetime
+	sessionIdleTimeout = c.SessionIdle
+	switch c.SessionEvict {
+	case "persist":
+		discardIdleSessions = false
+	case "discard":
+		discardIdleSessions = true
+	default:
+		log.Printf("Ignoring -session-evict %q: want persist or discard", c.SessionEvict)
+	}
+}
+
+// Flags whose usage names their environment variable, as "(env NAME)";
+// those read it as their default
+var flagEnvRe = regexp.MustCompile(`\(env [A-Z0-9_]+\)`)
+
+// Environment variable for a flag that names none: the flag's name in
+// upper case with underscores, so -admin-password is ADMIN_PASSWORD
+func flagEnvName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Set each flag left off the command line, and naming no variable of its
+// own, from its environment variable. Call after fs.Parse.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || flagEnvRe.MatchString(f.Usage) {
+			return
+		}
+		name := flagEnvName(f.Name)
+		if v := envString(name, ""); v != "" {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, name, e)
+			}
+		}
+	})
+	return err
+}
+
+func envString(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v := envString(name, "")
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Ignoring %s=%q: %v", name, v, err)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"unicode/utf8"
+)
+
+// Rough token costs for estimating what a chat takes of the context window.
+// Models differ, so these err on the generous side: about four characters
+// of ASCII text per token and one for any other character, framing for each
+// message, and a fixed cost per image.
+const (
+	asciiPerToken    = 4
+	messageOverhead  = 4
+	imageTokens      = 768
+	minContextBudget = 64 // never fit to less, whatever the reserve
+)
+
+// Estimated tokens a message takes in the prompt
+func estimateTokens(m Message) int {
+	text := m.Content + m.Name + m.ToolName
+	for _, call := range m.ToolCalls {
+		b, _ := json.Marshal(call)
+		text += string(b)
+	}
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+asciiPerToken-1)/asciiPerToken + other + messageOverhead + imageTokens*len(m.Images)
+}
+
+func estimateTotalTokens(messages []Message) int {
+	total := 0
+	for _, m := range messages {
+		total += estimateTokens(m)
+	}
+	return total
+}
+
+// Drop the oldest turns until the rest fit in budget tokens, so the chat
+// still opens with a user message and no tool result loses its call.
+// Leading system messages and the last message are always kept. Returns
+// the messages to send and how many were dropped.
+func fitContext(messages []Message, budget int) ([]Message, int) {
+	total := estimateTotalTokens(messages)
+	if total <= budget || len(messages) == 0 {
+		return messages, 0
+	}
+	system := 0
+	for system < len(messages)-1 && messages[system].Role == "system" {
+		system++
+	}
+	cut := system
+	for cut < len(messages)-1 && total > budget {
+		total -= estimateTokens(messages[cut])
+		cut++
+		for cut < len(messages)-1 && messages[cut].Role != "user" {
+			total -= estimateTokens(messages[cut])
+			cut++
+		}
+	}
+	out := make([]Message, 0, system+len(messages)-cut)
+	out = append(append(out, messages[:system]...), messages[cut:]...)
+	return out, cut - system
+}
+
+// The context window of a chat with these options: the num_ctx they set,
+// else the configured one, or 0 for no limit. budget is what the messages
+// may take of it, leaving room for the reply.
+func contextWindow(opts map[string]interface{}) (window, budget int) {
+	cfg := currentFileConfig().Context
+	window = cfg.NumCtx
+	if n, ok := optionNumber(opts["num_ctx"]); ok && n > 0 {
+		window = int(n)
+	}
+	if window <= 0 {
+		return 0, 0
+	}
+	reserve := cfg.Reserve
+	if reserve == 0 {
+		reserve = window / 4
+		if n, ok := optionNumber(opts["num_predict"]); ok && n > 0 && int(n) < window/2 {
+			reserve = int(n)
+		}
+	}
+	budget = window - reserve
+	if budget < minContextBudget {
+		budget = minContextBudget
+	}
+	return window, budget
+}
+
+// Fit a chat into its context window. The configured window is sent when
+// the chat sets none, so Ollama uses the size the chat was fitted to.
+func fitChatContext(req *OllamaChatRequest) {
+	window, budget := contextWindow(req.Options)
+	if window <= 0 {
+		return
+	}
+	if _, ok := req.Options["num_ctx"]; !ok {
+		opts := make(map[string]interface{}, len(req.Options)+1)
+		for k, v := range req.Options {
+			opts[k] = v
+		}
+		opts["num_ctx"] = window
+		req.Options = opts
+	}
+	var dropped int
+	req.Messages, dropped = fitContext(req.Messages, budget)
+	if dropped > 0 {
+		log.Printf("Context: left out the %d oldest messages to fit %d of %d tokens", dropped, budget, window)
+	}
+}
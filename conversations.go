@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxConversationTitle = 80
+	maxSystemPrompt      = 8000
+	firstConversation    = "Chat"
+)
+
+// ConversationInfo is one of a session's named conversations
+type ConversationInfo struct {
+	ID    int
+	Title string
+	// Sent first in every chat of the conversation; empty for the server's
+	SystemPrompt string
+	Options      map[string]interface{} // model options for its chats
+	Summary      *ConversationSummary   // of its older turns, sent in their place
+	Share        string                 // token of its read-only link, set for pages; empty when not shared
+}
+
+// The session's conversations, oldest first, and the active one. Every
+// session starts with conversation 0; when the last one is deleted a new
+// one takes its place.
+func projectConversations(events []MessageEvent) ([]ConversationInfo, int) {
+	convs := []ConversationInfo{{ID: 0, Title: firstConversation}}
+	active := 0
+	for _, ev := range events {
+		switch ev.Type {
+		case EventConversationCreated:
+			convs = append(convs, ConversationInfo{ID: ev.Conversation, Title: ev.Content})
+		case EventConversationRenamed:
+			for i := range convs {
+				if convs[i].ID == ev.Conversation {
+					convs[i].Title = ev.Content
+				}
+			}
+		case EventConversationPrompt:
+			for i := range convs {
+				if convs[i].ID == ev.Conversation {
+					convs[i].SystemPrompt = ev.Content
+				}
+			}
+		case EventConversationOptions:
+			var opts map[string]interface{}
+			json.Unmarshal([]byte(ev.Content), &opts)
+			opts, _ = cleanGenerationOptions(opts)
+			for i := range convs {
+				if convs[i].ID == ev.Conversation {
+					convs[i].Options = opts
+				}
+			}
+		case EventConversationSummary:
+			var sum ConversationSummary
+			if err := json.Unmarshal([]byte(ev.Content), &sum); err != nil {
+				continue
+			}
+			for i := range convs {
+				if convs[i].ID == ev.Conversation {
+					convs[i].Summary = &sum
+				}
+			}
+		case EventConversationDeleted:
+			for i := range convs {
+				if convs[i].ID == ev.Conversation {
+					convs = append(convs[:i:i], convs[i+1:]...)
+					break
+				}
+			}
+		case EventConversationSwitched:
+			active = ev.Conversation
+		}
+	}
+	return convs, active
+}
+
+// Index of a conversation in the session's list, or -1
+func (s *session) conversationIndex(id int) int {
+	for i, c := range s.Conversations {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Start a conversation and make it the active one. Callers must hold
+// sessionMut.
+func (s *session) createConversation(title string) int {
+	return s.createConversationAt(title, time.Time{})
+}
+
+// Start a conversation created at the given time, as for an imported one;
+// now when it is zero. Callers must hold sessionMut.
+func (s *session) createConversationAt(title string, created time.Time) int {
+	id := 0
+	for _, ev := range s.Events {
+		if ev.Type == EventConversationCreated && ev.Conversation > id {
+			id = ev.Conversation
+		}
+	}
+	id++
+	if title = cleanConversationTitle(title); title == "" {
+		title = fmt.Sprintf("Chat %d", id+1)
+	}
+	s.recordIn(id, MessageEvent{Type: EventConversationCreated, Content: title, Time: created})
+	s.recordIn(id, MessageEvent{Type: EventConversationSwitched})
+	return id
+}
+
+// Give a conversation a new title. Callers must hold sessionMut.
+func (s *session) renameConversation(id int, title string) error {
+	if s.conversationIndex(id) < 0 {
+		return errUnknownConversation
+	}
+	if title = cleanConversationTitle(title); title == "" {
+		return fmt.Errorf("%w: a title is required", errInvalidRequest)
+	}
+	s.recordIn(id, MessageEvent{Type: EventConversationRenamed, Content: title})
+	return nil
+}
+
+// Set the system prompt a conversation's chats start with; empty goes back
+// to the server's. Callers must hold sessionMut.
+func (s *session) setConversationPrompt(id int, prompt string) error {
+	i := s.conversationIndex(id)
+	if i < 0 {
+		return errUnknownConversation
+	}
+	prompt = strings.TrimSpace(prompt)
+	if len(prompt) > maxSystemPrompt {
+		return fmt.Errorf("%w: the system prompt is longer than %d bytes", errInvalidRequest, maxSystemPrompt)
+	}
+	if prompt != s.Conversations[i].SystemPrompt {
+		s.recordIn(id, MessageEvent{Type: EventConversationPrompt, Content: prompt})
+	}
+	return nil
+}
+
+// Messages of a conversation to send to the model, led by the
+// conversation's system prompt when it has one. That takes the place of
+// the server's default. Callers must hold sessionMut.
+func (s *session) withConversationPrompt(conv int, messages []Message) []Message {
+	i := s.conversationIndex(conv)
+	if i < 0 || s.Conversations[i].SystemPrompt == "" {
+		return messages
+	}
+	return append([]Message{{Role: "system", Content: s.Conversations[i].SystemPrompt}}, messages...)
+}
+
+// Make a conversation the one the chat continues. Callers must hold
+// sessionMut.
+func (s *session) switchConversation(id int) error {
+	if s.conversationIndex(id) < 0 {
+		return errUnknownConversation
+	}
+	if id != s.Active {
+		s.recordIn(id, MessageEvent{Type: EventConversationSwitched})
+	}
+	return nil
+}
+
+// Remove a conversation from the list. Its events stay in the log. When
+// it was the active one, the newest remaining conversation takes over.
+// Callers must hold sessionMut.
+func (s *session) deleteConversation(id int) error {
+	if s.conversationIndex(id) < 0 {
+		return errUnknownConversation
+	}
+	s.recordIn(id, MessageEvent{Type: EventConversationDeleted})
+	s.unshareConversation(id)
+	if id != s.Active {
+		return nil
+	}
+	if len(s.Conversations) == 0 {
+		s.createConversation("")
+		return nil
+	}
+	return s.switchConversation(s.Conversations[len(s.Conversations)-1].ID)
+}
+
+// Start a conversation holding a copy of the active one up to and
+// including a message, and make it the active one, so the chat can go
+// another way from there while the original stays as it was. The copy
+// counts against sessionMessageLimit. Callers must hold sessionMut.
+func (s *session) forkConversation(id int) error {
+	i := s.messageIndex(id)
+	if i < 0 {
+		return errUnknownMessage
+	}
+	if err := s.checkMessageLimit(i + 1); err != nil {
+		return err
+	}
+	const suffix = " (fork)"
+	prefix := append([]Message(nil), s.History[:i+1]...)
+	added := messageTimes(s.Events, s.Active)
+	from := s.Conversations[s.conversationIndex(s.Active)]
+	title := from.Title
+	if r := []rune(title); len(r) > maxConversationTitle-len(suffix) {
+		title = string(r[:maxConversationTitle-len(suffix)])
+	}
+	fork := s.createConversation(title + suffix)
+	if from.SystemPrompt != "" {
+		s.recordIn(fork, MessageEvent{Type: EventConversationPrompt, Content: from.SystemPrompt})
+	}
+	if from.Options != nil {
+		s.setConversationOptions(fork, from.Options)
+	}
+	for _, m := range prefix {
+		msg := m
+		s.recordIn(fork, MessageEvent{Type: EventAdded, Message: &msg, Time: added[m.ID]})
+	}
+	s.LastActive = time.Now()
+	return nil
+}
+
+func cleanConversationTitle(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+	if r := []rune(title); len(r) > maxConversationTitle {
+		title = string(r[:maxConversationTitle])
+	}
+	return title
+}
+
+// Append a message to a given conversation, such as the one a reply was
+// asked for even if the user has switched since. A user message is refused
+// with errSessionFull once the session holds sessionMessageLimit messages;
+// replies to prompts already taken always join. Callers must hold
+// sessionMut.
+func (s *session) appendTo(conv int, msg Message) error {
+	if msg.Role == "user" {
+		if err := s.checkMessageLimit(1); err != nil {
+			return err
+		}
+	}
+	s.recordIn(conv, MessageEvent{Type: EventAdded, Message: &msg})
+	s.LastActive = time.Now()
+	return nil
+}
+
+// Apply a conversation action from the page or the JSON API. Callers must
+// hold sessionMut.
+func (s *session) conversationAction(action string, id int, title, prompt string, opts map[string]interface{}) error {
+	switch action {
+	case "new":
+		s.createConversation(title)
+		return nil
+	case "rename":
+		return s.renameConversation(id, title)
+	case "prompt":
+		return s.setConversationPrompt(id, prompt)
+	case "options":
+		return s.setConversationOptions(id, opts)
+	case "switch":
+		return s.switchConversation(id)
+	case "delete":
+		return s.deleteConversation(id)
+	case "share":
+		_, err := s.shareConversation(id)
+		return err
+	case "unshare":
+		if s.conversationIndex(id) < 0 {
+			return errUnknownConversation
+		}
+		s.unshareConversation(id)
+		return nil
+	}
+	return fmt.Errorf("%w: unknown conversation action", errInvalidRequest)
+}
+
+// Manage the session's conversations. Form fields: action (new, rename,
+// prompt, options, switch, delete, share or unshare), id, title,
+// system_prompt, and a field for each model option.
+func conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := getSessionID(w, r)
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	var opts map[string]interface{}
+	var err error
+	if r.FormValue("action") == "options" {
+		opts, err = generationOptionsFromForm(r)
+	}
+
+	if err == nil {
+		sessionMut.Lock()
+		err = getSession(sessionID).conversationAction(r.FormValue("action"), id, r.FormValue("title"), r.FormValue("system_prompt"), opts)
+		sessionMut.Unlock()
+	}
+
+	switch {
+	case err == nil:
+		redirect(w, r, "/", http.StatusSeeOther)
+	case err == errUnknownConversation:
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+	case err == errEncryptedShare:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
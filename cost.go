@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Reply tokens a cost estimate assumes for a chat that sets no num_predict
+const defaultReplyTokens = 500
+
+// FallbackConfig prices the fallback backend's models, so the messages it
+// answers show what they cost and an expensive chat waits for a go-ahead
+type FallbackConfig struct {
+	// Dollars per million tokens by model; "*" prices models not listed
+	Prices map[string]ModelPrice `yaml:"prices"`
+	// Chats estimated above this many dollars are sent only once confirmed;
+	// 0 never asks
+	ConfirmAbove float64 `yaml:"confirm_above"`
+	// Reply length the estimate assumes when a chat sets no num_predict; 0
+	// for defaultReplyTokens
+	ReplyTokens int `yaml:"reply_tokens"`
+}
+
+// ModelPrice is what a model charges, in dollars per million tokens
+type ModelPrice struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+func (f FallbackConfig) check() error {
+	if f.ConfirmAbove < 0 || f.ReplyTokens < 0 {
+		return errors.New("fallback: confirm_above and reply_tokens must not be negative")
+	}
+	for model, p := range f.Prices {
+		if p.Input < 0 || p.Output < 0 {
+			return fmt.Errorf("fallback.prices.%s: prices must not be negative", model)
+		}
+	}
+	return nil
+}
+
+// The configured price of a fallback model, and whether it has one
+func fallbackPrice(model string) (ModelPrice, bool) {
+	prices := currentFileConfig().Fallback.Prices
+	if p, ok := prices[model]; ok {
+		return p, true
+	}
+	p, ok := prices["*"]
+	return p, ok
+}
+
+// Dollars for a number of prompt and reply tokens at a price
+func (p ModelPrice) cost(promptTokens, replyTokens int) float64 {
+	return (float64(promptTokens)*p.Input + float64(replyTokens)*p.Output) / 1e6
+}
+
+// The model a chat is sent to on the fallback backend
+func fallbackModelFor(chatReq OllamaChatRequest) string {
+	if fallbackModel != "" {
+		return fallbackModel
+	}
+	return chatReq.Model
+}
+
+// CostError is returned for a fallback chat estimated to cost more than
+// the configured threshold, until it is confirmed
+type CostError struct {
+	Model    string
+	Estimate float64 // dollars
+	Limit    float64
+}
+
+func (e *CostError) Error() string {
+	return fmt.Sprintf("answering on %s is estimated to cost %s, above the %s that needs confirming",
+		e.Model, formatCost(e.Estimate), formatCost(e.Limit))
+}
+
+type costConfirmedKey struct{}
+
+// Mark a context's chats as confirmed whatever the fallback estimates
+func withCostConfirmed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, costConfirmedKey{}, true)
+}
+
+func costConfirmed(ctx context.Context) bool {
+	ok, _ := ctx.Value(costConfirmedKey{}).(bool)
+	return ok
+}
+
+// Estimate what a chat costs on the fallback: its messages with the
+// context counter, and num_predict reply tokens, else the configured reply
+// length. It fails with a CostError when the estimate needs confirming and
+// ctx has not confirmed it. promptTokens is 0 for an unpriced model.
+func checkFallbackCost(ctx context.Context, chatReq OllamaChatRequest) (promptTokens int, err error) {
+	model := fallbackModelFor(chatReq)
+	price, ok := fallbackPrice(model)
+	if !ok {
+		return 0, nil
+	}
+	cfg := currentFileConfig().Fallback
+	promptTokens = estimateTotalTokens(chatReq.Messages)
+	replyTokens := cfg.ReplyTokens
+	if replyTokens == 0 {
+		replyTokens = defaultReplyTokens
+	}
+	if n, ok := optionNumber(chatReq.Options["num_predict"]); ok && n > 0 {
+		replyTokens = int(n)
+	}
+	estimate := price.cost(promptTokens, replyTokens)
+	if cfg.ConfirmAbove > 0 && estimate > cfg.ConfirmAbove && !costConfirmed(ctx) {
+		return 0, &CostError{Model: model, Estimate: estimate, Limit: cfg.ConfirmAbove}
+	}
+	return promptTokens, nil
+}
+
+// A dollar amount, with more places for the fractions of a cent a single
+// message tends to cost
+func formatCost(dollars float64) string {
+	switch {
+	case dollars == 0:
+		return "$0"
+	case dollars < 0.01:
+		return fmt.Sprintf("$%.4f", dollars)
+	}
+	return fmt.Sprintf("$%.2f", dollars)
+}
+
+// ConfirmCostPage is the data for confirm_cost.html
+type ConfirmCostPage struct {
+	Err    *CostError
+	Action string     // where the confirmation is posted
+	Fields url.Values // form fields posted again with it
+}
+
+// Answer a page request whose chat needs its cost confirmed with a page
+// asking for it, posting the confirmation and form to action. It returns
+// false for any other error.
+func confirmCost(w http.ResponseWriter, r *http.Request, err error, action string, form url.Values) bool {
+	var costErr *CostError
+	if !errors.As(err, &costErr) {
+		return false
+	}
+	fields := url.Values{}
+	for k, v := range form {
+		if k != "confirm_cost" {
+			fields[k] = v
+		}
+	}
+	renderPageStatus(w, r, http.StatusPaymentRequired, "confirm_cost.html", ConfirmCostPage{Err: costErr, Action: action, Fields: fields})
+	return true
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasoning blocks are left out of training targets
+var thinkBlock = regexp.MustCompile(`(?s)<think>.*?</think>`)
+
+// DatasetConversation is one conversation offered for export
+type DatasetConversation struct {
+	Key      string // chat, chat/<n>, journal/<date> or scenario/<n>
+	Title    string
+	Messages []Message
+	Updated  time.Time // when it last changed
+}
+
+// DatasetPage holds data for the dataset builder template
+type DatasetPage struct {
+	Conversations []DatasetConversation
+}
+
+// Collect every exportable conversation in a session. Callers must hold
+// sessionMut.
+func datasetConversations(sess *session) []DatasetConversation {
+	var convs []DatasetConversation
+	updated := make(map[int]time.Time)
+	for _, ev := range sess.Events {
+		updated[ev.Conversation] = ev.Time
+	}
+	for _, c := range sess.Conversations {
+		history := sess.History
+		if c.ID != sess.Active {
+			history = projectHistory(sess.Events, c.ID)
+		}
+		if len(history) == 0 {
+			continue
+		}
+		key := "chat"
+		if c.ID != 0 {
+			key = "chat/" + strconv.Itoa(c.ID)
+		}
+		convs = append(convs, DatasetConversation{Key: key, Title: c.Title, Messages: history, Updated: updated[c.ID]})
+	}
+
+	dates := make([]string, 0, len(sess.Journal))
+	for date := range sess.Journal {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	for _, date := range dates {
+		convs = append(convs, DatasetConversation{Key: "journal/" + date, Title: "Journal " + date,
+			Messages: sess.Journal[date], Updated: sess.JournalUpdated[date]})
+	}
+
+	for _, run := range sess.Scenarios {
+		convs = append(convs, DatasetConversation{
+			Key:      "scenario/" + strconv.Itoa(run.ID),
+			Title:    fmt.Sprintf("Scenario: %s #%d", run.Scenario.Title, run.ID),
+			Messages: run.History,
+			Updated:  run.Updated,
+		})
+	}
+	return convs
+}
+
+// Dataset builder: GET lists conversations, POST exports the selected ones
+// (conversation=<key>, repeated) as format=sharegpt or format=jsonl, with
+// personal data handled per privacy=redact, anonymize or none. Without
+// privacy, the older redact field still chooses: redacted when set, left
+// as it is when not.
+func datasetHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+
+	sessionMut.Lock()
+	convs := datasetConversations(getSession(sessionID))
+	for i := range convs {
+		convs[i].Messages = append([]Message(nil), convs[i].Messages...)
+	}
+	sessionMut.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		renderPage(w, r, "dataset.html", DatasetPage{Conversations: convs})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Malformed form submission", http.StatusBadRequest)
+		return
+	}
+	selected := make(map[string]bool)
+	for _, key := range r.Form["conversation"] {
+		selected[key] = true
+	}
+	format := r.FormValue("format")
+	if format != "sharegpt" && format != "jsonl" {
+		http.Error(w, "Unknown dataset format", http.StatusBadRequest)
+		return
+	}
+
+	var chosen []DatasetConversation
+	var texts []string
+	for _, conv := range convs {
+		if selected[conv.Key] {
+			chosen = append(chosen, conv)
+			for _, msg := range conv.Messages {
+				texts = append(texts, msg.Content)
+			}
+		}
+	}
+
+	privacy := r.FormValue("privacy")
+	if privacy == "" {
+		privacy = "none"
+		if r.FormValue("redact") != "" {
+			privacy = "redact"
+		}
+	}
+	var transform func(string) string
+	switch privacy {
+	case "redact":
+		transform = redact
+	case "anonymize":
+		transform = newAnonymizer(texts).Anonymize
+	case "none":
+		transform = func(s string) string { return s }
+	default:
+		http.Error(w, "Unknown privacy option", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="dataset-%s.jsonl"`, format))
+	enc := json.NewEncoder(w)
+	for _, conv := range chosen {
+		record := datasetRecord(conv.Messages, format, transform)
+		if record == nil {
+			continue
+		}
+		if err := enc.Encode(record); err != nil {
+			log.Printf("Dataset export error: %v", err)
+			return
+		}
+	}
+}
+
+// Convert one conversation to a training record, or nil if it has no
+// assistant reply to learn from
+func datasetRecord(messages []Message, format string, transform func(string) string) interface{} {
+	type chatTurn struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}
+	type shareGPTTurn struct {
+		From  string `json:"from"`
+		Value string `json:"value"`
+	}
+
+	var turns []chatTurn
+	hasReply := false
+	for _, msg := range messages {
+		content := transform(strings.TrimSpace(msg.Content))
+		if content == "" {
+			continue
+		}
+		if msg.Role == "assistant" {
+			content = strings.TrimSpace(thinkBlock.ReplaceAllString(content, ""))
+			hasReply = true
+		}
+		turns = append(turns, chatTurn{Role: msg.Role, Content: content})
+	}
+	if !hasReply {
+		return nil
+	}
+
+	if format == "jsonl" {
+		return struct {
+			Messages []chatTurn `json:"messages"`
+		}{turns}
+	}
+
+	speakers := map[string]string{"system": "system", "user": "human", "assistant": "gpt"}
+	out := make([]shareGPTTurn, 0, len(turns))
+	for _, t := range turns {
+		out = append(out, shareGPTTurn{From: speakers[t.Role], Value: t.Content})
+	}
+	return struct {
+		Conversations []shareGPTTurn `json:"conversations"`
+	}{out}
+}
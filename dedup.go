@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// How alike two conversations or messages must be to be reported, from 0
+// to 1; the page can ask for another with ?threshold=
+var dedupThreshold = 0.8
+
+// Messages shorter than this are not reported when repeated, since "yes"
+// and "thanks" come up in any chat
+const minDuplicateMessage = 20
+
+// DuplicateConversations is a pair of conversations in one session with
+// mostly the same messages, as after importing a chat twice
+type DuplicateConversations struct {
+	Session    string // hash of the session ID
+	Keep, Drop DuplicateConversation
+	Similarity float64 // share of messages the two have in common; 1 when identical
+}
+
+// DuplicateConversation is one side of a pair of duplicates
+type DuplicateConversation struct {
+	ID       int
+	Title    string
+	Messages int
+}
+
+// DuplicateMessage is a message that repeats an earlier one of the same
+// role in its conversation, as when a prompt was sent twice
+type DuplicateMessage struct {
+	Session      string // hash of the session ID
+	Conversation int
+	Title        string // of the conversation
+	ID, Of       int    // the repeat and the message it repeats
+	Role         string
+	Preview      string
+	Similarity   float64 // of the two messages' words; 1 when the same
+}
+
+// DuplicatesPage holds data for the admin duplicates page
+type DuplicatesPage struct {
+	Threshold     float64
+	Conversations []DuplicateConversations
+	Messages      []DuplicateMessage
+	L             Localizer
+}
+
+// Hash of a message's role and content, ignoring case and spacing
+func messageFingerprint(m Message) [sha256.Size]byte {
+	return sha256.Sum256([]byte(m.Role + "\x00" + strings.Join(strings.Fields(strings.ToLower(m.Content)), " ")))
+}
+
+// Share of two conversations' messages found in both, counting repeats:
+// twice the messages in common over the messages of both
+func conversationSimilarity(a, b [][sha256.Size]byte) float64 {
+	if len(a)+len(b) == 0 {
+		return 0
+	}
+	counts := make(map[[sha256.Size]byte]int, len(a))
+	for _, h := range a {
+		counts[h]++
+	}
+	common := 0
+	for _, h := range b {
+		if counts[h] > 0 {
+			counts[h]--
+			common++
+		}
+	}
+	return float64(2*common) / float64(len(a)+len(b))
+}
+
+// Jaccard similarity of two texts' sets of lowercased words
+func textSimilarity(a, b string) float64 {
+	words := func(s string) map[string]bool {
+		set := make(map[string]bool)
+		for _, w := range strings.Fields(strings.ToLower(s)) {
+			set[w] = true
+		}
+		return set
+	}
+	wa, wb := words(a), words(b)
+	if len(wa)+len(wb) == 0 {
+		return 0
+	}
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(wa)+len(wb)-common)
+}
+
+// scannedConversation is a conversation's messages copied out of its
+// session, so it can be compared without holding sessionMut
+type scannedConversation struct {
+	info         ConversationInfo
+	history      []Message
+	fingerprints [][sha256.Size]byte
+}
+
+// Copy out a session's conversations for findDuplicates. Callers must hold
+// sessionMut.
+func (s *session) scanConversations() []scannedConversation {
+	var convs []scannedConversation
+	for _, c := range s.Conversations {
+		var history []Message
+		if c.ID == s.Active {
+			history = append(history, s.History...)
+		} else {
+			history = projectHistory(s.Events, c.ID)
+		}
+		if len(history) == 0 {
+			continue
+		}
+		sc := scannedConversation{info: c, history: history}
+		for _, m := range history {
+			sc.fingerprints = append(sc.fingerprints, messageFingerprint(m))
+		}
+		convs = append(convs, sc)
+	}
+	return convs
+}
+
+// Find near-duplicate conversations and repeated messages among the
+// conversations of the session with a given hash
+func findDuplicates(hash string, convs []scannedConversation, threshold float64) ([]DuplicateConversations, []DuplicateMessage) {
+	var pairs []DuplicateConversations
+	for i := range convs {
+		for j := i + 1; j < len(convs); j++ {
+			sim := conversationSimilarity(convs[i].fingerprints, convs[j].fingerprints)
+			if sim < threshold {
+				continue
+			}
+			side := func(c scannedConversation) DuplicateConversation {
+				return DuplicateConversation{ID: c.info.ID, Title: c.info.Title, Messages: len(c.history)}
+			}
+			pairs = append(pairs, DuplicateConversations{Session: hash, Keep: side(convs[i]), Drop: side(convs[j]), Similarity: sim})
+		}
+	}
+
+	var repeats []DuplicateMessage
+	for _, c := range convs {
+		for i, m := range c.history {
+			if utf8.RuneCountInString(strings.TrimSpace(m.Content)) < minDuplicateMessage {
+				continue
+			}
+			for j := 0; j < i; j++ {
+				earlier := c.history[j]
+				if earlier.Role != m.Role {
+					continue
+				}
+				sim := 1.0
+				if c.fingerprints[i] != c.fingerprints[j] {
+					sim = textSimilarity(m.Content, earlier.Content)
+				}
+				if sim >= threshold {
+					repeats = append(repeats, DuplicateMessage{Session: hash, Conversation: c.info.ID, Title: c.info.Title,
+						ID: m.ID, Of: earlier.ID, Role: m.Role, Preview: messagePreview(m.Content), Similarity: sim})
+					break
+				}
+			}
+		}
+	}
+	return pairs, repeats
+}
+
+// Start of a message for listings
+func messagePreview(content string) string {
+	const max = 120
+	content = strings.Join(strings.Fields(content), " ")
+	if r := []rune(content); len(r) > max {
+		return string(r[:max]) + "…"
+	}
+	return content
+}
+
+// Scan every session, in memory or in the store, for duplicates. Sessions
+// are copied out one at a time and compared without holding sessionMut, so
+// chats go on meanwhile. Encrypted chats are left alone, as only their
+// owner can read them.
+func allDuplicates(threshold float64) ([]DuplicateConversations, []DuplicateMessage) {
+	ids, err := allSessionIDs()
+	if err != nil {
+		log.Printf("Duplicates: listing stored sessions: %v", err)
+	}
+	var pairs []DuplicateConversations
+	var repeats []DuplicateMessage
+	for _, id := range ids {
+		sessionMut.Lock()
+		sess, ok := sessions[id]
+		if !ok {
+			sess = loadSession(id)
+		}
+		var convs []scannedConversation
+		if sess != nil && sess.Transcript == nil {
+			convs = sess.scanConversations()
+		}
+		sessionMut.Unlock()
+		p, r := findDuplicates(sessionHash(id), convs, threshold)
+		pairs, repeats = append(pairs, p...), append(repeats, r...)
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].Session != pairs[j].Session {
+			return pairs[i].Session < pairs[j].Session
+		}
+		return pairs[i].Keep.ID < pairs[j].Keep.ID
+	})
+	sort.SliceStable(repeats, func(i, j int) bool {
+		if repeats[i].Session != repeats[j].Session {
+			return repeats[i].Session < repeats[j].Session
+		}
+		return repeats[i].ID < repeats[j].ID
+	})
+	return pairs, repeats
+}
+
+// The ID of the session, in memory or in the store, with a given hash;
+// empty when there is none
+func sessionIDByHash(hash string) string {
+	ids, err := allSessionIDs()
+	if err != nil {
+		log.Printf("Duplicates: listing stored sessions: %v", err)
+	}
+	for _, id := range ids {
+		if sessionHash(id) == hash {
+			return id
+		}
+	}
+	return ""
+}
+
+// Move the messages of one conversation that another lacks into the other,
+// in their order and with their times, then delete the first. Callers must
+// hold sessionMut.
+func (s *session) mergeConversation(drop, keep int) error {
+	if drop == keep || s.conversationIndex(drop) < 0 || s.conversationIndex(keep) < 0 {
+		return errUnknownConversation
+	}
+	have := make(map[[sha256.Size]byte]int)
+	for _, m := range projectHistory(s.Events, keep) {
+		have[messageFingerprint(m)]++
+	}
+	added := messageTimes(s.Events, drop)
+	for _, m := range projectHistory(s.Events, drop) {
+		if h := messageFingerprint(m); have[h] > 0 {
+			have[h]--
+			continue
+		}
+		msg := m
+		s.recordIn(keep, MessageEvent{Type: EventAdded, Message: &msg, Time: added[m.ID]})
+	}
+	return s.deleteConversation(drop)
+}
+
+// Remove a message from any of the session's conversations. Callers must
+// hold sessionMut.
+func (s *session) deleteMessageIn(conv, id int) error {
+	for _, m := range projectHistory(s.Events, conv) {
+		if m.ID == id {
+			s.recordIn(conv, MessageEvent{Type: EventDeleted, MessageID: id})
+			return nil
+		}
+	}
+	return errUnknownMessage
+}
+
+// GET /admin/duplicates lists near-duplicate conversations and repeated
+// messages in every session. POST acts on one, back to the list:
+// action=merge (session, keep, drop), action=delete_conversation (session,
+// conversation) or action=delete_message (session, conversation, id).
+func adminDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		threshold := dedupThreshold
+		if s := r.URL.Query().Get("threshold"); s != "" {
+			t, err := strconv.ParseFloat(s, 64)
+			if err != nil || t <= 0 || t > 1 {
+				http.Error(w, "threshold must be a number above 0 and at most 1", http.StatusBadRequest)
+				return
+			}
+			threshold = t
+		}
+		page := DuplicatesPage{Threshold: threshold, L: requestLocalizer(r)}
+		page.Conversations, page.Messages = allDuplicates(threshold)
+		renderPage(w, r, "duplicates.html", page)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	formInt := func(name string) int {
+		n, _ := strconv.Atoi(r.FormValue(name))
+		return n
+	}
+	id := sessionIDByHash(r.FormValue("session"))
+	sessionMut.Lock()
+	var sess *session
+	if id != "" {
+		// A stored session comes into memory to be changed, as for a request
+		if sess = getSession(id); sess.Transcript != nil {
+			sess = nil
+		}
+	}
+	var err error
+	switch action := r.FormValue("action"); {
+	case sess == nil:
+		err = errUnknownConversation
+	case action == "merge":
+		err = sess.mergeConversation(formInt("drop"), formInt("keep"))
+	case action == "delete_conversation":
+		err = sess.deleteConversation(formInt("conversation"))
+	case action == "delete_message":
+		err = sess.deleteMessageIn(formInt("conversation"), formInt("id"))
+	default:
+		sessionMut.Unlock()
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	sessionMut.Unlock()
+
+	switch {
+	case errors.Is(err, errUnknownConversation), errors.Is(err, errUnknownMessage):
+		http.Error(w, "No such conversation or message; it may have changed since the list was shown", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		redirect(w, r, "/admin/duplicates", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "regexp"
+
+// Fenced ```mermaid blocks as emitted by the markdown renderers
+var mermaidBlockRe = regexp.MustCompile(`(?s)<pre><code class="language-mermaid">(.*?)</code></pre>`)
+
+// Mark mermaid code blocks for the client-side diagram renderer. The source
+// stays HTML-escaped inside the <pre>, so it doubles as the raw fallback
+// when mermaid is not installed or the diagram fails to parse.
+func markDiagrams(rendered string) string {
+	return mermaidBlockRe.ReplaceAllString(rendered, `<pre class="mermaid">$1</pre>`)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// Free bytes on the filesystem holding dir
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, errors.New("free disk space is only known on Unix systems")
+}
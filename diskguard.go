@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Disk limits checked before and during model pulls, set from flags
+var (
+	// Ollama's model directory, when Ollama runs on this machine
+	modelsDir string
+	// Free space to leave in modelsDir
+	minFreeDisk int64
+	// Most the installed models of one Ollama host may add up to
+	modelsQuota int64
+)
+
+var errLowDisk = errors.New("not enough disk space for the model")
+
+// DiskStatus is how close one Ollama host is to its disk limits
+type DiskStatus struct {
+	Host    string
+	Used    int64 // size of the installed models
+	Quota   int64 // 0 is no quota
+	Free    int64 // free bytes in modelsDir; -1 when unknown
+	Warning string
+}
+
+// Parse a size like "512MB" or "20GB" (powers of 1024); a bare number is bytes
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	shift := 0
+	for i, unit := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(s, unit) {
+			s, shift = strings.TrimSpace(strings.TrimSuffix(s, unit)), 10*(i+1)
+			break
+		}
+	}
+	s = strings.TrimSuffix(s, "B")
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(int64(1)<<shift)), nil
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%d KB", n>>10)
+}
+
+// Disk usage of the host reached through ctx
+func diskStatus(ctx context.Context) (DiskStatus, error) {
+	st := DiskStatus{Host: upstreamFor(ctx), Quota: modelsQuota, Free: -1}
+	models, err := ollamaListModels(ctx)
+	if err != nil {
+		return st, err
+	}
+	for _, m := range models {
+		st.Used += m.Size
+	}
+	if modelsDir != "" {
+		if st.Free, err = freeDiskSpace(modelsDir); err != nil {
+			return st, err
+		}
+	}
+	if err := st.room(0); err != nil {
+		st.Warning = err.Error()
+	}
+	return st, nil
+}
+
+// Check that need more bytes fit within the quota and the free space floor
+func (st DiskStatus) room(need int64) error {
+	if st.Quota > 0 && st.Used+need > st.Quota {
+		return fmt.Errorf("%w: %s would be used on %s, over the %s quota", errLowDisk,
+			formatSize(st.Used+need), st.Host, formatSize(st.Quota))
+	}
+	if st.Free >= 0 && st.Free-need < minFreeDisk {
+		return fmt.Errorf("%w: %s free on %s, %s must stay free", errLowDisk,
+			formatSize(st.Free-need), st.Host, formatSize(minFreeDisk))
+	}
+	return nil
+}
+
+// Pull a model unless the host is already at its disk limits, stopping
+// before a layer that would take it over them, so a download never fills
+// the disk halfway through
+func guardedPull(ctx context.Context, model string, onProgress func(PullProgress)) error {
+	if modelsDir == "" && modelsQuota == 0 {
+		return ollamaPull(ctx, model, onProgress)
+	}
+	st, err := diskStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("checking disk space: %w", err)
+	}
+	if err := st.room(0); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	started := make(map[string]bool)
+	var refused error
+	err = ollamaPull(ctx, model, func(p PullProgress) {
+		if p.Digest != "" && p.Total > 0 && !started[p.Digest] {
+			started[p.Digest] = true
+			if modelsDir != "" {
+				if free, err := freeDiskSpace(modelsDir); err == nil {
+					st.Free = free
+				}
+			}
+			if err := st.room(p.Total - p.Completed); err != nil {
+				refused = err
+				cancel()
+				return
+			}
+			// Count the layer as installed for the quota check of the next one
+			st.Used += p.Total - p.Completed
+		}
+		if onProgress != nil {
+			onProgress(p)
+		}
+	})
+	if refused != nil {
+		return refused
+	}
+	return err
+}
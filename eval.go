@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxEvalDatasetBytes = 8 << 20
+	maxEvalCases        = 500
+	// Judge scores at or above this count as a pass
+	evalPassScore = 4
+)
+
+// EvalCase is one prompt/expected-answer pair from a dataset
+type EvalCase struct {
+	Prompt   string `json:"prompt"`
+	Expected string `json:"expected"`
+}
+
+// EvalResult is the model's answer to a case and the judge's verdict
+type EvalResult struct {
+	EvalCase
+	Answer    string
+	Score     int
+	Reasoning string
+	Error     string
+}
+
+// EvalRun is one pass of a dataset through a model and a judge
+type EvalRun struct {
+	ID         int
+	Dataset    string
+	Model      string
+	JudgeModel string
+	Cases      []EvalCase
+	Results    []EvalResult
+	Started    time.Time
+	Finished   time.Time
+	Done       bool
+}
+
+// Passed counts results the judge scored as correct
+func (e *EvalRun) Passed() int {
+	n := 0
+	for _, res := range e.Results {
+		if res.Score >= evalPassScore {
+			n++
+		}
+	}
+	return n
+}
+
+// MeanScore averages the judge's scores over completed cases
+func (e *EvalRun) MeanScore() string {
+	total, scored := 0, 0
+	for _, res := range e.Results {
+		if res.Error == "" {
+			total += res.Score
+			scored++
+		}
+	}
+	if scored == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(float64(total)/float64(scored), 'f', 2, 64)
+}
+
+// Copy of a run that is safe to read while executeEval keeps appending to
+// the original. Callers must hold sessionMut.
+func (e *EvalRun) snapshot() *EvalRun {
+	copied := *e
+	copied.Results = append([]EvalResult(nil), e.Results...)
+	return &copied
+}
+
+// EvalPage holds data for the eval templates
+type EvalPage struct {
+	Runs         []*EvalRun
+	Run          *EvalRun
+	DefaultModel string
+	Error        string
+	L            Localizer
+}
+
+// Schema the judge's verdict must follow
+var judgeSchema = json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "score": {"type": "integer", "minimum": 1, "maximum": 5},
+    "reasoning": {"type": "string"}
+  },
+  "required": ["score", "reasoning"]
+}`)
+
+// Eval routes:
+//
+//	GET  /evals           upload form and past runs
+//	POST /evals           start a run from an uploaded dataset
+//	GET  /evals/<n>       results table (refreshes while running)
+//	GET  /evals/<n>/csv   results as CSV
+func evalsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/evals"), "/")
+
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			sessionMut.Lock()
+			sess := getSession(sessionID)
+			var runs []*EvalRun
+			for _, run := range sess.Evals {
+				runs = append(runs, run.snapshot())
+			}
+			l := sess.localizer(r)
+			sessionMut.Unlock()
+			renderPage(w, r, "evals.html", EvalPage{Runs: runs, DefaultModel: defaultModelFor(r.Context()), L: l})
+		case http.MethodPost:
+			startEval(w, r, sessionID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	idPart, format := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		idPart, format = path[:i], path[i+1:]
+	}
+	id, err := strconv.Atoi(idPart)
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	var run *EvalRun
+	if err == nil && id >= 1 && id <= len(sess.Evals) {
+		run = sess.Evals[id-1].snapshot()
+	}
+	l := sess.localizer(r)
+	sessionMut.Unlock()
+
+	switch {
+	case run == nil || r.Method != http.MethodGet:
+		http.NotFound(w, r)
+	case format == "csv":
+		writeEvalCSV(w, run)
+	case format == "":
+		renderPage(w, r, "eval.html", EvalPage{Run: run, L: l})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func startEval(w http.ResponseWriter, r *http.Request, sessionID string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxEvalDatasetBytes)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, "Dataset upload failed", http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("dataset")
+	if err != nil {
+		http.Error(w, "A dataset file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	cases, err := parseEvalDataset(file, header.Filename)
+	if err != nil {
+		renderPageStatus(w, r, http.StatusBadRequest, "evals.html", EvalPage{DefaultModel: defaultModelFor(r.Context()), Error: err.Error(), L: requestLocalizer(r)})
+		return
+	}
+
+	run := &EvalRun{
+		Dataset:    header.Filename,
+		Model:      strings.TrimSpace(r.FormValue("model")),
+		JudgeModel: strings.TrimSpace(r.FormValue("judge_model")),
+		Cases:      cases,
+		Started:    time.Now(),
+	}
+	if run.Model == "" {
+		run.Model = defaultModelFor(r.Context())
+	}
+	if run.JudgeModel == "" {
+		run.JudgeModel = run.Model
+	}
+	for _, model := range []string{run.Model, run.JudgeModel} {
+		if err := checkModelAllowed(r.Context(), model); err != nil {
+			renderPageStatus(w, r, http.StatusBadRequest, "evals.html", EvalPage{DefaultModel: defaultModelFor(r.Context()), Error: err.Error(), L: requestLocalizer(r)})
+			return
+		}
+	}
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	run.ID = len(sess.Evals) + 1
+	sess.Evals = append(sess.Evals, run)
+	sessionMut.Unlock()
+
+	err = submitTask("eval", fmt.Sprintf("eval %d: %s", run.ID, run.Dataset),
+		func(context.Context) error { executeEval(run); return nil }, nil)
+	if err != nil {
+		http.Error(w, "Too much background work queued; try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	redirect(w, r, fmt.Sprintf("/evals/%d", run.ID), http.StatusSeeOther)
+}
+
+// Read cases from JSONL ({"prompt", "expected"} per line) or CSV with a
+// header row naming prompt and expected columns
+func parseEvalDataset(r io.Reader, filename string) ([]EvalCase, error) {
+	var cases []EvalCase
+
+	if strings.HasSuffix(strings.ToLower(filename), ".csv") {
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("reading CSV: %w", err)
+		}
+		if len(records) < 2 {
+			return nil, errors.New("CSV dataset needs a header row and at least one case")
+		}
+		promptCol, expectedCol := -1, -1
+		for i, name := range records[0] {
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "prompt", "question", "input":
+				promptCol = i
+			case "expected", "answer", "output":
+				expectedCol = i
+			}
+		}
+		if promptCol < 0 || expectedCol < 0 {
+			return nil, errors.New("CSV header must include prompt and expected columns")
+		}
+		for _, rec := range records[1:] {
+			if promptCol < len(rec) && expectedCol < len(rec) {
+				cases = append(cases, EvalCase{Prompt: rec[promptCol], Expected: rec[expectedCol]})
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64<<10), maxEvalDatasetBytes)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			var raw map[string]string
+			if err := json.Unmarshal([]byte(text), &raw); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			c := EvalCase{Prompt: firstNonEmpty(raw["prompt"], raw["question"], raw["input"]),
+				Expected: firstNonEmpty(raw["expected"], raw["answer"], raw["output"])}
+			cases = append(cases, c)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var valid []EvalCase
+	for _, c := range cases {
+		if strings.TrimSpace(c.Prompt) != "" {
+			valid = append(valid, c)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, errors.New("dataset contains no cases")
+	}
+	if len(valid) > maxEvalCases {
+		return nil, fmt.Errorf("dataset has %d cases; the limit is %d", len(valid), maxEvalCases)
+	}
+	return valid, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Answer and judge every case in turn, publishing results as they land
+func executeEval(run *EvalRun) {
+	ctx := context.Background()
+	for _, c := range run.Cases {
+		res := EvalResult{EvalCase: c}
+
+		answer, err := ollamaComplete(ctx, OllamaChatRequest{
+			Model:    run.Model,
+			Messages: []Message{{Role: "user", Content: c.Prompt}},
+		})
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Answer = answer
+			res.Score, res.Reasoning, err = judgeAnswer(ctx, run.JudgeModel, c, answer)
+			if err != nil {
+				res.Error = err.Error()
+			}
+		}
+
+		sessionMut.Lock()
+		run.Results = append(run.Results, res)
+		sessionMut.Unlock()
+	}
+
+	sessionMut.Lock()
+	run.Done = true
+	run.Finished = time.Now()
+	sessionMut.Unlock()
+	log.Printf("Eval %q finished: %d cases", run.Dataset, len(run.Cases))
+}
+
+// Ask the judge model to score an answer against the expected one
+func judgeAnswer(ctx context.Context, model string, c EvalCase, answer string) (int, string, error) {
+	prompt := fmt.Sprintf("You are grading an AI assistant's answer. Compare it to the reference answer and score it "+
+		"from 1 (wrong or irrelevant) to 5 (fully correct and complete). Judge meaning, not wording.\n\n"+
+		"Question:\n%s\n\nReference answer:\n%s\n\nAssistant's answer:\n%s\n\n"+
+		`Respond only with JSON: {"score": <1-5>, "reasoning": "<one sentence>"}`,
+		c.Prompt, c.Expected, answer)
+
+	reply, err := ollamaComplete(ctx, OllamaChatRequest{
+		Model:    model,
+		Messages: []Message{{Role: "user", Content: prompt}},
+		Format:   judgeSchema,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	var verdict struct {
+		Score     int    `json:"score"`
+		Reasoning string `json:"reasoning"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(reply)), &verdict); err != nil {
+		return 0, "", fmt.Errorf("judge returned invalid JSON: %w", err)
+	}
+	if verdict.Score < 1 || verdict.Score > 5 {
+		return 0, "", fmt.Errorf("judge returned out-of-range score %d", verdict.Score)
+	}
+	return verdict.Score, verdict.Reasoning, nil
+}
+
+func writeEvalCSV(w http.ResponseWriter, run *EvalRun) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="eval-%d.csv"`, run.ID))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"prompt", "expected", "answer", "score", "reasoning", "error"})
+	for _, res := range run.Results {
+		score := ""
+		if res.Error == "" {
+			score = strconv.Itoa(res.Score)
+		}
+		cw.Write([]string{res.Prompt, res.Expected, res.Answer, score, res.Reasoning, res.Error})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Eval CSV error: %v", err)
+	}
+}
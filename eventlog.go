@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Kinds of change recorded in a session's chat event log
+const (
+	EventAdded       = "added"
+	EventEdited      = "edited"
+	EventDeleted     = "deleted"
+	EventRegenerated = "regenerated"
+	EventUndone      = "undone"
+
+	// Conversation changes: Conversation is the one concerned, and Content
+	// the title when it is created or renamed, its system prompt, or its
+	// model options or summary as a JSON object
+	EventConversationCreated  = "conversation_created"
+	EventConversationRenamed  = "conversation_renamed"
+	EventConversationDeleted  = "conversation_deleted"
+	EventConversationSwitched = "conversation_switched"
+	EventConversationPrompt   = "conversation_prompt"
+	EventConversationOptions  = "conversation_options"
+	EventConversationSummary  = "conversation_summary"
+)
+
+var (
+	errUnknownMessage      = errors.New("message not found")
+	errNothingToUndo       = errors.New("nothing to undo")
+	errUnknownConversation = errors.New("conversation not found")
+)
+
+// MessageEvent is one entry in the append-only chat log. The chat history
+// is a projection of these events; nothing is ever rewritten in place.
+type MessageEvent struct {
+	Seq       int       `json:"seq"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	MessageID int       `json:"message_id,omitempty"`
+	Message   *Message  `json:"message,omitempty"`   // added: the new message
+	Content   string    `json:"content,omitempty"`   // edited, regenerated: the new content
+	Reasoning string    `json:"reasoning,omitempty"` // regenerated: the new reply's reasoning
+	Backend   string    `json:"backend,omitempty"`   // regenerated: the fallback backend that answered
+	Cost      float64   `json:"cost,omitempty"`      // regenerated: the new reply's estimated cost
+	Target    int       `json:"target,omitempty"`    // undone: Seq of the reverted event
+	// Conversation the event belongs to; 0 is the session's first
+	Conversation int `json:"conversation,omitempty"`
+}
+
+// Record an event in the active conversation and update the history
+// projection. Callers must hold sessionMut.
+func (s *session) record(ev MessageEvent) {
+	s.recordIn(s.Active, ev)
+}
+
+// Record an event in the given conversation. Its time is now unless set,
+// as for imported messages. The store saves it once sessionMut is free of
+// it, through storeWrites. Callers must hold sessionMut.
+func (s *session) recordIn(conv int, ev MessageEvent) {
+	if s.transcriptLocked() {
+		log.Printf("Dropped a %s event for locked session %s", ev.Type, sessionHash(s.id))
+		return
+	}
+	now := time.Now()
+	ev.Seq = len(s.Events) + 1
+	if ev.Time.IsZero() {
+		ev.Time = now
+	}
+	ev.Conversation = conv
+	if ev.Type == EventAdded {
+		s.nextMessageID++
+		ev.MessageID = s.nextMessageID
+		msg := withReasoning(*ev.Message)
+		msg.ID = ev.MessageID
+		if msg.Role == "assistant" {
+			msg.Content, msg.Reasoning = sanitizeMarkdown(msg.Content), sanitizeMarkdown(msg.Reasoning)
+		}
+		ev.Message = &msg
+	}
+	if ev.Type == EventRegenerated || ev.Type == EventEdited && s.isReply(ev.MessageID) {
+		ev.Content, ev.Reasoning = sanitizeMarkdown(ev.Content), sanitizeMarkdown(ev.Reasoning)
+	}
+	s.Events = append(s.Events, ev)
+	if ev.Type == EventAdded {
+		enforceSessionCaps(s)
+	}
+	if s.Transcript != nil {
+		if err := s.storeSealed(ev); err != nil {
+			log.Printf("Session store error: %v", err)
+		}
+	} else {
+		storeWrites.add(s.id, ev, now)
+	}
+
+	switch {
+	case isConversationEvent(ev.Type):
+		s.project()
+	case conv != s.Active:
+		// The history shown is another conversation's
+	case ev.Type == EventUndone:
+		s.History = projectHistory(s.Events, conv)
+		s.rendered = nil
+	case ev.Type == EventAdded:
+		s.History = applyEvent(s.History, ev)
+	default:
+		s.History = applyEvent(s.History, ev)
+		delete(s.rendered, ev.MessageID)
+	}
+}
+
+func isConversationEvent(typ string) bool {
+	switch typ {
+	case EventConversationCreated, EventConversationRenamed, EventConversationDeleted, EventConversationSwitched,
+		EventConversationPrompt, EventConversationOptions, EventConversationSummary:
+		return true
+	}
+	return false
+}
+
+// Rebuild the conversation list and the active conversation's history from
+// the log. Callers must hold sessionMut.
+func (s *session) project() {
+	s.Conversations, s.Active = projectConversations(s.Events)
+	s.History = projectHistory(s.Events, s.Active)
+}
+
+// Rebuild a conversation's history from the full log, skipping undone
+// events
+func projectHistory(events []MessageEvent, conv int) []Message {
+	undone := make(map[int]bool)
+	for _, ev := range events {
+		if ev.Type == EventUndone {
+			undone[ev.Target] = true
+		}
+	}
+	var history []Message
+	for _, ev := range events {
+		if ev.Conversation == conv && !undone[ev.Seq] {
+			history = applyEvent(history, ev)
+		}
+	}
+	return history
+}
+
+// When each message of a conversation was added, by message ID
+func messageTimes(events []MessageEvent, conv int) map[int]time.Time {
+	times := make(map[int]time.Time)
+	for _, ev := range events {
+		if ev.Type == EventAdded && ev.Conversation == conv {
+			times[ev.MessageID] = ev.Time
+		}
+	}
+	return times
+}
+
+// Apply one event to a history. The slice is copied on edits and deletes
+// so earlier snapshots handed out by callers stay unchanged.
+func applyEvent(history []Message, ev MessageEvent) []Message {
+	switch ev.Type {
+	case EventAdded:
+		return append(history, *ev.Message)
+	case EventEdited, EventRegenerated:
+		out := append([]Message(nil), history...)
+		for i := range out {
+			if out[i].ID == ev.MessageID {
+				out[i].Content = ev.Content
+				if ev.Type == EventRegenerated {
+					out[i].Reasoning, out[i].Backend, out[i].Cost = ev.Reasoning, ev.Backend, ev.Cost
+				}
+			}
+		}
+		return out
+	case EventDeleted:
+		out := make([]Message, 0, len(history))
+		for _, m := range history {
+			if m.ID != ev.MessageID {
+				out = append(out, m)
+			}
+		}
+		return out
+	}
+	return history
+}
+
+// Index of a message in the current history, or -1
+func (s *session) messageIndex(id int) int {
+	for i, m := range s.History {
+		if m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Whether a message in the current history is an assistant reply, whose
+// raw HTML is cleaned before it is stored. Callers must hold sessionMut.
+func (s *session) isReply(id int) bool {
+	i := s.messageIndex(id)
+	return i >= 0 && s.History[i].Role == "assistant"
+}
+
+// Change a message's content. Callers must hold sessionMut.
+func (s *session) editMessage(id int, content string) error {
+	if s.messageIndex(id) < 0 {
+		return errUnknownMessage
+	}
+	s.record(MessageEvent{Type: EventEdited, MessageID: id, Content: content})
+	return nil
+}
+
+// Remove a message from the history. Callers must hold sessionMut.
+func (s *session) deleteMessage(id int) error {
+	if s.messageIndex(id) < 0 {
+		return errUnknownMessage
+	}
+	s.record(MessageEvent{Type: EventDeleted, MessageID: id})
+	return nil
+}
+
+// Rewrite the conversation from a user message: give it new content and
+// remove every message after it, so the chat continues from there.
+// Callers must hold sessionMut.
+func (s *session) rewriteFrom(id int, content string) error {
+	i := s.messageIndex(id)
+	if i < 0 || s.History[i].Role != "user" {
+		return errUnknownMessage
+	}
+	var later []int
+	for _, m := range s.History[i+1:] {
+		later = append(later, m.ID)
+	}
+	if content != s.History[i].Content {
+		s.record(MessageEvent{Type: EventEdited, MessageID: id, Content: content})
+	}
+	for _, id := range later {
+		s.record(MessageEvent{Type: EventDeleted, MessageID: id})
+	}
+	return nil
+}
+
+// Replace an assistant message with a new reply. Callers must hold
+// sessionMut.
+func (s *session) regenerateMessage(id int, reply Message) error {
+	i := s.messageIndex(id)
+	if i < 0 || s.History[i].Role != "assistant" {
+		return errUnknownMessage
+	}
+	reasoning, content := splitReasoning(reply.Content)
+	s.record(MessageEvent{Type: EventRegenerated, MessageID: id, Content: content, Reasoning: reasoning, Backend: reply.Backend, Cost: reply.Cost})
+	return nil
+}
+
+// ID of the last assistant message in the history, or 0 when there is
+// none. Callers must hold sessionMut.
+func (s *session) lastReplyID() int {
+	for i := len(s.History) - 1; i >= 0; i-- {
+		if s.History[i].Role == "assistant" {
+			return s.History[i].ID
+		}
+	}
+	return 0
+}
+
+// Revert the most recent change that has not been undone yet. Callers must
+// hold sessionMut.
+func (s *session) undo() error {
+	undone := make(map[int]bool)
+	for _, ev := range s.Events {
+		if ev.Type == EventUndone {
+			undone[ev.Target] = true
+		}
+	}
+	for i := len(s.Events) - 1; i >= 0; i-- {
+		ev := s.Events[i]
+		if ev.Conversation == s.Active && ev.Type != EventUndone && !isConversationEvent(ev.Type) && !undone[ev.Seq] {
+			s.record(MessageEvent{Type: EventUndone, Target: ev.Seq})
+			return nil
+		}
+	}
+	return errNothingToUndo
+}
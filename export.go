@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runs of characters left out of download file names
+var fileNameUnsafeRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// ConversationExport is the JSON download of a conversation; messages use
+// the same schema as the JSON API
+type ConversationExport struct {
+	Title    string    `json:"title"`
+	Exported time.Time `json:"exported"`
+	Messages []Message `json:"messages"`
+}
+
+// GET /export/markdown, /export/json, /export/text, /export/print,
+// /export/pdf, /export/modelfile and /export/ollama, or /export?format=:
+// download a conversation, the active one unless ?conversation= names
+// another. text and ollama are shown inline for copying, and print is a
+// page for the browser to print.
+func conversationExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := strings.TrimPrefix(r.URL.Path, "/export/")
+	if r.URL.Path == "/export" {
+		format = r.URL.Query().Get("format")
+	}
+	switch format {
+	case "markdown", "json", "text", "print", "pdf", "modelfile", "ollama":
+	default:
+		http.Error(w, "Unknown export format", http.StatusBadRequest)
+		return
+	}
+	if format == "pdf" && pdfCommand == "" {
+		http.Error(w, errPDFNotConfigured.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	sessionID := getSessionID(w, r)
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	conv := sess.Active
+	if v := r.URL.Query().Get("conversation"); v != "" {
+		conv, _ = strconv.Atoi(v)
+	}
+	i := sess.conversationIndex(conv)
+	var export ConversationExport
+	var times map[int]time.Time
+	var handoff OllamaChatRequest
+	if i >= 0 {
+		export = ConversationExport{Title: sess.Conversations[i].Title, Exported: time.Now().UTC(),
+			Messages: projectHistory(sess.Events, conv)}
+		times = messageTimes(sess.Events, conv)
+		handoff = sess.conversationRequest(conv, export.Messages)
+	}
+	l := sess.localizer(r)
+	sessionMut.Unlock()
+
+	if i < 0 {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	name := exportFileName(export.Title)
+
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, name))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(export)
+		return
+	case "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.md"`, name))
+		fmt.Fprint(w, markdownTranscript(export))
+		return
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.txt"`, name))
+		fmt.Fprint(w, plainTranscript(export))
+		return
+	case "modelfile":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.Modelfile"`, name))
+		fmt.Fprint(w, modelfileTranscript(handoff))
+		return
+	case "ollama":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.sh"`, name))
+		fmt.Fprint(w, ollamaHandoffScript(export.Title, handoff))
+		return
+	}
+
+	page, err := printTranscript(export, times, l)
+	if err != nil {
+		http.Error(w, "Error rendering the transcript", http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+	if format == "print" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+		return
+	}
+	pdf, err := htmlToPDF(r.Context(), page)
+	if err != nil {
+		http.Error(w, "Error converting the transcript to PDF", http.StatusBadGateway)
+		log.Printf("PDF export error: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, name))
+	w.Write(pdf)
+}
+
+// A conversation title as a file name, without extension
+func exportFileName(title string) string {
+	name := strings.Trim(fileNameUnsafeRe.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if name == "" {
+		name = "conversation"
+	}
+	return name
+}
+
+// A conversation as a Markdown document, one section per message
+func markdownTranscript(export ConversationExport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n_Exported %s_\n", export.Title, export.Exported.Format("2006-01-02 15:04 MST"))
+	for _, m := range export.Messages {
+		heading := titleCase(m.Role)
+		switch {
+		case m.Name != "":
+			heading = m.Name
+		case m.ToolName != "":
+			heading += " (" + m.ToolName + ")"
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n", heading)
+		if m.Content != "" {
+			b.WriteString(strings.TrimSpace(m.Content) + "\n")
+		}
+		for _, call := range m.ToolCalls {
+			fmt.Fprintf(&b, "\n_Called `%s` with `%s`_\n", call.Function.Name, call.Function.Arguments)
+		}
+		if n := len(m.Images); n > 0 {
+			fmt.Fprintf(&b, "\n_%d image(s) attached_\n", n)
+		}
+	}
+	return b.String()
+}
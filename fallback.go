@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Optional OpenAI-compatible backend for chats Ollama cannot answer,
+// because it is down or lacks the model; set by -fallback-url, such as
+// https://api.openai.com/v1, with its key from -fallback-key or
+// FALLBACK_API_KEY. fallbackModel replaces the chat's model there when
+// set.
+var (
+	fallbackURL   string
+	fallbackKey   string
+	fallbackModel string
+)
+
+// Client for the fallback backend. It has Ollama's connect and read
+// timeouts, so a stalled cloud API fails like a stalled Ollama, but is
+// used through send: no retries, and no circuit of its own.
+var fallbackClient = newOllamaClient()
+
+// Name messages the fallback answered are labelled with: its host
+func fallbackName() string {
+	if u, err := url.Parse(fallbackURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return fallbackURL
+}
+
+type answerKey struct{}
+
+// answer records which backend answered the chats made under a context,
+// and for a priced fallback model what the prompt took
+type answer struct {
+	mu           sync.Mutex
+	backend      string
+	model        string
+	promptTokens int
+}
+
+// Tag a context so answeredBy can tell which backend its chats went to
+func withAnswerLabel(ctx context.Context) context.Context {
+	return context.WithValue(ctx, answerKey{}, &answer{})
+}
+
+// The backend that answered the last chat under ctx: empty for Ollama,
+// else the fallback's name
+func answeredBy(ctx context.Context) string {
+	a, ok := ctx.Value(answerKey{}).(*answer)
+	if !ok {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.backend
+}
+
+// The assistant message for a reply generated under ctx, labelled with the
+// backend that answered and, when that is a priced fallback model, the
+// estimated cost of its prompt and reply
+func assistantReply(ctx context.Context, reply string) Message {
+	msg := Message{Role: "assistant", Content: reply}
+	a, ok := ctx.Value(answerKey{}).(*answer)
+	if !ok {
+		return msg
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	msg.Backend = a.backend
+	if price, ok := fallbackPrice(a.model); ok && a.backend != "" {
+		msg.Cost = price.cost(a.promptTokens, estimateTokens(msg))
+	}
+	return msg
+}
+
+// Record the fallback backend that answered a chat under ctx, with the
+// model it used and the tokens its prompt took
+func setAnsweredBy(ctx context.Context, backend, model string, promptTokens int) {
+	if a, ok := ctx.Value(answerKey{}).(*answer); ok {
+		a.mu.Lock()
+		a.backend, a.model, a.promptTokens = backend, model, promptTokens
+		a.mu.Unlock()
+	}
+}
+
+// Whether an Ollama chat should go to the fallback instead: Ollama could
+// not be reached, failed, or does not have the model
+func needsFallback(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusNotFound || resp.StatusCode >= 500
+}
+
+// Send an Ollama chat request body to the fallback backend, returning a
+// response in Ollama's format, streamed as NDJSON when the request is, so
+// callers read it as they would Ollama's. A chat whose estimated cost
+// needs confirming fails with a CostError unless ctx confirms it.
+func fallbackDo(ctx context.Context, body []byte) (*http.Response, error) {
+	var chatReq OllamaChatRequest
+	if err := json.Unmarshal(body, &chatReq); err != nil {
+		return nil, err
+	}
+	promptTokens, err := checkFallbackCost(ctx, chatReq)
+	if err != nil {
+		return nil, err
+	}
+	out := OpenAIChatRequest{Model: fallbackModelFor(chatReq), Stream: chatReq.Stream}
+	for _, m := range chatReq.Messages {
+		out.Messages = append(out.Messages, openAIMessage(m))
+	}
+	if t, ok := optionNumber(chatReq.Options["temperature"]); ok {
+		out.Temperature = &t
+	}
+	if p, ok := optionNumber(chatReq.Options["top_p"]); ok {
+		out.TopP = &p
+	}
+	if n, ok := optionNumber(chatReq.Options["num_predict"]); ok && n > 0 {
+		max := int(n)
+		out.MaxTokens = &max
+	}
+	payload, err := json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(fallbackURL, "/")+"/chat/completions", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if fallbackKey != "" {
+		req.Header.Set("Authorization", "Bearer "+fallbackKey)
+	}
+	resp, err := fallbackClient.send(req)
+	if err != nil {
+		return nil, fmt.Errorf("fallback backend: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fallback backend returned status %d", resp.StatusCode)
+	}
+	setAnsweredBy(ctx, fallbackName(), out.Model, promptTokens)
+
+	translated := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/x-ndjson"}}, Request: req}
+	if !chatReq.Stream {
+		defer resp.Body.Close()
+		var completion OpenAICompletion
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			return nil, err
+		}
+		var reply Message
+		if len(completion.Choices) > 0 && completion.Choices[0].Message != nil {
+			reply = Message{Role: "assistant", Content: completion.Choices[0].Message.Content}
+		}
+		b, _ := json.Marshal(OllamaChatResponse{Message: reply, Done: true})
+		translated.Body = io.NopCloser(bytes.NewReader(b))
+		return translated, nil
+	}
+
+	// Server-sent chunks in, Ollama's NDJSON out
+	pr, pw := io.Pipe()
+	go func() {
+		defer resp.Body.Close()
+		enc := json.NewEncoder(pw)
+		sc := bufio.NewScanner(resp.Body)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			data := strings.TrimPrefix(sc.Text(), "data: ")
+			if data == sc.Text() {
+				continue
+			}
+			if data == "[DONE]" {
+				break
+			}
+			var chunk OpenAICompletion
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if len(chunk.Choices) == 0 || chunk.Choices[0].Delta == nil || chunk.Choices[0].Delta.Content == "" {
+				continue
+			}
+			if err := enc.Encode(OllamaChatResponse{Message: Message{Role: "assistant", Content: chunk.Choices[0].Delta.Content}}); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if err := sc.Err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		enc.Encode(OllamaChatResponse{Message: Message{Role: "assistant"}, Done: true})
+		pw.Close()
+	}()
+	translated.Body = pr
+	return translated, nil
+}
+
+// A chat message in OpenAI's format, images as data URL parts
+func openAIMessage(m Message) OpenAIMessage {
+	out := OpenAIMessage{Role: m.Role, Name: m.Name}
+	if len(m.Images) == 0 {
+		out.Content, _ = json.Marshal(m.Content)
+		return out
+	}
+	parts := []map[string]interface{}{{"type": "text", "text": m.Content}}
+	for _, img := range m.Images {
+		kind := "image/png"
+		if raw, err := base64.StdEncoding.DecodeString(img); err == nil {
+			kind = http.DetectContentType(raw)
+		}
+		parts = append(parts, map[string]interface{}{
+			"type":      "image_url",
+			"image_url": map[string]string{"url": "data:" + kind + ";base64," + img},
+		})
+	}
+	out.Content, _ = json.Marshal(parts)
+	return out
+}
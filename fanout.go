@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How a subscriber is treated when its buffer is full
+type overflowPolicy int
+
+const (
+	// Discard tokens the subscriber has no room for. It still gets the
+	// full reply from Result, so it can catch up at the end.
+	dropTokens overflowPolicy = iota
+	// Hold the upstream read until the subscriber takes the token, for up
+	// to slowSubscriberTimeout; a subscriber that stays stuck is evicted
+	waitForSubscriber
+)
+
+// Longest a waitForSubscriber subscriber may stall the upstream read
+var slowSubscriberTimeout = 2 * time.Second
+
+// tokenHub fans one generation's tokens out to several consumers (a
+// socket, speech, persistence) with a buffer per subscriber, so one slow
+// consumer cannot stall the upstream read for everyone else. Publish and
+// Close must be called from a single goroutine, the one reading Ollama.
+type tokenHub struct {
+	mu     sync.Mutex
+	subs   []*tokenSubscriber
+	closed bool
+	reply  string
+	err    error
+	done   chan struct{}
+}
+
+// tokenSubscriber receives tokens on C until the generation ends or the
+// subscriber is evicted or leaves
+type tokenSubscriber struct {
+	C <-chan string
+
+	hub     *tokenHub
+	ch      chan string
+	policy  overflowPolicy
+	dropped int  // guarded by hub.mu
+	evicted bool // guarded by hub.mu
+	left    bool // guarded by hub.mu
+}
+
+func newTokenHub() *tokenHub {
+	return &tokenHub{done: make(chan struct{})}
+}
+
+// Subscribe adds a consumer with room for buffer pending tokens. Tokens
+// published before it subscribed are not replayed.
+func (h *tokenHub) Subscribe(buffer int, policy overflowPolicy) *tokenSubscriber {
+	ch := make(chan string, buffer)
+	sub := &tokenSubscriber{C: ch, hub: h, ch: ch, policy: policy}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+	} else {
+		h.subs = append(h.subs, sub)
+	}
+	return sub
+}
+
+// Publish hands a token to every subscriber according to its policy
+func (h *tokenHub) Publish(token string) {
+	h.mu.Lock()
+	subs := append([]*tokenSubscriber(nil), h.subs...)
+	h.mu.Unlock()
+
+	for _, sub := range subs {
+		if !sub.deliver(token) {
+			h.mu.Lock()
+			h.remove(sub)
+			h.mu.Unlock()
+			close(sub.ch)
+		}
+	}
+}
+
+// Send one token, reporting whether the subscriber should stay
+func (s *tokenSubscriber) deliver(token string) bool {
+	s.hub.mu.Lock()
+	left := s.left
+	s.hub.mu.Unlock()
+	if left {
+		return false
+	}
+
+	select {
+	case s.ch <- token:
+		return true
+	default:
+	}
+
+	if s.policy == dropTokens {
+		s.hub.mu.Lock()
+		s.dropped++
+		s.hub.mu.Unlock()
+		return true
+	}
+
+	timer := time.NewTimer(slowSubscriberTimeout)
+	defer timer.Stop()
+	select {
+	case s.ch <- token:
+		return true
+	case <-timer.C:
+		s.hub.mu.Lock()
+		s.evicted = true
+		s.hub.mu.Unlock()
+		return false
+	}
+}
+
+// Drop a subscriber from the list. Callers must hold h.mu.
+func (h *tokenHub) remove(sub *tokenSubscriber) {
+	for i, s := range h.subs {
+		if s == sub {
+			h.subs = append(h.subs[:i], h.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close ends the generation with its full reply, closing every
+// subscriber's channel
+func (h *tokenHub) Close(reply string, err error) {
+	h.mu.Lock()
+	subs := h.subs
+	h.subs = nil
+	h.closed = true
+	h.reply, h.err = reply, err
+	h.mu.Unlock()
+
+	for _, sub := range subs {
+		close(sub.ch)
+	}
+	close(h.done)
+}
+
+// Leave stops delivery to the subscriber; its channel is closed on the
+// next publish. The subscriber should keep draining C until then.
+func (s *tokenSubscriber) Leave() {
+	s.hub.mu.Lock()
+	s.left = true
+	s.hub.mu.Unlock()
+}
+
+// Result waits for the generation to end and returns the full reply
+func (s *tokenSubscriber) Result() (string, error) {
+	<-s.hub.done
+	return s.hub.reply, s.hub.err
+}
+
+// Dropped counts tokens discarded because the subscriber's buffer was full
+func (s *tokenSubscriber) Dropped() int {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.dropped
+}
+
+// Evicted reports whether the subscriber was cut off for stalling
+func (s *tokenSubscriber) Evicted() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.evicted
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAML file of settings that may change while the server runs; set from
+// -config
+var configPath string
+
+// How often the config file is checked for changes; a var so tests can
+// shorten it
+var configPollInterval = 5 * time.Second
+
+// FileConfig holds the settings read from -config. All but SessionStore
+// take effect as soon as the file changes.
+type FileConfig struct {
+	// Models API callers may ask for; any when empty
+	Models []string `yaml:"models"`
+	// Prepended to chats that bring no system message of their own
+	SystemPrompt string    `yaml:"system_prompt"`
+	RateLimit    RateLimit `yaml:"rate_limit"`
+	// Used when -session-store is not given; read at startup only
+	SessionStore string `yaml:"session_store"`
+	// Limits on model options such as num_predict, applied to every chat
+	OptionLimits map[string]OptionLimit `yaml:"option_limits"`
+	Context      struct {
+		// Tokens chats are fitted into, dropping the oldest messages; 0 for
+		// no limit. A chat's own num_ctx option takes precedence.
+		NumCtx int `yaml:"num_ctx"`
+		// Tokens kept free for the reply; 0 for num_predict when it is
+		// under half the window, else a quarter of it
+		Reserve int `yaml:"reserve"`
+		// Summarize older turns as a chat nears its window, instead of
+		// only dropping them, keeping the newest keep_recent messages
+		Summarize  bool `yaml:"summarize"`
+		KeepRecent int  `yaml:"keep_recent"`
+	} `yaml:"context"`
+	HTML struct {
+		// Elements replies may use beyond the defaults, each with the
+		// attributes it may carry; "*" lists attributes for any element
+		Allow map[string][]string `yaml:"allow"`
+	} `yaml:"html"`
+	// Namespaces served from one server, by name; see tenant.go
+	Tenants map[string]*Tenant `yaml:"tenants"`
+	// Addresses allowed to reach each group of routes; see netpolicy.go
+	Network NetworkConfig `yaml:"network"`
+	// Prices of the fallback backend's models; see cost.go
+	Fallback FallbackConfig `yaml:"fallback"`
+}
+
+// RateLimit is a token bucket: a steady rate with a burst allowance
+type RateLimit struct {
+	// Generations each client may start per minute; 0 for no limit
+	PerMinute int `yaml:"per_minute"`
+	// Generations allowed in a row before the rate applies
+	Burst int `yaml:"burst"`
+}
+
+// Check the limit and fill in a burst of 1 when none is given
+func (l *RateLimit) check() error {
+	if l.PerMinute < 0 || l.Burst < 0 {
+		return errors.New("rate_limit values must not be negative")
+	}
+	if l.PerMinute > 0 && l.Burst == 0 {
+		l.Burst = 1
+	}
+	return nil
+}
+
+// OptionLimit bounds one model option. Requests outside min and max are
+// clamped; value replaces whatever a request sends, and default is sent
+// when a request sets nothing.
+type OptionLimit struct {
+	Min     *float64    `yaml:"min"`
+	Max     *float64    `yaml:"max"`
+	Value   interface{} `yaml:"value"`
+	Default interface{} `yaml:"default"`
+}
+
+var (
+	fileConfigMut sync.RWMutex
+	fileConfig    FileConfig
+	configModTime time.Time
+)
+
+// The settings currently in effect
+func currentFileConfig() FileConfig {
+	fileConfigMut.RLock()
+	defer fileConfigMut.RUnlock()
+	return fileConfig
+}
+
+// Read and check the config file, replacing the settings in effect. On
+// error the previous settings stay.
+func loadFileConfig() error {
+	if configPath == "" {
+		return nil
+	}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var cfg FileConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if err := cfg.RateLimit.check(); err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if err := checkTenants(cfg.Tenants); err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if cfg.Context.NumCtx < 0 || cfg.Context.Reserve < 0 || cfg.Context.KeepRecent < 0 {
+		return fmt.Errorf("%s: context values must not be negative", configPath)
+	}
+	if err := checkHTMLAllow(cfg.HTML.Allow); err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if err := cfg.Network.check(); err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if err := cfg.Fallback.check(); err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	for name, l := range cfg.OptionLimits {
+		if l.Min != nil && l.Max != nil && *l.Min > *l.Max {
+			return fmt.Errorf("%s: option_limits.%s: min is above max", configPath, name)
+		}
+	}
+	if !modelInList(cfg.Models, defaultModel) {
+		log.Printf("Config: the default model %s is not in models; requests must name an allowed one", defaultModel)
+	}
+
+	fileConfigMut.Lock()
+	defer fileConfigMut.Unlock()
+	if configModTime != (time.Time{}) && cfg.SessionStore != fileConfig.SessionStore {
+		log.Printf("Config: session_store changed; it takes effect after a restart")
+		cfg.SessionStore = fileConfig.SessionStore
+	}
+	fileConfig, configModTime = cfg, info.ModTime()
+	setHTMLAllow(cfg.HTML.Allow)
+	return nil
+}
+
+// Reload the config file whenever its modification time changes
+func watchFileConfig() {
+	if configPath == "" {
+		return
+	}
+	go func() {
+		for range time.Tick(configPollInterval) {
+			reloadFileConfig()
+		}
+	}()
+}
+
+func reloadFileConfig() {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		log.Printf("Config reload error: %v", err)
+		return
+	}
+	fileConfigMut.RLock()
+	changed := !info.ModTime().Equal(configModTime)
+	fileConfigMut.RUnlock()
+	if !changed {
+		return
+	}
+	if err := loadFileConfig(); err != nil {
+		log.Printf("Config reload error: %v; keeping the previous settings", err)
+		return
+	}
+	log.Printf("Config reloaded from %s", configPath)
+}
+
+// Whether the config allows a model, and the tenant a request under ctx
+// is for allows it too; a name without a tag means :latest
+func modelAllowed(ctx context.Context, model string) bool {
+	if t := tenantFrom(ctx); t != nil && !modelInList(t.Models, model) {
+		return false
+	}
+	return modelInList(currentFileConfig().Models, model)
+}
+
+// An error for requests naming a model the config does not allow
+func checkModelAllowed(ctx context.Context, model string) error {
+	if !modelAllowed(ctx, model) {
+		return fmt.Errorf("%w: model %q is not allowed", errInvalidRequest, model)
+	}
+	return nil
+}
+
+func modelInList(allowed []string, model string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, m := range allowed {
+		if fullModelName(m) == fullModelName(model) {
+			return true
+		}
+	}
+	return false
+}
+
+// Put the configured system prompt first unless the chat has its own
+func withSystemPrompt(messages []Message) []Message {
+	prompt := currentFileConfig().SystemPrompt
+	if prompt == "" || (len(messages) > 0 && messages[0].Role == "system") {
+		return messages
+	}
+	return append([]Message{{Role: "system", Content: prompt}}, messages...)
+}
+
+// Apply the configured option limits to a chat's options, returning the
+// options to send and a notice for each one changed
+func limitOptions(opts map[string]interface{}) (map[string]interface{}, []string) {
+	limits := currentFileConfig().OptionLimits
+	if len(limits) == 0 {
+		return opts, nil
+	}
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make(map[string]interface{}, len(opts)+len(limits))
+	for k, v := range opts {
+		out[k] = v
+	}
+	var notices []string
+	for _, name := range names {
+		l := limits[name]
+		v, set := out[name]
+		switch {
+		case l.Value != nil:
+			if set && fmt.Sprint(v) != fmt.Sprint(l.Value) {
+				notices = append(notices, fmt.Sprintf("%s is fixed at %v", name, l.Value))
+			}
+			out[name] = l.Value
+			continue
+		case !set && l.Default != nil:
+			out[name] = l.Default
+			continue
+		case !set:
+			continue
+		}
+		n, ok := optionNumber(v)
+		if !ok {
+			if l.Min != nil || l.Max != nil {
+				notices = append(notices, fmt.Sprintf("%s must be a number; it was left out", name))
+				delete(out, name)
+			}
+			continue
+		}
+		if l.Min != nil && n < *l.Min {
+			out[name] = *l.Min
+			notices = append(notices, fmt.Sprintf("%s raised to the minimum of %v", name, *l.Min))
+		}
+		if l.Max != nil && n > *l.Max {
+			out[name] = *l.Max
+			notices = append(notices, fmt.Sprintf("%s lowered to the maximum of %v", name, *l.Max))
+		}
+	}
+	if len(out) == 0 {
+		return nil, notices
+	}
+	return out, notices
+}
+
+func optionNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultFlashcardCount = 10
+	maxFlashcardCount     = 50
+)
+
+// Flashcard is one question/answer pair
+type Flashcard struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+// FlashcardPage holds data for the flashcards template
+type FlashcardPage struct {
+	Cards []Flashcard
+	Count int
+	Error string
+}
+
+// JSON schema the model's reply must follow
+var flashcardSchema = json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "cards": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "question": {"type": "string"},
+          "answer": {"type": "string"}
+        },
+        "required": ["question", "answer"]
+      }
+    }
+  },
+  "required": ["cards"]
+}`)
+
+var errInvalidFlashcards = errors.New("model returned no usable flashcards")
+
+// Show the current deck, or generate a new one from the conversation
+// (?source=conversation) or an uploaded document (?source=document).
+func flashcardsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+
+	if r.Method == http.MethodGet {
+		sessionMut.Lock()
+		cards := getSession(sessionID).Flashcards
+		sessionMut.Unlock()
+		renderPage(w, r, "flashcards.html", FlashcardPage{Cards: cards, Count: defaultFlashcardCount})
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var material string
+	if r.URL.Query().Get("source") == "document" {
+		msg, err := readUserMessage(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), submissionStatus(err))
+			return
+		}
+		material = msg.Content
+	} else {
+		sessionMut.Lock()
+		var transcript strings.Builder
+		for _, msg := range getSession(sessionID).History {
+			fmt.Fprintf(&transcript, "%s: %s\n\n", strings.Title(msg.Role), msg.Content)
+		}
+		sessionMut.Unlock()
+		material = transcript.String()
+	}
+
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count < 1 {
+		count = defaultFlashcardCount
+	}
+	if count > maxFlashcardCount {
+		count = maxFlashcardCount
+	}
+
+	if strings.TrimSpace(material) == "" {
+		renderPage(w, r, "flashcards.html", FlashcardPage{Count: count, Error: "There is nothing to make flashcards from yet."})
+		return
+	}
+
+	cards, err := generateFlashcards(r, material, count)
+	if err != nil {
+		log.Printf("Flashcard error: %v", err)
+		renderPageStatus(w, r, http.StatusBadGateway, "flashcards.html", FlashcardPage{Count: count, Error: "Could not generate flashcards: " + err.Error()})
+		return
+	}
+
+	sessionMut.Lock()
+	getSession(sessionID).Flashcards = cards
+	sessionMut.Unlock()
+
+	redirect(w, r, "/flashcards", http.StatusSeeOther)
+}
+
+// Ask the model for structured flashcards and validate what comes back
+func generateFlashcards(r *http.Request, material string, count int) ([]Flashcard, error) {
+	prompt := fmt.Sprintf("Create %d study flashcards covering the key facts in the material below. "+
+		"Each card has a short question and a concise answer. Respond only with JSON of the form "+
+		`{"cards": [{"question": "...", "answer": "..."}]}`+".\n\nMaterial:\n%s", count, material)
+
+	reply, err := ollamaComplete(r.Context(), OllamaChatRequest{
+		Model:    defaultModelFor(r.Context()),
+		Messages: []Message{{Role: "user", Content: prompt}},
+		Format:   flashcardSchema,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseFlashcards(reply, count)
+}
+
+// Decode and validate the model's JSON: blank or duplicate cards are
+// dropped and the deck is capped at count.
+func parseFlashcards(reply string, count int) ([]Flashcard, error) {
+	var out struct {
+		Cards []Flashcard `json:"cards"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(reply)), &out); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidFlashcards, err)
+	}
+
+	seen := make(map[string]bool)
+	var cards []Flashcard
+	for _, c := range out.Cards {
+		c.Question = strings.TrimSpace(c.Question)
+		c.Answer = strings.TrimSpace(c.Answer)
+		key := strings.ToLower(c.Question)
+		if c.Question == "" || c.Answer == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		cards = append(cards, c)
+		if len(cards) == count {
+			break
+		}
+	}
+	if len(cards) == 0 {
+		return nil, errInvalidFlashcards
+	}
+	return cards, nil
+}
+
+// Download the current deck as an Anki-importable tab-separated file
+func flashcardsExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	sessionMut.Lock()
+	cards := getSession(sessionID).Flashcards
+	sessionMut.Unlock()
+
+	if len(cards) == 0 {
+		http.Error(w, "No flashcards to export", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="flashcards.txt"`)
+	fmt.Fprint(w, "#separator:tab\n#html:false\n")
+	for _, c := range cards {
+		fmt.Fprintf(w, "%s\t%s\n", ankiField(c.Question), ankiField(c.Answer))
+	}
+}
+
+// Keep a field on one line and free of the tab separator
+func ankiField(s string) string {
+	return strings.NewReplacer("\t", " ", "\r\n", " ", "\n", " ").Replace(s)
+}
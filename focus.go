@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long a focus session may sit idle before it is summarised
+var focusIdle = 15 * time.Minute
+
+// Instructions given to the model when it writes a focus summary
+const focusSummaryPrompt = "You write concise meeting notes. Summarise the conversation below in a short paragraph, " +
+	"then list concrete action items as a markdown checklist. If there are no action items, say so."
+
+// Heading that marks summary messages in the history
+const focusSummaryHeading = "## Session summary"
+
+// Start or end a focus session. Ending one summarises it immediately.
+func focusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+
+	switch r.FormValue("action") {
+	case "start":
+		sessionMut.Lock()
+		sess := getSession(sessionID)
+		sess.Focus = true
+		// Only what is said from now on, in any conversation, is summarised
+		sess.SummarizedID = make(map[int]int, len(sess.Conversations))
+		for _, c := range sess.Conversations {
+			sess.SummarizedID[c.ID] = sess.nextMessageID
+		}
+		sessionMut.Unlock()
+	case "end":
+		if err := summarizeSession(r.Context(), sessionID); err != nil {
+			writeOllamaError(w, r, http.StatusBadGateway, err)
+			log.Printf("Focus summary error: %v", err)
+			return
+		}
+		sessionMut.Lock()
+		getSession(sessionID).Focus = false
+		sessionMut.Unlock()
+	default:
+		http.Error(w, "Unknown focus action", http.StatusBadRequest)
+		return
+	}
+
+	redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Summarise the messages of the active conversation added since its last
+// summary and append the summary with action items to it.
+func summarizeSession(ctx context.Context, sessionID string) error {
+	ctx = withTenant(ctx, sessionTenant(sessionID))
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	conv := sess.Active
+	pending := sess.unsummarized(conv)
+	sessionMut.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	upTo := pending[len(pending)-1].ID
+
+	var transcript strings.Builder
+	for _, msg := range pending {
+		fmt.Fprintf(&transcript, "%s: %s\n\n", titleCase(msg.Role), msg.Content)
+	}
+
+	summary, err := ollamaComplete(ctx, OllamaChatRequest{
+		Model: defaultModelFor(ctx),
+		Messages: []Message{
+			{Role: "system", Content: focusSummaryPrompt},
+			{Role: "user", Content: transcript.String()},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	sess = getSession(sessionID)
+	// Another summary may have landed while the model was working, or the
+	// conversation been deleted
+	if sess.SummarizedID[conv] >= upTo || sess.conversationIndex(conv) < 0 {
+		return nil
+	}
+	arrived := len(sess.unsummarized(conv)) > len(pending)
+	sess.recordIn(conv, MessageEvent{Type: EventAdded, Message: &Message{
+		Role:    "assistant",
+		Content: focusSummaryHeading + "\n\n" + strings.TrimSpace(summary),
+	}})
+	if sess.SummarizedID == nil {
+		sess.SummarizedID = make(map[int]int)
+	}
+	sess.SummarizedID[conv] = sess.nextMessageID
+	// Messages sent while the model was working go into the next summary
+	if arrived {
+		sess.SummarizedID[conv] = upTo
+	}
+	return nil
+}
+
+// Messages of a conversation added since its last summary. Message IDs
+// only grow, so this holds up when earlier messages are deleted or undone.
+// Callers must hold sessionMut.
+func (s *session) unsummarized(conv int) []Message {
+	history := s.History
+	if conv != s.Active {
+		history = projectHistory(s.Events, conv)
+	}
+	var pending []Message
+	for _, msg := range history {
+		if msg.ID > s.SummarizedID[conv] {
+			pending = append(pending, msg)
+		}
+	}
+	return pending
+}
+
+// Periodically summarise focus sessions that have gone idle
+func startFocusWatcher(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			var idle []string
+			sessionMut.Lock()
+			for id, sess := range sessions {
+				if sess.Focus && len(sess.unsummarized(sess.Active)) > 0 && time.Since(sess.LastActive) >= focusIdle {
+					idle = append(idle, id)
+				}
+			}
+			sessionMut.Unlock()
+
+			for _, id := range idle {
+				id := id
+				err := submitTask("summary", "focus session "+sessionHash(id),
+					func(ctx context.Context) error { return summarizeSession(ctx, id) }, nil)
+				if err != nil {
+					log.Printf("Focus summary error: %v", err)
+				}
+			}
+		}
+	}()
+}
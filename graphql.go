@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+)
+
+// GraphQLRequest is the body of a query over HTTP and the payload of a
+// subscribe message over WebSocket
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// ChatToken is one streamed piece of a chat subscription
+type ChatToken struct {
+	Content string `json:"content"`
+	Done    bool   `json:"done"`
+}
+
+type graphqlSessionKey struct{}
+
+// Session the GraphQL request runs as
+func graphqlSession(ctx context.Context) string {
+	id, _ := ctx.Value(graphqlSessionKey{}).(string)
+	return id
+}
+
+// Snapshot the requesting session's conversations
+func graphqlConversations(ctx context.Context) []DatasetConversation {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	convs := datasetConversations(getSession(graphqlSession(ctx)))
+	for i := range convs {
+		convs[i].Messages = append([]Message(nil), convs[i].Messages...)
+	}
+	return convs
+}
+
+// GraphQLUsage counts messages in the requesting session
+type GraphQLUsage struct {
+	Conversations     int `json:"conversations"`
+	Messages          int `json:"messages"`
+	UserMessages      int `json:"userMessages"`
+	AssistantMessages int `json:"assistantMessages"`
+	Characters        int `json:"characters"`
+}
+
+var graphqlSchema = mustGraphQLSchema()
+
+func mustGraphQLSchema() graphql.Schema {
+	// Fields without a resolver are read from the source struct's JSON tags
+	messageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Message",
+		Fields: graphql.Fields{
+			"role":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"content": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":    &graphql.Field{Type: graphql.String, Description: "Speaking agent, in multi-agent conversations"},
+		},
+	})
+	conversationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Conversation",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(DatasetConversation).Key, nil }},
+			"title": &graphql.Field{Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(DatasetConversation).Title, nil }},
+			"messageCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return len(p.Source.(DatasetConversation).Messages), nil
+				}},
+			"messages": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(messageType))),
+				Args: graphql.FieldConfigArgument{
+					"last": &graphql.ArgumentConfig{Type: graphql.Int, Description: "Only the most recent messages"},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					msgs := p.Source.(DatasetConversation).Messages
+					if last, ok := p.Args["last"].(int); ok && last >= 0 && last < len(msgs) {
+						msgs = msgs[len(msgs)-last:]
+					}
+					return msgs, nil
+				},
+			},
+		},
+	})
+	modelType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Model",
+		Fields: graphql.Fields{
+			"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"size": &graphql.Field{Type: graphql.Float, Description: "Size in bytes"},
+			"modifiedAt": &graphql.Field{Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(OllamaModel).ModifiedAt.Format(time.RFC3339), nil
+				}},
+		},
+	})
+	usageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Usage",
+		Fields: graphql.Fields{
+			"conversations":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"messages":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"userMessages":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"assistantMessages": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"characters":        &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+	tokenType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "ChatToken",
+		Fields: graphql.Fields{
+			"content": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"done":    &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"conversations": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(conversationType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphqlConversations(p.Context), nil
+				},
+			},
+			"conversation": &graphql.Field{
+				Type: conversationType,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					for _, conv := range graphqlConversations(p.Context) {
+						if conv.Key == p.Args["id"] {
+							return conv, nil
+						}
+					}
+					return nil, nil
+				},
+			},
+			"models": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(modelType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return serviceListModels(p.Context)
+				},
+			},
+			"usage": &graphql.Field{
+				Type: graphql.NewNonNull(usageType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var u GraphQLUsage
+					for _, conv := range graphqlConversations(p.Context) {
+						u.Conversations++
+						for _, msg := range conv.Messages {
+							u.Messages++
+							u.Characters += len(msg.Content)
+							switch msg.Role {
+							case "user":
+								u.UserMessages++
+							case "assistant":
+								u.AssistantMessages++
+							}
+						}
+					}
+					return u, nil
+				},
+			},
+		},
+	})
+
+	subscription := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"chat": &graphql.Field{
+				Type:        graphql.NewNonNull(tokenType),
+				Description: "Send a message to the chat and stream the reply token by token",
+				Args: graphql.FieldConfigArgument{
+					"message": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"model":   &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Subscribe: subscribeChat,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source, nil
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Subscription: subscription})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// Add the message to the session's chat and stream the reply as ChatTokens
+func subscribeChat(p graphql.ResolveParams) (interface{}, error) {
+	text := strings.TrimSpace(p.Args["message"].(string))
+	if text == "" {
+		return nil, errEmptyPrompt
+	}
+	model, _ := p.Args["model"].(string)
+	sessionID := graphqlSession(p.Context)
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	if err := sess.append(Message{Role: "user", Content: text}); err != nil {
+		sessionMut.Unlock()
+		return nil, err
+	}
+	conv := sess.Active
+	params := ChatParams{Model: model, Messages: sess.conversationMessages(conv, append([]Message(nil), sess.History...)),
+		Options: sess.withConversationOptions(conv, nil)}
+	sessionMut.Unlock()
+
+	tokens := make(chan interface{})
+	go func() {
+		defer close(tokens)
+		send := func(tok ChatToken) bool {
+			select {
+			case tokens <- tok:
+				return true
+			case <-p.Context.Done():
+				return false
+			}
+		}
+		ctx := withAnswerLabel(p.Context)
+		reply, err := serviceStreamChat(ctx, params, func(chunk string) {
+			send(ChatToken{Content: chunk})
+		})
+		if err != nil {
+			log.Printf("GraphQL chat error: %v", err)
+			return
+		}
+		sessionMut.Lock()
+		getSession(sessionID).appendTo(conv, assistantReply(ctx, reply))
+		sessionMut.Unlock()
+		send(ChatToken{Done: true})
+	}()
+	return tokens, nil
+}
+
+var graphqlUpgrader = websocket.Upgrader{Subprotocols: []string{"graphql-transport-ws"}}
+
+// Queries over POST (or GET with ?query=), subscriptions over WebSocket
+// using the graphql-transport-ws protocol. Everything runs against the
+// caller's session.
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	ctx := context.WithValue(r.Context(), graphqlSessionKey{}, sessionID)
+
+	if websocket.IsWebSocketUpgrade(r) {
+		serveGraphQLSocket(w, r.WithContext(ctx))
+		return
+	}
+
+	var req GraphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			json.Unmarshal([]byte(vars), &req.Variables)
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestBytes)).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if strings.HasPrefix(strings.TrimSpace(req.Query), "subscription") {
+		writeAPIError(w, http.StatusBadRequest, "subscriptions need a WebSocket connection")
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  req.Query,
+		OperationName:  req.OperationName,
+		VariableValues: req.Variables,
+		Context:        ctx,
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+// graphqlWSMessage is a graphql-transport-ws frame
+type graphqlWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func serveGraphQLSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := graphqlUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("GraphQL upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxAPIRequestBytes)
+
+	var writeMu sync.Mutex
+	send := func(msg interface{}) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.WriteJSON(msg)
+	}
+
+	// Cancels each running subscription, by ID
+	var subsMu sync.Mutex
+	subs := make(map[string]context.CancelFunc)
+	defer func() {
+		subsMu.Lock()
+		for _, cancel := range subs {
+			cancel()
+		}
+		subsMu.Unlock()
+	}()
+
+	acked := false
+	for {
+		var msg graphqlWSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case "connection_init":
+			acked = true
+			send(graphqlWSMessage{Type: "connection_ack"})
+		case "ping":
+			send(graphqlWSMessage{Type: "pong"})
+		case "subscribe":
+			if !acked {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4401, "Unauthorized"), time.Now().Add(time.Second))
+				return
+			}
+			var req GraphQLRequest
+			if err := json.Unmarshal(msg.Payload, &req); err != nil {
+				send(map[string]interface{}{"id": msg.ID, "type": "error", "payload": []map[string]string{{"message": "invalid payload"}}})
+				continue
+			}
+			ctx, cancel := context.WithCancel(r.Context())
+			subsMu.Lock()
+			subs[msg.ID] = cancel
+			subsMu.Unlock()
+
+			go func(id string) {
+				results := graphql.Subscribe(graphql.Params{
+					Schema:         graphqlSchema,
+					RequestString:  req.Query,
+					OperationName:  req.OperationName,
+					VariableValues: req.Variables,
+					Context:        ctx,
+				})
+				// Drain until closed so the executor never blocks
+				for res := range results {
+					if ctx.Err() == nil {
+						send(map[string]interface{}{"id": id, "type": "next", "payload": res})
+					}
+				}
+				if ctx.Err() == nil {
+					send(graphqlWSMessage{ID: id, Type: "complete"})
+				}
+				subsMu.Lock()
+				delete(subs, id)
+				subsMu.Unlock()
+				cancel()
+			}(msg.ID)
+		case "complete":
+			subsMu.Lock()
+			if cancel, ok := subs[msg.ID]; ok {
+				cancel()
+			}
+			subsMu.Unlock()
+		}
+	}
+}
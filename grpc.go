@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"deepseek-app/internal/chatpb"
+)
+
+// Address the gRPC server listens on; empty disables it
+var grpcAddr string
+
+// grpcServer adapts the service layer to the ChatService gRPC API
+type grpcServer struct {
+	chatpb.UnimplementedChatServiceServer
+}
+
+func newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if !grpcNetworkAllowed(ctx) {
+				return nil, errNetworkDenied
+			}
+			return handler(grpcPriority(ctx), req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if !grpcNetworkAllowed(ss.Context()) {
+				return errNetworkDenied
+			}
+			return handler(srv, priorityStream{ss, grpcPriority(ss.Context())})
+		}),
+	)
+	chatpb.RegisterChatServiceServer(srv, grpcServer{})
+	return srv
+}
+
+// Returned to calls from addresses the config's network rules keep out
+var errNetworkDenied = status.Error(codes.PermissionDenied, "address not allowed")
+
+// Tag a call's context with the priority of its API key, sent as
+// "authorization: Bearer <key>" metadata
+func grpcPriority(ctx context.Context) context.Context {
+	var auth string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		auth = md.Get("authorization")[0]
+	}
+	return withPriority(ctx, apiKeyPriority(auth))
+}
+
+// priorityStream carries a priority-tagged context into a streaming call
+type priorityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s priorityStream) Context() context.Context { return s.ctx }
+
+// Serve gRPC on grpcAddr in the background
+func startGRPCServer() error {
+	if grpcAddr == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		return err
+	}
+	runningGRPC = newGRPCServer()
+	go func() {
+		log.Printf("gRPC server listening on %s", grpcAddr)
+		if err := runningGRPC.Serve(lis); err != nil {
+			log.Printf("gRPC server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// The running gRPC server, if -grpc-addr started one
+var runningGRPC *grpc.Server
+
+// Stop the gRPC server, letting calls in progress finish until ctx ends;
+// the channel closes once it has stopped
+func stopGRPCServer(ctx context.Context) <-chan struct{} {
+	stopped := make(chan struct{})
+	if runningGRPC == nil {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+		graceful := make(chan struct{})
+		go func() {
+			runningGRPC.GracefulStop()
+			close(graceful)
+		}()
+		select {
+		case <-graceful:
+		case <-ctx.Done():
+			runningGRPC.Stop()
+		}
+	}()
+	return stopped
+}
+
+// Map a service layer error to a gRPC status
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, errBackendUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		log.Printf("gRPC upstream error: %v", err)
+		return status.Error(codes.Unavailable, "error communicating with Ollama")
+	}
+}
+
+func chatParamsFromProto(req *chatpb.ChatRequest) ChatParams {
+	p := ChatParams{Model: req.GetModel()}
+	for _, m := range req.GetMessages() {
+		msg := Message{Role: m.GetRole(), Content: m.GetContent()}
+		for _, img := range m.GetImages() {
+			msg.Images = append(msg.Images, base64.StdEncoding.EncodeToString(img))
+		}
+		p.Messages = append(p.Messages, msg)
+	}
+	return p
+}
+
+func (grpcServer) Chat(ctx context.Context, req *chatpb.ChatRequest) (*chatpb.ChatResponse, error) {
+	msg, err := serviceChat(ctx, chatParamsFromProto(req))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &chatpb.ChatResponse{Message: &chatpb.Message{Role: msg.Role, Content: msg.Content}}, nil
+}
+
+func (grpcServer) StreamChat(req *chatpb.ChatRequest, stream chatpb.ChatService_StreamChatServer) error {
+	var sendErr error
+	_, err := serviceStreamChat(stream.Context(), chatParamsFromProto(req), func(chunk string) {
+		if sendErr == nil {
+			sendErr = stream.Send(&chatpb.ChatChunk{Content: chunk})
+		}
+	})
+	if err != nil {
+		return grpcError(err)
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	return stream.Send(&chatpb.ChatChunk{Done: true})
+}
+
+func (grpcServer) ListModels(ctx context.Context, _ *chatpb.ListModelsRequest) (*chatpb.ListModelsResponse, error) {
+	models, err := serviceListModels(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &chatpb.ListModelsResponse{}
+	for _, m := range models {
+		resp.Models = append(resp.Models, &chatpb.Model{Name: m.Name, Size: m.Size, ModifiedAt: m.ModifiedAt.Format(time.RFC3339)})
+	}
+	return resp, nil
+}
+
+func (grpcServer) Embeddings(ctx context.Context, req *chatpb.EmbeddingsRequest) (*chatpb.EmbeddingsResponse, error) {
+	vectors, err := serviceEmbeddings(ctx, req.GetModel(), req.GetInput())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &chatpb.EmbeddingsResponse{}
+	for _, v := range vectors {
+		resp.Embeddings = append(resp.Embeddings, &chatpb.Embedding{Values: v})
+	}
+	return resp, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A conversation as an Ollama Modelfile that carries it on in the CLI: FROM
+// the model it is chatting with, its options as PARAMETERs, its system
+// prompt and summary as SYSTEM, and each turn as a MESSAGE. Tool calls and
+// results have no Modelfile form and are left out, as are images, which
+// are only counted.
+func modelfileTranscript(req OllamaChatRequest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "FROM %s\n", req.Model)
+
+	keys := make([]string, 0, len(req.Options))
+	for k := range req.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch v := req.Options[k].(type) {
+		case []interface{}:
+			for _, s := range v {
+				fmt.Fprintf(&b, "PARAMETER %s %s\n", k, modelfileValue(s))
+			}
+		case []string:
+			for _, s := range v {
+				fmt.Fprintf(&b, "PARAMETER %s %s\n", k, modelfileValue(s))
+			}
+		default:
+			fmt.Fprintf(&b, "PARAMETER %s %s\n", k, modelfileValue(v))
+		}
+	}
+
+	messages := req.Messages
+	var system []string
+	for len(messages) > 0 && messages[0].Role == "system" {
+		system = append(system, strings.TrimSpace(messages[0].Content))
+		messages = messages[1:]
+	}
+	if len(system) > 0 {
+		fmt.Fprintf(&b, "SYSTEM %s\n", modelfileString(strings.Join(system, "\n\n")))
+	}
+
+	images := 0
+	for _, m := range messages {
+		images += len(m.Images)
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			continue
+		}
+		if strings.TrimSpace(m.Content) == "" {
+			continue // a bare tool call
+		}
+		fmt.Fprintf(&b, "MESSAGE %s %s\n", m.Role, modelfileString(strings.TrimSpace(m.Content)))
+	}
+	if images > 0 {
+		fmt.Fprintf(&b, "# %d image(s) attached in the chat are not carried over\n", images)
+	}
+	return b.String()
+}
+
+// A PARAMETER value; strings such as stop sequences are quoted
+func modelfileValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return modelfileString(s)
+	}
+	return fmt.Sprint(v)
+}
+
+// Text as a Modelfile triple-quoted string, with any quotes in it escaped
+// so they cannot end it early
+func modelfileString(s string) string {
+	return `"""` + strings.ReplaceAll(s, `"`, `\"`) + `"""`
+}
+
+// A shell script that writes the conversation's Modelfile, creates a model
+// from it and starts `ollama run` with the conversation already in place
+func ollamaHandoffScript(title string, req OllamaChatRequest) string {
+	name := "handoff-" + exportFileName(title)
+	modelfile := modelfileTranscript(req)
+	// The here-document ends at the first line that is just its delimiter
+	delim := "MODELFILE"
+	for strings.Contains("\n"+modelfile, "\n"+delim+"\n") {
+		delim += "_"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Continue %q in the Ollama CLI\n", title)
+	fmt.Fprintf(&b, "cat > %s.Modelfile <<'%s'\n%s%s\n", name, delim, modelfile, delim)
+	fmt.Fprintf(&b, "ollama create %s -f %s.Modelfile && ollama run %s\n", name, name, name)
+	return b.String()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Content-Security-Policy for every page. Scripts and styles come only from
+// /static (KaTeX, mermaid and the page scripts are served from there); KaTeX
+// and mermaid set inline styles on the markup they render, hence
+// 'unsafe-inline' for styles only, and KaTeX's fonts may be data: URIs.
+const defaultCSP = "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data: blob:; font-src 'self' data:; connect-src 'self'; media-src 'self' blob:; " +
+	"object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+
+// Security headers sent with every response, set from flags; an empty
+// value leaves that header out
+var (
+	contentSecurityPolicy = defaultCSP
+	frameOptions          = "DENY"
+	referrerPolicy        = "same-origin"
+	// Sent only on HTTPS requests, directly or through a proxy that sets
+	// X-Forwarded-Proto
+	hstsMaxAge = 180 * 24 * time.Hour
+)
+
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if contentSecurityPolicy != "" {
+			h.Set("Content-Security-Policy", contentSecurityPolicy)
+		}
+		if frameOptions != "" {
+			h.Set("X-Frame-Options", frameOptions)
+		}
+		if referrerPolicy != "" {
+			h.Set("Referrer-Policy", referrerPolicy)
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		if hstsMaxAge > 0 && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
+			h.Set("Strict-Transport-Security", "max-age="+strconv.FormatInt(int64(hstsMaxAge/time.Second), 10)+"; includeSubDomains")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
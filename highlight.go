@@ -0,0 +1,61 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// Fenced code blocks as emitted by the markdown renderers, with or without
+// a language
+var codeBlockRe = regexp.MustCompile(`(?s)<pre><code(?: class="language-([\w+-]+)")?>(.*?)</code></pre>`)
+
+// Token spans carry short classes such as "hl-k" for keywords, styled in
+// style.css. Surrounding <pre> and per-line spans are left out so the
+// block keeps the markup the renderers gave it.
+var codeFormatter = chromahtml.New(
+	chromahtml.WithClasses(true),
+	chromahtml.ClassPrefix("hl-"),
+	chromahtml.PreventSurroundingPre(true),
+)
+
+// Highlight fenced code blocks. The language comes from the fence, or is
+// guessed from the code when the fence has none; blocks in a language
+// chroma does not know are left as they are.
+func highlightCode(rendered string) string {
+	return codeBlockRe.ReplaceAllStringFunc(rendered, func(block string) string {
+		m := codeBlockRe.FindStringSubmatch(block)
+		lang, code := m[1], html.UnescapeString(m[2])
+		var lexer chroma.Lexer
+		if lang != "" {
+			lexer = lexers.Get(lang)
+		} else {
+			lexer = lexers.Analyse(code)
+		}
+		if lexer == nil {
+			return block
+		}
+		if lang == "" {
+			lang = strings.ToLower(strings.ReplaceAll(lexer.Config().Name, " ", "-"))
+			if aliases := lexer.Config().Aliases; len(aliases) > 0 {
+				lang = aliases[0]
+			}
+		}
+		it, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+		if err != nil {
+			return block
+		}
+		var b strings.Builder
+		b.WriteString(`<pre><code class="language-` + html.EscapeString(lang) + `">`)
+		if err := codeFormatter.Format(&b, styles.Fallback, it); err != nil {
+			return block
+		}
+		b.WriteString("</code></pre>")
+		return b.String()
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Change the chat history through the session event log. Form fields:
+// action (edit, resubmit, delete, regenerate, undo or fork), id (the message),
+// content for edits, and optionally model and temperature for
+// regenerating.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	action := r.FormValue("action")
+	id, _ := strconv.Atoi(r.FormValue("id"))
+
+	var err error
+	switch action {
+	case "edit":
+		content := strings.TrimSpace(r.FormValue("content"))
+		if content == "" {
+			http.Error(w, "Message content is required", http.StatusBadRequest)
+			return
+		}
+		sessionMut.Lock()
+		err = getSession(sessionID).editMessage(id, content)
+		sessionMut.Unlock()
+	case "resubmit":
+		content := strings.TrimSpace(r.FormValue("content"))
+		if content == "" {
+			http.Error(w, "Message content is required", http.StatusBadRequest)
+			return
+		}
+		err = resubmitMessage(r, sessionID, id, content)
+		if err != nil && err != errUnknownMessage {
+			writeOllamaError(w, r, http.StatusBadGateway, err)
+			log.Printf("Ollama API error: %v", err)
+			return
+		}
+	case "delete":
+		sessionMut.Lock()
+		err = getSession(sessionID).deleteMessage(id)
+		sessionMut.Unlock()
+	case "undo":
+		sessionMut.Lock()
+		err = getSession(sessionID).undo()
+		sessionMut.Unlock()
+	case "fork":
+		sessionMut.Lock()
+		err = getSession(sessionID).forkConversation(id)
+		sessionMut.Unlock()
+	case "regenerate":
+		if !regenerateFromForm(w, r, sessionID, id) {
+			return
+		}
+	default:
+		http.Error(w, "Unknown history action", http.StatusBadRequest)
+		return
+	}
+
+	switch err {
+	case nil:
+		redirect(w, r, "/", http.StatusSeeOther)
+	case errUnknownMessage:
+		http.Error(w, "Message not found", http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// POST /chat/regenerate: replace the last assistant reply of the active
+// conversation with a new one. Optional form fields model and temperature
+// ask a different model, or the same one less or more creatively.
+func chatRegenerateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := getSessionID(w, r)
+	sessionMut.Lock()
+	id := getSession(sessionID).lastReplyID()
+	sessionMut.Unlock()
+	if regenerateFromForm(w, r, sessionID, id) {
+		redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// Regenerate a reply with the model and temperature form fields, answering
+// the request itself and returning false when that fails
+func regenerateFromForm(w http.ResponseWriter, r *http.Request, sessionID string, id int) bool {
+	var temperature *float64
+	if v := strings.TrimSpace(r.FormValue("temperature")); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "Temperature must be a number", http.StatusBadRequest)
+			return false
+		}
+		temperature = &t
+	}
+	err := regenerateReply(r, sessionID, id, strings.TrimSpace(r.FormValue("model")), temperature)
+	switch {
+	case err == nil:
+		return true
+	case err == errUnknownMessage:
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, errInvalidRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case confirmCost(w, r, err, r.URL.Path, r.PostForm):
+	default:
+		writeOllamaError(w, r, http.StatusBadGateway, err)
+		log.Printf("Ollama API error: %v", err)
+	}
+	return false
+}
+
+// Ask the model again for an assistant message, given the conversation
+// that preceded it. The model defaults to the server's, and a nil
+// temperature to the model's own.
+func regenerateReply(r *http.Request, sessionID string, id int, model string, temperature *float64) error {
+	if model == "" {
+		model = defaultModelFor(r.Context())
+	}
+	if err := checkModelAllowed(r.Context(), model); err != nil {
+		return err
+	}
+	if temperature != nil && *temperature < 0 {
+		return fmt.Errorf("%w: temperature must be at least 0", errInvalidRequest)
+	}
+	var opts map[string]interface{}
+	if temperature != nil {
+		opts = map[string]interface{}{"temperature": *temperature}
+	}
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	i := sess.messageIndex(id)
+	if i < 0 || sess.History[i].Role != "assistant" {
+		sessionMut.Unlock()
+		return errUnknownMessage
+	}
+	chatReq := sess.conversationRequest(sess.Active, append([]Message(nil), sess.History[:i]...))
+	chatReq.Model, chatReq.Options = model, sess.withConversationOptions(sess.Active, opts)
+	sessionMut.Unlock()
+
+	ctx := withAnswerLabel(r.Context())
+	if r.FormValue("confirm_cost") != "" {
+		ctx = withCostConfirmed(ctx)
+	}
+	reply, err := ollamaComplete(ctx, chatReq)
+	if err != nil {
+		return err
+	}
+
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	// The message may have been deleted while the model was working
+	return getSession(sessionID).regenerateMessage(id, assistantReply(ctx, reply))
+}
+
+// Edit a user message, drop what came after it and answer it again, as if
+// the conversation had gone that way from the start. Like a chat message
+// the reply runs to completion unless stopped, keeping what was generated.
+func resubmitMessage(r *http.Request, sessionID string, id int, content string) error {
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	if err := sess.rewriteFrom(id, content); err != nil {
+		sessionMut.Unlock()
+		return err
+	}
+	chatReq, conv := sess.conversationRequest(sess.Active, sess.History), sess.Active
+	ctx, done := sess.trackGeneration(withPriority(context.Background(), priorityFrom(r.Context())))
+	sessionMut.Unlock()
+	defer done()
+
+	reply, err := ollamaComplete(ctx, chatReq)
+	if err != nil && ctx.Err() != nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sessionMut.Lock()
+	getSession(sessionID).appendTo(conv, assistantReply(ctx, reply))
+	sessionMut.Unlock()
+	return nil
+}
+
+// Audit trail: the session's chat event log as JSON
+func historyEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	sessionMut.Lock()
+	events := append([]MessageEvent{}, getSession(sessionID).Events...)
+	sessionMut.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": events})
+}
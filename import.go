@@ -0,0 +1,383 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Largest export file accepted; ChatGPT's conversations.json holds
+	// every conversation of an account
+	maxImportBytes = 64 << 20
+	// Conversations taken from one file, oldest first
+	maxImportConversations = 100
+	// Largest image taken from a ChatGPT export archive
+	maxImportImageBytes = 20 << 20
+)
+
+var errUnknownImport = errors.New("not a ChatGPT or Open WebUI export, a chat with a messages list, or an export from this app")
+
+// importedConversation is one conversation read from an export file
+type importedConversation struct {
+	Title    string
+	Created  time.Time // zero when the export has none
+	Messages []importedMessage
+}
+
+// Finds the image an export's asset pointer names, base64-encoded; nil
+// when the export came without its files
+type importAssets func(pointer string) (string, bool)
+
+type importedMessage struct {
+	Message
+	Time time.Time // zero when the export has none
+}
+
+// The parts of ChatGPT's conversations.json used here. Each conversation is
+// a tree of messages; current_node is the last message of the branch shown.
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	CurrentNode string                 `json:"current_node"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	Parent  string `json:"parent"`
+	Message *struct {
+		Author struct {
+			Role string `json:"role"`
+			Name string `json:"name"`
+		} `json:"author"`
+		CreateTime float64 `json:"create_time"`
+		Content    struct {
+			ContentType string            `json:"content_type"`
+			Parts       []json.RawMessage `json:"parts"` // text, or objects for images
+			Text        string            `json:"text"`  // code and other typed content
+		} `json:"content"`
+		Metadata struct {
+			Hidden bool `json:"is_visually_hidden_from_conversation"`
+		} `json:"metadata"`
+	} `json:"message"`
+}
+
+// An image part of a ChatGPT message, e.g. an upload or a generated picture
+type chatGPTAssetPart struct {
+	ContentType  string `json:"content_type"`
+	AssetPointer string `json:"asset_pointer"` // e.g. "file-service://file-abc"
+}
+
+// The messages of a ChatGPT conversation along the branch shown, oldest
+// first, leaving out hidden and empty ones. Images come along when assets
+// can find them.
+func (c chatGPTConversation) messages(assets importAssets) []importedMessage {
+	var ids []string
+	if c.CurrentNode != "" {
+		for id := c.CurrentNode; id != "" && len(ids) <= len(c.Mapping); id = c.Mapping[id].Parent {
+			ids = append(ids, id)
+		}
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	} else {
+		for id := range c.Mapping {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return c.Mapping[ids[i]].createTime() < c.Mapping[ids[j]].createTime() })
+	}
+
+	var out []importedMessage
+	for _, id := range ids {
+		m := c.Mapping[id].Message
+		if m == nil || m.Metadata.Hidden {
+			continue
+		}
+		var texts, images []string
+		for _, part := range m.Content.Parts {
+			var text string
+			var asset chatGPTAssetPart
+			switch {
+			case json.Unmarshal(part, &text) == nil:
+				if text != "" {
+					texts = append(texts, text)
+				}
+			case assets != nil && json.Unmarshal(part, &asset) == nil && asset.ContentType == "image_asset_pointer":
+				if img, ok := assets(asset.AssetPointer); ok {
+					images = append(images, img)
+				}
+			}
+		}
+		if len(texts) == 0 && m.Content.Text != "" {
+			texts = append(texts, m.Content.Text)
+		}
+		msg := importedMessage{Message: Message{Role: m.Author.Role, Content: strings.Join(texts, "\n"), Images: images},
+			Time: unixSeconds(m.CreateTime)}
+		if msg.Role == "tool" {
+			msg.ToolName = m.Author.Name
+		}
+		if strings.TrimSpace(msg.Content) != "" || len(images) > 0 {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func (n chatGPTNode) createTime() float64 {
+	if n.Message == nil {
+		return 0
+	}
+	return n.Message.CreateTime
+}
+
+func unixSeconds(t float64) time.Time {
+	if t <= 0 {
+		return time.Time{}
+	}
+	sec, frac := math.Modf(t)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// Read the conversations in an export file: ChatGPT's export archive or its
+// conversations.json (a list, or one conversation), Open WebUI's database
+// or chat export, this app's JSON export, or any object with a messages
+// list in the chat format, such as an Ollama chat request
+func readImport(data []byte) ([]importedConversation, error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return readImportArchive(data)
+	}
+	if bytes.HasPrefix(data, sqliteHeader) {
+		return readWebUIDatabase(data)
+	}
+	return parseImport(data, nil)
+}
+
+// Read ChatGPT's export archive: conversations.json, with the images its
+// messages point to taken from the files beside it
+func readImportArchive(data []byte) ([]importedConversation, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errUnknownImport
+	}
+	var doc *zip.File
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		name := path.Base(f.Name)
+		switch {
+		case f.FileInfo().IsDir():
+		case name == "conversations.json":
+			if doc == nil || len(f.Name) < len(doc.Name) {
+				doc = f
+			}
+		default:
+			files[name] = f
+		}
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("%w: the archive has no conversations.json", errInvalidRequest)
+	}
+	conversations, err := readZipFile(doc, maxImportBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: conversations.json: %v", errInvalidRequest, err)
+	}
+
+	// Files are named after the pointer's ID, e.g. "file-abc-photo.png"
+	// for file-service://file-abc
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assets := func(pointer string) (string, bool) {
+		_, id, ok := strings.Cut(pointer, "://")
+		if !ok || id == "" {
+			return "", false
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, id) {
+				continue
+			}
+			data, err := readZipFile(files[name], maxImportImageBytes)
+			if err != nil || !strings.HasPrefix(http.DetectContentType(data), "image/") {
+				return "", false
+			}
+			return base64.StdEncoding.EncodeToString(data), true
+		}
+		return "", false
+	}
+	return parseImport(conversations, assets)
+}
+
+// The contents of an archive entry, refused past limit bytes
+func readZipFile(f *zip.File, limit int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err == nil && int64(len(data)) > limit {
+		err = errors.New("file too large")
+	}
+	return data, err
+}
+
+func parseImport(data []byte, assets importAssets) ([]importedConversation, error) {
+	data = bytes.TrimSpace(data)
+	if convs, ok := parseWebUIExport(data); ok {
+		return convs, nil
+	}
+	if len(data) > 0 && data[0] == '[' {
+		var list []chatGPTConversation
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, errUnknownImport
+		}
+		sort.SliceStable(list, func(i, j int) bool { return list[i].CreateTime < list[j].CreateTime })
+		var out []importedConversation
+		for _, c := range list {
+			if c.Mapping == nil {
+				return nil, errUnknownImport
+			}
+			out = append(out, importedConversation{Title: c.Title, Created: unixSeconds(c.CreateTime), Messages: c.messages(assets)})
+		}
+		return out, nil
+	}
+
+	var doc struct {
+		chatGPTConversation
+		Messages []Message `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errUnknownImport
+	}
+	switch {
+	case doc.Mapping != nil:
+		return []importedConversation{{Title: doc.Title, Created: unixSeconds(doc.CreateTime), Messages: doc.messages(assets)}}, nil
+	case doc.Messages != nil:
+		conv := importedConversation{Title: doc.Title}
+		for _, m := range doc.Messages {
+			m.ID = 0
+			conv.Messages = append(conv.Messages, importedMessage{Message: m})
+		}
+		return []importedConversation{conv}, nil
+	}
+	return nil, errUnknownImport
+}
+
+// Check a conversation can join a chat, mapping roles onto the chat's
+func (c *importedConversation) clean() error {
+	if len(c.Messages) == 0 {
+		return fmt.Errorf("%w: conversation %q has no messages", errInvalidRequest, c.Title)
+	}
+	for i := range c.Messages {
+		switch c.Messages[i].Role {
+		case "system", "user", "assistant", "tool":
+		case "developer":
+			c.Messages[i].Role = "system"
+		default:
+			return fmt.Errorf("%w: message %d has unknown role %q", errInvalidRequest, i, c.Messages[i].Role)
+		}
+	}
+	return nil
+}
+
+// Add imported conversations to a session, each as a new conversation,
+// returning their IDs. The last one becomes the active one. Nothing is
+// added, and errSessionFull returned, when their messages would take the
+// session past sessionMessageLimit. Callers must hold sessionMut.
+func (s *session) importConversations(convs []importedConversation) ([]int, error) {
+	n := 0
+	for _, c := range convs {
+		n += len(c.Messages)
+	}
+	if err := s.checkMessageLimit(n); err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, c := range convs {
+		id := s.createConversationAt(c.Title, c.Created)
+		ids = append(ids, id)
+		for _, m := range c.Messages {
+			msg := m.Message
+			s.recordIn(id, MessageEvent{Type: EventAdded, Message: &msg, Time: m.Time})
+		}
+	}
+	s.LastActive = time.Now()
+	return ids, nil
+}
+
+// The conversations of an export file that can be imported, at most
+// maxImportConversations of the newest. ChatGPT keeps empty
+// conversations; they are skipped, and an error is returned only when
+// nothing is left.
+func prepareImport(data []byte) ([]importedConversation, error) {
+	convs, err := readImport(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(convs) > maxImportConversations {
+		convs = convs[len(convs)-maxImportConversations:]
+	}
+	var kept []importedConversation
+	err = fmt.Errorf("%w: the file has no conversations", errInvalidRequest)
+	for _, c := range convs {
+		if err = c.clean(); err == nil {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, err
+	}
+	return kept, nil
+}
+
+// POST /import: start conversations from an uploaded export file (form
+// field "file"), such as ChatGPT's export archive
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := getSessionID(w, r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	file, _, err := r.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Export file too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "An export file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Could not read the export file", http.StatusBadRequest)
+		return
+	}
+	kept, err := prepareImport(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessionMut.Lock()
+	_, err = getSession(sessionID).importConversations(kept)
+	sessionMut.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), submissionStatus(err))
+		return
+	}
+	redirect(w, r, "/", http.StatusSeeOther)
+}
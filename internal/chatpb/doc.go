@@ -0,0 +1,4 @@
+// Package chatpb holds the generated gRPC bindings for proto/chat.proto.
+package chatpb
+
+//go:generate protoc -I ../../proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chat.proto
@@ -0,0 +1,305 @@
+// Package fakeollama provides an httptest-based stand-in for the Ollama API,
+// used by the handler tests to exercise streaming, upstream errors, and slow
+// responses without a running model.
+package fakeollama
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message mirrors a chat message in Ollama's wire format
+type Message struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Images    []string   `json:"images,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	ToolName  string     `json:"tool_name,omitempty"`
+}
+
+// ToolCall is a function call requested by the model
+type ToolCall struct {
+	Function struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	} `json:"function"`
+}
+
+// Tool is a function offered to the model in a request
+type Tool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name string `json:"name"`
+	} `json:"function"`
+}
+
+// ChatRequest is the request body received on /api/chat
+type ChatRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+	Tools    []Tool    `json:"tools"`
+
+	Options   map[string]interface{} `json:"options"`
+	KeepAlive string                 `json:"keep_alive"`
+}
+
+// chatChunk is one NDJSON line of a streamed chat response
+type chatChunk struct {
+	Model   string  `json:"model"`
+	Message Message `json:"message"`
+	Done    bool    `json:"done"`
+}
+
+// Server is a fake Ollama server. The zero configuration streams a short
+// "Hello from fake Ollama" reply in a few chunks.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	chunks     []string
+	chunkDelay time.Duration
+	status     int
+	malformed  bool
+	dropAfter  int
+	toolCall   *ToolCall
+	requests   []ChatRequest
+	models     []string
+	pulls      []string
+	installed  bool // chats need an installed model
+}
+
+// New starts a fake Ollama server. Callers must Close it when done.
+func New() *Server {
+	s := &Server{
+		chunks:    []string{"Hello", " from", " fake", " Ollama"},
+		status:    http.StatusOK,
+		dropAfter: -1,
+		models:    []string{"fake-model"},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/chat", s.chatHandler)
+	mux.HandleFunc("/api/tags", s.tagsHandler)
+	mux.HandleFunc("/api/embed", s.embedHandler)
+	mux.HandleFunc("/api/pull", s.pullHandler)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetChunks sets the content pieces streamed back for each chat request
+func (s *Server) SetChunks(chunks ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks = chunks
+}
+
+// SetChunkDelay makes the server pause before writing each chunk
+func (s *Server) SetChunkDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunkDelay = d
+}
+
+// FailWith makes subsequent chat requests fail with the given status code
+// and an Ollama-style {"error": ...} body.
+func (s *Server) FailWith(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// SetMalformed makes the server emit a chunk that is not valid JSON after
+// the first regular chunk.
+func (s *Server) SetMalformed(malformed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.malformed = malformed
+}
+
+// DropAfter closes the stream after n chunks without sending a done chunk.
+// A negative n disables dropping.
+func (s *Server) DropAfter(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropAfter = n
+}
+
+// CallTool makes the server answer a request that offers tools with a call
+// to the named tool, until the request carries that tool's result
+func (s *Server) CallTool(name string, args map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	call := &ToolCall{}
+	call.Function.Name = name
+	call.Function.Arguments = args
+	s.toolCall = call
+}
+
+// RequireInstalled makes chat requests for a model that is neither
+// "fake-model" nor pulled since fail with 404, as Ollama's do
+func (s *Server) RequireInstalled(require bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.installed = require
+}
+
+// Pulls returns the models pulled so far
+func (s *Server) Pulls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.pulls...)
+}
+
+// Requests returns the chat requests received so far
+func (s *Server) Requests() []ChatRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ChatRequest(nil), s.requests...)
+}
+
+func (s *Server) chatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Like Ollama, stream unless the request says otherwise
+	req := ChatRequest{Stream: true}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	chunks := append([]string(nil), s.chunks...)
+	delay, status, malformed, dropAfter, toolCall := s.chunkDelay, s.status, s.malformed, s.dropAfter, s.toolCall
+	missing := s.installed
+	for _, m := range s.models {
+		if m == req.Model {
+			missing = false
+		}
+	}
+	s.mu.Unlock()
+
+	if missing {
+		writeError(w, http.StatusNotFound, "model '"+req.Model+"' not found, try pulling it first")
+		return
+	}
+
+	if status != http.StatusOK {
+		writeError(w, status, "fake failure")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	if toolCall != nil && len(req.Tools) > 0 && !answered(req, toolCall.Function.Name) {
+		enc.Encode(chatChunk{Model: req.Model, Message: Message{Role: "assistant", ToolCalls: []ToolCall{*toolCall}}, Done: true})
+		return
+	}
+
+	if !req.Stream {
+		var content string
+		for _, c := range chunks {
+			content += c
+		}
+		enc.Encode(chatChunk{Model: req.Model, Message: Message{Role: "assistant", Content: content}, Done: true})
+		return
+	}
+
+	for i, c := range chunks {
+		if dropAfter >= 0 && i >= dropAfter {
+			return
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		enc.Encode(chatChunk{Model: req.Model, Message: Message{Role: "assistant", Content: c}})
+		if malformed && i == 0 {
+			w.Write([]byte("{not json\n"))
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	enc.Encode(chatChunk{Model: req.Model, Message: Message{Role: "assistant"}, Done: true})
+}
+
+// Lists "fake-model" and any models pulled since
+func (s *Server) tagsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	var models []map[string]interface{}
+	for _, name := range s.models {
+		models = append(models, map[string]interface{}{"name": name, "size": 1234, "modified_at": "2024-05-01T10:00:00Z"})
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"models": models})
+}
+
+// Streams a short download of one 200-byte layer, then installs the model
+func (s *Server) pullHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model string `json:"model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]interface{}{"status": "pulling manifest"})
+	for done := 0; done <= 200; done += 100 {
+		enc.Encode(map[string]interface{}{"status": "pulling layer", "digest": "sha256:fake", "total": 200, "completed": done})
+	}
+
+	s.mu.Lock()
+	s.pulls = append(s.pulls, req.Model)
+	s.models = append(s.models, req.Model)
+	s.mu.Unlock()
+	enc.Encode(map[string]interface{}{"status": "success"})
+}
+
+// Embeds each input as [length, number of spaces]
+func (s *Server) embedHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Input []string `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	embeddings := make([][]float32, len(req.Input))
+	for i, in := range req.Input {
+		embeddings[i] = []float32{float32(len(in)), float32(strings.Count(in, " "))}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"embeddings": embeddings})
+}
+
+// Whether the request already carries the result of the named tool
+func answered(req ChatRequest, tool string) bool {
+	for _, m := range req.Messages {
+		if m.Role == "tool" && m.ToolName == tool {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key used to sign webhook callbacks; callbacks are refused without one
+var webhookSecret string
+
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+	// Finished jobs are dropped after this long
+	jobRetention = 24 * time.Hour
+)
+
+// Delay before each webhook retry; a var so tests can shorten it
+var webhookBackoff = 2 * time.Second
+
+// Set up in main once -fetch-* flags are parsed
+var webhookClient = fetchPolicy.client(webhookTimeout)
+
+// APIJobRequest is the body of POST /api/v1/jobs
+type APIJobRequest struct {
+	Model       string    `json:"model"`
+	Messages    []Message `json:"messages"`
+	CallbackURL string    `json:"callback_url"`
+}
+
+// Job is an asynchronous chat completion
+type Job struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"` // "queued", "running", "completed" or "failed"
+	Model       string     `json:"model"`
+	Message     *Message   `json:"message,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Created     time.Time  `json:"created"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	CallbackURL string     `json:"-"`
+}
+
+var (
+	jobs   = make(map[string]*Job)
+	jobMut sync.Mutex
+)
+
+// Async completion routes:
+//
+//	POST /api/v1/jobs        start a job; 202 with the job, POSTed to callback_url when done
+//	GET  /api/v1/jobs/<id>   poll a job
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/jobs"), "/")
+	if id != "" {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		jobMut.Lock()
+		job, ok := jobs[id]
+		var snapshot Job
+		if ok {
+			snapshot = *job
+		}
+		jobMut.Unlock()
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "unknown job")
+			return
+		}
+		writeJSON(w, http.StatusOK, snapshot)
+		return
+	}
+
+	var req APIJobRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	params := ChatParams{Model: req.Model, Messages: req.Messages}
+	if err := params.validate(r.Context()); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.CallbackURL != "" {
+		if webhookSecret == "" {
+			writeAPIError(w, http.StatusBadRequest, "callbacks are disabled: the server has no webhook secret")
+			return
+		}
+		u, err := url.Parse(req.CallbackURL)
+		if err == nil {
+			err = fetchPolicy.checkURL(u)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "callback_url is not allowed: "+err.Error())
+			return
+		}
+	}
+
+	job := &Job{ID: newRunID(), Status: "queued", Model: params.Model, Created: time.Now(), CallbackURL: req.CallbackURL}
+	jobMut.Lock()
+	pruneJobs()
+	jobs[job.ID] = job
+	snapshot := *job
+	jobMut.Unlock()
+
+	err := submitTask("completion", "job "+job.ID,
+		func(ctx context.Context) error { return runJob(ctx, job, params) },
+		func(err error) { finishJob(job, err) })
+	if err != nil {
+		jobMut.Lock()
+		delete(jobs, job.ID)
+		jobMut.Unlock()
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", basePath(r.Context())+"/api/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+// Drop finished jobs past their retention. Callers must hold jobMut.
+func pruneJobs() {
+	for id, job := range jobs {
+		if job.Finished != nil && time.Since(*job.Finished) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+}
+
+// One attempt at a job's completion; the worker pool retries failures
+func runJob(ctx context.Context, job *Job, params ChatParams) error {
+	jobMut.Lock()
+	job.Status = "running"
+	jobMut.Unlock()
+
+	msg, err := serviceChat(ctx, params)
+	if err != nil {
+		return err
+	}
+	jobMut.Lock()
+	job.Message = &msg
+	jobMut.Unlock()
+	return nil
+}
+
+// Record a job's outcome once its task is finished and notify the callback
+func finishJob(job *Job, err error) {
+	now := time.Now()
+	jobMut.Lock()
+	job.Finished = &now
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+	} else {
+		job.Status = "completed"
+	}
+	snapshot := *job
+	jobMut.Unlock()
+
+	if snapshot.CallbackURL != "" {
+		deliverWebhook(snapshot)
+	}
+}
+
+// Sign a webhook body: hex HMAC-SHA256 of "<timestamp>.<body>", so a
+// captured request can't be replayed later with a new timestamp
+func webhookSignature(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// POST the finished job to its callback URL, retrying on failure
+func deliverWebhook(job Job) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("Webhook encode error: %v", err)
+		return
+	}
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		timestamp := fmt.Sprint(time.Now().Unix())
+		req, err := http.NewRequest(http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Webhook request error: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", webhookSignature(timestamp, body))
+
+		resp, err := webhookClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("Webhook for job %s failed (attempt %d/%d): %v", job.ID, attempt, webhookAttempts, err)
+		if attempt < webhookAttempts {
+			time.Sleep(webhookBackoff * time.Duration(attempt))
+		}
+	}
+}
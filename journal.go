@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	journalDayLayout   = "2006-01-02"
+	journalMonthLayout = "2006-01"
+)
+
+// JournalDay is one day's entry in the month index
+type JournalDay struct {
+	Date    string
+	Day     int
+	Entries int
+	Today   bool
+}
+
+// JournalPage holds data for the journal templates
+type JournalPage struct {
+	Month     string // "2006-01"
+	MonthName string // "January 2006"
+	PrevMonth string
+	NextMonth string
+	Days      []JournalDay
+
+	Date     string // day view only
+	DateName string
+	Today    bool
+	History  []MessageView
+}
+
+// Journal routes: /journal shows a month index, /journal/<date> a day.
+// Posting to /journal/ writes to today's entry, which is created on demand.
+func journalHandler(w http.ResponseWriter, r *http.Request) {
+	date := strings.Trim(strings.TrimPrefix(r.URL.Path, "/journal"), "/")
+
+	switch {
+	case r.Method == http.MethodPost:
+		journalPostHandler(w, r)
+	case r.Method != http.MethodGet:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case date == "":
+		journalIndexHandler(w, r)
+	default:
+		journalDayHandler(w, r, date)
+	}
+}
+
+func journalIndexHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	month, err := time.ParseInLocation(journalMonthLayout, r.URL.Query().Get("month"), now.Location())
+	if err != nil {
+		month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	}
+
+	sessionID := getSessionID(w, r)
+	sessionMut.Lock()
+	journal := getSession(sessionID).Journal
+	counts := make(map[string]int, len(journal))
+	for date, entries := range journal {
+		counts[date] = len(entries)
+	}
+	sessionMut.Unlock()
+
+	page := JournalPage{
+		Month:     month.Format(journalMonthLayout),
+		MonthName: month.Format("January 2006"),
+		PrevMonth: month.AddDate(0, -1, 0).Format(journalMonthLayout),
+		NextMonth: month.AddDate(0, 1, 0).Format(journalMonthLayout),
+	}
+	today := now.Format(journalDayLayout)
+	for d := month; d.Month() == month.Month(); d = d.AddDate(0, 0, 1) {
+		date := d.Format(journalDayLayout)
+		page.Days = append(page.Days, JournalDay{Date: date, Day: d.Day(), Entries: counts[date], Today: date == today})
+	}
+
+	renderPage(w, r, "journal.html", page)
+}
+
+func journalDayHandler(w http.ResponseWriter, r *http.Request, date string) {
+	day, err := time.ParseInLocation(journalDayLayout, date, time.Local)
+	if err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	sessionMut.Lock()
+	entries := getSession(sessionID).Journal[date]
+	history := make([]MessageView, len(entries))
+	for i, msg := range entries {
+		history[i] = MessageView{Message: msg, Index: i}
+	}
+	sessionMut.Unlock()
+
+	renderPage(w, r, "journal_day.html", JournalPage{
+		Month:    day.Format(journalMonthLayout),
+		Date:     date,
+		DateName: day.Format("Monday, 2 January 2006"),
+		Today:    date == time.Now().Format(journalDayLayout),
+		History:  history,
+	})
+}
+
+// Add a timestamped entry to today's journal and ask the model to respond
+func journalPostHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	userMessage, err := readUserMessage(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), submissionStatus(err))
+		return
+	}
+
+	now := time.Now()
+	date := now.Format(journalDayLayout)
+	userMessage.Content = fmt.Sprintf("[%s] %s", now.Format("15:04"), userMessage.Content)
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	if sess.Journal == nil {
+		sess.Journal = make(map[string][]Message)
+		sess.JournalUpdated = make(map[string]time.Time)
+	}
+	sess.Journal[date] = append(sess.Journal[date], userMessage)
+	sess.JournalUpdated[date] = now
+	sess.LastActive = now
+	history := append([]Message(nil), sess.Journal[date]...)
+	sessionMut.Unlock()
+
+	reply, err := ollamaComplete(r.Context(), OllamaChatRequest{Model: defaultModelFor(r.Context()), Messages: history})
+	if err != nil {
+		writeOllamaError(w, r, http.StatusBadGateway, err)
+		log.Printf("Journal Ollama error: %v", err)
+		return
+	}
+
+	sessionMut.Lock()
+	sess = getSession(sessionID)
+	sess.Journal[date] = append(sess.Journal[date], Message{Role: "assistant", Content: reply})
+	sess.JournalUpdated[date] = time.Now()
+	sessionMut.Unlock()
+
+	redirect(w, r, "/journal/"+date, http.StatusSeeOther)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// keep_alive sent with every chat request. Ollama unloads a model, and its
+// prompt cache, when requests disagree or the timer runs out, so one value
+// is used everywhere.
+var ollamaKeepAlive = "30m"
+
+// Ollama instances serving the same models; each conversation sticks to one
+// so its prompt prefix stays in that instance's KV cache, and new ones are
+// spread over them by ollamaBalance. Empty means ollamaURL alone.
+var ollamaReplicas []string
+
+type (
+	affinityKey struct{}
+	upstreamKey struct{}
+)
+
+// Conversation identity for choosing a replica: a hash of the model and
+// the first user message, which are already there on the first turn and
+// stay the same as the conversation grows. Hashed so the sticky table holds
+// neither the prompt nor its size.
+func conversationKey(req OllamaChatRequest) string {
+	h := sha256.New()
+	h.Write([]byte(req.Model))
+	for _, m := range req.Messages {
+		if m.Role == "user" {
+			h.Write([]byte{0})
+			h.Write([]byte(m.Content))
+			break
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Tag a context with the conversation its requests belong to
+func withAffinity(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, affinityKey{}, key)
+}
+
+// Direct a context's requests to one Ollama host, bypassing affinity
+func withUpstream(ctx context.Context, base string) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, base)
+}
+
+// Every configured Ollama host, the tenants' included
+func upstreams() []string {
+	hosts := ollamaReplicas
+	if len(hosts) == 0 {
+		hosts = []string{ollamaURL}
+	}
+	seen := make(map[string]bool)
+	for _, h := range hosts {
+		seen[h] = true
+	}
+	tenants := currentFileConfig().Tenants
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, h := range tenants[name].Ollama {
+			if !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts
+}
+
+// Base URL for a request: a host set with withUpstream, or else one of the
+// hosts of the request's tenant, or of the server, chosen for the
+// conversation key by the -ollama-balance policy (see pickHost)
+func upstreamFor(ctx context.Context) string {
+	if base, ok := ctx.Value(upstreamKey{}).(string); ok {
+		return base
+	}
+	key, _ := ctx.Value(affinityKey{}).(string)
+	hosts, fallback := ollamaReplicas, ollamaURL
+	if t := tenantFrom(ctx); t != nil && len(t.Ollama) > 0 {
+		hosts, fallback = t.Ollama, t.Ollama[0]
+	}
+	if len(hosts) == 0 || (key == "" && ollamaBalance == balanceAffinity) {
+		return fallback
+	}
+	return pickHost(hosts, key)
+}
+
+// Fill in the configured system prompt, option limits and the cache hints
+// every chat request carries, fit it into its context window, and tag the
+// context with the conversation
+func prepareChat(ctx context.Context, req *OllamaChatRequest) context.Context {
+	req.Messages = withSystemPrompt(req.Messages)
+	req.Options, _ = limitOptions(req.Options)
+	// Keyed before fitting, which drops the first messages as the chat grows
+	ctx = withAffinity(ctx, conversationKey(*req))
+	fitChatContext(req)
+	if req.KeepAlive == "" {
+		req.KeepAlive = ollamaKeepAlive
+	}
+	return ctx
+}
+
+// Running time-to-first-token figures for streamed replies
+var ttft struct {
+	sync.Mutex
+	count int
+	total time.Duration
+	last  time.Duration
+}
+
+func recordTTFT(d time.Duration) {
+	ttft.Lock()
+	defer ttft.Unlock()
+	ttft.count++
+	ttft.total += d
+	ttft.last = d
+}
+
+// Mean and most recent time to first token, for the admin page
+func ttftStats() (mean, last time.Duration, count int) {
+	ttft.Lock()
+	defer ttft.Unlock()
+	if ttft.count > 0 {
+		mean = ttft.total / time.Duration(ttft.count)
+	}
+	return mean, ttft.last, ttft.count
+}
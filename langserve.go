@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+const maxChainRequestBytes = 1 << 20
+
+// chainConfig is the subset of a LangChain RunnableConfig the chains use
+type chainConfig struct {
+	Configurable struct {
+		Model string `json:"model"`
+	} `json:"configurable"`
+}
+
+// chainRequest is the body of /invoke and /stream
+type chainRequest struct {
+	Input  json.RawMessage `json:"input"`
+	Config chainConfig     `json:"config"`
+}
+
+// chainBatchRequest is the body of /batch
+type chainBatchRequest struct {
+	Inputs []json.RawMessage `json:"inputs"`
+	Config chainConfig       `json:"config"`
+}
+
+// Prompt templates served as LangServe runnables, each a prompt | model |
+// string-output chain:
+//
+//	POST /chains/<id>/invoke         {"input": {...}} -> {"output": "...", "metadata": {...}}
+//	POST /chains/<id>/batch          {"inputs": [...]} -> {"output": [...], "metadata": {...}}
+//	POST /chains/<id>/stream         server-sent "metadata", "data" and "end" events
+//	GET  /chains/<id>/input_schema   JSON schema of the template variables
+//	GET  /chains/<id>/output_schema  {"type": "string"}
+func langServeHandler(w http.ResponseWriter, r *http.Request) {
+	id, method, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/chains"), "/"), "/")
+	pt, ok := promptTemplates[id]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown chain")
+		return
+	}
+
+	switch method {
+	case "input_schema":
+		writeJSON(w, http.StatusOK, chainInputSchema(pt))
+		return
+	case "output_schema":
+		writeJSON(w, http.StatusOK, map[string]string{"title": "ChainOutput", "type": "string"})
+		return
+	case "invoke", "batch", "stream":
+	default:
+		writeAPIError(w, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body := io.LimitReader(r.Body, maxChainRequestBytes)
+	if method == "batch" {
+		var req chainBatchRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, "invalid request body")
+			return
+		}
+		if err := checkModelAllowed(r.Context(), chainModel(r.Context(), req.Config)); err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		outputs := make([]string, len(req.Inputs))
+		runIDs := make([]string, len(req.Inputs))
+		for i, input := range req.Inputs {
+			msgs, err := chainMessages(pt, input)
+			if err != nil {
+				writeAPIError(w, http.StatusUnprocessableEntity, fmt.Sprintf("input %d: %v", i, err))
+				return
+			}
+			outputs[i], err = ollamaComplete(r.Context(), OllamaChatRequest{Model: chainModel(r.Context(), req.Config), Messages: msgs})
+			if err != nil {
+				log.Printf("Chain %s error: %v", pt.ID, err)
+				writeAPIError(w, http.StatusBadGateway, "error communicating with Ollama")
+				return
+			}
+			runIDs[i] = newRunID()
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"output": outputs, "metadata": map[string]interface{}{"run_ids": runIDs}})
+		return
+	}
+
+	var req chainRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "invalid request body")
+		return
+	}
+	if err := checkModelAllowed(r.Context(), chainModel(r.Context(), req.Config)); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	msgs, err := chainMessages(pt, req.Input)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	chatReq := OllamaChatRequest{Model: chainModel(r.Context(), req.Config), Messages: msgs}
+	runID := newRunID()
+
+	if method == "stream" {
+		streamChain(w, r, chatReq, runID)
+		return
+	}
+
+	output, err := ollamaComplete(r.Context(), chatReq)
+	if err != nil {
+		log.Printf("Chain %s error: %v", pt.ID, err)
+		writeAPIError(w, http.StatusBadGateway, "error communicating with Ollama")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"output": output, "metadata": map[string]string{"run_id": runID}})
+}
+
+// Stream a chain's output as server-sent events in LangServe's format
+func streamChain(w http.ResponseWriter, r *http.Request, chatReq OllamaChatRequest, runID string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	event := func(name string, data interface{}) {
+		fmt.Fprintf(w, "event: %s\n", name)
+		if data != nil {
+			payload, _ := json.Marshal(data)
+			fmt.Fprintf(w, "data: %s\n", payload)
+		}
+		fmt.Fprint(w, "\n")
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	event("metadata", map[string]string{"run_id": runID})
+	_, err := ollamaStream(r.Context(), chatReq, func(chunk string) {
+		event("data", chunk)
+	})
+	if err != nil {
+		log.Printf("Chain stream error: %v", err)
+		event("error", map[string]interface{}{"status_code": http.StatusBadGateway, "message": "error communicating with Ollama"})
+		return
+	}
+	event("end", nil)
+}
+
+// Fill the template from an input object; a template with a single
+// variable also accepts a bare string
+func chainMessages(pt *PromptTemplate, input json.RawMessage) ([]Message, error) {
+	vars := make(map[string]string)
+	var text string
+	if err := json.Unmarshal(input, &text); err == nil {
+		names := templateVars(pt)
+		if len(names) != 1 {
+			return nil, fmt.Errorf("input must be an object with keys %s", strings.Join(names, ", "))
+		}
+		vars[names[0]] = text
+	} else {
+		var raw map[string]interface{}
+		if err := json.Unmarshal(input, &raw); err != nil {
+			return nil, fmt.Errorf("input must be an object or a string")
+		}
+		for k, v := range raw {
+			if s, ok := v.(string); ok {
+				vars[k] = s
+			} else {
+				vars[k] = fmt.Sprint(v)
+			}
+		}
+	}
+	return pt.Messages(vars)
+}
+
+func chainModel(ctx context.Context, config chainConfig) string {
+	if config.Configurable.Model != "" {
+		return config.Configurable.Model
+	}
+	return defaultModelFor(ctx)
+}
+
+// Variable names used in a template, sorted
+func templateVars(pt *PromptTemplate) []string {
+	seen := make(map[string]bool)
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, child := range n.Nodes {
+					walk(child)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, cmd := range n.Cmds {
+					for _, arg := range cmd.Args {
+						walk(arg)
+					}
+				}
+			}
+		case *parse.FieldNode:
+			seen[n.Ident[0]] = true
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	walk(pt.tmpl.Tree.Root)
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// JSON schema for a chain's input: an object of string variables
+func chainInputSchema(pt *PromptTemplate) map[string]interface{} {
+	names := templateVars(pt)
+	props := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		props[name] = map[string]string{"title": strings.Title(name), "type": "string"}
+	}
+	return map[string]interface{}{"title": "ChainInput", "type": "object", "properties": props, "required": names}
+}
+
+// Random version 4 UUID identifying one run
+func newRunID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata" // time zones for hosts without a zoneinfo database, such as Windows
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// localeStyle is how one locale writes times and how long ago they were
+type localeStyle struct {
+	Name        string // shown in the settings form
+	Date, Clock string // time layouts: date with time, and time of day
+	// Relative times; the formats take a count
+	JustNow, Minutes, Hours, Yesterday, Days string
+}
+
+// Locales the pages can be shown in; the first is used when the browser
+// asks for none of them
+var localeStyles = []struct {
+	Tag language.Tag
+	localeStyle
+}{
+	{language.AmericanEnglish, localeStyle{"English (US)", "Jan 2, 2006 3:04 PM", "3:04:05 PM",
+		"just now", "%d min ago", "%d h ago", "yesterday", "%d days ago"}},
+	{language.BritishEnglish, localeStyle{"English (UK)", "2 Jan 2006 15:04", "15:04:05",
+		"just now", "%d min ago", "%d h ago", "yesterday", "%d days ago"}},
+	{language.German, localeStyle{"Deutsch", "02.01.2006 15:04", "15:04:05",
+		"gerade eben", "vor %d Min.", "vor %d Std.", "gestern", "vor %d Tagen"}},
+	{language.French, localeStyle{"Français", "02/01/2006 15:04", "15:04:05",
+		"à l'instant", "il y a %d min", "il y a %d h", "hier", "il y a %d jours"}},
+	{language.Spanish, localeStyle{"Español", "02/01/2006 15:04", "15:04:05",
+		"ahora mismo", "hace %d min", "hace %d h", "ayer", "hace %d días"}},
+}
+
+var localeMatcher = func() language.Matcher {
+	tags := make([]language.Tag, len(localeStyles))
+	for i, l := range localeStyles {
+		tags[i] = l.Tag
+	}
+	return language.NewMatcher(tags)
+}()
+
+// LocaleOption is a locale offered in the settings form
+type LocaleOption struct {
+	Tag  string
+	Name string
+}
+
+func localeOptions() []LocaleOption {
+	opts := make([]LocaleOption, len(localeStyles))
+	for i, l := range localeStyles {
+		opts[i] = LocaleOption{Tag: l.Tag.String(), Name: l.Name}
+	}
+	return opts
+}
+
+// Index in localeStyles of a locale the user picked, or -1
+func localeIndex(tag string) int {
+	for i, l := range localeStyles {
+		if strings.EqualFold(l.Tag.String(), tag) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Localizer formats times and numbers for one user, so pages show them in
+// the user's language and time zone without relying on script. Its zero
+// value formats like the first locale in server time.
+type Localizer struct {
+	style   int
+	printer *message.Printer
+	zone    *time.Location
+	now     time.Time // reference for relative times; zero for the clock
+}
+
+// A localizer for a chosen locale and IANA time zone. An empty locale is
+// matched against the Accept-Language header instead, and an empty zone
+// is server time.
+func newLocalizer(locale, zone, acceptLanguage string) Localizer {
+	i := localeIndex(locale)
+	if i < 0 {
+		tags, _, _ := language.ParseAcceptLanguage(acceptLanguage)
+		_, i, _ = localeMatcher.Match(tags...)
+	}
+	l := Localizer{style: i, printer: message.NewPrinter(localeStyles[i].Tag), zone: time.Local}
+	if loc, err := time.LoadLocation(zone); zone != "" && err == nil {
+		l.zone = loc
+	}
+	return l
+}
+
+// The localizer for a request from this session. Callers must hold
+// sessionMut.
+func (s *session) localizer(r *http.Request) Localizer {
+	return newLocalizer(s.Locale, s.TimeZone, r.Header.Get("Accept-Language"))
+}
+
+// The localizer for a request, from its session's settings when it has a
+// session
+func requestLocalizer(r *http.Request) Localizer {
+	if id, ok := cookieSessionID(r); ok {
+		sessionMut.Lock()
+		defer sessionMut.Unlock()
+		return getSession(id).localizer(r)
+	}
+	return newLocalizer("", "", r.Header.Get("Accept-Language"))
+}
+
+func (l Localizer) in(t time.Time) time.Time {
+	if l.zone == nil {
+		return t.Local()
+	}
+	return t.In(l.zone)
+}
+
+// Date and time; empty for the zero time
+func (l Localizer) Time(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return l.in(t).Format(localeStyles[l.style].Date)
+}
+
+// Time of day, to the second; empty for the zero time
+func (l Localizer) Clock(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return l.in(t).Format(localeStyles[l.style].Clock)
+}
+
+// How long ago a time was, such as "2 min ago"; the date once it is a week
+// old, and empty for the zero time
+func (l Localizer) Ago(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	now := l.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	style := localeStyles[l.style]
+	switch d := now.Sub(t); {
+	case d < time.Minute:
+		return style.JustNow
+	case d < time.Hour:
+		return fmt.Sprintf(style.Minutes, int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf(style.Hours, int(d/time.Hour))
+	case d < 48*time.Hour:
+		return style.Yesterday
+	case d < 7*24*time.Hour:
+		return fmt.Sprintf(style.Days, int(d/(24*time.Hour)))
+	}
+	return l.Time(t)
+}
+
+// A number with the locale's separators, to at most two decimals
+func (l Localizer) Number(v interface{}) string {
+	p := l.printer
+	if p == nil {
+		p = message.NewPrinter(localeStyles[l.style].Tag)
+	}
+	return p.Sprint(number.Decimal(v, number.MaxFractionDigits(2)))
+}
+
+// SettingsPage holds data for the display settings page
+type SettingsPage struct {
+	Locales  []LocaleOption
+	Locale   string // empty to follow the browser
+	TimeZone string // IANA name; empty for server time
+	// Show the model's reasoning, collapsed, above its replies
+	ShowReasoning bool
+	Error         string
+	L             Localizer
+	Now           time.Time
+}
+
+// GET /settings shows how the session's pages format times and numbers and
+// whether they show model reasoning; POST changes them (form fields locale,
+// time_zone and show_reasoning)
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	page := SettingsPage{Locales: localeOptions(), Locale: sess.Locale, TimeZone: sess.TimeZone, ShowReasoning: !sess.HideReasoning, Now: time.Now()}
+	if r.Method == http.MethodPost {
+		locale := strings.TrimSpace(r.FormValue("locale"))
+		zone := strings.TrimSpace(r.FormValue("time_zone"))
+		show := r.FormValue("show_reasoning") != ""
+		if _, err := time.LoadLocation(zone); zone != "" && err != nil {
+			page.Error = fmt.Sprintf("Unknown time zone %q; use an IANA name such as Europe/Berlin", zone)
+		} else if locale != "" && localeIndex(locale) < 0 {
+			page.Error = fmt.Sprintf("Unknown locale %q", locale)
+		} else {
+			sess.Locale, sess.TimeZone, sess.HideReasoning = locale, zone, !show
+		}
+		page.Locale, page.TimeZone, page.ShowReasoning = locale, zone, show
+	}
+	page.L = sess.localizer(r)
+	sessionMut.Unlock()
+
+	switch {
+	case page.Error != "":
+		renderPageStatus(w, r, http.StatusBadRequest, "settings.html", page)
+	case r.Method == http.MethodPost:
+		redirect(w, r, "/settings", http.StatusSeeOther)
+	default:
+		renderPage(w, r, "settings.html", page)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Failed logins allowed within loginWindow before further attempts are
+// refused until the window ends: per account, and per client address
+var (
+	loginWindow          = 15 * time.Minute
+	maxAccountFailures   = 5
+	maxAddressFailures   = 20
+	loginCaptchaFailures = 3 // failures after which captchaCheck is asked, when set
+)
+
+// Pause before answering a failed login, doubled with each failure in the
+// window up to loginSlowdownMax; vars so tests can shorten them
+var (
+	loginSlowdown    = 250 * time.Millisecond
+	loginSlowdownMax = 4 * time.Second
+)
+
+// Optional hook for a captcha provider: once an account has
+// loginCaptchaFailures failures, a login is only checked when this passes
+var captchaCheck func(r *http.Request) bool
+
+// loginStore counts failed logins per key over fixed windows. A session
+// store that implements it keeps the counts, so lockouts hold across
+// restarts and instances.
+type loginStore interface {
+	// Count a failure for key, returning the failures in the current window
+	AddLoginFailure(key string, window time.Duration) (int, error)
+	// Failures for key in the current window
+	LoginFailures(key string) (int, error)
+	ClearLoginFailures(key string) error
+}
+
+// Where failed logins are counted; the session store when it can
+var logins loginStore = newMemoryLogins()
+
+// memoryLogins counts failures for this instance alone
+type memoryLogins struct {
+	mu       sync.Mutex
+	failures map[string]loginFailures
+}
+
+type loginFailures struct {
+	count int
+	ends  time.Time
+}
+
+func newMemoryLogins() *memoryLogins {
+	return &memoryLogins{failures: map[string]loginFailures{}}
+}
+
+func (m *memoryLogins) AddLoginFailure(key string, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, f := range m.failures {
+		if now.After(f.ends) {
+			delete(m.failures, k)
+		}
+	}
+	f, ok := m.failures[key]
+	if !ok {
+		f.ends = now.Add(window)
+	}
+	f.count++
+	m.failures[key] = f
+	return f.count, nil
+}
+
+func (m *memoryLogins) LoginFailures(key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.failures[key]; ok && time.Now().Before(f.ends) {
+		return f.count, nil
+	}
+	return 0, nil
+}
+
+func (m *memoryLogins) ClearLoginFailures(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, key)
+	return nil
+}
+
+func loginKeys(r *http.Request, account string) (accountKey, addressKey string) {
+	return "account:" + account, "addr:" + clientAddr(r)
+}
+
+// Check a login may be attempted at all, answering the request itself when
+// the account or address is locked out or the captcha fails
+func loginAllowed(w http.ResponseWriter, r *http.Request, account string) bool {
+	accountKey, addressKey := loginKeys(r, account)
+	accountFailures, err := logins.LoginFailures(accountKey)
+	if err != nil {
+		log.Printf("Login store error: %v", err)
+	}
+	addressFailures, err := logins.LoginFailures(addressKey)
+	if err != nil {
+		log.Printf("Login store error: %v", err)
+	}
+	if accountFailures >= maxAccountFailures || addressFailures >= maxAddressFailures {
+		w.Header().Set("Retry-After", strconv.Itoa(int(loginWindow.Seconds())))
+		http.Error(w, "Too many failed logins; try again later", http.StatusTooManyRequests)
+		return false
+	}
+	if captchaCheck != nil && accountFailures >= loginCaptchaFailures && !captchaCheck(r) {
+		http.Error(w, "Captcha required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Count a failed login against the account and the address, then pause
+// so guesses stay slow even below the lockout
+func loginFailed(r *http.Request, account string) {
+	accountKey, addressKey := loginKeys(r, account)
+	n, err := logins.AddLoginFailure(accountKey, loginWindow)
+	if err != nil {
+		log.Printf("Login store error: %v", err)
+	}
+	if _, err := logins.AddLoginFailure(addressKey, loginWindow); err != nil {
+		log.Printf("Login store error: %v", err)
+	}
+	if n >= maxAccountFailures {
+		log.Printf("Login locked for %s after %d failures", account, n)
+	}
+	delay := loginSlowdown
+	for i := 1; i < n && delay < loginSlowdownMax; i++ {
+		delay *= 2
+	}
+	if delay > loginSlowdownMax {
+		delay = loginSlowdownMax
+	}
+	time.Sleep(delay)
+}
+
+// Forget an account's failures once it logs in
+func loginSucceeded(r *http.Request, account string) {
+	accountKey, _ := loginKeys(r, account)
+	if n, _ := logins.LoginFailures(accountKey); n == 0 {
+		return
+	}
+	if err := logins.ClearLoginFailures(accountKey); err != nil {
+		log.Printf("Login store error: %v", err)
+	}
+}
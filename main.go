@@ -1,43 +1,86 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"html/template"
-	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
-
-	"github.com/russross/blackfriday/v2"
 )
 
-// Session storage (in-memory)
-var (
-	sessions   = make(map[string][]Message)
-	sessionMut sync.Mutex
-)
+// Ollama API base URL
+var ollamaURL = "http://localhost:11434"
+
+// Model used for chat requests
+var defaultModel = "deepseek-r1:1.5b"
 
 // Message represents a chat message
 type Message struct {
-	Role    string `json:"role"` // "user" or "assistant"
-	Content string `json:"content"`
+	Role    string   `json:"role"` // "user" or "assistant"
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"` // base64-encoded image attachments
+	Name    string   `json:"name,omitempty"`   // speaking agent in multi-agent conversations
+
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"` // tools the model asked to run
+	ToolName  string     `json:"tool_name,omitempty"`  // tool whose output a "tool" message carries
+
+	Reasoning string  `json:"reasoning,omitempty"` // what a reasoning model thought before answering
+	Backend   string  `json:"backend,omitempty"`   // fallback backend that answered, empty for Ollama
+	Cost      float64 `json:"cost,omitempty"`      // estimated dollars, for a priced fallback model
+
+	ID int `json:"-"` // chat history message ID, from the session event log
+}
+
+// Most recent messages rendered on the home page
+const maxRenderedMessages = 200
+
+// MessageView is a history entry prepared for display
+type MessageView struct {
+	Message
+	Index int           // position in the full history
+	HTML  template.HTML // rendered content of assistant messages
+	Time  time.Time     // when the message was added
+
+	// Collapsed block of the rendered reasoning, unless the user hides it
+	ReasoningHTML template.HTML
 }
 
 // PageData holds data for the HTML template
 type PageData struct {
-	History []Message
+	History []MessageView
+	Hidden  int  // older messages left out of the page
+	Focus   bool // focus session in progress
+
+	Conversations []ConversationInfo
+	Active        int // ID of the conversation shown
+
+	L Localizer // formats times and numbers for the user
+
+	Brand Branding // the tenant's title and colour
+
+	Pending []PendingPrompt // the conversation's prompts waiting for Ollama
 }
 
 // OllamaChatRequest defines the request body for Ollama's chat API
 type OllamaChatRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream,omitempty"`
+	Model    string          `json:"model"`
+	Messages []Message       `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Format   json.RawMessage `json:"format,omitempty"` // "json" or a JSON schema
+	Tools    []Tool          `json:"tools,omitempty"`
+	// Model parameters such as temperature or num_ctx
+	Options map[string]interface{} `json:"options,omitempty"`
+	// How long Ollama keeps the model loaded afterwards, e.g. "30m"
+	KeepAlive string `json:"keep_alive,omitempty"`
 }
 
 // OllamaChatResponse defines the response from Ollama's chat API
@@ -47,11 +90,242 @@ type OllamaChatResponse struct {
 }
 
 func main() {
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/chat", chatHandler)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	log.Println("Server running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", recoveryMiddleware(http.DefaultServeMux)))
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Stdout, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "prompts" {
+		if err := runPromptsCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg := defaultConfig()
+	cfg.registerFlags(flag.CommandLine)
+	recordDir := flag.String("record", "", "record Ollama responses as fixtures into `dir`")
+	replayDir := flag.String("replay", "", "replay Ollama responses from fixtures in `dir` instead of calling Ollama")
+	replayDelay := flag.Duration("replay-delay", 0, "pause between replayed stream chunks")
+	flag.BoolVar(&devMode, "dev", false, "re-parse templates on every request")
+	flag.DurationVar(&focusIdle, "focus-idle", focusIdle, "idle time after which a focus session is summarised")
+	flag.StringVar(&sttURL, "stt-url", "", "base URL of an OpenAI-compatible speech-to-text service")
+	flag.StringVar(&sttModel, "stt-model", sttModel, "speech-to-text model name")
+	flag.StringVar(&ttsURL, "tts-url", "", "base URL of an OpenAI-compatible text-to-speech service")
+	flag.StringVar(&ttsModel, "tts-model", ttsModel, "text-to-speech model name")
+	flag.StringVar(&ttsVoice, "tts-voice", ttsVoice, "text-to-speech voice")
+	flag.StringVar(&pdfCommand, "pdf-command", "", "HTML-to-PDF converter reading stdin and writing stdout, e.g. \"wkhtmltopdf --quiet - -\"; PDF export is off without it")
+	flag.StringVar(&webhookSecret, "webhook-secret", "", "key for signing job completion webhooks; callbacks are refused without it")
+	flag.StringVar(&contentSecurityPolicy, "csp", contentSecurityPolicy, "Content-Security-Policy header; empty to leave it out")
+	flag.StringVar(&frameOptions, "frame-options", frameOptions, "X-Frame-Options header; empty to leave it out")
+	flag.StringVar(&referrerPolicy, "referrer-policy", referrerPolicy, "Referrer-Policy header; empty to leave it out")
+	flag.DurationVar(&hstsMaxAge, "hsts", hstsMaxAge, "Strict-Transport-Security max-age sent over HTTPS; 0 to leave it out")
+	fetchAllow := flag.String("fetch-allow", "", "comma-separated hosts user-supplied URLs (job callbacks) may reach; any public host if empty")
+	fetchDeny := flag.String("fetch-deny", "", "comma-separated hosts user-supplied URLs may never reach")
+	flag.BoolVar(&fetchPolicy.AllowPrivate, "fetch-allow-private", false, "let user-supplied URLs reach loopback and private addresses")
+	flag.IntVar(&fetchPolicy.MaxRedirects, "fetch-max-redirects", fetchPolicy.MaxRedirects, "redirects followed for user-supplied URLs")
+	flag.StringVar(&grpcAddr, "grpc", "", "serve the gRPC API on `addr` (e.g. :9090)")
+	flag.StringVar(&mcpConfigPath, "mcp", "", "YAML file of MCP servers whose tools the model may use")
+	flag.StringVar(&mcpServerToken, "mcp-token", "", "bearer token enabling the /mcp server endpoint for external MCP clients")
+	flag.StringVar(&anonymizeConfigPath, "anonymize", "", "YAML file of extra names and patterns to anonymize on export")
+	flag.StringVar(&promptDir, "prompts", promptDir, "directory of prompt template YAML files")
+	flag.IntVar(&workerCount, "workers", workerCount, "background tasks run at once")
+	flag.IntVar(&taskAttempts, "task-attempts", taskAttempts, "attempts per background task before it is marked failed")
+	flag.StringVar(&ollamaKeepAlive, "keep-alive", ollamaKeepAlive, "keep_alive sent with every chat request, so the model and its prompt cache stay loaded")
+	replicas := flag.String("ollama-replicas", "", "comma-separated Ollama base URLs; each conversation sticks to one to reuse its cache")
+	flag.Func("ollama-balance", "how conversations are spread over -ollama-replicas: affinity (hashed, the default), round-robin or least-loaded", setBalance)
+	flag.DurationVar(&ollamaHealthInterval, "ollama-health-interval", ollamaHealthInterval, "how often every Ollama host is checked, so ones that are down get no chats; 0 for no checks")
+	flag.BoolVar(&autoPull, "pull", false, "pull configured models that are missing from Ollama at startup")
+	flag.BoolVar(&pullMissing, "pull-missing", pullMissing, "pull a model a chat asks for when Ollama does not have it and the config lists it, showing the download, then answer")
+	flag.DurationVar(&ollamaConnectTimeout, "ollama-connect-timeout", ollamaConnectTimeout, "how long connecting to Ollama may take")
+	flag.DurationVar(&ollamaReadTimeout, "ollama-read-timeout", ollamaReadTimeout, "how long Ollama may go without sending anything, including while it loads the model; 0 for no limit")
+	flag.IntVar(&ollamaRetries, "ollama-retries", ollamaRetries, "times a request is retried, with backoff, when connecting fails or Ollama is busy")
+	flag.IntVar(&breakerFailures, "breaker-failures", breakerFailures, "failed Ollama calls in a row after which calls to that host fail at once until it recovers; 0 to never stop calling")
+	flag.DurationVar(&breakerProbeInterval, "breaker-probe", breakerProbeInterval, "how often a host that stopped answering is checked for recovery")
+	flag.BoolVar(&offlineQueue, "offline-queue", offlineQueue, "queue chat prompts while the Ollama host is down and send them when it recovers, instead of refusing them")
+	flag.StringVar(&fallbackURL, "fallback-url", "", "base URL of an OpenAI-compatible API, e.g. https://api.openai.com/v1, answering chats when Ollama is down or lacks the model")
+	flag.StringVar(&fallbackKey, "fallback-key", envString("FALLBACK_API_KEY", ""), "API key for -fallback-url (env FALLBACK_API_KEY)")
+	flag.StringVar(&fallbackModel, "fallback-model", "", "model asked for at -fallback-url; empty to send the chat's own model")
+	flag.StringVar(&modelsDir, "models-dir", "", "Ollama's model directory, when it runs on this machine, to check free space before pulls")
+	flag.Func("min-free-disk", "free space to keep in -models-dir, e.g. 20GB; pulls that would go below it are refused", func(s string) (err error) {
+		minFreeDisk, err = parseSize(s)
+		return err
+	})
+	flag.Func("models-quota", "most the installed models of each Ollama host may add up to, e.g. 200GB", func(s string) (err error) {
+		modelsQuota, err = parseSize(s)
+		return err
+	})
+	flag.IntVar(&ollamaSlots, "ollama-slots", 0, "generations sent to Ollama at once, queued by priority beyond that (0 = no limit)")
+	flag.StringVar(&apiKeysPath, "api-keys", "", "YAML file assigning priority classes to API keys")
+	flag.StringVar(&adminPassword, "admin-password", "", "password for the /admin pages (user \"admin\"); they are off without it")
+	flag.StringVar(&scenarioDir, "scenarios", scenarioDir, "directory of roleplay scenario YAML files")
+	flag.StringVar(&variablesPassphrase, "vars-key", "", "passphrase the conversation variables for tools are encrypted with (random per run if empty)")
+	storeSpec := flag.String("session-store", "", "where chat history is kept: memory (the default), sqlite:<file> to survive restarts, or a redis:// URL to share it between instances")
+	flag.IntVar(&maxSessions, "max-sessions", 0, "sessions kept in memory before the least recently used are evicted; 0 for no cap")
+	flag.IntVar(&maxMessages, "max-messages", 0, "messages kept in memory across all sessions before the least recently used sessions are evicted; 0 for no cap")
+	flag.IntVar(&sessionMessageLimit, "session-messages", 0, "messages a session may hold before its prompts are refused; 0 for no limit")
+	flag.BoolVar(&bindSessionUA, "session-bind-ua", false, "refuse session cookies sent by a different User-Agent than the one the session started with")
+	flag.DurationVar(&maintenanceInterval, "maintenance-interval", maintenanceInterval, "how often orphaned images are pruned and the session store compacted; 0 for only the admin button")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long a shutdown waits for requests and replies in progress before stopping them")
+	flag.StringVar(&configPath, "config", "", "YAML file of allowed models, system prompt and rate limits, reloaded when it changes")
+	rendererName := flag.String("renderer", "blackfriday", "markdown renderer: "+rendererNames)
+	flag.Parse()
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	cfg.apply()
+	fetchPolicy.AllowHosts, fetchPolicy.DenyHosts = splitList(*fetchAllow), splitList(*fetchDeny)
+	webhookClient = fetchPolicy.client(webhookTimeout)
+	ollamaReplicas = splitList(*replicas)
+	ollamaClient, fallbackClient = newOllamaClient(), newOllamaClient()
+
+	r, err := newRenderer(*rendererName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderer = r
+
+	if err := loadAssets(); err != nil {
+		log.Fatalf("Asset error: %v", err)
+	}
+	if err := loadTemplates(); err != nil {
+		log.Fatalf("Template error: %v", err)
+	}
+	if err := loadScenarios(); err != nil {
+		log.Fatalf("Scenario error: %v", err)
+	}
+	if err := loadPromptTemplates(); err != nil {
+		log.Fatalf("Prompt template error: %v", err)
+	}
+	if err := loadAnonymizer(); err != nil {
+		log.Fatalf("Anonymizer error: %v", err)
+	}
+	if err := loadVariablesKey(); err != nil {
+		log.Fatalf("Variables key error: %v", err)
+	}
+	if err := loadFileConfig(); err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	if *storeSpec == "" {
+		*storeSpec = currentFileConfig().SessionStore
+	}
+	if store, err = openSessionStore(*storeSpec); err != nil {
+		log.Fatalf("Session store error: %v", err)
+	}
+	if l, ok := store.(loginStore); ok {
+		logins = l
+	}
+	if err := loadAPIKeys(); err != nil {
+		log.Fatalf("API key error: %v", err)
+	}
+
+	if err := configureReplay(ollamaClient.HTTP, *recordDir, *replayDir, *replayDelay); err != nil {
+		log.Fatalf("Replay setup error: %v", err)
+	}
+
+	checkModels()
+
+	if err := loadMCPServers(); err != nil {
+		log.Fatalf("MCP error: %v", err)
+	}
+
+	if err := startGRPCServer(); err != nil {
+		log.Fatalf("gRPC error: %v", err)
+	}
+
+	startFocusWatcher(time.Minute)
+	startCompactionWatcher(time.Minute)
+	startSessionReaper()
+	startMaintenance(maintenanceInterval)
+	startHealthChecks(ollamaHealthInterval)
+	watchFileConfig()
+
+	lis, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Server running on %s", cfg.ListenAddr)
+	err = runServer(&http.Server{Handler: newRouter()}, lis, stop)
+	storeWrites.flush()
+	if cerr := store.Close(); cerr != nil {
+		log.Printf("Session store close error: %v", cerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Server stopped")
+}
+
+// Build the application's handler tree
+func newRouter() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", homeHandler)
+	mux.HandleFunc("/chat", chatHandler)
+	mux.HandleFunc("/chat/stream", chatStreamHandler)
+	mux.HandleFunc("/chat/stop", chatStopHandler)
+	mux.HandleFunc("/chat/regenerate", chatRegenerateHandler)
+	mux.HandleFunc("/chat/confirm", chatConfirmHandler)
+	mux.HandleFunc("/ws", chatSocketHandler)
+	mux.HandleFunc("/history", historyHandler)
+	mux.HandleFunc("/conversations", conversationsHandler)
+	mux.HandleFunc("/history/events", historyEventsHandler)
+	mux.HandleFunc("/export/table", tableExportHandler)
+	mux.HandleFunc("/export/markdown", conversationExportHandler)
+	mux.HandleFunc("/export/json", conversationExportHandler)
+	mux.HandleFunc("/export/text", conversationExportHandler)
+	mux.HandleFunc("/export/print", conversationExportHandler)
+	mux.HandleFunc("/export/pdf", conversationExportHandler)
+	mux.HandleFunc("/export/modelfile", conversationExportHandler)
+	mux.HandleFunc("/export/ollama", conversationExportHandler)
+	mux.HandleFunc("/export", conversationExportHandler)
+	mux.HandleFunc("/export/site", siteExportHandler)
+	mux.HandleFunc("/import", importHandler)
+	mux.HandleFunc("/shared/", sharedHandler)
+	mux.HandleFunc("/focus", focusHandler)
+	mux.HandleFunc("/journal", journalHandler)
+	mux.HandleFunc("/journal/", journalHandler)
+	mux.HandleFunc("/flashcards", flashcardsHandler)
+	mux.HandleFunc("/flashcards/export", flashcardsExportHandler)
+	mux.HandleFunc("/scenarios", scenariosHandler)
+	mux.HandleFunc("/scenarios/", scenariosHandler)
+	mux.HandleFunc("/agents", agentsHandler)
+	mux.HandleFunc("/agents/", agentsHandler)
+	mux.HandleFunc("/evals", evalsHandler)
+	mux.HandleFunc("/evals/", evalsHandler)
+	mux.HandleFunc("/prompts", promptsHandler)
+	mux.HandleFunc("/dataset", datasetHandler)
+	mux.HandleFunc("/variables", variablesHandler)
+	mux.HandleFunc("/schedules", schedulesHandler)
+	mux.HandleFunc("/privacy", privacyHandler)
+	mux.HandleFunc("/settings", settingsHandler)
+	mux.HandleFunc("/voice", voicePageHandler)
+	mux.HandleFunc("/voice/ws", voiceSocketHandler)
+	mux.HandleFunc("/api/v1/chat", apiChatHandler)
+	mux.HandleFunc("/api/v1/history", apiHistoryHandler)
+	mux.HandleFunc("/api/v1/conversations", apiConversationsHandler)
+	mux.HandleFunc("/api/v1/import", apiImportHandler)
+	mux.HandleFunc("/api/v1/models", apiModelsHandler)
+	mux.HandleFunc("/api/v1/embeddings", apiEmbeddingsHandler)
+	mux.HandleFunc("/api/v1/jobs", jobsHandler)
+	mux.HandleFunc("/api/v1/jobs/", jobsHandler)
+	mux.HandleFunc("/api/v1/voice", voiceAPIHandler)
+	mux.HandleFunc("/v1/chat/completions", openAIChatHandler)
+	mux.HandleFunc("/chat/pending", pendingHandler)
+	mux.HandleFunc("/v1/models", openAIModelsHandler)
+	mux.HandleFunc("/graphql", graphqlHandler)
+	mux.HandleFunc("/mcp", mcpServerHandler)
+	mux.HandleFunc("/admin", adminHandler)
+	mux.HandleFunc("/admin/pulls", adminPullsHandler)
+	mux.HandleFunc("/admin/schedules", adminSchedulesHandler)
+	mux.HandleFunc("/admin/schedules.ics", adminSchedulesCalendarHandler)
+	mux.HandleFunc("/admin/duplicates", adminDuplicatesHandler)
+	mux.HandleFunc("/admin/maintenance", adminMaintenanceHandler)
+	mux.HandleFunc("/chains/", langServeHandler)
+	mux.Handle("/static/", staticHandler())
+	return recoveryMiddleware(securityHeadersMiddleware(gzipMiddleware(tenantMiddleware(networkPolicyMiddleware(rateLimitMiddleware(priorityMiddleware(transcriptMiddleware(mux))))))))
 }
 
 // Home page handler
@@ -61,32 +335,39 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	funcMap := template.FuncMap{
-		"title": func(s string) string {
-			return strings.Title(s)
-		},
-		"safeHTML": func(content string) template.HTML {
-			return template.HTML(content)
-		},
-	}
-
 	sessionID := getSessionID(w, r)
+
+	// Copy only the tail that will be shown, not the whole conversation
 	sessionMut.Lock()
-	history := sessions[sessionID]
+	sess := getSession(sessionID)
+	history := sess.History
+	focus := sess.Focus
+	convs, active := append([]ConversationInfo(nil), sess.Conversations...), sess.Active
+	for i := range convs {
+		convs[i].Share = sess.Shared[convs[i].ID]
+	}
+	hidden := 0
+	if len(history) > maxRenderedMessages {
+		hidden = len(history) - maxRenderedMessages
+	}
+	added := messageTimes(sess.Events, active)
+	visible := make([]MessageView, 0, len(history)-hidden)
+	for i := hidden; i < len(history); i++ {
+		visible = append(visible, MessageView{Message: history[i], Index: i, Time: added[history[i].ID]})
+	}
+	l := sess.localizer(r)
+	pending := sess.pendingIn(active)
 	sessionMut.Unlock()
 
-	formattedHistory := make([]Message, len(history))
-	for i, msg := range history {
-		formattedHistory[i] = msg
-		formattedHistory[i].Content = cleanResponse(msg.Content)
+	renderHistory(sessionID, visible)
+	base := basePath(r.Context())
+	for i, v := range visible {
+		if v.HTML != "" {
+			visible[i].HTML = template.HTML(addTableLinks(string(v.HTML), base, v.Index))
+		}
 	}
 
-	tmpl := template.Must(template.New("index.html").Funcs(funcMap).ParseFiles("templates/index.html"))
-	err := tmpl.Execute(w, PageData{History: formattedHistory})
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.Printf("Template error: %v", err)
-	}
+	renderPage(w, r, "index.html", PageData{History: visible, Hidden: hidden, Focus: focus, Conversations: convs, Active: active, L: l, Brand: requestBranding(r), Pending: pending})
 }
 
 // Chat handler with history
@@ -97,69 +378,149 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionID := getSessionID(w, r)
-	userMessage := r.FormValue("prompt")
+	userMessage, err := readUserMessage(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), submissionStatus(err))
+		return
+	}
 
+	// Run to completion even if the browser goes away, unless stopped, but
+	// keep the priority
 	sessionMut.Lock()
-	sessions[sessionID] = append(sessions[sessionID], Message{
-		Role:    "user",
-		Content: userMessage,
-	})
-	history := sessions[sessionID]
+	sess := getSession(sessionID)
+	if sess.queueIfOffline(userMessage) {
+		sessionMut.Unlock()
+		redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := sess.append(userMessage); err != nil {
+		sessionMut.Unlock()
+		http.Error(w, err.Error(), submissionStatus(err))
+		return
+	}
+	reqBody, conv := sess.conversationRequest(sess.Active, sess.History), sess.Active
+	ctx, done := sess.trackGeneration(withPriority(context.Background(), priorityFrom(r.Context())))
+	sessionMut.Unlock()
+	defer done()
+
+	answerChat(ctx, w, r, sessionID, conv, reqBody)
+}
+
+// POST /chat/confirm: answer the active conversation's last message, a
+// prompt left unanswered because its fallback cost needed confirming
+func chatConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	if n := len(sess.History); n == 0 || sess.History[n-1].Role != "user" {
+		sessionMut.Unlock()
+		http.Error(w, "There is no message waiting for an answer", http.StatusConflict)
+		return
+	}
+	reqBody, conv := sess.conversationRequest(sess.Active, sess.History), sess.Active
+	ctx, done := sess.trackGeneration(withCostConfirmed(withPriority(context.Background(), priorityFrom(r.Context()))))
 	sessionMut.Unlock()
+	defer done()
+
+	answerChat(ctx, w, r, sessionID, conv, reqBody)
+}
 
-	reqBody := OllamaChatRequest{
-		Model:    "deepseek-r1:1.5b",
-		Messages: history,
-		Stream:   true, // Enable streaming
+// Answer a chat from the page's form, adding the reply to conversation
+// conv and going back to the page
+func answerChat(ctx context.Context, w http.ResponseWriter, r *http.Request, sessionID string, conv int, reqBody OllamaChatRequest) {
+	if tools := mcpTools(); len(tools) > 0 {
+		reqBody.Tools = tools
+		chatWithTools(ctx, w, r, sessionID, conv, reqBody)
+		return
 	}
-	reqJSON, _ := json.Marshal(reqBody)
 
-	resp, err := http.Post("http://localhost:11434/api/chat", "application/json", bytes.NewBuffer(reqJSON))
+	reqBody.Stream = true // Enable streaming
+	ctx = prepareChat(ctx, &reqBody)
+	req, err := newOllamaRequest(ctx, "/api/chat", reqBody)
 	if err != nil {
 		http.Error(w, "Error communicating with Ollama", http.StatusInternalServerError)
+		log.Printf("Ollama request error: %v", err)
+		return
+	}
+
+	start := time.Now()
+	resp, err := ollamaDo(req)
+	if err != nil && ctx.Err() != nil {
+		// Stopped before the reply began
+		redirect(w, r, "/", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		writeOllamaError(w, r, http.StatusInternalServerError, err)
 		log.Printf("Ollama API error: %v", err)
 		return
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "Error communicating with Ollama", http.StatusBadGateway)
+		log.Printf("Ollama API returned status %d", resp.StatusCode)
+		return
+	}
+
 	var assistantResponse strings.Builder
 
-	decoder := json.NewDecoder(resp.Body)
-	for {
-		var ollamaResp OllamaChatResponse
-		if err := decoder.Decode(&ollamaResp); err == io.EOF {
+	sc := newChunkScanner(resp.Body)
+	for sc.Next() {
+		if assistantResponse.Len() == 0 && sc.Chunk().Message.Content != "" {
+			recordTTFT(time.Since(start))
+		}
+		assistantResponse.WriteString(sc.Chunk().Message.Content)
+		if sc.Chunk().Done {
 			break
-		} else if err != nil {
-			http.Error(w, "Failed to parse response", http.StatusInternalServerError)
-			log.Printf("JSON decode error: %v", err)
-			return
 		}
+	}
+	// A stopped reply keeps what was generated
+	if err := sc.Err(); err != nil && ctx.Err() == nil {
+		http.Error(w, "Failed to parse response", http.StatusInternalServerError)
+		log.Printf("JSON decode error: %v", err)
+		return
+	}
 
-		assistantResponse.WriteString(ollamaResp.Message.Content)
+	// Store the raw markdown; it is rendered when the page is displayed
+	reply := assistantResponse.String()
 
-		if ollamaResp.Done {
-			break
-		}
+	// Only its size: the reply may be from an encrypted transcript
+	log.Printf("Assistant response: %d bytes for session %s", len(reply), sessionHash(sessionID))
+
+	if reply != "" {
+		sessionMut.Lock()
+		getSession(sessionID).appendTo(conv, assistantReply(ctx, reply))
+		sessionMut.Unlock()
 	}
 
-	cleanedResponse := cleanResponse(assistantResponse.String())
+	redirect(w, r, "/", http.StatusSeeOther)
+}
 
-	log.Printf("Cleaned Assistant Response: %s", cleanedResponse)
+// Answer a chat message with MCP tools available. Tool calls need the
+// whole reply, so this path does not stream.
+func chatWithTools(ctx context.Context, w http.ResponseWriter, r *http.Request, sessionID string, conv int, chatReq OllamaChatRequest) {
+	var run toolRunner
+	chatReq.Messages, run = toolChat(sessionID, chatReq.Messages)
+	reply, err := completeWithTools(ctx, chatReq, run)
+	if err != nil && ctx.Err() != nil {
+		redirect(w, r, "/", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		writeOllamaError(w, r, http.StatusBadGateway, err)
+		log.Printf("Ollama API error: %v", err)
+		return
+	}
 
 	sessionMut.Lock()
-	sessions[sessionID] = append(sessions[sessionID], Message{
-		Role:    "assistant",
-		Content: cleanedResponse,
-	})
+	getSession(sessionID).appendTo(conv, assistantReply(ctx, reply))
 	sessionMut.Unlock()
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-// Clean up the response content and unescape HTML entities
-func cleanResponse(content string) string {
-	content = strings.ReplaceAll(content, "<think>", "")
-	return string(blackfriday.Run([]byte(content)))
+	redirect(w, r, "/", http.StatusSeeOther)
 }
 
 // Recovery middleware to catch panics
@@ -175,20 +536,13 @@ func recoveryMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// Get or create session ID
+// Get the request's session ID, or start a session when its cookie is
+// missing or not accepted
 func getSessionID(w http.ResponseWriter, r *http.Request) string {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		sessionID := generateSessionID()
-		http.SetCookie(w, &http.Cookie{
-			Name:    "session_id",
-			Value:   sessionID,
-			Expires: time.Now().Add(24 * time.Hour),
-			Path:    "/",
-		})
-		return sessionID
-	}
-	return cookie.Value
+	if id, ok := cookieSessionID(r); ok {
+		return id
+	}
+	return newSession(w, r)
 }
 
 // Generate secure session ID
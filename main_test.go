@@ -0,0 +1,7137 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+
+	"deepseek-app/internal/chatpb"
+	"deepseek-app/internal/fakeollama"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testApp wires the real router to a fake Ollama upstream
+type testApp struct {
+	t      *testing.T
+	ollama *fakeollama.Server
+	server *httptest.Server
+	client *http.Client
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	if err := loadAssets(); err != nil {
+		t.Fatalf("loading assets: %v", err)
+	}
+	if err := loadTemplates(); err != nil {
+		t.Fatalf("loading templates: %v", err)
+	}
+	if err := loadVariablesKey(); err != nil {
+		t.Fatalf("loading variables key: %v", err)
+	}
+
+	fake := fakeollama.New()
+	oldURL := ollamaURL
+	ollamaURL = fake.URL
+	oldBackoff := ollamaClient.Backoff
+	ollamaClient.Backoff = time.Millisecond
+
+	sessionMut.Lock()
+	sessions = make(map[string]*session)
+	rotatedSessions = map[string]string{}
+	shareLinks = map[string]*session{}
+	sessionMut.Unlock()
+	logins = newMemoryLogins()
+
+	srv := httptest.NewServer(newRouter())
+	jar, _ := cookiejar.New(nil)
+
+	t.Cleanup(func() {
+		srv.Close()
+		fake.Close()
+		ollamaURL = oldURL
+		ollamaClient.Backoff = oldBackoff
+	})
+
+	return &testApp{
+		t:      t,
+		ollama: fake,
+		server: srv,
+		client: &http.Client{Jar: jar, Timeout: 5 * time.Second},
+	}
+}
+
+// chat posts a prompt and returns the final response after redirects
+func (a *testApp) chat(prompt string) (int, string) {
+	a.t.Helper()
+	resp, err := a.client.PostForm(a.server.URL+"/chat", url.Values{"prompt": {prompt}})
+	if err != nil {
+		a.t.Fatalf("POST /chat: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestChatStreamsReplyIntoHistory(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Hello", ", ", "world")
+
+	status, body := app.chat("hi there")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body: %s", status, body)
+	}
+	if !strings.Contains(body, "Hello, world") {
+		t.Errorf("rendered page missing assembled reply; body: %s", body)
+	}
+	if !strings.Contains(body, "hi there") {
+		t.Errorf("rendered page missing user prompt; body: %s", body)
+	}
+
+	reqs := app.ollama.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream got %d requests, want 1", len(reqs))
+	}
+	if !reqs[0].Stream {
+		t.Errorf("upstream request did not ask for streaming")
+	}
+	if got := reqs[0].Messages; len(got) != 1 || got[0].Role != "user" || got[0].Content != "hi there" {
+		t.Errorf("upstream messages = %+v", got)
+	}
+}
+
+func TestChatSendsFullHistory(t *testing.T) {
+	app := newTestApp(t)
+
+	app.chat("first")
+	app.chat("second")
+
+	reqs := app.ollama.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("upstream got %d requests, want 2", len(reqs))
+	}
+	msgs := reqs[1].Messages
+	if len(msgs) != 3 {
+		t.Fatalf("second request carried %d messages, want 3: %+v", len(msgs), msgs)
+	}
+	if msgs[0].Content != "first" || msgs[1].Role != "assistant" || msgs[2].Content != "second" {
+		t.Errorf("unexpected history order: %+v", msgs)
+	}
+}
+
+func TestHistoryEventLog(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("first")
+	app.chat("second")
+
+	post := func(form url.Values) int {
+		t.Helper()
+		resp, err := app.client.PostForm(app.server.URL+"/history", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	history := func() []string {
+		sessionMut.Lock()
+		defer sessionMut.Unlock()
+		var out []string
+		for _, s := range sessions {
+			for _, m := range s.History {
+				out = append(out, m.Content)
+			}
+		}
+		return out
+	}
+
+	// Messages 1-4: first, reply, second, reply
+	if code := post(url.Values{"action": {"edit"}, "id": {"1"}, "content": {"edited"}}); code != http.StatusOK {
+		t.Fatalf("edit status = %d", code)
+	}
+	if code := post(url.Values{"action": {"delete"}, "id": {"3"}}); code != http.StatusOK {
+		t.Fatalf("delete status = %d", code)
+	}
+	app.ollama.SetChunks("again")
+	if code := post(url.Values{"action": {"regenerate"}, "id": {"2"}}); code != http.StatusOK {
+		t.Fatalf("regenerate status = %d", code)
+	}
+	if reqs := app.ollama.Requests(); len(reqs[2].Messages) != 1 || reqs[2].Messages[0].Content != "edited" {
+		t.Errorf("regenerate sent %+v, want only the edited first message", reqs[2].Messages)
+	}
+	if got := strings.Join(history(), "|"); got != "edited|again|Hello from fake Ollama" {
+		t.Errorf("history = %q", got)
+	}
+
+	// Undo the regenerate, then the delete
+	post(url.Values{"action": {"undo"}})
+	post(url.Values{"action": {"undo"}})
+	if got := strings.Join(history(), "|"); got != "edited|Hello from fake Ollama|second|Hello from fake Ollama" {
+		t.Errorf("history after undo = %q", got)
+	}
+	if code := post(url.Values{"action": {"delete"}, "id": {"99"}}); code != http.StatusNotFound {
+		t.Errorf("deleting unknown message: status = %d, want 404", code)
+	}
+
+	resp, err := app.client.Get(app.server.URL + "/history/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var audit struct {
+		Events []MessageEvent `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&audit); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, ev := range audit.Events {
+		types = append(types, ev.Type)
+	}
+	want := "added added added added edited deleted regenerated undone undone"
+	if got := strings.Join(types, " "); got != want {
+		t.Errorf("event types = %q, want %q", got, want)
+	}
+	if last := audit.Events[len(audit.Events)-1]; last.Target != 6 {
+		t.Errorf("second undo reverted event %d, want 6", last.Target)
+	}
+}
+
+func TestRegenerateLastReply(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("first")
+	app.chat("second")
+
+	post := func(form url.Values) int {
+		t.Helper()
+		resp, err := app.client.PostForm(app.server.URL+"/chat/regenerate", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	app.ollama.SetChunks("cooler")
+	if code := post(url.Values{"model": {"other-model"}, "temperature": {"0.2"}}); code != http.StatusOK {
+		t.Fatalf("regenerate status = %d", code)
+	}
+	reqs := app.ollama.Requests()
+	last := reqs[len(reqs)-1]
+	if last.Model != "other-model" || last.Options["temperature"] != 0.2 || len(last.Messages) != 3 || last.Messages[2].Content != "second" {
+		t.Errorf("regenerate sent %s %v %+v", last.Model, last.Options, last.Messages)
+	}
+	sessionMut.Lock()
+	var history []string
+	for _, s := range sessions {
+		for _, m := range s.History {
+			history = append(history, m.Content)
+		}
+	}
+	sessionMut.Unlock()
+	if got := strings.Join(history, "|"); got != "first|Hello from fake Ollama|second|cooler" {
+		t.Errorf("history = %q", got)
+	}
+	if code := post(url.Values{"temperature": {"hot"}}); code != http.StatusBadRequest {
+		t.Errorf("bad temperature: status = %d", code)
+	}
+
+	// The JSON API regenerates the last reply when no ID is given
+	resp, err := app.client.Post(app.server.URL+"/api/v1/history", "application/json",
+		strings.NewReader(`{"action": "regenerate", "temperature": -1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative temperature: status = %d", resp.StatusCode)
+	}
+	if n := len(app.ollama.Requests()); n != len(reqs) {
+		t.Errorf("invalid regenerations reached Ollama: %d requests, want %d", n, len(reqs))
+	}
+}
+
+func TestResubmitUserMessage(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("first")
+	app.chat("second")
+	app.chat("third")
+
+	post := func(form url.Values) int {
+		t.Helper()
+		resp, err := app.client.PostForm(app.server.URL+"/history", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Messages 1-6: first, reply, second, reply, third, reply
+	app.ollama.SetChunks("rewritten")
+	if code := post(url.Values{"action": {"resubmit"}, "id": {"3"}, "content": {"second, rephrased"}}); code != http.StatusOK {
+		t.Fatalf("resubmit status = %d", code)
+	}
+	reqs := app.ollama.Requests()
+	if last := reqs[len(reqs)-1].Messages; len(last) != 3 || last[2].Content != "second, rephrased" {
+		t.Errorf("resubmit sent %+v", last)
+	}
+	sessionMut.Lock()
+	var history, types []string
+	for _, s := range sessions {
+		for _, m := range s.History {
+			history = append(history, m.Content)
+		}
+		for _, ev := range s.Events[6:] {
+			types = append(types, ev.Type)
+		}
+	}
+	sessionMut.Unlock()
+	if got := strings.Join(history, "|"); got != "first|Hello from fake Ollama|second, rephrased|rewritten" {
+		t.Errorf("history = %q", got)
+	}
+	if got := strings.Join(types, " "); got != "edited deleted deleted deleted added" {
+		t.Errorf("events = %q", got)
+	}
+	if code := post(url.Values{"action": {"resubmit"}, "id": {"2"}, "content": {"x"}}); code != http.StatusNotFound {
+		t.Errorf("resubmitting a reply: status = %d, want 404", code)
+	}
+}
+
+func TestConversations(t *testing.T) {
+	app := newTestApp(t)
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = db
+	defer func() {
+		store = memoryStore{}
+		db.Close()
+	}()
+
+	post := func(form url.Values) (int, string) {
+		t.Helper()
+		resp, err := app.client.PostForm(app.server.URL+"/conversations", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	only := func() *session {
+		for _, sess := range sessions {
+			return sess
+		}
+		return nil
+	}
+
+	app.ollama.SetChunks("about cats")
+	app.chat("cats?")
+	code, page := post(url.Values{"action": {"new"}, "title": {"  Work   stuff "}})
+	if code != http.StatusOK || strings.Contains(page, "cats?") || !strings.Contains(page, `<li class="active">`) {
+		t.Fatalf("new conversation: %d %s", code, page)
+	}
+	app.ollama.SetChunks("about work")
+	_, page = app.chat("work?")
+	if !strings.Contains(page, "Work stuff") || strings.Contains(page, "cats?") {
+		t.Errorf("second conversation page: %s", page)
+	}
+	// Each conversation's prompt carries only its own history
+	reqs := app.ollama.Requests()
+	if msgs := reqs[len(reqs)-1].Messages; len(msgs) != 1 || msgs[0].Content != "work?" {
+		t.Errorf("second conversation sent %+v", msgs)
+	}
+
+	// A reply finishing after a switch lands where it was asked
+	sessionMut.Lock()
+	sess := only()
+	sess.switchConversation(0)
+	sess.appendTo(1, Message{Role: "assistant", Content: "late reply"})
+	if len(sess.History) != 2 || sess.History[1].Content != "about cats" {
+		t.Errorf("history after switching back = %+v", sess.History)
+	}
+	// Undo only reaches the conversation shown
+	sess.undo()
+	if len(sess.History) != 1 {
+		t.Errorf("undo in the first conversation: %+v", sess.History)
+	}
+	sessionMut.Unlock()
+
+	post(url.Values{"action": {"rename"}, "id": {"0"}, "title": {"Pets"}})
+	if code, _ := post(url.Values{"action": {"rename"}, "id": {"0"}, "title": {"  "}}); code != http.StatusBadRequest {
+		t.Errorf("empty title: status %d", code)
+	}
+	if code, _ := post(url.Values{"action": {"switch"}, "id": {"7"}}); code != http.StatusNotFound {
+		t.Errorf("unknown conversation: status %d", code)
+	}
+
+	// A restart keeps the conversations and the one in use
+	sessionMut.Lock()
+	sessions = make(map[string]*session)
+	sessionMut.Unlock()
+	_, page = post(url.Values{"action": {"delete"}, "id": {"0"}})
+	sessionMut.Lock()
+	sess = only()
+	convs, active := sess.Conversations, sess.Active
+	history := sess.History
+	sessionMut.Unlock()
+	if len(convs) != 1 || convs[0].Title != "Work stuff" || active != 1 {
+		t.Errorf("after deleting the first: %+v, active %d", convs, active)
+	}
+	if len(history) != 3 || history[2].Content != "late reply" || !strings.Contains(page, "late reply") {
+		t.Errorf("history of the remaining conversation = %+v", history)
+	}
+
+	// Deleting the last one starts a fresh conversation
+	post(url.Values{"action": {"delete"}, "id": {"1"}})
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	if sess := only(); len(sess.Conversations) != 1 || sess.Active != 2 || len(sess.History) != 0 {
+		t.Errorf("after deleting every conversation: %+v, active %d", sess.Conversations, sess.Active)
+	}
+}
+
+func TestForkConversation(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("first")
+	app.chat("second")
+	history := func() (string, []Message, *session) {
+		sessionMut.Lock()
+		defer sessionMut.Unlock()
+		for _, s := range sessions {
+			var out []string
+			for _, m := range s.History {
+				out = append(out, m.Content)
+			}
+			return strings.Join(out, "|"), s.History, s
+		}
+		return "", nil, nil
+	}
+	_, original, sess := history()
+
+	// Messages 1-4: first, reply, second, reply
+	resp, err := app.client.PostForm(app.server.URL+"/history", url.Values{"action": {"fork"}, "id": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "Chat (fork)") {
+		t.Fatalf("fork: %d %s", resp.StatusCode, page)
+	}
+	app.ollama.SetChunks("another way")
+	app.chat("alternative")
+	if got, _, _ := history(); got != "first|Hello from fake Ollama|alternative|another way" {
+		t.Errorf("fork history = %q", got)
+	}
+	if reqs := app.ollama.Requests(); len(reqs[len(reqs)-1].Messages) != 3 {
+		t.Errorf("fork reply was asked with %+v", reqs[len(reqs)-1].Messages)
+	}
+	sessionMut.Lock()
+	times := messageTimes(sess.Events, sess.Active)
+	forkTime := times[sess.History[0].ID]
+	sessionMut.Unlock()
+	if !forkTime.Equal(messageTimes(sess.Events, 0)[original[0].ID]) {
+		t.Errorf("forked message time %v differs from the original's", forkTime)
+	}
+
+	app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"switch"}, "id": {"0"}})
+	if got, _, _ := history(); got != "first|Hello from fake Ollama|second|Hello from fake Ollama" {
+		t.Errorf("original history = %q", got)
+	}
+	resp, err = app.client.PostForm(app.server.URL+"/history", url.Values{"action": {"fork"}, "id": {"99"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("forking at an unknown message: status = %d", resp.StatusCode)
+	}
+}
+
+func TestConversationSystemPrompt(t *testing.T) {
+	app := newTestApp(t)
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte("system_prompt: Server default.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath = path
+	t.Cleanup(func() { configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{} })
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	system := func() []string {
+		t.Helper()
+		reqs := app.ollama.Requests()
+		var out []string
+		for _, m := range reqs[len(reqs)-1].Messages {
+			if m.Role == "system" {
+				out = append(out, m.Content)
+			}
+		}
+		return out
+	}
+
+	app.chat("hello")
+	if got := system(); !reflect.DeepEqual(got, []string{"Server default."}) {
+		t.Errorf("without a conversation prompt: %q", got)
+	}
+	resp, err := app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"prompt"}, "id": {"0"}, "system_prompt": {"  Answer in French. "}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), ">Answer in French.</textarea>") {
+		t.Errorf("prompt not shown on the page: %s", page)
+	}
+	app.chat("again")
+	if got := system(); !reflect.DeepEqual(got, []string{"Answer in French."}) {
+		t.Errorf("with a conversation prompt: %q", got)
+	}
+
+	// Forks keep the prompt; the JSON API lists and changes it
+	app.client.PostForm(app.server.URL+"/history", url.Values{"action": {"fork"}, "id": {"2"}})
+	api := func(body string) (int, []APIConversation) {
+		t.Helper()
+		var resp *http.Response
+		var err error
+		if body == "" {
+			resp, err = app.client.Get(app.server.URL + "/api/v1/conversations")
+		} else {
+			resp, err = app.client.Post(app.server.URL+"/api/v1/conversations", "application/json", strings.NewReader(body))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Conversations []APIConversation `json:"conversations"`
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.Conversations
+	}
+	if _, convs := api(""); len(convs) != 2 || convs[1].SystemPrompt != "Answer in French." || !convs[1].Active {
+		t.Errorf("conversations = %+v", convs)
+	}
+	if code, convs := api(`{"action": "prompt", "id": 1, "system_prompt": ""}`); code != http.StatusOK || convs[1].SystemPrompt != "" {
+		t.Errorf("clearing the prompt: %d %+v", code, convs)
+	}
+	app.chat("in the fork")
+	if got := system(); !reflect.DeepEqual(got, []string{"Server default."}) {
+		t.Errorf("after clearing: %q", got)
+	}
+	if code, _ := api(`{"action": "prompt", "id": 9, "system_prompt": "x"}`); code != http.StatusNotFound {
+		t.Errorf("unknown conversation: status %d", code)
+	}
+	if code, _ := api(`{"action": "prompt", "id": 0, "system_prompt": "` + strings.Repeat("x", maxSystemPrompt+1) + `"}`); code != http.StatusBadRequest {
+		t.Errorf("long prompt: status %d", code)
+	}
+}
+
+func TestConversationOptions(t *testing.T) {
+	app := newTestApp(t)
+	lastOptions := func() map[string]interface{} {
+		t.Helper()
+		reqs := app.ollama.Requests()
+		return reqs[len(reqs)-1].Options
+	}
+	post := func(form url.Values) (int, string) {
+		t.Helper()
+		resp, err := app.client.PostForm(app.server.URL+"/conversations", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		page, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(page)
+	}
+
+	app.chat("hello")
+	if opts := lastOptions(); len(opts) != 0 {
+		t.Errorf("options without overrides: %v", opts)
+	}
+	code, page := post(url.Values{"action": {"options"}, "id": {"0"}, "temperature": {"0.3"}, "top_k": {"40"}, "seed": {" 7 "}, "top_p": {""}})
+	if code != http.StatusOK || !strings.Contains(page, `name="top_k" value="40"`) || !strings.Contains(page, `name="top_p" value=""`) {
+		t.Errorf("options not shown on the page: %d %s", code, page)
+	}
+	app.chat("again")
+	if opts := lastOptions(); opts["temperature"] != 0.3 || opts["top_k"] != 40.0 || opts["seed"] != 7.0 || len(opts) != 3 {
+		t.Errorf("chat options = %v", opts)
+	}
+	// Renaming leaves the options alone, even with a blank form
+	post(url.Values{"action": {"rename"}, "id": {"0"}, "title": {"Tuned"}, "top_k": {"x"}})
+
+	for _, form := range []url.Values{
+		{"top_k": {"2.5"}},
+		{"top_p": {"1.5"}},
+		{"temperature": {"warm"}},
+	} {
+		form.Set("action", "options")
+		form.Set("id", "0")
+		if code, _ := post(form); code != http.StatusBadRequest {
+			t.Errorf("%v: status %d", form, code)
+		}
+	}
+
+	api := func(body string) (int, []APIConversation) {
+		t.Helper()
+		resp, err := app.client.Post(app.server.URL+"/api/v1/conversations", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Conversations []APIConversation `json:"conversations"`
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.Conversations
+	}
+	if code, convs := api(`{"action": "options", "id": 0, "options": {"num_predict": 64, "temperature": 0}}`); code != http.StatusOK ||
+		convs[0].Title != "Tuned" || !reflect.DeepEqual(convs[0].Options, map[string]interface{}{"num_predict": 64.0, "temperature": 0.0}) {
+		t.Errorf("setting options: %d %+v", code, convs)
+	}
+	if code, _ := api(`{"action": "options", "id": 0, "options": {"mirostat": 1}}`); code != http.StatusBadRequest {
+		t.Errorf("unknown option: status %d", code)
+	}
+	if code, _ := api(`{"action": "options", "id": 0, "options": {"seed": "7"}}`); code != http.StatusBadRequest {
+		t.Errorf("string option: status %d", code)
+	}
+
+	// A session chat's own options win over the conversation's
+	resp, err := app.client.Post(app.server.URL+"/api/v1/chat", "application/json",
+		strings.NewReader(`{"session": true, "messages": [{"role": "user", "content": "hi"}], "options": {"temperature": 0.9}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if opts := lastOptions(); opts["temperature"] != 0.9 || opts["num_predict"] != 64.0 {
+		t.Errorf("API chat options = %v", opts)
+	}
+
+	// Forks keep them; clearing leaves them to the model
+	app.client.PostForm(app.server.URL+"/history", url.Values{"action": {"fork"}, "id": {"2"}})
+	if code, convs := api(`{"action": "options", "id": 0}`); code != http.StatusOK || convs[0].Options != nil ||
+		!reflect.DeepEqual(convs[1].Options, map[string]interface{}{"num_predict": 64.0, "temperature": 0.0}) {
+		t.Errorf("after clearing: %d %+v", code, convs)
+	}
+}
+
+func TestSharedConversationFeed(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("**Summary** for today")
+	app.chat("summarise <today>")
+
+	resp, err := app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"share"}, "id": {"0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	m := regexp.MustCompile(`href="/shared/([A-Za-z0-9_-]+)"`).FindSubmatch(page)
+	if m == nil {
+		t.Fatalf("no share link on the page: %s", page)
+	}
+	link := app.server.URL + "/shared/" + string(m[1])
+
+	// Anyone with the link can read, without a session
+	get := func(url string) (int, string, string) {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+	}
+	if code, _, body := get(link); code != http.StatusOK || !strings.Contains(body, "<strong>Summary</strong>") || strings.Contains(body, `action="/chat"`) {
+		t.Errorf("shared page: %d %s", code, body)
+	}
+	code, typ, body := get(link + "/atom")
+	if code != http.StatusOK || typ != "application/atom+xml; charset=utf-8" {
+		t.Fatalf("feed: %d %s", code, typ)
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal([]byte(body), &feed); err != nil {
+		t.Fatalf("feed is not XML: %v\n%s", err, body)
+	}
+	if len(feed.Entries) != 2 || feed.Title != "Chat" || feed.ID != link || feed.Entries[0].ID != link+"#message-2" ||
+		feed.Entries[0].Content.Type != "html" || !strings.Contains(feed.Entries[0].Content.Body, "<strong>Summary</strong>") ||
+		feed.Entries[1].Content.Body != "summarise <today>" {
+		t.Errorf("feed = %+v", feed)
+	}
+	if _, err := time.Parse(time.RFC3339, feed.Updated); err != nil {
+		t.Errorf("feed updated %q: %v", feed.Updated, err)
+	}
+
+	app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"unshare"}, "id": {"0"}})
+	if code, _, _ := get(link + "/atom"); code != http.StatusNotFound {
+		t.Errorf("feed after unsharing: status %d", code)
+	}
+}
+
+func TestConversationExport(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Use **tabs**.")
+	app.chat("tabs or spaces?")
+	resp, err := app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"new"}, "title": {"Other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	app.chat("unrelated")
+
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := app.client.Get(app.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, md := get("/export/markdown?conversation=0")
+	if resp.Header.Get("Content-Disposition") != `attachment; filename="chat.md"` {
+		t.Errorf("Content-Disposition = %q", resp.Header.Get("Content-Disposition"))
+	}
+	for _, want := range []string{"# Chat\n", "## User\n\ntabs or spaces?\n", "## Assistant\n\nUse **tabs**.\n"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("markdown missing %q:\n%s", want, md)
+		}
+	}
+	if strings.Contains(md, "unrelated") {
+		t.Errorf("markdown includes another conversation:\n%s", md)
+	}
+
+	// Without a conversation, the active one
+	resp, body := get("/export/json")
+	var export ConversationExport
+	if err := json.Unmarshal([]byte(body), &export); err != nil {
+		t.Fatalf("json export: %v: %s", err, body)
+	}
+	if export.Title != "Other" || len(export.Messages) != 2 || export.Messages[0].Content != "unrelated" || export.Messages[1].Role != "assistant" {
+		t.Errorf("json export = %+v", export)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+
+	if resp, _ := get("/export/json?conversation=9"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown conversation: status %d", resp.StatusCode)
+	}
+}
+
+func TestPlainTextExport(t *testing.T) {
+	md := "<think>pondering</think>\n\n# Plan\n\nUse **tabs**, not _spaces_; see [the guide](https://example.com/g) or <https://go.dev>.\n" +
+		"Wrapped line, `x := 1` \\*literal\\*.\n\n" +
+		"1. First\n2. Second\n   - nested\n\n- [x] done\n\n> quoted\n\n```go\nfunc main() {}\n```\n\n" +
+		"| A | B |\n|---|---|\n| 1 | **2** |\n\n---\n\nThe end &amp; more."
+	want := "pondering\n\nPlan\n\nUse tabs, not spaces; see the guide (https://example.com/g) or https://go.dev. " +
+		"Wrapped line, x := 1 *literal*.\n\n1. First\n2. Second\n   - nested\n\n- [x] done\n\n> quoted\n\n" +
+		"    func main() {}\n\nA | B\n1 | 2\n\nThe end & more."
+	if got := plainText(md); got != want {
+		t.Errorf("plainText:\n%s\nwant:\n%s", got, want)
+	}
+
+	app := newTestApp(t)
+	app.ollama.SetChunks("Use **tabs**.\n\n- always")
+	app.chat("tabs or **spaces**?")
+	resp, err := app.client.Get(app.server.URL + "/export?format=text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := string(body); got != "Chat\n\nUser: tabs or **spaces**?\n\nAssistant:\nUse tabs.\n\n- always\n" {
+		t.Errorf("text export = %q", got)
+	}
+	if resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" || resp.Header.Get("Content-Disposition") != `inline; filename="chat.txt"` {
+		t.Errorf("headers = %v", resp.Header)
+	}
+}
+
+func TestOllamaHandoffExport(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks(`Say "hi".`)
+	app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"prompt"}, "id": {"0"}, "system_prompt": {"Be brief."}})
+	app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"options"}, "id": {"0"}, "temperature": {"0.5"}})
+	app.chat("greeting?")
+
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := app.client.Get(app.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, modelfile := get("/export/modelfile")
+	want := "FROM " + defaultModel + "\nPARAMETER temperature 0.5\nSYSTEM \"\"\"Be brief.\"\"\"\n" +
+		"MESSAGE user \"\"\"greeting?\"\"\"\nMESSAGE assistant \"\"\"Say \\\"hi\\\".\"\"\"\n"
+	if modelfile != want {
+		t.Errorf("modelfile:\n%s\nwant:\n%s", modelfile, want)
+	}
+	if resp.Header.Get("Content-Disposition") != `attachment; filename="chat.Modelfile"` {
+		t.Errorf("Content-Disposition = %q", resp.Header.Get("Content-Disposition"))
+	}
+
+	_, script := get("/export?format=ollama")
+	for _, want := range []string{"cat > handoff-chat.Modelfile <<'MODELFILE'\n" + modelfile + "MODELFILE\n",
+		"ollama create handoff-chat -f handoff-chat.Modelfile && ollama run handoff-chat\n"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+}
+
+func TestSiteExport(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Use **tabs**.")
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	resp, err := app.client.Post(app.server.URL+"/api/v1/chat", "application/json",
+		strings.NewReader(`{"session": true, "messages": [{"role": "user", "content": "<b>tabs</b> or spaces?", "images": ["`+png+`", "bm90IGFuIGltYWdl"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"new"}, "title": {"Other / notes"}})
+	app.chat("unrelated")
+	app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"new"}, "title": {"Left out"}})
+
+	export := func(query string) (int, map[string]string) {
+		t.Helper()
+		resp, err := app.client.Get(app.server.URL + "/export/site" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatalf("not a zip: %v", err)
+		}
+		files := make(map[string]string)
+		for _, f := range zr.File {
+			rc, _ := f.Open()
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			files[f.Name] = string(b)
+		}
+		return resp.StatusCode, files
+	}
+
+	_, files := export("?conversation=1&conversation=0")
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"0-chat.html", "1-other-notes.html", "assets/images/0-1-0.png", "assets/style.css", "index.html"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("bundle files = %q, want %q", names, want)
+	}
+	index := files["index.html"]
+	if !strings.Contains(index, `href="1-other-notes.html"`) || strings.Index(index, "Other / notes") > strings.Index(index, ">Chat<") ||
+		strings.Contains(index, "Left out") {
+		t.Errorf("index.html:\n%s", index)
+	}
+	page := files["0-chat.html"]
+	for _, want := range []string{`href="assets/style.css"`, "&lt;b&gt;tabs&lt;/b&gt; or spaces?", "<strong>tabs</strong>",
+		`src="assets/images/0-1-0.png"`, `href="index.html"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("conversation page missing %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "<script") || strings.Contains(page, "unrelated") {
+		t.Errorf("conversation page:\n%s", page)
+	}
+
+	// Without a choice, every conversation
+	if _, files := export(""); files["2-left-out.html"] == "" || len(files) != 6 {
+		t.Errorf("full export has %d files", len(files))
+	}
+	if code, _ := export("?conversation=9"); code != http.StatusNotFound {
+		t.Errorf("unknown conversation: status %d", code)
+	}
+}
+
+func TestPrintAndPDFExport(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Use **tabs**.")
+	app.chat("<i>tabs</i> or spaces?")
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := app.client.Get(app.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, page := get("/export/print")
+	for _, want := range []string{"<h1>Chat</h1>", "@page", "&lt;i&gt;tabs&lt;/i&gt; or spaces?", "<strong>tabs</strong>"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("print page missing %q:\n%s", want, page)
+		}
+	}
+	if resp.Header.Get("Content-Type") != "text/html; charset=utf-8" || strings.Contains(page, "<script") {
+		t.Errorf("print page %q:\n%s", resp.Header.Get("Content-Type"), page)
+	}
+	if resp, md := get("/export?format=markdown&conversation=0"); resp.StatusCode != http.StatusOK || !strings.Contains(md, "## Assistant") {
+		t.Errorf("format=markdown: %d %s", resp.StatusCode, md)
+	}
+	if resp, _ := get("/export?format=docx"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d", resp.StatusCode)
+	}
+
+	if resp, _ := get("/export?format=pdf"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("PDF without a converter: status %d", resp.StatusCode)
+	}
+	// cat stands in for the converter: the PDF is the page it was given
+	pdfCommand = "cat"
+	t.Cleanup(func() { pdfCommand = "" })
+	resp, pdf := get("/export/pdf?conversation=0")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/pdf" ||
+		resp.Header.Get("Content-Disposition") != `attachment; filename="chat.pdf"` || !strings.Contains(pdf, "<strong>tabs</strong>") {
+		t.Errorf("PDF export: %d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), resp.Header.Get("Content-Disposition"))
+	}
+	if _, home := get("/"); !strings.Contains(home, `href="/export/pdf?conversation=0"`) {
+		t.Error("no PDF link on the page")
+	}
+	pdfCommand = "false"
+	if resp, _ := get("/export/pdf"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("failing converter: status %d", resp.StatusCode)
+	}
+}
+
+func TestConversationImport(t *testing.T) {
+	app := newTestApp(t)
+	upload := func(file string) int {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "conversations.json")
+		part.Write([]byte(file))
+		mw.Close()
+		resp, err := app.client.Post(app.server.URL+"/import", mw.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// ChatGPT's export: take the branch ending at current_node, without the
+	// hidden system message or the abandoned first answer
+	chatGPT := `[{"title": "Empty", "create_time": 1, "mapping": {}},
+	{"title": "Trip plans", "create_time": 1700000000, "current_node": "c",
+	 "mapping": {
+	  "root": {"parent": "", "message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": [""]}, "metadata": {"is_visually_hidden_from_conversation": true}}},
+	  "q": {"parent": "root", "message": {"author": {"role": "user"}, "create_time": 1700000000.5, "content": {"content_type": "text", "parts": ["Where to in May?"]}}},
+	  "a": {"parent": "q", "message": {"author": {"role": "assistant"}, "create_time": 1700000001, "content": {"content_type": "text", "parts": ["Lisbon."]}}},
+	  "c": {"parent": "q", "message": {"author": {"role": "assistant"}, "create_time": 1700000002, "content": {"content_type": "text", "parts": ["Porto."]}}}}}]`
+	if code := upload(chatGPT); code != http.StatusOK {
+		t.Fatalf("ChatGPT import: status %d", code)
+	}
+	sessionMut.Lock()
+	var sess *session
+	for _, s := range sessions {
+		sess = s
+	}
+	convs, history := sess.Conversations, sess.History
+	added := sess.Events[len(sess.Events)-2]
+	sessionMut.Unlock()
+	if len(convs) != 2 || convs[1].Title != "Trip plans" {
+		t.Errorf("conversations = %+v", convs)
+	}
+	if len(history) != 2 || history[0].Content != "Where to in May?" || history[1].Content != "Porto." {
+		t.Errorf("imported history = %+v", history)
+	}
+	if want := time.Unix(1700000000, 5e8); !added.Time.Equal(want) {
+		t.Errorf("imported message time = %v, want %v", added.Time, want)
+	}
+
+	// This app's own export goes back in as it came out
+	resp, err := app.client.Get(app.server.URL + "/export/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if code := upload(string(exported)); code != http.StatusOK {
+		t.Fatalf("re-import: status %d", code)
+	}
+	sessionMut.Lock()
+	convs, history = sess.Conversations, sess.History
+	sessionMut.Unlock()
+	if len(convs) != 3 || convs[2].Title != "Trip plans" || len(history) != 2 || history[1].Content != "Porto." {
+		t.Errorf("after re-import: %+v %+v", convs, history)
+	}
+
+	for _, bad := range []string{`{"title": "x"}`, `{"messages": [{"role": "narrator", "content": "hi"}]}`, `not json`} {
+		if code := upload(bad); code != http.StatusBadRequest {
+			t.Errorf("import of %s: status %d", bad, code)
+		}
+	}
+
+	// The export archive as ChatGPT sends it, with an uploaded image beside
+	// conversations.json, through the JSON API
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for name, data := range map[string]string{
+		"chat.html":                 "<html></html>",
+		"file-Pic1-photo.png":       string(png),
+		"export/conversations.json": `[{"title": "Photo", "create_time": 1690000000, "current_node": "q", "mapping": {"q": {"parent": "", "message": {"author": {"role": "user"}, "create_time": 1690000005, "content": {"content_type": "multimodal_text", "parts": [{"content_type": "image_asset_pointer", "asset_pointer": "file-service://file-Pic1"}, {"content_type": "image_asset_pointer", "asset_pointer": "file-service://file-Missing"}, "What is this?"]}}}}}]`,
+	} {
+		f, _ := zw.Create(name)
+		f.Write([]byte(data))
+	}
+	zw.Close()
+	resp, err = app.client.Post(app.server.URL+"/api/v1/import", "application/zip", &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Imported      []int             `json:"imported"`
+		Conversations []APIConversation `json:"conversations"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(out.Imported) != 1 || len(out.Conversations) != 4 || out.Conversations[3].Title != "Photo" {
+		t.Fatalf("archive import: %d %+v", resp.StatusCode, out)
+	}
+	sessionMut.Lock()
+	history = sess.History
+	var created time.Time
+	for _, ev := range sess.Events {
+		if ev.Type == EventConversationCreated && ev.Conversation == out.Imported[0] {
+			created = ev.Time
+		}
+	}
+	sessionMut.Unlock()
+	if len(history) != 1 || history[0].Content != "What is this?" || len(history[0].Images) != 1 ||
+		history[0].Images[0] != base64.StdEncoding.EncodeToString(png) {
+		t.Errorf("archive history = %+v", history)
+	}
+	if !created.Equal(time.Unix(1690000000, 0)) {
+		t.Errorf("conversation created %v", created)
+	}
+
+	var empty bytes.Buffer
+	zw = zip.NewWriter(&empty)
+	zw.Create("chat.html")
+	zw.Close()
+	if code := upload(empty.String()); code != http.StatusBadRequest {
+		t.Errorf("archive without conversations.json: status %d", code)
+	}
+}
+
+func TestWebUIImport(t *testing.T) {
+	app := newTestApp(t)
+	post := func(data []byte) []APIConversation {
+		t.Helper()
+		resp, err := app.client.Post(app.server.URL+"/api/v1/import", "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Conversations []APIConversation `json:"conversations"`
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("import: status %d", resp.StatusCode)
+		}
+		return out.Conversations
+	}
+	history := func() []Message {
+		sessionMut.Lock()
+		defer sessionMut.Unlock()
+		for _, s := range sessions {
+			return s.History
+		}
+		return nil
+	}
+
+	// Open WebUI's "export chats": the branch ending at currentId is kept,
+	// without the regenerated answer, and images come from data URLs
+	webUI := `[{"id": "1", "title": "Colours", "created_at": 1710000000, "chat": {"title": "Colours", "history": {"currentId": "a2", "messages": {
+	  "q": {"id": "q", "parentId": null, "role": "user", "content": "What colour is this?", "timestamp": 1710000001, "files": [{"type": "image", "url": "data:image/png;base64,iVBORw0KGgo="}]},
+	  "a1": {"id": "a1", "parentId": "q", "role": "assistant", "content": "Red.", "timestamp": 1710000002},
+	  "a2": {"id": "a2", "parentId": "q", "role": "assistant", "content": "Blue.", "timestamp": 1710000003}}}}}]`
+	convs := post([]byte(webUI))
+	if len(convs) != 2 || convs[1].Title != "Colours" {
+		t.Errorf("conversations = %+v", convs)
+	}
+	if h := history(); len(h) != 2 || h[0].Content != "What colour is this?" || len(h[0].Images) != 1 ||
+		h[0].Images[0] != "iVBORw0KGgo=" || h[1].Content != "Blue." {
+		t.Errorf("Open WebUI history = %+v", h)
+	}
+
+	// ollama-webui exported the chat alone, with millisecond timestamps
+	old := `{"title": "Old", "timestamp": 1700000000000, "history": {"messages": {}}, "messages": [
+	  {"id": "x", "role": "user", "content": "hello"}, {"id": "y", "parentId": "x", "role": "assistant", "content": "hi"}]}`
+	if convs := post([]byte(old)); len(convs) != 3 || convs[2].Title != "Old" {
+		t.Errorf("ollama-webui import: %+v", convs)
+	}
+
+	// webui.db itself, with its chats and prompts
+	path := filepath.Join(t.TempDir(), "webui.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE chat (id TEXT, user_id TEXT, title TEXT, chat TEXT, created_at INTEGER, updated_at INTEGER)`,
+		`INSERT INTO chat VALUES ('2', 'u', 'Later', '{"history": {"currentId": "m", "messages": {"m": {"id": "m", "role": "user", "content": "second"}}}}', 1720000000, 0)`,
+		`INSERT INTO chat VALUES ('1', 'u', 'Earlier', '{"history": {"currentId": "m", "messages": {"m": {"id": "m", "role": "user", "content": "first"}}}}', 1715000000, 0)`,
+		`CREATE TABLE prompt (command TEXT, user_id TEXT, title TEXT, content TEXT, timestamp INTEGER)`,
+		`INSERT INTO prompt VALUES ('/Translate', 'u', 'Translate', 'Translate into {{language | select:options=["fr","de"]}}: {{CLIPBOARD}}', 0)`,
+		`INSERT INTO prompt VALUES ('/broken', 'u', 'Broken', 'Uses {{ "unclosed }}', 0)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if convs := post(data); len(convs) != 5 || convs[3].Title != "Earlier" || convs[4].Title != "Later" {
+		t.Errorf("database import: %+v", convs)
+	}
+	if h := history(); len(h) != 1 || h[0].Content != "second" {
+		t.Errorf("database history = %+v", h)
+	}
+
+	oldDir := promptDir
+	defer func() {
+		promptDir = oldDir
+		loadPromptTemplates()
+	}()
+	dir := t.TempDir()
+	if err := runPromptsImport([]string{"-dir", dir, path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadPromptTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	pt, ok := promptTemplates["translate"]
+	if !ok || len(promptTemplates) != 1 {
+		t.Fatalf("imported prompts = %v", promptTemplates)
+	}
+	if got, err := pt.Render(map[string]string{"language": "fr", "CLIPBOARD": "hello"}); err != nil || got != "Translate into fr: hello" {
+		t.Errorf("Render = %q, %v", got, err)
+	}
+	// A second import leaves the template alone
+	os.WriteFile(filepath.Join(dir, "translate.yaml"), []byte("template: mine\n"), 0o644)
+	runPromptsImport([]string{"-dir", dir, path})
+	if b, _ := os.ReadFile(filepath.Join(dir, "translate.yaml")); string(b) != "template: mine\n" {
+		t.Errorf("existing template overwritten: %s", b)
+	}
+}
+
+func TestSQLiteSessionStore(t *testing.T) {
+	app := newTestApp(t)
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = db
+	defer func() {
+		store = memoryStore{}
+		db.Close()
+	}()
+
+	app.ollama.SetChunks("first reply")
+	app.chat("first")
+	app.ollama.SetChunks("second reply")
+	app.chat("second")
+	var sessionID string
+	sessionMut.Lock()
+	for id, sess := range sessions {
+		sessionID = id
+		sess.editMessage(sess.History[0].ID, "first, edited")
+		sess.regenerateMessage(sess.History[3].ID, Message{Role: "assistant", Content: "<think>why</think>second, again",
+			Backend: "api.example.com", Cost: 0.002})
+	}
+	// A restart: nothing is left in memory
+	sessions = make(map[string]*session)
+	sessionMut.Unlock()
+
+	_, body := app.chat("third")
+	for _, want := range []string{"first, edited", "first reply", "second, again", "third"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page after reload is missing %q", want)
+		}
+	}
+	sessionMut.Lock()
+	history := getSession(sessionID).History
+	sessionMut.Unlock()
+	if len(history) != 6 || history[4].ID != 5 || history[5].ID != 6 {
+		t.Errorf("message IDs after reload: %+v", history)
+	}
+	if len(history) > 3 && (history[3].Reasoning != "why" || history[3].Backend != "api.example.com" || history[3].Cost != 0.002) {
+		t.Errorf("regenerated reasoning, backend and cost after reload: %+v", history[3])
+	}
+
+	reapSessions(time.Now().Add(time.Minute))
+	if _, _, ok, err := db.Load(sessionID); ok || err != nil {
+		t.Errorf("expired session still stored (err %v)", err)
+	}
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	if len(sessions) != 0 {
+		t.Errorf("%d sessions left in memory after expiry", len(sessions))
+	}
+}
+
+func TestIdleSessionEviction(t *testing.T) {
+	app := newTestApp(t)
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = db
+	defer func() {
+		store, discardIdleSessions = memoryStore{}, false
+		db.Close()
+	}()
+
+	app.ollama.SetChunks("kept reply")
+	app.chat("kept")
+	var sessionID string
+	sessionMut.Lock()
+	for id := range sessions {
+		sessionID = id
+	}
+	sessionMut.Unlock()
+
+	// Recently used sessions stay, however long ago their chat changed
+	sessionMut.Lock()
+	sessions[sessionID].LastActive = time.Now().Add(-time.Hour)
+	sessionMut.Unlock()
+	if n := evictIdleSessions(time.Now().Add(-time.Minute)); n != 0 {
+		t.Errorf("evicted %d sessions in use", n)
+	}
+
+	// Evicted, the chat is kept in the store and comes back
+	if n := evictIdleSessions(time.Now().Add(time.Minute)); n != 1 {
+		t.Fatalf("evicted %d sessions, want 1", n)
+	}
+	if _, body := app.chat("again"); !strings.Contains(body, "kept reply") {
+		t.Errorf("evicted session's chat did not come back:\n%s", body)
+	}
+
+	// Discarded, it is gone from the store as well
+	discardIdleSessions = true
+	if n := evictIdleSessions(time.Now().Add(time.Minute)); n != 1 {
+		t.Fatalf("evicted %d sessions, want 1", n)
+	}
+	if _, _, ok, err := db.Load(sessionID); ok || err != nil {
+		t.Errorf("discarded session still stored (err %v)", err)
+	}
+}
+
+func TestSessionCaps(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("reply")
+	defer func() { maxSessions, maxMessages, sessionMessageLimit = 0, 0, 0 }()
+	before := sessionMemory()
+
+	// Past the session cap the least recently used go
+	maxSessions = 2
+	visit := func() *http.Cookie {
+		resp, err := http.Get(app.server.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Cookies()[0]
+	}
+	// Evictions happen in the background, once the caps are checked
+	u, _ := url.Parse(app.server.URL)
+	chatting := func() string {
+		for _, c := range app.client.Jar.Cookies(u) {
+			if c.Name == sessionCookieName("") {
+				return c.Value
+			}
+		}
+		return ""
+	}
+	settled := func() (n int, kept bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for capsEnforcing.Load() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		sessionMut.Lock()
+		defer sessionMut.Unlock()
+		_, kept = sessions[chatting()]
+		return len(sessions), kept
+	}
+	first := visit()
+	time.Sleep(time.Millisecond)
+	visit()
+	time.Sleep(time.Millisecond)
+	visit()
+	settled()
+	sessionMut.Lock()
+	_, kept := sessions[first.Value]
+	n := len(sessions)
+	sessionMut.Unlock()
+	if kept || n != 2 {
+		t.Errorf("after three sessions with a cap of two: %d in memory, first kept %v", n, kept)
+	}
+
+	// Past the message cap too, the chatting session staying
+	maxSessions, maxMessages = 0, 3
+	app.chat("one")
+	app.chat("two")
+	if n, kept := settled(); n != 1 || !kept {
+		t.Errorf("%d sessions in memory over the message cap, want the chatting one", n)
+	}
+
+	// A full session takes no more prompts, whichever way they come
+	maxMessages, sessionMessageLimit = 0, 4
+	if code, _ := app.chat("three"); code != http.StatusInsufficientStorage {
+		t.Errorf("prompt to a full session: status %d", code)
+	}
+	header := http.Header{"Origin": {app.server.URL}}
+	for _, c := range app.client.Jar.Cookies(u) {
+		header.Add("Cookie", c.String())
+	}
+	conn, wsResp, err := websocket.DefaultDialer.Dial("ws://"+u.Host+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsResp.Body.Close()
+	conn.WriteJSON(ChatFrame{Type: "prompt", Text: "three"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame ChatFrame
+	if err := conn.ReadJSON(&frame); err != nil || frame.Type != "error" || !strings.Contains(frame.Error, "most allowed") {
+		t.Errorf("socket prompt to a full session: %+v, %v", frame, err)
+	}
+	conn.Close()
+	resp, err := app.client.Post(app.server.URL+"/api/v1/import", "application/json",
+		strings.NewReader(`{"title": "Imported", "messages": [{"role": "user", "content": "hi"}, {"role": "assistant", "content": "hello"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("import into a full session: status %d", resp.StatusCode)
+	}
+	sessionMut.Lock()
+	held := getSession(chatting()).messageCount()
+	sessionMut.Unlock()
+	if held != 4 {
+		t.Errorf("full session holds %d messages, want 4", held)
+	}
+
+	m := sessionMemory()
+	if m.EvictedLRU-before.EvictedLRU != 3 || m.Refused-before.Refused != 3 {
+		t.Errorf("memory stats = %+v, before %+v", m, before)
+	}
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	app := newTestApp(t)
+	mr := miniredis.RunT(t)
+	rs, err := openSessionStore("redis://" + mr.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = rs
+	defer func() {
+		store = memoryStore{}
+		rs.Close()
+	}()
+
+	app.ollama.SetChunks("first reply")
+	app.chat("first")
+	var sessionID string
+	sessionMut.Lock()
+	for id := range sessions {
+		sessionID = id
+	}
+	sessionMut.Unlock()
+	eventsKey, activeKey := redisKeys(sessionID)
+	if ttl := mr.TTL(activeKey); ttl != sessionLifetime {
+		t.Errorf("TTL = %v, want %v", ttl, sessionLifetime)
+	}
+
+	// Another instance answers the next message
+	other, err := openRedisStore("redis://" + mr.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{Role: "user", Content: "asked elsewhere"}
+	if err := other.Append(sessionID, MessageEvent{Seq: 3, Type: EventAdded, Time: time.Now(), MessageID: 3, Message: &msg}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// The write is announced, rather than looked for on every request
+	stale := func() bool {
+		sessionMut.Lock()
+		defer sessionMut.Unlock()
+		return sessions[sessionID].stale
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !stale() {
+		if time.Now().After(deadline) {
+			t.Fatal("the other instance's write was never announced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Sharing this process, it would mark the session for this instance's writes
+	other.Close()
+	app.ollama.SetChunks("answered here")
+	_, body := app.chat("and here")
+	for _, want := range []string{"first reply", "asked elsewhere", "answered here"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page is missing %q", want)
+		}
+	}
+	storeWrites.flush()
+	if n, _ := mr.List(eventsKey); len(n) != 5 {
+		t.Errorf("stored %d events, want 5", len(n))
+	}
+
+	// Nothing changed elsewhere: the cached session is used as it is
+	commands := mr.CommandCount()
+	resp, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := mr.CommandCount() - commands; n != 0 {
+		t.Errorf("loading the page sent %d Redis commands", n)
+	}
+
+	mr.FastForward(sessionLifetime + time.Second)
+	if _, _, ok, err := rs.Load(sessionID); ok || err != nil {
+		t.Errorf("session survived its TTL (err %v)", err)
+	}
+}
+
+func TestEncryptedTranscript(t *testing.T) {
+	app := newTestApp(t)
+	dir := t.TempDir()
+	db, err := openSQLiteStore(filepath.Join(dir, "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = db
+	defer func() {
+		store = memoryStore{}
+		db.Close()
+	}()
+
+	app.ollama.SetChunks("the secret plan")
+	app.chat("tell me the plan")
+	privacy := func(form url.Values) int {
+		resp, err := app.client.PostForm(app.server.URL+"/privacy", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := privacy(url.Values{"action": {"encrypt"}, "passphrase": {"short"}, "confirm": {"short"}}); code != http.StatusBadRequest {
+		t.Errorf("short passphrase: status %d", code)
+	}
+	if code := privacy(url.Values{"action": {"encrypt"}, "passphrase": {"correct horse"}, "confirm": {"correct horse"}}); code != http.StatusOK {
+		t.Fatalf("encrypt: status %d", code)
+	}
+
+	// Unlocked in this browser, the chat carries on as before
+	app.ollama.SetChunks("step two")
+	if _, body := app.chat("and then?"); !strings.Contains(body, "the secret plan") || !strings.Contains(body, "step two") {
+		t.Errorf("unlocked page is missing the chat: %s", body)
+	}
+
+	// Between requests the server holds nothing readable
+	var sessionID string
+	sessionMut.Lock()
+	for id, sess := range sessions {
+		sessionID = id
+		if len(sess.History) != 0 || sess.Transcript.key != nil {
+			t.Errorf("plaintext kept after the request: %+v", sess.History)
+		}
+	}
+	sessions = make(map[string]*session)
+	sessionMut.Unlock()
+	raw, _ := os.ReadFile(filepath.Join(dir, "sessions.db"))
+	for _, secret := range []string{"secret plan", "step two", "and then"} {
+		if bytes.Contains(raw, []byte(secret)) {
+			t.Errorf("store holds %q in plain text", secret)
+		}
+	}
+
+	// Without the key the chat is locked
+	if code := privacy(url.Values{"action": {"lock"}}); code != http.StatusOK {
+		t.Errorf("lock: status %d", code)
+	}
+	resp, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/privacy" {
+		t.Errorf("locked chat went to %s, want /privacy", resp.Request.URL.Path)
+	}
+	if code := privacy(url.Values{"action": {"unlock"}, "passphrase": {"wrong horse"}}); code != http.StatusBadRequest {
+		t.Errorf("wrong passphrase: status %d", code)
+	}
+	if code := privacy(url.Values{"action": {"unlock"}, "passphrase": {"correct horse"}}); code != http.StatusOK {
+		t.Errorf("unlock: status %d", code)
+	}
+
+	app.ollama.SetChunks("step three")
+	_, body := app.chat("last step?")
+	for _, want := range []string{"tell me the plan", "step two", "step three"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page after unlock is missing %q", want)
+		}
+	}
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	// Locking and unlocking gave the session new IDs
+	if _, ok := sessions[sessionID]; ok || len(sessions) != 1 {
+		t.Errorf("session ID not rotated: %d sessions, old ID kept %v", len(sessions), ok)
+	}
+}
+
+func TestSessionFixation(t *testing.T) {
+	app := newTestApp(t)
+	u, _ := url.Parse(app.server.URL)
+	sessionCookie := func() string {
+		for _, c := range app.client.Jar.Cookies(u) {
+			if c.Name == "session_id" {
+				return c.Value
+			}
+		}
+		return ""
+	}
+	get := func(userAgent string) {
+		req, _ := http.NewRequest(http.MethodGet, app.server.URL+"/", nil)
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := app.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// An ID the server never issued is replaced, not adopted
+	app.client.Jar.SetCookies(u, []*http.Cookie{{Name: "session_id", Value: "sess-planted"}})
+	app.chat("hello")
+	issued := sessionCookie()
+	if issued == "sess-planted" || issued == "" {
+		t.Fatalf("planted session ID was accepted: %q", issued)
+	}
+	sessionMut.Lock()
+	_, planted := sessions["sess-planted"]
+	sessionMut.Unlock()
+	if planted {
+		t.Error("a session was created under the planted ID")
+	}
+
+	// Encrypting rotates the ID; the old one no longer reaches the chat
+	resp, err := app.client.PostForm(app.server.URL+"/privacy", url.Values{
+		"action": {"encrypt"}, "passphrase": {"correct horse"}, "confirm": {"correct horse"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	rotated := sessionCookie()
+	if rotated == issued {
+		t.Fatal("session ID not rotated on encrypt")
+	}
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	req, _ := http.NewRequest(http.MethodGet, app.server.URL+"/", nil)
+	req.AddCookie(&http.Cookie{Name: "session_id", Value: issued})
+	resp, err = noRedirect.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if cookies := resp.Cookies(); len(cookies) == 0 || cookies[0].Name != "session_id" || cookies[0].Value == issued {
+		t.Errorf("old session ID still accepted; status %d, cookies %v", resp.StatusCode, cookies)
+	}
+
+	// The old ID is forgotten once its session leaves memory
+	sessionMut.Lock()
+	moved := rotatedSessions[issued]
+	sessionMut.Unlock()
+	if moved != rotated {
+		t.Errorf("old ID leads to %q, want %q", moved, rotated)
+	}
+	evictIdleSessions(time.Now().Add(time.Minute))
+	sessionMut.Lock()
+	left := len(rotatedSessions)
+	sessionMut.Unlock()
+	if left != 0 {
+		t.Errorf("%d rotated IDs kept after their session was evicted", left)
+	}
+
+	// Bound sessions refuse a cookie from another User-Agent
+	bindSessionUA = true
+	defer func() { bindSessionUA = false }()
+	app.client.Jar.SetCookies(u, []*http.Cookie{{Name: "session_id", Value: "", MaxAge: -1}})
+	get("browser-a")
+	bound := sessionCookie()
+	get("browser-a")
+	if sessionCookie() != bound {
+		t.Error("same User-Agent was given a new session")
+	}
+	get("browser-b")
+	if sessionCookie() == bound {
+		t.Error("cookie accepted from a different User-Agent")
+	}
+}
+
+func TestRenderers(t *testing.T) {
+	const doc = "# Plan\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n- [x] done\n\nSee<b>this</b>[^1].\n\n[^1]: A note.\n"
+	for _, tc := range []struct {
+		name       string
+		want, skip []string
+	}{
+		{"", []string{"<h1>Plan</h1>", "<table>", "<td>1</td>"}, []string{"# Plan"}},
+		{"blackfriday", []string{"<h1>Plan</h1>", "<table>", "<td>1</td>"}, []string{"# Plan"}},
+		{"goldmark", []string{"<h1>Plan</h1>", "<table>", "<td>1</td>", `<input checked="" disabled="" type="checkbox"`, `class="footnotes"`},
+			[]string{"# Plan", "[^1]"}},
+		{"plain", []string{"# Plan", "| a | b |", "[^1]", "&lt;b&gt;this&lt;/b&gt;"}, []string{"<h1>", "<table>", "<b>"}},
+	} {
+		r, err := newRenderer(tc.name)
+		if err != nil {
+			t.Fatalf("newRenderer(%q): %v", tc.name, err)
+		}
+		// Sanitizing keeps what each renderer relies on
+		html := string(sanitizeHTML(r.Render(doc)))
+		for _, want := range tc.want {
+			if !strings.Contains(html, want) {
+				t.Errorf("%q renderer: missing %q in %s", tc.name, want, html)
+			}
+		}
+		for _, skip := range tc.skip {
+			if strings.Contains(html, skip) {
+				t.Errorf("%q renderer: unexpected %q in %s", tc.name, skip, html)
+			}
+		}
+	}
+	if _, err := newRenderer("markdown-it"); err == nil || !strings.Contains(err.Error(), rendererNames) {
+		t.Errorf("unknown renderer: err = %v", err)
+	}
+
+	// Replies on the page go through the chosen renderer
+	app := newTestApp(t)
+	old := renderer
+	renderer, _ = newRenderer("plain")
+	t.Cleanup(func() { renderer = old })
+	app.ollama.SetChunks("**not bold**")
+	if _, page := app.chat("hi"); !strings.Contains(page, "**not bold**") || strings.Contains(page, "<strong>not bold") {
+		t.Errorf("plain renderer not used for the page: %s", page)
+	}
+}
+
+// countingRenderer records which markdown it was asked to render
+type countingRenderer struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (c *countingRenderer) Render(markdown string) string {
+	c.mu.Lock()
+	c.calls = append(c.calls, markdown)
+	c.mu.Unlock()
+	return plainRenderer{}.Render(markdown)
+}
+
+func TestRenderedMessageCache(t *testing.T) {
+	app := newTestApp(t)
+	counter := &countingRenderer{}
+	old := renderer
+	renderer = counter
+	t.Cleanup(func() { renderer = old })
+
+	app.chat("first")
+	app.chat("second")
+	// The page after each chat renders only the new reply
+	if len(counter.calls) != 2 {
+		t.Fatalf("rendered %d times over two chats, want 2: %q", len(counter.calls), counter.calls)
+	}
+
+	resp, err := app.client.PostForm(app.server.URL+"/history", url.Values{"action": {"edit"}, "id": {"4"}, "content": {"*changed*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(counter.calls) != 3 || counter.calls[2] != "*changed*" {
+		t.Errorf("after edit, renders = %q; want only the edited message re-rendered", counter.calls)
+	}
+	if !strings.Contains(string(body), "*changed*") {
+		t.Errorf("page does not show the edited reply; body: %s", body)
+	}
+}
+
+func TestHistoryRenderCap(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("hello")
+	u, _ := url.Parse(app.server.URL)
+	var id string
+	for _, c := range app.client.Jar.Cookies(u) {
+		if c.Name == sessionCookieName("") {
+			id = c.Value
+		}
+	}
+	sessionMut.Lock()
+	sess := getSession(id)
+	for i := 0; len(sess.History) < maxRenderedMessages+10; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		if err := sess.append(Message{Role: role, Content: fmt.Sprintf("msg-%03d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessionMut.Unlock()
+
+	counter := &countingRenderer{}
+	old := renderer
+	renderer = counter
+	t.Cleanup(func() { renderer = old })
+	resp, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	page := string(body)
+
+	// Only the newest messages are copied and rendered; the rest are counted
+	if !strings.Contains(page, "10 earlier messages not shown") || strings.Contains(page, "msg-007") || !strings.Contains(page, "msg-008") {
+		t.Errorf("page does not show just the newest %d messages: %s", maxRenderedMessages, page)
+	}
+	if len(counter.calls) != maxRenderedMessages/2 {
+		t.Errorf("rendered %d replies, want %d", len(counter.calls), maxRenderedMessages/2)
+	}
+	// Flushed as it is written, the page goes out chunked
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Transfer-Encoding = %q", resp.TransferEncoding)
+	}
+
+	// A page larger than the buffer is written in pieces no larger than it
+	views := make([]MessageView, maxRenderedMessages)
+	for i := range views {
+		views[i] = MessageView{Message: Message{Role: "user", Content: strings.Repeat("x", 500)}, Index: i}
+	}
+	w := &writeRecorder{ResponseRecorder: httptest.NewRecorder()}
+	renderPage(w, httptest.NewRequest(http.MethodGet, "/", nil), "index.html", PageData{History: views, L: newLocalizer("", "", "")})
+	if w.Code != http.StatusOK || len(w.writes) < 2 {
+		t.Fatalf("status %d in %d writes", w.Code, len(w.writes))
+	}
+	for _, n := range w.writes {
+		if n > 16<<10 {
+			t.Errorf("wrote %d bytes at once", n)
+		}
+	}
+	if !w.Flushed || w.Body.Len() < maxRenderedMessages*500 {
+		t.Errorf("flushed %v, %d bytes written", w.Flushed, w.Body.Len())
+	}
+}
+
+// writeRecorder records the size of each write to a response
+type writeRecorder struct {
+	*httptest.ResponseRecorder
+	writes []int
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestExtractMath(t *testing.T) {
+	tests := []struct {
+		in, out string
+		tex     []string // display math is prefixed with "="
+	}{
+		{"a $x_1$ b", "a MATHPH0X b", []string{"x_1"}},
+		{`\(a\) and \[b\]`, "MATHPH1X and MATHPH0X", []string{"=b", "a"}},
+		{"$$\n\\sum_i x_i\n$$", "MATHPH0X", []string{"=\\sum_i x_i"}},
+		// Math delimiters inside code spans and fences are left alone
+		{"`$x$` and $y$", "`$x$` and MATHPH0X", []string{"y"}},
+		{"```\n$$z$$\n```\n$$w$$", "```\n$$z$$\n```\nMATHPH0X", []string{"=w"}},
+		// Currency, padding and unbalanced delimiters are not math
+		{"costs $5 and $10", "costs $5 and $10", nil},
+		{"a $x$5", "a $x$5", nil},
+		{"$ x $", "$ x $", nil},
+		{"$x alone", "$x alone", nil},
+		{`\[ open`, `\[ open`, nil},
+		{"$$a$", "$$a$", nil},
+		{"$a$$", "$a$$", nil},
+	}
+	for _, tt := range tests {
+		out, segs := extractMath(tt.in)
+		var tex []string
+		for _, seg := range segs {
+			if seg.display {
+				tex = append(tex, "="+seg.tex)
+			} else {
+				tex = append(tex, seg.tex)
+			}
+		}
+		if out != tt.out || strings.Join(tex, "|") != strings.Join(tt.tex, "|") {
+			t.Errorf("extractMath(%q) = %q %q, want %q %q", tt.in, out, tex, tt.out, tt.tex)
+		}
+	}
+}
+
+func TestRestoreMath(t *testing.T) {
+	segs := []mathSegment{{tex: "a<b"}, {tex: `\frac{1}{2}`, display: true}}
+	got := restoreMath("<p>MATHPH0X, MATHPH1X and MATHPH7X</p>", segs)
+	want := `<p><span class="math math-inline">a&lt;b</span>, <span class="math math-display">\frac{1}{2}</span> and MATHPH7X</p>`
+	if got != want {
+		t.Errorf("restoreMath = %q, want %q", got, want)
+	}
+
+	// Markdown syntax inside math reaches the page untouched
+	html := cleanResponse("Area: $x_1 * y_2 * z$ and `$code$`")
+	if !strings.Contains(html, `<span class="math math-inline">x_1 * y_2 * z</span>`) || !strings.Contains(html, "<code>$code$</code>") {
+		t.Errorf("cleanResponse = %q", html)
+	}
+}
+
+func TestMarkDiagrams(t *testing.T) {
+	old := renderer
+	defer func() { renderer = old }()
+	for _, name := range []string{"blackfriday", "goldmark"} {
+		renderer, _ = newRenderer(name)
+		html := cleanResponse("```mermaid\ngraph TD; A-->B\n```\n\n```go\nx := 1\n```")
+		if !strings.Contains(html, `<pre class="mermaid">graph TD; A--&gt;B`) {
+			t.Errorf("%s: mermaid block not marked: %q", name, html)
+		}
+		if !strings.Contains(html, `<code class="language-go">`) {
+			t.Errorf("%s: other code blocks should stay as they are: %q", name, html)
+		}
+	}
+	// Without a language the block is ordinary code
+	if got := markDiagrams("<pre><code>graph TD</code></pre>"); got != "<pre><code>graph TD</code></pre>" {
+		t.Errorf("markDiagrams changed a plain block: %q", got)
+	}
+}
+
+func TestHighlightCode(t *testing.T) {
+	old := renderer
+	defer func() { renderer = old }()
+	for _, name := range []string{"blackfriday", "goldmark"} {
+		renderer, _ = newRenderer(name)
+		html := cleanResponse("```go\nfunc main() { s := \"<b>&\" }\n```")
+		if !strings.Contains(html, `<code class="language-go"><span class="hl-kd">func</span>`) {
+			t.Errorf("%s: go block not highlighted: %q", name, html)
+		}
+		// Code stays escaped inside the highlighting
+		if !strings.Contains(html, `<span class="hl-s">&#34;&lt;b&gt;&amp;&#34;</span>`) {
+			t.Errorf("%s: string literal not escaped: %q", name, html)
+		}
+	}
+
+	// Without a language on the fence, it is guessed from the code
+	got := highlightCode("<pre><code>#!/bin/sh\necho hi\n</code></pre>")
+	if !strings.Contains(got, `<code class="language-bash">`) || !strings.Contains(got, `<span class="hl-c`) {
+		t.Errorf("shell script not detected: %q", got)
+	}
+	// Unknown languages and mermaid diagrams are left alone
+	for _, block := range []string{
+		`<pre><code class="language-nosuchlang">x &lt; y</code></pre>`,
+		`<pre class="mermaid">graph TD</pre>`,
+	} {
+		if got := highlightCode(block); got != block {
+			t.Errorf("highlightCode(%q) = %q", block, got)
+		}
+	}
+	if got := sanitizeHTML(`<span class="hl-k">if</span>`); got != `<span class="hl-k">if</span>` {
+		t.Errorf("highlight class removed: %q", got)
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	attacks := []string{
+		"<script>alert(1)</script>",
+		`<img src="x" onerror="alert(1)">`,
+		"[click](javascript:alert(1))",
+		`<a href="javascript:alert(1)">click</a>`,
+		`<iframe src="https://evil.example"></iframe>`,
+		`<svg onload="alert(1)"></svg>`,
+		`<p style="background:url(javascript:alert(1))">x</p>`,
+	}
+	old := renderer
+	for _, name := range []string{"blackfriday", "goldmark", "plain"} {
+		renderer, _ = newRenderer(name)
+		for _, attack := range attacks {
+			html := strings.ToLower(cleanResponse("Look: " + attack))
+			for _, bad := range []string{"<script", `onerror="`, `onload="`, `href="javascript:`, "<iframe", `style="`} {
+				if strings.Contains(html, bad) {
+					t.Errorf("%s: %q rendered as %q", name, attack, html)
+				}
+			}
+		}
+	}
+	renderer = old
+
+	// Markup the app's own rendering depends on survives
+	for _, keep := range []string{
+		`<span class="math math-inline">x</span>`,
+		`<pre class="mermaid">graph TD</pre>`,
+		`<code class="language-go">x</code>`,
+		`<a href="https://example.com" rel="nofollow">link</a>`,
+	} {
+		if got := string(sanitizeHTML(keep)); got != keep {
+			t.Errorf("sanitizeHTML(%q) = %q", keep, got)
+		}
+	}
+	if got := sanitizeHTML(`<span class="evil">x</span>`); got != "<span>x</span>" {
+		t.Errorf("unknown class kept: %q", got)
+	}
+
+	// The page itself never carries the model's script
+	app := newTestApp(t)
+	app.ollama.SetChunks(`Hi <script>alert("pwned")</script><img src=x onerror=alert(1)>`)
+	_, page := app.chat("hello")
+	if strings.Contains(page, "<script>alert") || !strings.Contains(page, `<p>Hi <img src="x"></p>`) {
+		t.Errorf("script injected into the page: %s", page)
+	}
+
+	tmpl := template.Must(template.New("t").Funcs(templateFuncs).Parse(`{{title .Role}}: {{markdown .Content}}`))
+	var b strings.Builder
+	if err := tmpl.Execute(&b, Message{Role: "assistant", Content: "<script>x()</script>**hi**"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != "Assistant: <p><strong>hi</strong></p>\n" {
+		t.Errorf("template output = %q", got)
+	}
+	if got := titleCase("<b>"); got != "<b>" {
+		t.Errorf("titleCase changed markup: %q", got)
+	}
+}
+
+func TestHTMLAllowlist(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks(`Press <kbd data-key="c">Ctrl</kbd>+C <script>x()</script>`)
+	_, page := app.chat("how do I copy")
+	if strings.Contains(page, "<kbd") {
+		t.Fatalf("kbd kept by the default policy: %s", page)
+	}
+
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configPath = path
+	t.Cleanup(func() {
+		configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{}
+		setHTMLAllow(nil)
+	})
+	for _, bad := range []string{
+		"html:\n  allow:\n    script: []\n",
+		"html:\n  allow:\n    kbd: [onclick]\n",
+		"html:\n  allow:\n    \"*\": [style]\n",
+		"html:\n  allow:\n    \"k b\": []\n",
+	} {
+		write(bad)
+		if err := loadFileConfig(); err == nil {
+			t.Errorf("config %q accepted", bad)
+		}
+	}
+
+	// The cached render of the reply is redone under the new policy
+	write("html:\n  allow:\n    kbd: [data-key]\n")
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `<kbd data-key="c">Ctrl</kbd>`) || strings.Contains(string(body), "<script>x()") {
+		t.Errorf("page after allowing kbd: %s", body)
+	}
+	if got := sanitizeHTML(`<kbd onclick="x()" data-key="c">k</kbd>`); got != `<kbd data-key="c">k</kbd>` {
+		t.Errorf("sanitizeHTML = %q", got)
+	}
+}
+
+func TestSanitizeStoredContent(t *testing.T) {
+	for in, want := range map[string]string{
+		"Hi <script>alert(1)</script>there":                                "Hi there",
+		`<img src="x" onerror="alert(1)"> **bold**`:                        `<img src="x"> **bold**`,
+		`<a href=" java&#09;script:alert(1)" title="t">click</a>`:          `<a title="t">click</a>`,
+		`<iframe src="https://evil.example"></iframe><!-- x -->ok`:         "ok",
+		"Escape `<script>` like so:\n\n```html\n<script>x()</script>\n```": "Escape `<script>` like so:\n\n```html\n<script>x()</script>\n```",
+		"Mail <me@example.com> or see <https://example.com>, 1 < 2":        "Mail <me@example.com> or see <https://example.com>, 1 < 2",
+		`Press <kbd data-key="c">Ctrl</kbd>`:                               `Press <kbd data-key="c">Ctrl</kbd>`,
+		"unclosed <style>body{display:none}":                               "unclosed ",
+	} {
+		if got := sanitizeMarkdown(in); got != want {
+			t.Errorf("sanitizeMarkdown(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	// Replies and imported replies are stored clean, so the API and the
+	// exports hand out no script; prompts are kept as the user wrote them
+	app := newTestApp(t)
+	app.ollama.SetChunks(`Hi <script>alert("pwned")</script><img src=x onerror=alert(1)>`)
+	app.chat("what does <script> do?")
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "conversation.json")
+	part.Write([]byte(`{"title": "Imported", "messages": [{"role": "user", "content": "hi"},
+		{"role": "assistant", "content": "<a href=\"javascript:alert(1)\" onclick=\"x()\">link</a>", "reasoning": "<script>y()</script>hmm"}]}`))
+	mw.Close()
+	resp, err := app.client.Post(app.server.URL+"/import", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("import: status %d", resp.StatusCode)
+	}
+
+	for _, path := range []string{"/export/json?conversation=0", "/export/markdown?conversation=0", "/export/json?conversation=1"} {
+		resp, err := app.client.Get(app.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		out := string(b)
+		for _, bad := range []string{"<script>alert", "onerror", "onclick", "javascript:", "y()"} {
+			if strings.Contains(out, bad) {
+				t.Errorf("%s hands out %q: %s", path, bad, out)
+			}
+		}
+		if path == "/export/markdown?conversation=0" && (!strings.Contains(out, "what does <script> do?") || !strings.Contains(out, `Hi <img src="x">`)) {
+			t.Errorf("%s = %s", path, out)
+		}
+	}
+}
+
+func TestConversationStaysOnReplica(t *testing.T) {
+	app := newTestApp(t)
+	other := fakeollama.New()
+	defer other.Close()
+	old := ollamaReplicas
+	ollamaReplicas = []string{app.ollama.URL, other.URL}
+	defer func() { ollamaReplicas = old }()
+
+	app.chat("first")
+	app.chat("second")
+	app.chat("third")
+
+	a, b := app.ollama.Requests(), other.Requests()
+	if len(a)+len(b) != 3 || (len(a) != 0 && len(b) != 0) {
+		t.Fatalf("turns split across replicas: %d and %d requests", len(a), len(b))
+	}
+	for _, req := range append(a, b...) {
+		if req.KeepAlive != ollamaKeepAlive {
+			t.Errorf("keep_alive = %q, want %q", req.KeepAlive, ollamaKeepAlive)
+		}
+	}
+	if _, _, n := ttftStats(); n == 0 {
+		t.Error("no time-to-first-token samples recorded")
+	}
+}
+
+func TestConversationKeyFirstTurn(t *testing.T) {
+	turn1 := OllamaChatRequest{Model: "m", Messages: []Message{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "first"},
+	}}
+	turn2 := turn1
+	turn2.Messages = append(append([]Message(nil), turn1.Messages...),
+		Message{Role: "assistant", Content: "ok"}, Message{Role: "user", Content: "second"})
+	if conversationKey(turn1) != conversationKey(turn2) {
+		t.Fatalf("turn 1 key %q differs from turn 2 key %q", conversationKey(turn1), conversationKey(turn2))
+	}
+	long := OllamaChatRequest{Model: "m", Messages: []Message{{Role: "user", Content: strings.Repeat("secret ", 1000)}}}
+	if key := conversationKey(long); len(key) != 64 || strings.Contains(key, "secret") {
+		t.Errorf("key holds the prompt: %q", key)
+	}
+
+	old := ollamaReplicas
+	defer func() { ollamaReplicas = old }()
+	for n := 2; n <= 8; n++ {
+		ollamaReplicas = nil
+		for i := 0; i < n; i++ {
+			ollamaReplicas = append(ollamaReplicas, fmt.Sprintf("http://replica-%d:11434", i))
+		}
+		a := upstreamFor(prepareChat(context.Background(), &turn1))
+		b := upstreamFor(prepareChat(context.Background(), &turn2))
+		if a != b {
+			t.Errorf("%d replicas: turn 1 on %s, turn 2 on %s", n, a, b)
+		}
+	}
+}
+
+func TestLoadBalancing(t *testing.T) {
+	app := newTestApp(t)
+	defer func(r []string, b string, d time.Duration) {
+		ollamaReplicas, ollamaBalance, breakerProbeInterval = r, b, d
+	}(ollamaReplicas, ollamaBalance, breakerProbeInterval)
+	breakerProbeInterval = 50 * time.Millisecond
+
+	// A second host behind a switch that takes it down
+	second := fakeollama.New()
+	defer second.Close()
+	var down atomic.Bool
+	target, _ := url.Parse(second.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "no route", http.StatusBadGateway)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	ollamaReplicas = []string{app.ollama.URL, upstream.URL}
+	if err := setBalance(balanceRoundRobin); err != nil {
+		t.Fatal(err)
+	}
+
+	// Which host was asked a prompt
+	on := func(fake *fakeollama.Server, prompt string) bool {
+		for _, req := range fake.Requests() {
+			if m := req.Messages[len(req.Messages)-1]; m.Content == prompt {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		app.client.PostForm(app.server.URL+"/conversations", url.Values{"action": {"new"}, "title": {fmt.Sprint("c", i)}})
+		app.chat(fmt.Sprint("q", i))
+	}
+	var first, other int
+	for i := 0; i < 4; i++ {
+		switch q := fmt.Sprint("q", i); {
+		case on(app.ollama, q) && !on(second, q):
+			first++
+		case on(second, q) && !on(app.ollama, q):
+			other++
+		}
+	}
+	if first != 2 || other != 2 {
+		t.Errorf("round robin sent %d conversations to one host and %d to the other", first, other)
+	}
+
+	// A conversation stays on its host
+	stuck := second
+	if on(app.ollama, "q3") {
+		stuck = app.ollama
+	}
+	app.chat("q3 again")
+	if !on(stuck, "q3 again") {
+		t.Error("follow-up went to another host")
+	}
+
+	// A host failing its health check gets no chats until it recovers
+	down.Store(true)
+	checkHosts()
+	if hosts := hostStatuses(); len(hosts) != 2 || !hosts[0].Up || hosts[1].Up {
+		t.Errorf("hosts while the second is down = %+v", hosts)
+	}
+	for i := 0; i < 2; i++ {
+		q := fmt.Sprint("while down ", i)
+		if status, _ := app.chat(q); status != http.StatusOK || !on(app.ollama, q) {
+			t.Errorf("chat %d while the second host is down: status %d", i, status)
+		}
+	}
+	down.Store(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for hostStatuses()[1].Up == false && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !hostStatuses()[1].Up {
+		t.Error("second host not back after recovering")
+	}
+
+	// Least loaded: a new conversation avoids the busy host
+	setBalance(balanceLeastLoaded)
+	if u, _ := url.Parse(upstream.URL); loadOf(u.Host).Load() != 0 {
+		t.Fatalf("second host has %d requests in flight after its replies", loadOf(u.Host).Load())
+	}
+	busy, _ := url.Parse(app.ollama.URL)
+	hold := trackLoad(busy.Host)
+	defer hold()
+	for i := 0; i < 3; i++ {
+		if host := pickHost(ollamaReplicas, fmt.Sprint("new ", i)); host != upstream.URL {
+			t.Errorf("least loaded picked %s", host)
+		}
+	}
+	if setBalance("random") == nil {
+		t.Error("unknown balancing accepted")
+	}
+}
+
+func TestChatStreamSSE(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Hel", "lo")
+
+	resp, err := app.client.PostForm(app.server.URL+"/chat/stream", url.Values{"prompt": {"hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var chunks []APIChatChunk
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if data := strings.TrimPrefix(sc.Text(), "data: "); data != sc.Text() {
+			var c APIChatChunk
+			json.Unmarshal([]byte(data), &c)
+			chunks = append(chunks, c)
+		}
+	}
+	if len(chunks) != 3 || chunks[0].Content != "Hel" || chunks[1].Content != "lo" || !chunks[2].Done {
+		t.Fatalf("events = %+v", chunks)
+	}
+
+	page, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(page.Body)
+	page.Body.Close()
+	if !strings.Contains(string(body), "Hello") {
+		t.Errorf("streamed reply not saved to history; body: %s", body)
+	}
+}
+
+func TestChatStop(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("one", " two", " three", " four")
+	app.ollama.SetChunkDelay(100 * time.Millisecond)
+	page, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Body.Close()
+
+	resp, err := app.client.PostForm(app.server.URL+"/chat/stream", url.Values{"prompt": {"count"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var chunks []APIChatChunk
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		data := strings.TrimPrefix(sc.Text(), "data: ")
+		if data == sc.Text() {
+			continue
+		}
+		var c APIChatChunk
+		json.Unmarshal([]byte(data), &c)
+		chunks = append(chunks, c)
+		if len(chunks) == 1 {
+			stop, err := app.client.Post(app.server.URL+"/chat/stop", "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out struct{ Stopped int }
+			json.NewDecoder(stop.Body).Decode(&out)
+			stop.Body.Close()
+			if out.Stopped != 1 {
+				t.Errorf("stopped %d generations, want 1", out.Stopped)
+			}
+		}
+	}
+	last := chunks[len(chunks)-1]
+	if !last.Done || !last.Stopped || len(chunks) > 3 {
+		t.Fatalf("events = %+v", chunks)
+	}
+
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	for _, sess := range sessions {
+		if len(sess.History) != 2 || !strings.HasPrefix(sess.History[1].Content, "one") || strings.Contains(sess.History[1].Content, "four") {
+			t.Errorf("history after stop = %+v", sess.History)
+		}
+		if len(sess.generations) != 0 {
+			t.Errorf("%d generations still tracked", len(sess.generations))
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("one", " two", " three", " four")
+	app.ollama.SetChunkDelay(50 * time.Millisecond)
+	defer func(d time.Duration) { shutdownTimeout = d }(shutdownTimeout)
+
+	// Start a server, a chat streaming on it, and then shut the server down
+	shutDuringChat := func() (chat string, served error, took time.Duration) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop := make(chan os.Signal, 1)
+		done := make(chan error, 1)
+		go func() { done <- runServer(&http.Server{Handler: newRouter()}, lis, stop) }()
+
+		replied := make(chan string, 1)
+		go func() {
+			resp, err := http.PostForm("http://"+lis.Addr().String()+"/chat/stream", url.Values{"prompt": {"count"}})
+			if err != nil {
+				replied <- err.Error()
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			replied <- string(body)
+		}()
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+			if active, _ := generations.stats(); active > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the chat never started")
+			}
+		}
+
+		start := time.Now()
+		stop <- os.Interrupt
+		served = <-done
+		took = time.Since(start)
+		if _, err := net.DialTimeout("tcp", lis.Addr().String(), time.Second); err == nil {
+			t.Error("the server still accepts connections after shutting down")
+		}
+		return <-replied, served, took
+	}
+
+	// Replies in progress finish before the server stops
+	chat, err, _ := shutDuringChat()
+	if err != nil || !strings.Contains(chat, "four") {
+		t.Errorf("shut down with %v; the chat got:\n%s", err, chat)
+	}
+
+	// Past the timeout they are stopped, keeping what they have
+	shutdownTimeout = 60 * time.Millisecond
+	chat, err, took := shutDuringChat()
+	if err != nil || strings.Contains(chat, "four") || took > stopGrace {
+		t.Errorf("shut down with %v after %v; the chat got:\n%s", err, took, chat)
+	}
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	for _, sess := range sessions {
+		if n := len(sess.History); n == 0 || !strings.HasPrefix(sess.History[n-1].Content, "one") {
+			t.Errorf("history after a stopped reply = %+v", sess.History)
+		}
+	}
+}
+
+func TestChatSocketResumeAndRetry(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Hel", "lo", " there")
+
+	// Load the page first so both sockets share the session cookie
+	page, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Body.Close()
+	u, _ := url.Parse(app.server.URL)
+	header := http.Header{"Origin": {app.server.URL}}
+	for _, c := range app.client.Jar.Cookies(u) {
+		header.Add("Cookie", c.String())
+	}
+	dial := func() *websocket.Conn {
+		conn, resp, err := websocket.DefaultDialer.Dial("ws://"+u.Host+"/ws", header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return conn
+	}
+	// Read frames up to the one that ends a reply
+	readReply := func(conn *websocket.Conn) (frames []ChatFrame) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var f ChatFrame
+			if err := conn.ReadJSON(&f); err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, f)
+			if f.Type == "done" || f.Type == "cancelled" || f.Type == "error" {
+				return frames
+			}
+		}
+	}
+
+	conn := dial()
+	conn.WriteJSON(ChatFrame{Type: "prompt", Text: "hi"})
+	frames := readReply(conn)
+	conn.Close()
+	if len(frames) != 5 || frames[0].Type != "user" || frames[1].Text != "Hel" || frames[4].Type != "done" {
+		t.Fatalf("frames = %+v", frames)
+	}
+	if !strings.Contains(frames[4].HTML, "Hello there") {
+		t.Errorf("done html = %q", frames[4].HTML)
+	}
+
+	// A new socket picks the reply up after the first token it had
+	conn = dial()
+	defer conn.Close()
+	conn.WriteJSON(ChatFrame{Type: "resume", Reply: frames[0].Reply, From: 1})
+	resumed := readReply(conn)
+	if len(resumed) != 3 || resumed[0].Text != "lo" || resumed[0].Seq != 1 || resumed[2].Type != "done" {
+		t.Fatalf("resumed frames = %+v", resumed)
+	}
+
+	app.ollama.SetChunks("Bye")
+	conn.WriteJSON(ChatFrame{Type: "retry"})
+	retried := readReply(conn)
+	if len(retried) != 3 || retried[0].Type != "retry" || retried[1].Text != "Bye" {
+		t.Fatalf("retry frames = %+v", retried)
+	}
+
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	for _, sess := range sessions {
+		if len(sess.History) != 2 || sess.History[1].Content != "Bye" {
+			t.Errorf("history = %+v", sess.History)
+		}
+	}
+}
+
+func TestChatSlowStream(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("slow", " and", " steady")
+	app.ollama.SetChunkDelay(50 * time.Millisecond)
+
+	status, body := app.chat("take your time")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if !strings.Contains(body, "slow and steady") {
+		t.Errorf("slow reply not assembled; body: %s", body)
+	}
+}
+
+func TestChatUpstreamErrorStatus(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.FailWith(http.StatusInternalServerError)
+
+	status, _ := app.chat("anyone there?")
+	if status != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", status, http.StatusBadGateway)
+	}
+}
+
+func TestChatMalformedChunk(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetMalformed(true)
+
+	status, _ := app.chat("break it")
+	if status != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", status, http.StatusInternalServerError)
+	}
+}
+
+func TestChatUpstreamUnreachable(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.Close()
+
+	status, _ := app.chat("hello?")
+	if status != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", status, http.StatusInternalServerError)
+	}
+}
+
+func TestChatMethodNotAllowed(t *testing.T) {
+	app := newTestApp(t)
+
+	resp, err := app.client.Get(app.server.URL + "/chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestChatStreamClosedBeforeDone(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("partial", " answer", " lost")
+	app.ollama.DropAfter(2)
+
+	status, body := app.chat("cut me off")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if !strings.Contains(body, "partial answer") || strings.Contains(body, "lost") {
+		t.Errorf("expected only the streamed prefix; body: %s", body)
+	}
+}
+
+func TestChunkScanner(t *testing.T) {
+	chunk := func(content string) string {
+		return `{"message":{"role":"assistant","content":"` + content + `"}}` + "\n"
+	}
+
+	cases := []struct {
+		name    string
+		stream  string
+		want    string
+		wantErr error
+	}{
+		{"blank lines", chunk("a") + "\n\r\n" + chunk("b"), "ab", nil},
+		{"final line without newline", chunk("a") + strings.TrimSuffix(chunk("b"), "\n"), "ab", nil},
+		{"cut off mid-chunk", chunk("a") + `{"message":{"con`, "a", nil},
+		{"malformed", chunk("a") + "{not json\n" + chunk("b"), "a", &ChunkError{Line: 2}},
+		{"oversized", chunk("a") + chunk(strings.Repeat("x", maxChunkBytes)), "a", errChunkTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sc := newChunkScanner(strings.NewReader(c.stream))
+			var got strings.Builder
+			for sc.Next() {
+				got.WriteString(sc.Chunk().Message.Content)
+			}
+			if got.String() != c.want {
+				t.Errorf("content = %q, want %q", got.String(), c.want)
+			}
+			err := sc.Err()
+			switch want := c.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Errorf("err = %v, want nil", err)
+				}
+			case *ChunkError:
+				var ce *ChunkError
+				if !errors.As(err, &ce) || ce.Line != want.Line {
+					t.Errorf("err = %v, want error on line %d", err, want.Line)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Errorf("err = %v, want %v", err, want)
+				}
+			}
+		})
+	}
+}
+
+// A typical streamed reply: a few hundred short token chunks
+func benchmarkStream() []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for i := 0; i < 500; i++ {
+		enc.Encode(OllamaChatResponse{Message: Message{Role: "assistant", Content: " token"}})
+	}
+	enc.Encode(OllamaChatResponse{Message: Message{Role: "assistant"}, Done: true})
+	return b.Bytes()
+}
+
+func BenchmarkStreamJSONDecoder(b *testing.B) {
+	stream := benchmarkStream()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(stream)))
+	for i := 0; i < b.N; i++ {
+		dec := json.NewDecoder(bytes.NewReader(stream))
+		for {
+			var chunk OllamaChatResponse
+			if err := dec.Decode(&chunk); err != nil || chunk.Done {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkStreamChunkScanner(b *testing.B) {
+	stream := benchmarkStream()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(stream)))
+	for i := 0; i < b.N; i++ {
+		sc := newChunkScanner(bytes.NewReader(stream))
+		for sc.Next() && !sc.Chunk().Done {
+		}
+	}
+}
+
+// A chat request carrying a moderately long conversation
+func benchmarkChatRequest() OllamaChatRequest {
+	req := OllamaChatRequest{Model: defaultModel, Stream: true}
+	for i := 0; i < 40; i++ {
+		req.Messages = append(req.Messages,
+			Message{Role: "user", Content: strings.Repeat("question ", 40)},
+			Message{Role: "assistant", Content: strings.Repeat("answer ", 120)})
+	}
+	return req
+}
+
+func TestPooledBodyCloseDuringRead(t *testing.T) {
+	req, err := newOllamaRequest(context.Background(), "/api/chat", benchmarkChatRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Body
+
+	// One goroutine reads while another closes, as the transport may
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p := make([]byte, 16)
+		for {
+			if _, err := body.Read(p); err != nil {
+				return
+			}
+		}
+	}()
+	body.Close()
+	<-done
+
+	// The buffer is back in the pool; reusing it must not reach the old body
+	buf := getBuffer()
+	buf.WriteString("reused")
+	if n, err := body.Read(make([]byte, 16)); n != 0 || err != errBodyClosed {
+		t.Errorf("read after close = %d, %v; want 0, errBodyClosed", n, err)
+	}
+	putBuffer(buf)
+	if err := body.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
+
+func BenchmarkRequestMarshal(b *testing.B) {
+	chatReq := benchmarkChatRequest()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			data, _ := json.Marshal(chatReq)
+			http.NewRequest(http.MethodPost, "http://ollama/api/chat", bytes.NewReader(data))
+		}
+	})
+}
+
+func BenchmarkRequestPooled(b *testing.B) {
+	chatReq := benchmarkChatRequest()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, _ := newOllamaRequest(context.Background(), "/api/chat", chatReq)
+			req.Body.Close()
+		}
+	})
+}
+
+func BenchmarkStreamEncoder(b *testing.B) {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/chat", nil)
+	send := streamEncoder(httptest.NewRecorder(), r)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		send(APIChatChunk{Content: " token"})
+	}
+}
+
+func TestChatMultipartAttachments(t *testing.T) {
+	app := newTestApp(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("prompt", "summarise these")
+	fw, _ := mw.CreateFormFile("attachment", "notes.txt")
+	fw.Write(bytes.Repeat([]byte("line of notes\n"), 100000))
+	iw, _ := mw.CreateFormFile("attachment", "pixel.png")
+	iw.Write([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	mw.Close()
+
+	resp, err := app.client.Post(app.server.URL+"/chat", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	reqs := app.ollama.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream got %d requests, want 1", len(reqs))
+	}
+	msg := reqs[0].Messages[0]
+	if !strings.HasPrefix(msg.Content, "summarise these\n\n--- notes.txt ---\n```\nline of notes") {
+		t.Errorf("attachment not inlined into prompt: %.80q", msg.Content)
+	}
+	if len(msg.Images) != 1 {
+		t.Errorf("got %d images, want 1", len(msg.Images))
+	}
+}
+
+func TestChatRejectsOversizedPart(t *testing.T) {
+	app := newTestApp(t)
+	old := maxPartBytes
+	maxPartBytes = 1 << 10
+	defer func() { maxPartBytes = old }()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("prompt", "read this")
+	fw, _ := mw.CreateFormFile("attachment", "big.txt")
+	fw.Write(bytes.Repeat([]byte("x"), maxPartBytes+1))
+	mw.Close()
+
+	resp, err := app.client.Post(app.server.URL+"/chat", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", resp.StatusCode)
+	}
+	if n := len(app.ollama.Requests()); n != 0 {
+		t.Errorf("oversized submission reached Ollama %d times", n)
+	}
+}
+
+func TestChatSpillsLargePartToDisk(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("read it")
+	defer func(limit int, dir string) { partMemoryLimit, uploadSpillDir = limit, dir }(partMemoryLimit, uploadSpillDir)
+	partMemoryLimit = 1 << 10
+	post := func(size int) int {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("prompt", "read this")
+		fw, _ := mw.CreateFormFile("attachment", "notes.txt")
+		fw.Write(bytes.Repeat([]byte("y"), size))
+		mw.Close()
+		resp, err := app.client.Post(app.server.URL+"/chat", mw.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Spilling into a directory that is not there fails, so a part over
+	// the memory limit goes to disk, and one under it does not
+	uploadSpillDir = filepath.Join(t.TempDir(), "missing")
+	if status := post(partMemoryLimit + 1); status != http.StatusInternalServerError {
+		t.Errorf("spill to a missing directory: status %d, want 500", status)
+	}
+	if status := post(partMemoryLimit); status != http.StatusOK {
+		t.Errorf("part within the memory limit: status %d", status)
+	}
+
+	// The spilled part reaches Ollama whole, and its file is removed
+	uploadSpillDir = t.TempDir()
+	if status := post(4 * partMemoryLimit); status != http.StatusOK {
+		t.Fatalf("spilled part: status %d", status)
+	}
+	reqs := app.ollama.Requests()
+	msgs := reqs[len(reqs)-1].Messages
+	if last := msgs[len(msgs)-1].Content; !strings.Contains(last, strings.Repeat("y", 4*partMemoryLimit)) {
+		t.Errorf("spilled attachment sent as %d bytes", len(last))
+	}
+	if left, _ := os.ReadDir(uploadSpillDir); len(left) != 0 {
+		t.Errorf("spill files left behind: %v", left)
+	}
+
+	// A spilled image is encoded as it is read back, and a spilled file
+	// that turns out not to be text is refused
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 4*partMemoryLimit)...)
+	binary := append(bytes.Repeat([]byte("z"), 2*partMemoryLimit), 0xff, 0xfe)
+	upload := func(name string, data []byte) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("prompt", "look")
+		fw, _ := mw.CreateFormFile("attachment", name)
+		fw.Write(data)
+		mw.Close()
+		resp, err := app.client.Post(app.server.URL+"/chat", mw.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := upload("big.png", png); status != http.StatusOK {
+		t.Fatalf("spilled image: status %d", status)
+	}
+	reqs = app.ollama.Requests()
+	msgs = reqs[len(reqs)-1].Messages
+	if images := msgs[len(msgs)-1].Images; len(images) != 1 || images[0] != base64.StdEncoding.EncodeToString(png) {
+		t.Errorf("spilled image sent as %d images", len(images))
+	}
+	if status := upload("data.bin", binary); status != http.StatusUnsupportedMediaType {
+		t.Errorf("spilled binary file: status %d, want 415", status)
+	}
+	if left, _ := os.ReadDir(uploadSpillDir); len(left) != 0 {
+		t.Errorf("spill files left behind: %v", left)
+	}
+}
+
+func TestChatRejectsEmptyPrompt(t *testing.T) {
+	app := newTestApp(t)
+
+	status, _ := app.chat("   ")
+	if status != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if n := len(app.ollama.Requests()); n != 0 {
+		t.Errorf("upstream called %d times for an empty prompt", n)
+	}
+}
+
+func TestTemplateFallback(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("still readable")
+
+	templateMut.Lock()
+	saved := templates
+	templates = nil
+	templateMut.Unlock()
+	defer func() {
+		templateMut.Lock()
+		templates = saved
+		templateMut.Unlock()
+	}()
+
+	for _, path := range []string{"/", "/journal", "/evals", "/flashcards"} {
+		resp, err := app.client.Get(app.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), "could not be rendered") ||
+			!strings.Contains(string(body), "</html>") {
+			t.Errorf("%s: status %d, body: %s", path, resp.StatusCode, body)
+		}
+		if path == "/" && !strings.Contains(string(body), "still readable") {
+			t.Errorf("fallback page lost the history: %s", body)
+		}
+	}
+}
+
+func TestTemplateOverlay(t *testing.T) {
+	app := newTestApp(t)
+	dir := t.TempDir()
+	// A whole page, and one block of a multi-part template
+	os.WriteFile(filepath.Join(dir, "journal.html"), []byte(`<p>Custom journal</p>`), 0o644)
+	os.WriteFile(filepath.Join(dir, "agents_run.html"), []byte(`{{define "agents_run_error"}}<p>Custom error</p>{{end}}`), 0o644)
+	templateOverlayDir = dir
+	defer func() {
+		templateOverlayDir = ""
+		loadTemplates()
+	}()
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) string {
+		resp, err := app.client.Get(app.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body)
+	}
+	if body := get("/journal"); body != "<p>Custom journal</p>" {
+		t.Errorf("journal page = %s", body)
+	}
+	if body := get("/"); !strings.Contains(body, `action="/chat"`) {
+		t.Errorf("page without an override changed: %s", body)
+	}
+	templateMut.RLock()
+	defer templateMut.RUnlock()
+	if templates.Lookup("agents_run_start") == nil || templates.Lookup("agents_run_error").Tree.Root.String() != "<p>Custom error</p>" {
+		t.Error("overlay block did not replace only its own definition")
+	}
+}
+
+func TestLocalizedFormatting(t *testing.T) {
+	at := time.Date(2026, 3, 5, 14, 30, 0, 0, time.UTC)
+	de := newLocalizer("de", "Europe/Berlin", "")
+	de.now = at.Add(2*time.Minute + 10*time.Second)
+	us := newLocalizer("", "America/New_York", "en-US,en;q=0.9")
+	us.now = at.Add(30 * time.Hour)
+	for _, c := range []struct{ got, want string }{
+		{de.Time(at), "05.03.2026 15:30"},
+		{de.Ago(at), "vor 2 Min."},
+		{de.Number(1234567.891), "1.234.567,89"},
+		{us.Time(at), "Mar 5, 2026 9:30 AM"},
+		{us.Clock(at), "9:30:00 AM"},
+		{us.Ago(at), "yesterday"},
+		{us.Ago(at.Add(-30 * 24 * time.Hour)), "Feb 3, 2026 9:30 AM"},
+		{us.Number(98765), "98,765"},
+		{newLocalizer("", "", "fr-CA, en;q=0.5").Number(0.5), "0,5"},
+		{Localizer{}.Number(1500), "1,500"},
+	} {
+		if c.got != c.want {
+			t.Errorf("got %q, want %q", c.got, c.want)
+		}
+	}
+
+	app := newTestApp(t)
+	app.ollama.SetChunks("hallo")
+	app.chat("hi")
+	settings := func(form url.Values) (int, string) {
+		t.Helper()
+		resp, err := app.client.PostForm(app.server.URL+"/settings", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, _ := settings(url.Values{"locale": {"de"}, "time_zone": {"Mars/Olympus"}}); code != http.StatusBadRequest {
+		t.Errorf("unknown time zone: %d", code)
+	}
+	if code, _ := settings(url.Values{"locale": {"tlh"}}); code != http.StatusBadRequest {
+		t.Errorf("unknown locale: %d", code)
+	}
+	if code, page := settings(url.Values{"locale": {"de"}, "time_zone": {"Europe/Berlin"}}); code != http.StatusOK || !strings.Contains(page, "1.234,5") {
+		t.Fatalf("settings: %d %s", code, page)
+	}
+	resp, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !regexp.MustCompile(`<time class="message-time" datetime="[^"]+Z" title="[0-9.]+ [0-9:]+">gerade eben</time>`).Match(page) {
+		t.Errorf("message times not localized: %s", page)
+	}
+}
+
+func TestReasoningSections(t *testing.T) {
+	for _, c := range []struct{ reply, reasoning, answer string }{
+		{"<think>\nhmm\n</think>\n\nYes.", "hmm", "Yes."},
+		{"hmm</think>Yes.", "hmm", "Yes."},
+		{"<think>still thinking", "still thinking", ""},
+		{"No tags <b>here</b>", "", "No tags <b>here</b>"},
+	} {
+		if reasoning, answer := splitReasoning(c.reply); reasoning != c.reasoning || answer != c.answer {
+			t.Errorf("splitReasoning(%q) = %q, %q", c.reply, reasoning, answer)
+		}
+	}
+
+	app := newTestApp(t)
+	app.ollama.SetChunks("<think>Check **units**</think>", "It is 42.")
+	_, page := app.chat("answer?")
+	if !strings.Contains(page, `<details class="reasoning"><summary>Reasoning</summary><p>Check <strong>units</strong></p>`) || !strings.Contains(page, "<p>It is 42.</p>") {
+		t.Errorf("reasoning not shown collapsed: %s", page)
+	}
+	sessionMut.Lock()
+	for _, sess := range sessions {
+		if m := sess.History[len(sess.History)-1]; m.Content != "It is 42." || m.Reasoning != "Check **units**" {
+			t.Errorf("reply stored as %+v", m)
+		}
+	}
+	sessionMut.Unlock()
+
+	resp, err := app.client.PostForm(app.server.URL+"/settings", url.Values{"locale": {""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), `name="show_reasoning" value="1" checked`) {
+		t.Errorf("reasoning still shown in settings")
+	}
+	if resp, err = app.client.Get(app.server.URL + "/"); err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "units") || !strings.Contains(string(body), "It is 42.") {
+		t.Errorf("reasoning shown after hiding it: %s", body)
+	}
+}
+
+func TestStaticAssetFingerprinting(t *testing.T) {
+	app := newTestApp(t)
+
+	url := assetURL("style.css")
+	if url == "/static/style.css" {
+		t.Fatalf("style.css was not fingerprinted")
+	}
+
+	resp, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), url) {
+		t.Errorf("home page does not link %s", url)
+	}
+
+	resp, err = app.client.Get(app.server.URL + url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, resp.StatusCode)
+	}
+	if cc := resp.Header.Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("fingerprinted asset Cache-Control = %q", cc)
+	}
+}
+
+func TestGzipCompressesHTML(t *testing.T) {
+	app := newTestApp(t)
+
+	req, _ := http.NewRequest(http.MethodGet, app.server.URL+"/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := app.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("home page not compressed; headers: %v", resp.Header)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(zr)
+	if !strings.Contains(string(page), "<form") {
+		t.Errorf("decompressed page looks wrong: %.200s", page)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, app.server.URL+"/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err = app.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("streaming request was compressed")
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	app := newTestApp(t)
+
+	get := func(header http.Header) http.Header {
+		req, _ := http.NewRequest(http.MethodGet, app.server.URL+"/", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := app.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+	h := get(nil)
+	if h.Get("Content-Security-Policy") != defaultCSP || h.Get("X-Frame-Options") != "DENY" ||
+		h.Get("Referrer-Policy") != "same-origin" || h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("headers = %v", h)
+	}
+	if got := h.Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("HSTS over plain HTTP: %q", got)
+	}
+	if got := get(http.Header{"X-Forwarded-Proto": {"https"}}).Get("Strict-Transport-Security"); got != "max-age=15552000; includeSubDomains" {
+		t.Errorf("HSTS over HTTPS = %q", got)
+	}
+
+	// The policy allows no inline scripts, so the templates must not have any
+	inline := regexp.MustCompile(`(?i)<script(\s[^>]*)?>\s*[^<\s]|\son[a-z]+\s*=|javascript:`)
+	files, _ := filepath.Glob(filepath.Join(templateDir, "*.html"))
+	for _, f := range files {
+		b, _ := os.ReadFile(f)
+		if loc := inline.FindIndex(b); loc != nil {
+			t.Errorf("%s has inline script: %q", f, b[loc[0]:loc[1]])
+		}
+	}
+}
+
+func TestConfigFromEnvAndFlags(t *testing.T) {
+	t.Setenv("OLLAMA_URL", "http://gpu-box:11434")
+	t.Setenv("DEFAULT_MODEL", "from-env")
+	t.Setenv("COOKIE_LIFETIME", "2h")
+	t.Setenv("LISTEN_ADDR", "")
+
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	if err := fs.Parse([]string{"-model", "from-flag", "-static", "/srv/static"}); err != nil {
+		t.Fatal(err)
+	}
+	want := Config{ListenAddr: ":8080", OllamaURL: "http://gpu-box:11434", DefaultModel: "from-flag",
+		TemplateDir: "templates", StaticDir: "/srv/static", CookieLifetime: 2 * time.Hour, SessionEvict: "persist"}
+	if cfg != want {
+		t.Errorf("config = %+v, want %+v", cfg, want)
+	}
+
+	// Every other flag reads a variable named after it; the flag wins, and
+	// the Config's own flags do not read their name as well
+	t.Setenv("ADMIN_PASSWORD", "from-env")
+	t.Setenv("WORKERS", "9")
+	t.Setenv("OFFLINE_QUEUE", "true")
+	t.Setenv("SESSION_STORE", "sqlite:env.db")
+	t.Setenv("MODEL", "ignored")
+	var admin, spec string
+	var workers int
+	var queue bool
+	fs.StringVar(&admin, "admin-password", "", "")
+	fs.IntVar(&workers, "workers", 4, "")
+	fs.BoolVar(&queue, "offline-queue", false, "")
+	fs.StringVar(&spec, "session-store", "", "")
+	if err := fs.Parse([]string{"-session-store", "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFlagsFromEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if admin != "from-env" || workers != 9 || !queue || spec != "memory" || cfg.DefaultModel != "from-flag" {
+		t.Errorf("admin %q, workers %d, queue %v, store %q, model %q", admin, workers, queue, spec, cfg.DefaultModel)
+	}
+	t.Setenv("WORKERS", "many")
+	if err := setFlagsFromEnv(fs); err == nil || !strings.Contains(err.Error(), "WORKERS") {
+		t.Errorf("bad WORKERS: %v", err)
+	}
+}
+
+func TestConfigFileReload(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("ok")
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	configPath = path
+	t.Cleanup(func() {
+		configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{}
+		rateLimiter.buckets = map[string]*rateBucket{}
+	})
+
+	write := func(yaml string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// Distinct times, since the file may change within the clock's resolution
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		reloadFileConfig()
+	}
+	post := func(model string) (int, http.Header) {
+		body := `{"model": "` + model + `", "messages": [{"role": "user", "content": "hello"}]}`
+		resp, err := http.Post(app.server.URL+"/api/v1/chat", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header
+	}
+
+	start := time.Now().Add(-time.Hour)
+	write("models: [llama3]\nsystem_prompt: Answer briefly.\n", start)
+	if code, _ := post("mistral"); code != http.StatusBadRequest {
+		t.Errorf("disallowed model: status %d", code)
+	}
+	if code, _ := post("llama3:latest"); code != http.StatusOK {
+		t.Fatalf("allowed model: status %d", code)
+	}
+	reqs := app.ollama.Requests()
+	if msgs := reqs[len(reqs)-1].Messages; len(msgs) != 2 || msgs[0].Role != "system" || msgs[0].Content != "Answer briefly." {
+		t.Errorf("messages sent = %+v", msgs)
+	}
+
+	// A broken file keeps the settings in effect
+	write("models: [", start.Add(time.Minute))
+	if code, _ := post("mistral"); code != http.StatusBadRequest {
+		t.Errorf("after a bad reload: status %d", code)
+	}
+
+	write("rate_limit: {per_minute: 1, burst: 2}\n", start.Add(2*time.Minute))
+	for i := 0; i < 2; i++ {
+		if code, _ := post("mistral"); code != http.StatusOK {
+			t.Fatalf("request %d within the burst: status %d", i, code)
+		}
+	}
+	code, header := post("mistral")
+	if code != http.StatusTooManyRequests || header.Get("Retry-After") == "" {
+		t.Errorf("over the limit: status %d, Retry-After %q", code, header.Get("Retry-After"))
+	}
+}
+
+func TestRateLimitClients(t *testing.T) {
+	apiKeys = map[string]APIKey{"real-token": {Name: "ci", Key: "real-token"}}
+	t.Cleanup(func() { apiKeys = map[string]APIKey{} })
+	client := func(auth string) string {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/chat", nil)
+		r.RemoteAddr = "203.0.113.7:5000"
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return rateLimitClient(r)
+	}
+	// Only a configured key gets a bucket of its own; made-up ones share
+	// the address's, so rotating them does not escape the limit
+	for auth, want := range map[string]string{
+		"Bearer real-token": "key:real-token",
+		"Bearer made-up-1":  "addr:203.0.113.7",
+		"Bearer made-up-2":  "addr:203.0.113.7",
+		"":                  "addr:203.0.113.7",
+	} {
+		if got := client(auth); got != want {
+			t.Errorf("client for %q = %q, want %q", auth, got, want)
+		}
+	}
+	if !rateLimited("/flashcards") || rateLimited("/chat/stop") {
+		t.Errorf("rateLimited(/flashcards) = %v, rateLimited(/chat/stop) = %v", rateLimited("/flashcards"), rateLimited("/chat/stop"))
+	}
+
+	// Over the socket each frame takes a token, a cancel excepted
+	app := newTestApp(t)
+	app.ollama.SetChunks("ok")
+	fileConfig = FileConfig{RateLimit: RateLimit{PerMinute: 1, Burst: 2}}
+	t.Cleanup(func() {
+		fileConfig = FileConfig{}
+		rateLimiter.buckets = map[string]*rateBucket{}
+	})
+	u, _ := url.Parse(app.server.URL)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://"+u.Host+"/ws", http.Header{"Origin": {app.server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, f := range []ChatFrame{{Type: "resume"}, {Type: "cancel"}, {Type: "resume"}, {Type: "prompt", Text: "hi"}} {
+		conn.WriteJSON(f)
+	}
+	var f ChatFrame
+	if err := conn.ReadJSON(&f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != "error" || !strings.Contains(f.Error, "rate limit exceeded") {
+		t.Errorf("third counted frame got %+v, want the rate limit error", f)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("ok")
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	config := `tenants:
+  acme:
+    models: [llama3]
+    rate_limit: {per_minute: 1}
+    branding: {title: Acme Chat, accent: "#0a7"}
+  beta:
+    hosts: [chat.beta.test]
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath = path
+	apiKeys = map[string]APIKey{"acme-token": {Name: "acme", Key: "acme-token", Tenant: "acme"}}
+	t.Cleanup(func() {
+		configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{}
+		apiKeys = map[string]APIKey{}
+		rateLimiter.buckets = map[string]*rateBucket{}
+	})
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, host, path, body string, cookies ...*http.Cookie) *http.Response {
+		req, err := http.NewRequest(method, app.server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host != "" {
+			req.Host = host
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	sessionCookie := func(resp *http.Response) *http.Cookie {
+		for _, c := range resp.Cookies() {
+			if strings.HasPrefix(c.Name, "session_id") {
+				return c
+			}
+		}
+		return nil
+	}
+
+	// By path prefix: the tenant's branding and a cookie of its own
+	resp := do("GET", "", "/t/acme/", "")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "<title>Acme Chat</title>") || !strings.Contains(string(body), `style="color: #0a7"`) {
+		t.Errorf("acme's page is not branded:\n%s", body)
+	}
+	acme := sessionCookie(resp)
+	if acme == nil || acme.Name != "session_id_acme" {
+		t.Fatalf("acme's session cookie = %+v", acme)
+	}
+	sessionMut.Lock()
+	_, stored := sessions["acme/"+acme.Value]
+	sessionMut.Unlock()
+	if !stored {
+		t.Errorf("acme's session is not kept under its tenant")
+	}
+
+	// The same cookie by subdomain opens the same session
+	resp = do("GET", "acme.chat.test", "/", "", acme)
+	resp.Body.Close()
+	if c := sessionCookie(resp); c != nil {
+		t.Errorf("acme's session was not accepted by subdomain; got %+v", c)
+	}
+
+	// Outside the tenant its session cannot be reached, slash or not
+	for _, c := range []*http.Cookie{{Name: "session_id", Value: acme.Value}, {Name: "session_id", Value: "acme/" + acme.Value}} {
+		resp = do("GET", "", "/", "", c)
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if sessionCookie(resp) == nil || !strings.Contains(string(body), "<title>"+defaultTitle+"</title>") {
+			t.Errorf("cookie %q opened a session outside its tenant", c.Value)
+		}
+	}
+
+	// Hosts listed for a tenant, and unknown prefixes
+	resp = do("GET", "chat.beta.test:8080", "/", "")
+	resp.Body.Close()
+	if c := sessionCookie(resp); c == nil || c.Name != "session_id_beta" {
+		t.Errorf("beta's host gave cookie %+v", c)
+	}
+	resp = do("GET", "", "/t/nobody/", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown tenant: status %d", resp.StatusCode)
+	}
+
+	// The tenant's models and quota
+	chat := func(host, model string) int {
+		resp := do("POST", host, "/api/v1/chat", `{"model": "`+model+`", "messages": [{"role": "user", "content": "hi"}]}`)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := chat("acme.chat.test", "mistral"); code != http.StatusBadRequest {
+		t.Errorf("model outside acme's list: status %d", code)
+	}
+	if code := chat("beta.chat.test", "mistral"); code != http.StatusOK {
+		t.Errorf("beta's chat: status %d", code)
+	}
+	if code := chat("acme.chat.test", "llama3"); code != http.StatusTooManyRequests {
+		// The refused request above used acme's one token
+		t.Errorf("over acme's quota: status %d", code)
+	}
+
+	// API keys stay within their tenant
+	req, _ := http.NewRequest("GET", app.server.URL+"/api/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer acme-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("acme's key outside acme: status %d", resp.StatusCode)
+	}
+}
+
+func TestTenantUpstreams(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("from the shared host")
+	acmeOllama := fakeollama.New()
+	defer acmeOllama.Close()
+	acmeOllama.SetChunks("from acme's host")
+
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	config := "tenants:\n  acme:\n    ollama: [" + acmeOllama.URL + "/]\n    default_model: acme-model\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath = path
+	t.Cleanup(func() { configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{} })
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := upstreams(); len(hosts) != 2 || hosts[1] != acmeOllama.URL {
+		t.Errorf("upstreams = %v", hosts)
+	}
+
+	// The JSON API and the web chat both go to the tenant's host, with its model
+	body := `{"messages": [{"role": "user", "content": "hi"}]}`
+	resp, err := http.Post(app.server.URL+"/t/acme/api/v1/chat", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = app.client.PostForm(app.server.URL+"/t/acme/chat", url.Values{"prompt": {"hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// The redirect after the chat, and the page's links, stay under the
+	// tenant's prefix
+	if resp.Request.URL.Path != "/t/acme/" {
+		t.Errorf("chat redirected to %s, want /t/acme/", resp.Request.URL.Path)
+	}
+	if !strings.Contains(string(page), `action="/t/acme/chat"`) || !strings.Contains(string(page), `data-base="/t/acme"`) || strings.Contains(string(page), `action="/chat"`) {
+		t.Errorf("acme's page links outside its prefix:\n%s", page)
+	}
+	sessionMut.Lock()
+	for id, sess := range sessions {
+		if strings.HasPrefix(id, "acme/") && (len(sess.History) == 0 || sess.History[len(sess.History)-1].Content != "from acme's host") {
+			t.Errorf("acme's chat = %+v", sess.History)
+		}
+	}
+	sessionMut.Unlock()
+	reqs := acmeOllama.Requests()
+	if len(reqs) != 2 || reqs[0].Model != "acme-model" || reqs[1].Model != "acme-model" {
+		t.Errorf("acme's host got %+v", reqs)
+	}
+
+	// Outside the tenant, the server's host and model
+	resp, err = http.Post(app.server.URL+"/api/v1/chat", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if reqs := app.ollama.Requests(); len(reqs) != 1 || reqs[0].Model != defaultModel {
+		t.Errorf("the shared host got %+v", reqs)
+	}
+
+	// A table's CSV link and an async job's Location keep the prefix too
+	acmeOllama.SetChunks("| a | b |\n|---|---|\n| 1 | 2 |\n")
+	resp, err = app.client.PostForm(app.server.URL+"/t/acme/chat", url.Values{"prompt": {"a table"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), `href="/t/acme/export/table?message=3&amp;table=0"`) {
+		t.Errorf("acme's CSV link is outside its prefix:\n%s", page)
+	}
+	resp, err = app.client.Get(app.server.URL + "/t/acme/export/table?message=3&table=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(csv) != "a,b\n1,2\n" {
+		t.Errorf("acme's CSV = %q", csv)
+	}
+	resp, err = http.Post(app.server.URL+"/t/acme/api/v1/jobs", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	loc := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusAccepted || !strings.HasPrefix(loc, "/t/acme/api/v1/jobs/") {
+		t.Fatalf("acme's job: status %d, Location %q", resp.StatusCode, loc)
+	}
+	resp, err = http.Get(app.server.URL + loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("polling acme's job: status %d", resp.StatusCode)
+	}
+}
+
+func TestAllowedModels(t *testing.T) {
+	app := newTestApp(t)
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte("models: [fake-model]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath = path
+	t.Cleanup(func() { configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{} })
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(app.ollama.URL+"/api/pull", "application/json", strings.NewReader(`{"model": "experimental:70b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Listings leave out models outside the allowlist
+	for _, path := range []string{"/api/v1/models", "/v1/models"} {
+		resp, err := http.Get(app.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), "fake-model") || strings.Contains(string(body), "experimental") {
+			t.Errorf("%s = %s", path, body)
+		}
+	}
+
+	// So do the pages that take a model
+	resp, err = app.client.Get(app.server.URL + "/evals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), `<option value="fake-model">`) {
+		t.Error("evals page does not suggest the allowed model")
+	}
+	resp, err = app.client.PostForm(app.server.URL+"/agents", url.Values{
+		"topic": {"tabs or spaces"}, "turns": {"1"},
+		"agent_name": {"A", "B"}, "agent_model": {"fake-model", "experimental:70b"}, "agent_prompt": {"For tabs.", "For spaces."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("agents with a disallowed model: status %d", resp.StatusCode)
+	}
+	resp, err = app.client.PostForm(app.server.URL+"/prompts", url.Values{"models": {"experimental:70b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("prompt tests with a disallowed model: status %d", resp.StatusCode)
+	}
+	resp, err = http.Post(app.server.URL+"/api/v1/embeddings", "application/json", strings.NewReader(`{"model": "experimental:70b", "input": ["hi"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("embeddings with a disallowed model: status %d", resp.StatusCode)
+	}
+}
+
+func TestOptionLimits(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("ok")
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	yaml := "option_limits:\n  num_predict: {max: 256, default: 128}\n  temperature: {min: 0.1}\n  num_ctx: {value: 4096}\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath = path
+	t.Cleanup(func() { configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{} })
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	lastOptions := func() map[string]interface{} {
+		reqs := app.ollama.Requests()
+		return reqs[len(reqs)-1].Options
+	}
+
+	body := `{"messages": [{"role": "user", "content": "hi"}], "options": {"num_predict": 5000, "temperature": 0, "num_ctx": 99, "top_k": 20}}`
+	resp, err := http.Post(app.server.URL+"/api/v1/chat", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Notices []string `json:"notices"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	opts := lastOptions()
+	if opts["num_predict"] != 256.0 || opts["temperature"] != 0.1 || opts["num_ctx"] != 4096.0 || opts["top_k"] != 20.0 {
+		t.Errorf("options sent = %v", opts)
+	}
+	want := []string{"num_ctx is fixed at 4096", "num_predict lowered to the maximum of 256", "temperature raised to the minimum of 0.1"}
+	if !reflect.DeepEqual(out.Notices, want) || !reflect.DeepEqual(resp.Header.Values("X-Option-Notice"), want) {
+		t.Errorf("notices = %q, headers %q", out.Notices, resp.Header.Values("X-Option-Notice"))
+	}
+
+	// Page chats choose no options, so they get the defaults and fixed values
+	app.chat("hello")
+	if opts := lastOptions(); opts["num_predict"] != 128.0 || opts["num_ctx"] != 4096.0 || len(opts) != 2 {
+		t.Errorf("page chat options = %v", opts)
+	}
+
+	if err := os.WriteFile(path, []byte("option_limits:\n  top_p: {min: 0.9, max: 0.1}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFileConfig(); err == nil {
+		t.Error("min above max was accepted")
+	}
+}
+
+func TestContextTruncation(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("ok")
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte("system_prompt: Be brief.\ncontext:\n  num_ctx: 200\n  reserve: 50\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath = path
+	t.Cleanup(func() { configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{} })
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := estimateTokens(Message{Role: "user", Content: strings.Repeat("x", 200)}); got != 54 {
+		t.Errorf("estimate for 200 ASCII characters = %d", got)
+	}
+	if got := estimateTokens(Message{Role: "user", Content: "日本語", Images: []string{"a"}}); got != 3+messageOverhead+imageTokens {
+		t.Errorf("estimate with an image = %d", got)
+	}
+
+	// Each turn is about 59 tokens, so the third leaves out the first
+	long := strings.Repeat("x", 200)
+	for i := 1; i <= 3; i++ {
+		app.chat(fmt.Sprintf("%d%s", i, long[1:]))
+	}
+	reqs := app.ollama.Requests()
+	last := reqs[len(reqs)-1]
+	var first []string
+	for _, m := range last.Messages {
+		first = append(first, m.Role+":"+m.Content[:1])
+	}
+	if want := []string{"system:B", "user:2", "assistant:o", "user:3"}; !reflect.DeepEqual(first, want) {
+		t.Errorf("messages sent = %q, want %q", first, want)
+	}
+	if last.Options["num_ctx"] != 200.0 {
+		t.Errorf("num_ctx sent = %v", last.Options["num_ctx"])
+	}
+	if len(reqs[1].Messages) != 4 {
+		t.Errorf("second turn sent %d messages; it fits", len(reqs[1].Messages))
+	}
+	sessionMut.Lock()
+	for _, s := range sessions {
+		if len(s.History) != 6 || s.History[0].Content[:1] != "1" {
+			t.Errorf("truncation changed the stored history: %d messages", len(s.History))
+		}
+	}
+	sessionMut.Unlock()
+
+	// A chat's own num_ctx is the window instead
+	body := `{"session": true, "messages": [{"role": "user", "content": "more"}], "options": {"num_ctx": 4096}}`
+	resp, err := app.client.Post(app.server.URL+"/api/v1/chat", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	reqs = app.ollama.Requests()
+	if n := len(reqs[len(reqs)-1].Messages); n != 8 {
+		t.Errorf("with num_ctx 4096, %d messages sent", n)
+	}
+
+	// However small the window, the system prompt and the newest message go
+	msgs := []Message{{Role: "system", Content: long}, {Role: "user", Content: long},
+		{Role: "assistant", ToolCalls: []ToolCall{{}}}, {Role: "tool", Content: long}, {Role: "user", Content: long}}
+	if out, dropped := fitContext(msgs, 10); dropped != 3 || len(out) != 2 || out[1].Role != "user" {
+		t.Errorf("fitContext kept %d, dropped %d", len(out), dropped)
+	}
+}
+
+func TestHistoryCompaction(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("ok")
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	yaml := "context:\n  num_ctx: 400\n  reserve: 100\n  summarize: true\n  keep_recent: 2\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath = path
+	t.Cleanup(func() { configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{} })
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", 200)
+	due := func() (string, bool) {
+		t.Helper()
+		sessionMut.Lock()
+		defer sessionMut.Unlock()
+		for id, s := range sessions {
+			return id, s.needsCompaction(s.Active, s.History)
+		}
+		return "", false
+	}
+
+	// About 59 tokens a turn against 225, three quarters of the budget
+	for i := 1; i <= 3; i++ {
+		app.chat(fmt.Sprintf("%d%s", i, long[1:]))
+	}
+	if _, ok := due(); ok {
+		t.Error("compaction due after three turns")
+	}
+	app.chat("4" + long[1:])
+	sessionID, ok := due()
+	if !ok {
+		t.Fatal("compaction not due after four turns")
+	}
+
+	app.ollama.SetChunks("The user sent three long lines.")
+	if err := compactConversation(context.Background(), sessionID, 0); err != nil {
+		t.Fatal(err)
+	}
+	reqs := app.ollama.Requests()
+	prompt := reqs[len(reqs)-1].Messages[1].Content
+	if !strings.Contains(prompt, "User: 3x") || strings.Contains(prompt, "User: 4x") {
+		t.Errorf("compaction prompt:\n%s", prompt)
+	}
+	if _, ok := due(); ok {
+		t.Error("compaction still due after compacting")
+	}
+
+	app.ollama.SetChunks("ok")
+	app.chat("next")
+	reqs = app.ollama.Requests()
+	var sent []string
+	for _, m := range reqs[len(reqs)-1].Messages {
+		if len(m.Content) > 4 {
+			m.Content = m.Content[:4]
+		}
+		sent = append(sent, m.Role+":"+m.Content)
+	}
+	if want := []string{"system:Summ", "user:4xxx", "assistant:ok", "user:next"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("messages sent = %q, want %q", sent, want)
+	}
+	resp, err := app.client.Get(app.server.URL + "/api/v1/conversations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Conversations []APIConversation `json:"conversations"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if len(out.Conversations) != 1 || out.Conversations[0].Summary != "The user sent three long lines." {
+		t.Errorf("conversations = %+v", out.Conversations)
+	}
+
+	// Editing a summarized message sets the summary aside
+	app.client.PostForm(app.server.URL+"/history", url.Values{"action": {"edit"}, "id": {"1"}, "content": {"changed"}})
+	app.chat("again")
+	reqs = app.ollama.Requests()
+	if first := reqs[len(reqs)-1].Messages[0]; first.Role != "user" || first.Content != "changed" {
+		t.Errorf("after an edit, the chat opens with %s %.10q", first.Role, first.Content)
+	}
+}
+
+func TestTableCSVExport(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Here:\n\n| Name | Score |\n|---|:--:|\n| **Ada** | 10 |\n| Bob, Jr. | 7 |\n")
+
+	_, page := app.chat("make a table")
+	if !strings.Contains(page, "/export/table?message=1&amp;table=0") {
+		t.Fatalf("page missing CSV link: %s", page)
+	}
+
+	resp, err := app.client.Get(app.server.URL + "/export/table?message=1&table=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	want := "Name,Score\nAda,10\n\"Bob, Jr.\",7\n"
+	if string(body) != want {
+		t.Errorf("csv = %q, want %q", body, want)
+	}
+
+	resp, err = app.client.Get(app.server.URL + "/export/table?message=1&table=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing table status = %d, want 404", resp.StatusCode)
+	}
+
+	// Cells a spreadsheet would run as formulas are quoted
+	app.ollama.SetChunks("| Cell | Value |\n|---|---|\n| =HYPERLINK(\"http://x\") | -5 |\n| +1+2 | @SUM(A1) |\n| -2+3 | 1.5 |\n")
+	app.chat("make another")
+	resp, err = app.client.Get(app.server.URL + "/export/table?message=3&table=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	want = "Cell,Value\n\"'=HYPERLINK(\"\"http://x\"\")\",-5\n'+1+2,'@SUM(A1)\n'-2+3,1.5\n"
+	if string(body) != want {
+		t.Errorf("csv = %q, want %q", body, want)
+	}
+}
+
+func TestFocusSessionSummary(t *testing.T) {
+	app := newTestApp(t)
+
+	post := func(action string) int {
+		resp, err := app.client.PostForm(app.server.URL+"/focus", url.Values{"action": {action}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	app.chat("before focus")
+	if status := post("start"); status != http.StatusOK {
+		t.Fatalf("start focus: status %d", status)
+	}
+	app.chat("plan the release")
+
+	app.ollama.SetChunks("Released on Friday.")
+	if status := post("end"); status != http.StatusOK {
+		t.Fatalf("end focus: status %d", status)
+	}
+
+	reqs := app.ollama.Requests()
+	last := reqs[len(reqs)-1]
+	if last.Stream || len(last.Messages) != 2 || last.Messages[0].Role != "system" {
+		t.Fatalf("summary request = %+v", last)
+	}
+	if strings.Contains(last.Messages[1].Content, "before focus") {
+		t.Errorf("summary included messages from before the focus session")
+	}
+	if !strings.Contains(last.Messages[1].Content, "plan the release") {
+		t.Errorf("summary transcript missing focus messages")
+	}
+
+	resp, err := app.client.Get(app.server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "Session summary") || !strings.Contains(string(page), "Released on Friday.") {
+		t.Errorf("summary not shown on page")
+	}
+}
+
+func TestFocusSummaryAfterDeletes(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("before focus")
+	app.chat("also before")
+	resp, err := app.client.PostForm(app.server.URL+"/focus", url.Values{"action": {"start"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	app.chat("plan the release")
+
+	// Removing messages from before the session must not hide the new ones
+	var sessionID string
+	sessionMut.Lock()
+	for id, sess := range sessions {
+		sessionID = id
+		sess.deleteMessage(sess.History[0].ID)
+		sess.deleteMessage(sess.History[0].ID)
+		sess.deleteMessage(sess.History[0].ID)
+	}
+	sessionMut.Unlock()
+
+	app.ollama.SetChunks("Release planned.")
+	if err := summarizeSession(context.Background(), sessionID); err != nil {
+		t.Fatal(err)
+	}
+	reqs := app.ollama.Requests()
+	transcript := reqs[len(reqs)-1].Messages[1].Content
+	if !strings.Contains(transcript, "plan the release") || strings.Contains(transcript, "before") {
+		t.Errorf("summary transcript = %q", transcript)
+	}
+
+	// Nothing new since the summary: a second pass does not call the model
+	sessionMut.Lock()
+	getSession(sessionID).undo()
+	sessionMut.Unlock()
+	if err := summarizeSession(context.Background(), sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(app.ollama.Requests()); n != len(reqs) {
+		t.Errorf("summarised again after an undo: %d requests, want %d", n, len(reqs))
+	}
+}
+
+func TestFocusSummaryPerConversation(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("before focus")
+	resp, err := app.client.PostForm(app.server.URL+"/focus", url.Values{"action": {"start"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	app.chat("first topic")
+
+	var sessionID string
+	sessionMut.Lock()
+	for id, sess := range sessions {
+		sessionID = id
+		sess.createConversation("Second")
+		sess.append(Message{Role: "user", Content: "second topic"})
+	}
+	sessionMut.Unlock()
+
+	transcript := func() string {
+		if err := summarizeSession(context.Background(), sessionID); err != nil {
+			t.Fatal(err)
+		}
+		reqs := app.ollama.Requests()
+		return reqs[len(reqs)-1].Messages[1].Content
+	}
+	app.ollama.SetChunks("Second summary.")
+	if got := transcript(); got != "User: second topic\n\n" {
+		t.Errorf("second conversation's transcript = %q", got)
+	}
+
+	// The first conversation's messages were not covered by that summary
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	if err := sess.switchConversation(0); err != nil {
+		t.Fatal(err)
+	}
+	sessionMut.Unlock()
+	app.ollama.SetChunks("First summary.")
+	if got := transcript(); !strings.Contains(got, "User: first topic") || strings.Contains(got, "before focus") || strings.Contains(got, "second") {
+		t.Errorf("first conversation's transcript = %q", got)
+	}
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	if h := projectHistory(sess.Events, 1); !strings.Contains(h[len(h)-1].Content, "Second summary.") {
+		t.Errorf("second conversation ends with %q", h[len(h)-1].Content)
+	}
+	if h := sess.History; !strings.Contains(h[len(h)-1].Content, "First summary.") {
+		t.Errorf("first conversation ends with %q", h[len(h)-1].Content)
+	}
+}
+
+func TestPromptTemplateTests(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("The library ", "now opens until 9pm.")
+
+	pt := &PromptTemplate{
+		ID:       "summary",
+		System:   "Be brief.",
+		Template: "Summarise: {{.text}}",
+		Tests: []PromptTest{
+			{Name: "mentions library", Vars: map[string]string{"text": "library hours"},
+				Assert: []PromptAssertion{{Contains: "Library"}, {Regex: `9 ?pm`}, {MaxLength: 100}}},
+			{Name: "too short", Vars: map[string]string{"text": "x"},
+				Assert: []PromptAssertion{{MinLength: 500}, {NotContains: "library"}}},
+			{Name: "missing var", Vars: map[string]string{}},
+		},
+	}
+	var err error
+	pt.tmpl, err = template.New(pt.ID).Option("missingkey=error").Parse(pt.Template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := runPromptTests(context.Background(), pt, []string{"m1", "m2"})
+	if len(results) != 6 {
+		t.Fatalf("got %d results, want 6", len(results))
+	}
+	if !results[0].Passed() || results[0].Model != "m1" || results[3].Model != "m2" {
+		t.Errorf("first test should pass on each model: %+v", results[0])
+	}
+	if len(results[1].Failures) != 2 {
+		t.Errorf("second test failures = %v, want 2", results[1].Failures)
+	}
+	if results[2].Error == "" {
+		t.Errorf("missing template variable should be an error")
+	}
+
+	reqs := app.ollama.Requests()
+	if len(reqs) != 4 || reqs[0].Messages[0].Role != "system" || reqs[0].Messages[1].Content != "Summarise: library hours" {
+		t.Fatalf("requests = %+v", reqs)
+	}
+}
+
+func TestDatasetExport(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("<think>hmm</think>", "Mail me at ", "bob@example.com")
+	app.chat("my IP is 192.168.1.20")
+
+	export := func(format, redact string) string {
+		form := url.Values{"conversation": {"chat"}, "format": {format}, "redact": {redact}}
+		resp, err := app.client.PostForm(app.server.URL+"/dataset", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d: %s", resp.StatusCode, body)
+		}
+		return string(body)
+	}
+
+	got := export("sharegpt", "1")
+	want := `{"conversations":[{"from":"human","value":"my IP is [IP]"},{"from":"gpt","value":"Mail me at [EMAIL]"}]}` + "\n"
+	if got != want {
+		t.Errorf("sharegpt export = %s, want %s", got, want)
+	}
+
+	got = export("jsonl", "")
+	if !strings.Contains(got, `{"role":"user","content":"my IP is 192.168.1.20"}`) || strings.Contains(got, "hmm") {
+		t.Errorf("jsonl export = %s", got)
+	}
+}
+
+func TestDatasetPrivacy(t *testing.T) {
+	app := newTestApp(t)
+	if err := loadAnonymizer(); err != nil {
+		t.Fatal(err)
+	}
+	app.ollama.SetChunks("Mail me at ", "bob@example.com")
+	app.chat("my IP is 192.168.1.20")
+
+	export := func(form url.Values) (int, string) {
+		form.Set("conversation", "chat")
+		form.Set("format", "sharegpt")
+		resp, err := app.client.PostForm(app.server.URL+"/dataset", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	for privacy, want := range map[string]string{
+		"redact":    `{"conversations":[{"from":"human","value":"my IP is [IP]"},{"from":"gpt","value":"Mail me at [EMAIL]"}]}` + "\n",
+		"anonymize": `{"conversations":[{"from":"human","value":"my IP is 192.0.2.1"},{"from":"gpt","value":"Mail me at user1@example.com"}]}` + "\n",
+		"none":      `{"conversations":[{"from":"human","value":"my IP is 192.168.1.20"},{"from":"gpt","value":"Mail me at bob@example.com"}]}` + "\n",
+	} {
+		// privacy wins over the older redact field
+		if code, got := export(url.Values{"privacy": {privacy}, "redact": {"1"}}); code != http.StatusOK || got != want {
+			t.Errorf("privacy=%s: status %d, export %s, want %s", privacy, code, got, want)
+		}
+	}
+	if code, _ := export(url.Values{"privacy": {"shred"}}); code != http.StatusBadRequest {
+		t.Errorf("unknown privacy option: status %d", code)
+	}
+}
+
+func TestAnonymizeConsistently(t *testing.T) {
+	if err := loadAnonymizer(); err != nil {
+		t.Fatal(err)
+	}
+	texts := []string{
+		"Jane wrote from jane@corp.com on 10.0.0.5.",
+		"Hi, my name is Jane Doe. Bob Smith is cc'd at bob@corp.com.",
+		"Reply to jane@corp.com, not 10.0.0.6. Dear Carla, thanks. Ask Bob Smith.",
+	}
+	a := newAnonymizer(texts)
+	var got []string
+	for _, text := range texts {
+		got = append(got, a.Anonymize(text))
+	}
+	want := []string{
+		"Person 1 wrote from user1@example.com on 192.0.2.1.",
+		"Hi, my name is Person 1. Person 2 is cc'd at user2@example.com.",
+		"Reply to user1@example.com, not 192.0.2.2. Dear Person 3, thanks. Ask Person 2.",
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("text %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestVoiceSocket(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("<think>plan</think>", "It is **sunny**. ", "Take a hat")
+
+	u, _ := url.Parse(app.server.URL)
+	header := http.Header{"Origin": {app.server.URL}}
+	for _, c := range app.client.Jar.Cookies(u) {
+		header.Add("Cookie", c.String())
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://"+u.Host+"/voice/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+
+	if err := conn.WriteJSON(VoiceEvent{Type: "transcript", Text: "weather?"}); err != nil {
+		t.Fatal(err)
+	}
+	var sentences []string
+	for {
+		var ev VoiceEvent
+		if err := conn.ReadJSON(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type == "sentence" {
+			sentences = append(sentences, ev.Text)
+		}
+		if ev.Type == "done" || ev.Type == "error" {
+			break
+		}
+	}
+	if strings.Join(sentences, "|") != "It is sunny.|Take a hat" {
+		t.Errorf("sentences = %q", sentences)
+	}
+
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	for _, sess := range sessions {
+		if len(sess.History) != 2 || sess.History[1].Content != "It is **sunny**. Take a hat" || sess.History[1].Reasoning != "plan" {
+			t.Errorf("history = %+v", sess.History)
+		}
+	}
+}
+
+func TestVoiceSentencesAcrossLinkChunks(t *testing.T) {
+	app := newTestApp(t)
+	// The speakable text shrinks once the link in the first chunk completes
+	app.ollama.SetChunks("See [docs](http://x.", "io). Next.")
+
+	u, _ := url.Parse(app.server.URL)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://"+u.Host+"/voice/ws", http.Header{"Origin": {app.server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+
+	conn.WriteJSON(VoiceEvent{Type: "transcript", Text: "where are the docs?"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var sentences []string
+	for {
+		var ev VoiceEvent
+		if err := conn.ReadJSON(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type == "sentence" {
+			sentences = append(sentences, ev.Text)
+		}
+		if ev.Type == "done" || ev.Type == "error" {
+			break
+		}
+	}
+	if strings.Join(sentences, " ") != "See docs. Next." {
+		t.Errorf("sentences = %q", sentences)
+	}
+}
+
+func TestTokenHubPolicies(t *testing.T) {
+	old := slowSubscriberTimeout
+	slowSubscriberTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { slowSubscriberTimeout = old })
+
+	hub := newTokenHub()
+	fast := hub.Subscribe(1, waitForSubscriber)
+	lossy := hub.Subscribe(1, dropTokens)        // never read until the end
+	stuck := hub.Subscribe(1, waitForSubscriber) // never read at all
+
+	var got strings.Builder
+	read := make(chan struct{})
+	go func() {
+		for tok := range fast.C {
+			got.WriteString(tok)
+		}
+		close(read)
+	}()
+
+	start := time.Now()
+	tokens := []string{"a", "b", "c", "d", "e"}
+	for _, tok := range tokens {
+		hub.Publish(tok)
+	}
+	hub.Close("abcde", nil)
+	<-read
+
+	if elapsed := time.Since(start); elapsed > 10*slowSubscriberTimeout {
+		t.Errorf("publishing took %v; a stuck subscriber stalled the stream", elapsed)
+	}
+	if got.String() != "abcde" {
+		t.Errorf("fast subscriber got %q", got.String())
+	}
+	if !stuck.Evicted() {
+		t.Error("stuck subscriber was not evicted")
+	}
+	if lossy.Dropped() != len(tokens)-1 {
+		t.Errorf("lossy subscriber dropped %d tokens, want %d", lossy.Dropped(), len(tokens)-1)
+	}
+	var kept []string
+	for tok := range lossy.C {
+		kept = append(kept, tok)
+	}
+	if reply, err := lossy.Result(); len(kept) != 1 || reply != "abcde" || err != nil {
+		t.Errorf("lossy subscriber kept %q, result %q, %v", kept, reply, err)
+	}
+}
+
+func TestVoiceAPI(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("<think>x</think>", "Turning on the **lights**.")
+
+	speech := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/audio/transcriptions":
+			if _, _, err := r.FormFile("file"); err != nil {
+				t.Errorf("no file sent to speech-to-text: %v", err)
+			}
+			io.WriteString(w, `{"text": " lights on "}`)
+		case "/v1/audio/speech":
+			body, _ := io.ReadAll(r.Body)
+			if !strings.Contains(string(body), `"input":"Turning on the lights."`) {
+				t.Errorf("speech request = %s", body)
+			}
+			w.Header().Set("Content-Type", "audio/wav")
+			io.WriteString(w, "RIFF")
+		}
+	}))
+	defer speech.Close()
+	oldSTT, oldTTS := sttURL, ttsURL
+	sttURL, ttsURL = speech.URL, speech.URL
+	defer func() { sttURL, ttsURL = oldSTT, oldTTS }()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("audio", "clip.wav")
+	part.Write([]byte("fake audio"))
+	mw.WriteField("speak", "true")
+	mw.Close()
+
+	resp, err := app.client.Post(app.server.URL+"/api/v1/voice", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out VoiceReply
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := VoiceReply{Transcript: "lights on", Reply: "Turning on the **lights**.", Audio: "UklGRg==", AudioType: "audio/wav"}
+	if resp.StatusCode != http.StatusOK || out != want {
+		t.Errorf("status %d, reply %+v", resp.StatusCode, out)
+	}
+}
+
+// When re-run with FAKE_MCP_SERVER=1 the test binary acts as a minimal MCP
+// server on stdio, offering an "add" tool and one resource
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_MCP_SERVER") == "1" {
+		serveFakeMCP(os.Stdin, os.Stdout)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func serveFakeMCP(in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+	enc := json.NewEncoder(out)
+	for scanner.Scan() {
+		var req struct {
+			ID     *int64          `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(scanner.Bytes(), &req)
+		if req.ID == nil {
+			continue
+		}
+		var result interface{}
+		switch req.Method {
+		case "initialize":
+			result = map[string]interface{}{"protocolVersion": mcpProtocolVersion,
+				"capabilities": map[string]interface{}{"tools": map[string]interface{}{}, "resources": map[string]interface{}{}}}
+		case "tools/list":
+			result = map[string]interface{}{"tools": []map[string]interface{}{{"name": "add", "description": "Add two numbers",
+				"inputSchema": map[string]interface{}{"type": "object"}}}}
+		case "resources/list":
+			result = map[string]interface{}{"resources": []map[string]string{{"uri": "note://todo", "name": "Todo list"}}}
+		case "tools/call":
+			var p struct {
+				Arguments struct{ A, B int } `json:"arguments"`
+			}
+			json.Unmarshal(req.Params, &p)
+			result = map[string]interface{}{"content": []map[string]string{{"type": "text", "text": strconv.Itoa(p.Arguments.A + p.Arguments.B)}}}
+		case "resources/read":
+			result = map[string]interface{}{"contents": []map[string]string{{"uri": "note://todo", "text": "buy milk"}}}
+		}
+		enc.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": *req.ID, "result": result})
+	}
+}
+
+func TestMCPToolsInChat(t *testing.T) {
+	app := newTestApp(t)
+
+	os.Setenv("FAKE_MCP_SERVER", "1")
+	client, err := startMCPClient(context.Background(), MCPServerConfig{Name: "calc", Command: os.Args[0]})
+	os.Unsetenv("FAKE_MCP_SERVER")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mcpClients = []*mcpClient{client}
+	defer func() {
+		mcpClients = nil
+		client.Close()
+	}()
+
+	tools := mcpTools()
+	if len(tools) != 2 || tools[0].Function.Name != "calc__add" || tools[1].Function.Name != "calc__read_resource" {
+		t.Fatalf("tools = %+v", tools)
+	}
+	var call ToolCall
+	call.Function.Name = "calc__read_resource"
+	call.Function.Arguments = json.RawMessage(`{"uri": "note://todo"}`)
+	if got := callMCPTool(context.Background(), call); got != "buy milk" {
+		t.Errorf("read_resource = %q", got)
+	}
+
+	app.ollama.CallTool("calc__add", map[string]interface{}{"a": 2, "b": 3})
+	app.ollama.SetChunks("2 + 3 = 5")
+	app.chat("what is 2 + 3?")
+
+	reqs := app.ollama.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d Ollama requests, want 2", len(reqs))
+	}
+	msgs := reqs[1].Messages
+	last := msgs[len(msgs)-1]
+	if last.Role != "tool" || last.ToolName != "calc__add" || last.Content != "5" {
+		t.Errorf("tool result message = %+v", last)
+	}
+
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	for _, sess := range sessions {
+		if got := sess.History[len(sess.History)-1].Content; got != "2 + 3 = 5" {
+			t.Errorf("stored reply = %q", got)
+		}
+	}
+}
+
+func TestToolVariables(t *testing.T) {
+	app := newTestApp(t)
+
+	post := func(form url.Values) (int, string) {
+		resp, err := app.client.PostForm(app.server.URL+"/variables", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, body := post(url.Values{"action": {"set"}, "name": {"API_URL"}, "value": {"https://internal.example/v2"}}); code != http.StatusOK ||
+		!strings.Contains(body, "API_URL") || strings.Contains(body, "internal.example") {
+		t.Fatalf("set: %d %s", code, body)
+	}
+	post(url.Values{"action": {"set"}, "name": {"TOKEN"}, "value": {"s3cret"}})
+	if code, _ := post(url.Values{"action": {"set"}, "name": {"api url"}, "value": {"x"}}); code != http.StatusBadRequest {
+		t.Errorf("invalid name: status %d", code)
+	}
+
+	var sessionID string
+	sessionMut.Lock()
+	for id, sess := range sessions {
+		sessionID = id
+		if bytes.Contains(sess.Variables["TOKEN"], []byte("s3cret")) {
+			t.Error("variable stored in plain text")
+		}
+	}
+	sessionMut.Unlock()
+
+	var got json.RawMessage
+	stub := func(ctx context.Context, call ToolCall) string {
+		got = call.Function.Arguments
+		return "fetched https://internal.example/v2/items with s3cret"
+	}
+	messages, _ := toolChat(sessionID, []Message{{Role: "user", Content: "list items"}})
+	if len(messages) != 2 || !strings.Contains(messages[0].Content, "${API_URL}") || strings.Contains(messages[0].Content, "s3cret") {
+		t.Errorf("messages = %+v", messages)
+	}
+
+	sessionMut.Lock()
+	vars := getSession(sessionID).variables()
+	sessionMut.Unlock()
+	var call ToolCall
+	call.Function.Arguments = json.RawMessage(`{"url": "${API_URL}/items", "headers": ["Bearer ${TOKEN}"], "other": "${UNSET}"}`)
+	out := withVariables(stub, vars)(context.Background(), call)
+
+	var args struct {
+		URL     string
+		Headers []string
+		Other   string
+	}
+	json.Unmarshal(got, &args)
+	if args.URL != "https://internal.example/v2/items" || args.Headers[0] != "Bearer s3cret" || args.Other != "${UNSET}" {
+		t.Errorf("expanded arguments = %s", got)
+	}
+	if out != "fetched ${API_URL}/items with ${TOKEN}" {
+		t.Errorf("tool output = %q", out)
+	}
+
+	post(url.Values{"action": {"delete"}, "name": {"TOKEN"}})
+	sessionMut.Lock()
+	names := getSession(sessionID).variableNames()
+	sessionMut.Unlock()
+	if len(names) != 1 || names[0] != "API_URL" {
+		t.Errorf("names after delete = %v", names)
+	}
+}
+
+func TestMCPServer(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Paris is the capital of France.")
+	app.chat("capital of france?")
+
+	mcpServerToken = "secret"
+	defer func() { mcpServerToken = "" }()
+
+	rpc := func(token, body string) (int, map[string]json.RawMessage) {
+		req, _ := http.NewRequest(http.MethodPost, app.server.URL+"/mcp", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out map[string]json.RawMessage
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	if status, _ := rpc("wrong", `{"jsonrpc":"2.0","id":1,"method":"ping"}`); status != http.StatusUnauthorized {
+		t.Errorf("bad token: status %d", status)
+	}
+	if status, _ := rpc("secret", `{"jsonrpc":"2.0","method":"notifications/initialized"}`); status != http.StatusAccepted {
+		t.Errorf("notification: status %d", status)
+	}
+
+	_, out := rpc("secret", `{"jsonrpc":"2.0","id":"s1","method":"tools/call","params":{"name":"search_conversations","arguments":{"query":"Paris capital"}}}`)
+	if string(out["id"]) != `"s1"` || !strings.Contains(string(out["result"]), "assistant: Paris is the capital of France.") {
+		t.Errorf("search response = %s %s", out["id"], out["result"])
+	}
+
+	_, out = rpc("secret", `{"jsonrpc":"2.0","id":2,"method":"resources/list"}`)
+	var list struct {
+		Resources []mcpResource `json:"resources"`
+	}
+	json.Unmarshal(out["result"], &list)
+	if len(list.Resources) != 1 || !strings.HasSuffix(list.Resources[0].URI, "/chat") {
+		t.Fatalf("resources = %s", out["result"])
+	}
+	_, out = rpc("secret", `{"jsonrpc":"2.0","id":3,"method":"resources/read","params":{"uri":"`+list.Resources[0].URI+`"}}`)
+	if !strings.Contains(string(out["result"]), "capital of france?") {
+		t.Errorf("read = %s", out["result"])
+	}
+}
+
+func TestMCPServerTenants(t *testing.T) {
+	app := newTestApp(t)
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte("tenants:\n  acme: {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath = path
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, mcpServerToken = db, "secret"
+	t.Cleanup(func() {
+		configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{}
+		store, mcpServerToken = memoryStore{}, ""
+		db.Close()
+	})
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessionMut.Lock()
+	getSession("acme/one").append(Message{Role: "user", Content: "acme's launch plan"})
+	getSession("plain").append(Message{Role: "user", Content: "a public note"})
+	getSession("stored").append(Message{Role: "user", Content: "a stored note"})
+	// Only in the store from here on
+	delete(sessions, "stored")
+	sessionMut.Unlock()
+
+	search := func(prefix, query string) string {
+		body := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"search_conversations","arguments":{"query":"` + query + `"}}}`
+		req, _ := http.NewRequest(http.MethodPost, app.server.URL+prefix+"/mcp", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return string(out)
+	}
+	if out := search("", "note"); !strings.Contains(out, "a public note") || !strings.Contains(out, "a stored note") {
+		t.Errorf("outside any tenant: %s", out)
+	}
+	if out := search("", "launch"); !strings.Contains(out, "No matches.") {
+		t.Errorf("acme's chat found outside acme: %s", out)
+	}
+	if out := search("/t/acme", "note"); !strings.Contains(out, "No matches.") {
+		t.Errorf("other chats found in acme: %s", out)
+	}
+	if out := search("/t/acme", "launch"); !strings.Contains(out, "acme's launch plan") {
+		t.Errorf("acme's own chat: %s", out)
+	}
+}
+
+func TestMCPSearchNewestFirst(t *testing.T) {
+	newTestApp(t)
+	sessionMut.Lock()
+	old := getSession("older")
+	old.append(Message{Role: "user", Content: "apple pie recipe"})
+	old.Events[len(old.Events)-1].Time = time.Now().Add(-time.Hour)
+	journal := getSession("newer")
+	journal.Journal = map[string][]Message{"2026-01-02": {{Role: "user", Content: "ate an apple"}}}
+	journal.JournalUpdated = map[string]time.Time{"2026-01-02": time.Now()}
+	journal.append(Message{Role: "user", Content: "apple tart"})
+	journal.Events[len(journal.Events)-1].Time = time.Now().Add(-time.Minute)
+	sessionMut.Unlock()
+
+	out, err := runMCPServerTool(nil, "search_conversations", "", "apple", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	want := []string{"ate an apple", "apple tart", "apple pie recipe"}
+	if len(lines) != len(want) {
+		t.Fatalf("results = %q", lines)
+	}
+	for i, w := range want {
+		if !strings.HasSuffix(lines[i], w) {
+			t.Errorf("result %d = %q, want it to end with %q", i, lines[i], w)
+		}
+	}
+
+	if out, _ := runMCPServerTool(nil, "search_conversations", "", "apple", 1); strings.Count(out, "\n") != 1 || !strings.Contains(out, "ate an apple") {
+		t.Errorf("limit 1 = %q", out)
+	}
+}
+
+func TestLangServeChain(t *testing.T) {
+	app := newTestApp(t)
+	if err := loadPromptTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	app.ollama.SetChunks("Short ", "summary.")
+
+	post := func(path, body string) string {
+		resp, err := http.Post(app.server.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", path, resp.StatusCode, out)
+		}
+		return string(out)
+	}
+
+	out := post("/chains/summarize/invoke", `{"input": {"sentences": 1, "text": "Long text."}, "config": {"configurable": {"model": "m2"}}}`)
+	if !strings.Contains(out, `"output":"Short summary."`) || !strings.Contains(out, `"run_id"`) {
+		t.Errorf("invoke = %s", out)
+	}
+	req := app.ollama.Requests()[0]
+	if req.Model != "m2" || !strings.Contains(req.Messages[1].Content, "in 1 sentence(s)") {
+		t.Errorf("chain request = %+v", req)
+	}
+
+	out = post("/chains/summarize/stream", `{"input": {"sentences": "2", "text": "x"}}`)
+	if !strings.HasPrefix(out, "event: metadata\ndata: {\"run_id\":") ||
+		!strings.Contains(out, "event: data\ndata: \"Short \"\n\nevent: data\ndata: \"summary.\"\n\nevent: end\n\n") {
+		t.Errorf("stream = %q", out)
+	}
+
+	resp, err := http.Get(app.server.URL + "/chains/summarize/input_schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(schema), `"required":["sentences","text"]`) {
+		t.Errorf("input schema = %s", schema)
+	}
+}
+
+func TestJSONAPI(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Hi", " there")
+
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(app.server.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(out)
+	}
+
+	code, out := post("/api/v1/chat", `{"messages": [{"role": "user", "content": "hello"}]}`)
+	if code != http.StatusOK || !strings.Contains(out, `"content":"Hi there"`) {
+		t.Errorf("chat: %d %s", code, out)
+	}
+	code, out = post("/api/v1/chat", `{"messages": [{"role": "user", "content": "hello"}], "stream": true}`)
+	if want := "data: {\"content\":\"Hi\",\"done\":false}\n\ndata: {\"content\":\" there\",\"done\":false}\n\ndata: {\"content\":\"\",\"done\":true}\n\n"; out != want {
+		t.Errorf("stream = %q", out)
+	}
+	code, out = post("/api/v1/chat?format=ndjson", `{"messages": [{"role": "user", "content": "hello"}], "stream": true}`)
+	if want := "{\"content\":\"Hi\",\"done\":false}\n{\"content\":\" there\",\"done\":false}\n{\"content\":\"\",\"done\":true}\n"; out != want {
+		t.Errorf("ndjson stream = %q", out)
+	}
+	if code, _ = post("/api/v1/chat", `{"messages": []}`); code != http.StatusBadRequest {
+		t.Errorf("empty messages: status %d", code)
+	}
+	code, out = post("/api/v1/embeddings", `{"input": ["a b", "c"]}`)
+	if code != http.StatusOK || !strings.Contains(out, `[[3,1],[1,0]]`) {
+		t.Errorf("embeddings: %d %s", code, out)
+	}
+}
+
+func TestAPIReasoning(t *testing.T) {
+	// Tags split anywhere across chunks
+	var split reasoningStream
+	var reasoning, answer []string
+	for _, chunk := range []string{"<thi", "nk>\nLet me see", "</th", "ink>\n\nIt is <", "b>4</b>."} {
+		r, a := split.next(chunk)
+		reasoning, answer = append(reasoning, r), append(answer, a)
+	}
+	r, a := split.flush()
+	reasoning, answer = append(reasoning, r), append(answer, a)
+	if got := strings.Join(reasoning, ""); got != "Let me see" {
+		t.Errorf("streamed reasoning = %q", reasoning)
+	}
+	if got := strings.Join(answer, ""); got != "It is <b>4</b>." {
+		t.Errorf("streamed answer = %q", answer)
+	}
+
+	app := newTestApp(t)
+	app.ollama.SetChunks("<think>2+2</think>", "Four.")
+	post := func(path, body string) string {
+		resp, err := app.client.Post(app.server.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return string(out)
+	}
+	if out := post("/api/v1/chat", `{"messages": [{"role": "user", "content": "2+2?"}], "session": true}`); !strings.Contains(out, `"content":"Four.","reasoning":"2+2"`) {
+		t.Errorf("chat = %s", out)
+	}
+	want := "{\"content\":\"\",\"reasoning\":\"2+2\",\"done\":false}\n{\"content\":\"Four.\",\"done\":false}\n{\"content\":\"\",\"done\":true}\n"
+	if out := post("/api/v1/chat?format=ndjson", `{"messages": [{"role": "user", "content": "2+2?"}], "stream": true}`); out != want {
+		t.Errorf("stream = %q", out)
+	}
+	resp, err := app.client.Get(app.server.URL + "/api/v1/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(out), `{"id":2,"role":"assistant","content":"Four.","reasoning":"2+2"}`) {
+		t.Errorf("history = %s", out)
+	}
+}
+
+func TestJSONHistoryAPI(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Hi", " there")
+
+	call := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, app.server.URL+path, strings.NewReader(body))
+		resp, err := app.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(out)
+	}
+
+	code, out := call("POST", "/api/v1/chat", `{"session": true, "options": {"temperature": 0.2}, "messages": [{"role": "user", "content": "hello"}]}`)
+	if code != http.StatusOK || !strings.Contains(out, `"content":"Hi there"`) {
+		t.Fatalf("chat: %d %s", code, out)
+	}
+	reqs := app.ollama.Requests()
+	if opts := reqs[len(reqs)-1].Options; opts["temperature"] != 0.2 {
+		t.Errorf("options sent = %v", opts)
+	}
+	call("POST", "/api/v1/chat?format=ndjson", `{"session": true, "stream": true, "messages": [{"role": "user", "content": "again"}]}`)
+	reqs = app.ollama.Requests()
+	if msgs := reqs[len(reqs)-1].Messages; len(msgs) != 3 || msgs[1].Content != "Hi there" {
+		t.Errorf("second chat did not continue the session: %+v", msgs)
+	}
+	// Stateless calls leave the session alone
+	call("POST", "/api/v1/chat", `{"messages": [{"role": "user", "content": "aside"}]}`)
+
+	code, out = call("GET", "/api/v1/history", "")
+	want := `{"messages":[{"id":1,"role":"user","content":"hello"},{"id":2,"role":"assistant","content":"Hi there"},` +
+		`{"id":3,"role":"user","content":"again"},{"id":4,"role":"assistant","content":"Hi there"}]}` + "\n"
+	if code != http.StatusOK || out != want {
+		t.Errorf("history: %d %s", code, out)
+	}
+	// The HTML UI shows the same conversation
+	if _, page := call("GET", "/", ""); !strings.Contains(page, "again") {
+		t.Error("page is missing the API conversation")
+	}
+
+	code, out = call("POST", "/api/v1/history", `{"action": "edit", "id": 3, "content": "once more"}`)
+	if code != http.StatusOK || !strings.Contains(out, `"content":"once more"`) {
+		t.Errorf("edit: %d %s", code, out)
+	}
+	code, out = call("POST", "/api/v1/history", `{"action": "delete", "id": 4}`)
+	if code != http.StatusOK || strings.Contains(out, `"id":4`) {
+		t.Errorf("delete: %d %s", code, out)
+	}
+	if code, _ = call("POST", "/api/v1/history", `{"action": "delete", "id": 99}`); code != http.StatusNotFound {
+		t.Errorf("delete unknown: status %d", code)
+	}
+	if code, _ = call("POST", "/api/v1/history", `{"action": "shred"}`); code != http.StatusBadRequest {
+		t.Errorf("unknown action: status %d", code)
+	}
+	if code, _ = call("POST", "/api/v1/chat", `{"session": true, "messages": []}`); code != http.StatusBadRequest {
+		t.Errorf("session chat without messages: status %d", code)
+	}
+}
+
+func TestOpenAIChatCompletions(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Hi", " there")
+
+	post := func(body string) (int, string) {
+		resp, err := http.Post(app.server.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(out)
+	}
+
+	code, out := post(`{"model": "llama3", "temperature": 0.5, "max_tokens": 20, "stop": "END",
+		"messages": [{"role": "developer", "content": "Be brief."},
+			{"role": "user", "content": [{"type": "text", "text": "What is this?"}, {"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBOR"}}]}]}`)
+	var completion OpenAICompletion
+	if err := json.Unmarshal([]byte(out), &completion); code != http.StatusOK || err != nil {
+		t.Fatalf("completion: %d %s", code, out)
+	}
+	if completion.Object != "chat.completion" || !strings.HasPrefix(completion.ID, "chatcmpl-") || completion.Model != "llama3" ||
+		len(completion.Choices) != 1 || completion.Choices[0].Message.Content != "Hi there" || *completion.Choices[0].FinishReason != "stop" {
+		t.Errorf("completion = %s", out)
+	}
+	reqs := app.ollama.Requests()
+	sent := reqs[len(reqs)-1]
+	if sent.Messages[0].Role != "system" || sent.Messages[1].Content != "What is this?" || len(sent.Messages[1].Images) != 1 || sent.Messages[1].Images[0] != "iVBOR" {
+		t.Errorf("messages sent = %+v", sent.Messages)
+	}
+	if sent.Options["temperature"] != 0.5 || sent.Options["num_predict"] != 20.0 || fmt.Sprint(sent.Options["stop"]) != "[END]" {
+		t.Errorf("options sent = %v", sent.Options)
+	}
+
+	code, out = post(`{"stream": true, "messages": [{"role": "user", "content": "hello"}]}`)
+	events := strings.Split(strings.TrimSuffix(out, "\n\n"), "\n\n")
+	if code != http.StatusOK || len(events) != 5 || events[4] != "data: [DONE]" {
+		t.Fatalf("stream: %d %q", code, out)
+	}
+	var text strings.Builder
+	for i, ev := range events[:4] {
+		var chunk OpenAICompletion
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(ev, "data: ")), &chunk); err != nil || chunk.Object != "chat.completion.chunk" {
+			t.Fatalf("chunk %d = %q", i, ev)
+		}
+		text.WriteString(chunk.Choices[0].Delta.Content)
+		if done := chunk.Choices[0].FinishReason != nil; done != (i == 3) {
+			t.Errorf("chunk %d finish_reason = %v", i, chunk.Choices[0].FinishReason)
+		}
+	}
+	if text.String() != "Hi there" || !strings.Contains(events[0], `"role":"assistant"`) {
+		t.Errorf("streamed %q from %q", text.String(), out)
+	}
+
+	code, out = post(`{"messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}}]}]}`)
+	if code != http.StatusBadRequest || !strings.Contains(out, `"type":"invalid_request_error"`) {
+		t.Errorf("remote image: %d %s", code, out)
+	}
+
+	resp, err := http.Get(app.server.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"object":"list"`) || !strings.Contains(string(body), `"owned_by":"ollama"`) {
+		t.Errorf("models = %s", body)
+	}
+
+	// With the session cookie, the exchange joins the session's history
+	app.chat("from the page")
+	app.ollama.SetChunks("from the SDK")
+	req, _ := http.NewRequest(http.MethodPost, app.server.URL+"/v1/chat/completions",
+		strings.NewReader(`{"messages": [{"role": "user", "content": "from a script"}]}`))
+	if resp, err = app.client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	for _, sess := range sessions {
+		if n := len(sess.History); n != 4 || sess.History[2].Content != "from a script" || sess.History[3].Content != "from the SDK" {
+			t.Errorf("session history = %+v", sess.History)
+		}
+	}
+}
+
+func TestGRPCAPI(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Hi", " there")
+
+	lis := bufconn.Listen(1 << 20)
+	srv := newGRPCServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := chatpb.NewChatServiceClient(conn)
+	ctx := context.Background()
+
+	req := &chatpb.ChatRequest{Messages: []*chatpb.Message{{Role: "user", Content: "hello"}}}
+	resp, err := client.Chat(ctx, req)
+	if err != nil || resp.GetMessage().GetContent() != "Hi there" {
+		t.Fatalf("Chat = %v, %v", resp, err)
+	}
+
+	stream, err := client.StreamChat(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []string
+	for {
+		chunk, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk.GetDone() {
+			break
+		}
+		chunks = append(chunks, chunk.GetContent())
+	}
+	if strings.Join(chunks, "|") != "Hi| there" {
+		t.Errorf("StreamChat chunks = %q", chunks)
+	}
+
+	models, err := client.ListModels(ctx, &chatpb.ListModelsRequest{})
+	if err != nil || len(models.GetModels()) != 1 || models.GetModels()[0].GetModifiedAt() != "2024-05-01T10:00:00Z" {
+		t.Errorf("ListModels = %v, %v", models, err)
+	}
+
+	emb, err := client.Embeddings(ctx, &chatpb.EmbeddingsRequest{Input: []string{"a b"}})
+	if err != nil || len(emb.GetEmbeddings()) != 1 || emb.GetEmbeddings()[0].GetValues()[0] != 3 {
+		t.Errorf("Embeddings = %v, %v", emb, err)
+	}
+
+	_, err = client.Chat(ctx, &chatpb.ChatRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("empty Chat error = %v", err)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Hi", " there")
+	app.chat("hello")
+
+	u, _ := url.Parse(app.server.URL)
+	header := http.Header{"Origin": {app.server.URL}}
+	for _, c := range app.client.Jar.Cookies(u) {
+		header.Add("Cookie", c.String())
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}
+	conn, resp, err := dialer.Dial("ws://"+u.Host+"/graphql", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+
+	conn.WriteJSON(map[string]string{"type": "connection_init"})
+	var ack graphqlWSMessage
+	if conn.ReadJSON(&ack); ack.Type != "connection_ack" {
+		t.Fatalf("got %q, want connection_ack", ack.Type)
+	}
+	conn.WriteJSON(map[string]interface{}{"id": "1", "type": "subscribe",
+		"payload": map[string]string{"query": `subscription { chat(message: "again") { content done } }`}})
+	var tokens []string
+	for {
+		var msg graphqlWSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "complete" {
+			break
+		}
+		tokens = append(tokens, string(msg.Payload))
+	}
+	want := []string{`{"data":{"chat":{"content":"Hi","done":false}}}`, `{"data":{"chat":{"content":" there","done":false}}}`,
+		`{"data":{"chat":{"content":"","done":true}}}`}
+	if strings.Join(tokens, "\n") != strings.Join(want, "\n") {
+		t.Errorf("subscription payloads:\n%s", strings.Join(tokens, "\n"))
+	}
+
+	body := `{"query": "{ conversations { id messageCount messages(last: 1) { role content } } usage { messages userMessages } }"}`
+	qresp, err := app.client.Post(app.server.URL+"/graphql", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(qresp.Body)
+	qresp.Body.Close()
+	wantQuery := `{"data":{"conversations":[{"id":"chat","messageCount":4,"messages":[{"content":"Hi there","role":"assistant"}]}],"usage":{"messages":4,"userMessages":2}}}`
+	if strings.TrimSpace(string(out)) != wantQuery {
+		t.Errorf("query = %s", out)
+	}
+}
+
+func TestWorkerPoolRetriesAndAdmin(t *testing.T) {
+	app := newTestApp(t)
+	oldBackoff, oldPassword := taskBackoff, adminPassword
+	taskBackoff, adminPassword = time.Millisecond, "hunter2"
+	defer func() { taskBackoff, adminPassword = oldBackoff, oldPassword }()
+
+	attempts := 0
+	finished := make(chan error, 1)
+	err := submitTask("test", "flaky task", func(context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("temporarily broken")
+		}
+		return nil
+	}, func(err error) { finished <- err })
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-finished:
+		if err != nil || attempts != 3 {
+			t.Errorf("task finished with %v after %d attempts, want success on attempt 3", err, attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("task did not finish")
+	}
+
+	get := func(password string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, app.server.URL+"/admin", nil)
+		if password != "" {
+			req.SetBasicAuth("admin", password)
+		}
+		resp, err := app.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, _ := get("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong password: status %d, want 401", code)
+	}
+	code, body := get("hunter2")
+	if code != http.StatusOK || !strings.Contains(body, "flaky task") || !strings.Contains(body, "<td>3</td>") {
+		t.Errorf("admin page: status %d, body: %s", code, body)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	app := newTestApp(t)
+	oldPassword, oldSlowdown, oldCaptcha := adminPassword, loginSlowdown, captchaCheck
+	adminPassword, loginSlowdown = "hunter2", 0
+	defer func() { adminPassword, loginSlowdown, captchaCheck = oldPassword, oldSlowdown, oldCaptcha }()
+
+	get := func(password, captcha string) int {
+		req, _ := http.NewRequest(http.MethodGet, app.server.URL+"/admin", nil)
+		req.SetBasicAuth("admin", password)
+		req.Header.Set("X-Captcha", captcha)
+		resp, err := app.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; i < maxAccountFailures-1; i++ {
+		get("guess", "")
+	}
+	// A success clears the account's failures
+	if code := get("hunter2", ""); code != http.StatusOK {
+		t.Fatalf("right password: status %d", code)
+	}
+
+	captchaCheck = func(r *http.Request) bool { return r.Header.Get("X-Captcha") == "solved" }
+	for i := 0; i < loginCaptchaFailures; i++ {
+		if code := get("guess", ""); code != http.StatusUnauthorized {
+			t.Errorf("failure %d: status %d", i+1, code)
+		}
+	}
+	if code := get("hunter2", ""); code != http.StatusForbidden {
+		t.Errorf("without the captcha: status %d, want 403", code)
+	}
+	for i := loginCaptchaFailures; i < maxAccountFailures; i++ {
+		get("guess", "solved")
+	}
+	if code := get("hunter2", "solved"); code != http.StatusTooManyRequests {
+		t.Errorf("locked out: status %d, want 429", code)
+	}
+
+	// The counts live in persistent stores when there is one
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	rs, err := openRedisStore("redis://" + mr.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	for name, ls := range map[string]loginStore{"sqlite": db, "redis": rs} {
+		for i := 1; i <= 3; i++ {
+			if n, err := ls.AddLoginFailure("account:admin", time.Second); n != i || err != nil {
+				t.Errorf("%s: failure %d counted as %d (err %v)", name, i, n, err)
+			}
+		}
+		if n, _ := ls.LoginFailures("account:other"); n != 0 {
+			t.Errorf("%s: other account has %d failures", name, n)
+		}
+		if err := ls.ClearLoginFailures("account:admin"); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := ls.LoginFailures("account:admin"); n != 0 {
+			t.Errorf("%s: %d failures after clearing", name, n)
+		}
+	}
+	db.AddLoginFailure("account:admin", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if n, _ := db.AddLoginFailure("account:admin", time.Second); n != 1 {
+		t.Errorf("sqlite: a new window starts at %d failures", n)
+	}
+	rs.AddLoginFailure("account:admin", time.Minute)
+	mr.FastForward(time.Minute)
+	if n, _ := rs.LoginFailures("account:admin"); n != 0 {
+		t.Errorf("redis: failures outlived their window: %d", n)
+	}
+}
+
+func TestGenerationQueuePriority(t *testing.T) {
+	old := ollamaSlots
+	ollamaSlots = 1
+	defer func() { ollamaSlots = old }()
+	q := &generationQueue{}
+
+	if err := q.acquire(context.Background(), priorityBatch); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := func(n int) {
+		for {
+			q.mu.Lock()
+			got := len(q.waiting)
+			q.mu.Unlock()
+			if got == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	order := make(chan priority, 3)
+	wait := func(p priority) {
+		go func() {
+			if err := q.acquire(context.Background(), p); err == nil {
+				order <- p
+				q.release()
+			}
+		}()
+	}
+	wait(priorityBatch)
+	queued(1)
+	wait(priorityAPI)
+	queued(2)
+
+	// A waiter that gives up leaves the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error)
+	go func() { gaveUp <- q.acquire(ctx, priorityInteractive) }()
+	queued(3)
+	cancel()
+	if err := <-gaveUp; err != context.Canceled {
+		t.Fatalf("cancelled acquire returned %v", err)
+	}
+	queued(2)
+
+	wait(priorityInteractive)
+	queued(3)
+	q.release()
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, (<-order).String())
+	}
+	if strings.Join(got, " ") != "interactive api batch" {
+		t.Errorf("slots granted in order %v, want interactive api batch", got)
+	}
+	if active, waiting := q.stats(); active != 0 || len(waiting) != 0 {
+		t.Errorf("after all releases: %d active, waiting %v", active, waiting)
+	}
+}
+
+func TestAPIKeyPriority(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/keys.yaml"
+	os.WriteFile(path, []byte("keys:\n  - name: nightly\n    key: k-batch\n    priority: batch\n"), 0o600)
+	old := apiKeysPath
+	apiKeysPath = path
+	defer func() { apiKeysPath = old; loadAPIKeys() }()
+	if err := loadAPIKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen priority
+	h := priorityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = priorityFrom(r.Context())
+	}))
+	for _, c := range []struct {
+		path, auth string
+		want       priority
+	}{
+		{"/chat", "", priorityInteractive},
+		{"/api/v1/chat", "", priorityAPI},
+		{"/api/v1/chat", "Bearer unknown", priorityAPI},
+		{"/api/v1/chat", "Bearer k-batch", priorityBatch},
+	} {
+		r := httptest.NewRequest(http.MethodPost, c.path, nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if seen != c.want {
+			t.Errorf("%s with %q: priority %v, want %v", c.path, c.auth, seen, c.want)
+		}
+	}
+}
+
+func TestEnsureModelsPullsMissing(t *testing.T) {
+	app := newTestApp(t)
+	models := []string{"fake-model", "new-model:7b"}
+
+	missing, err := ensureModels(context.Background(), models, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || !strings.HasSuffix(missing[0], ": new-model:7b") {
+		t.Errorf("missing = %q, want only new-model:7b", missing)
+	}
+	if pulls := app.ollama.Pulls(); len(pulls) != 0 {
+		t.Errorf("pulled %q without -pull", pulls)
+	}
+
+	if missing, err := ensureModels(context.Background(), models, true); err != nil || len(missing) != 0 {
+		t.Fatalf("with pull: missing %q, err %v", missing, err)
+	}
+	if pulls := app.ollama.Pulls(); len(pulls) != 1 || pulls[0] != "new-model:7b" {
+		t.Errorf("pulls = %q", pulls)
+	}
+	if missing, _ := ensureModels(context.Background(), models, false); len(missing) != 0 {
+		t.Errorf("still missing after pull: %q", missing)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{"512": 512, "4KB": 4 << 10, "1.5 GB": 3 << 29, "2tb": 2 << 40, "10B": 10}
+	for in, want := range cases {
+		if got, err := parseSize(in); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "GB", "-1MB", "lots"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) succeeded", in)
+		}
+	}
+}
+
+func TestPullDiskGuard(t *testing.T) {
+	app := newTestApp(t)
+	defer func() { modelsDir, minFreeDisk, modelsQuota = "", 0, 0 }()
+
+	// fake-model takes 1234 bytes and the download is a 200 byte layer
+	modelsQuota = 1000
+	if _, err := ensureModels(context.Background(), []string{"new-model"}, true); !errors.Is(err, errLowDisk) {
+		t.Errorf("over quota: err = %v", err)
+	}
+	if pulls := app.ollama.Pulls(); len(pulls) != 0 {
+		t.Errorf("pulled %q while over quota", pulls)
+	}
+	modelsQuota = 1300
+	if _, err := ensureModels(context.Background(), []string{"new-model"}, true); !errors.Is(err, errLowDisk) {
+		t.Errorf("layer over quota: err = %v", err)
+	}
+	modelsQuota = 2000
+	if _, err := ensureModels(context.Background(), []string{"new-model"}, true); err != nil {
+		t.Errorf("within quota: %v", err)
+	}
+
+	modelsQuota = 0
+	modelsDir = t.TempDir()
+	if _, err := freeDiskSpace(modelsDir); err != nil {
+		t.Skip(err)
+	}
+	minFreeDisk = 1 << 62
+	if _, err := ensureModels(context.Background(), []string{"other-model"}, true); !errors.Is(err, errLowDisk) {
+		t.Errorf("low free space: err = %v", err)
+	}
+}
+
+func TestInPullWindow(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		clock, _ := time.Parse(pullWindowLayout, hhmm)
+		return time.Date(2024, 3, 10, clock.Hour(), clock.Minute(), 0, 0, time.UTC)
+	}
+	cases := []struct {
+		now, start, end string
+		open            bool
+		closes          string // hh:mm, "+" for the next day
+	}{
+		{"02:00", "01:00", "06:00", true, "06:00"},
+		{"07:00", "01:00", "06:00", false, ""},
+		{"06:00", "01:00", "06:00", false, ""},
+		{"23:30", "23:00", "05:00", true, "05:00+"},
+		{"03:00", "23:00", "05:00", true, "05:00"},
+		{"12:00", "23:00", "05:00", false, ""},
+	}
+	for _, c := range cases {
+		open, closes := inPullWindow(at(c.now), c.start, c.end)
+		if open != c.open {
+			t.Errorf("%s in %s-%s: open = %v", c.now, c.start, c.end, open)
+			continue
+		}
+		if !open {
+			continue
+		}
+		want := at(strings.TrimSuffix(c.closes, "+"))
+		if strings.HasSuffix(c.closes, "+") {
+			want = want.AddDate(0, 0, 1)
+		}
+		if !closes.Equal(want) {
+			t.Errorf("%s in %s-%s: closes %v, want %v", c.now, c.start, c.end, closes, want)
+		}
+	}
+}
+
+func TestScheduledPull(t *testing.T) {
+	app := newTestApp(t)
+	adminPassword = "pw"
+	defer func() { adminPassword = "" }()
+
+	post := func(form url.Values) int {
+		req, _ := http.NewRequest(http.MethodPost, app.server.URL+"/admin/pulls", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "pw")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(url.Values{"action": {"schedule"}, "model": {"big-model"}, "start": {"25:00"}, "end": {"06:00"}}); code != http.StatusBadRequest {
+		t.Errorf("invalid window: status %d", code)
+	}
+
+	now := time.Now()
+	later := url.Values{"action": {"schedule"}, "model": {"later-model"},
+		"start": {now.Add(2 * time.Hour).Format(pullWindowLayout)}, "end": {now.Add(3 * time.Hour).Format(pullWindowLayout)}}
+	if code := post(later); code != http.StatusSeeOther {
+		t.Fatalf("schedule: status %d", code)
+	}
+	open := url.Values{"action": {"schedule"}, "model": {"big-model"}, "limit": {"512"},
+		"start": {now.Add(-time.Hour).Format(pullWindowLayout)}, "end": {now.Add(time.Hour).Format(pullWindowLayout)}}
+	if code := post(open); code != http.StatusSeeOther {
+		t.Fatalf("schedule: status %d", code)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pulls := pullSnapshot()
+		if pulls[0].State == PullDone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pull state %q, error %q", pulls[0].State, pulls[0].Error)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pulls := app.ollama.Pulls(); len(pulls) != 1 || pulls[0] != "big-model" {
+		t.Errorf("pulls = %q", pulls)
+	}
+
+	id := strconv.Itoa(pullSnapshot()[1].ID)
+	if code := post(url.Values{"action": {"cancel"}, "id": {id}}); code != http.StatusSeeOther {
+		t.Errorf("cancel: status %d", code)
+	}
+	if state := pullSnapshot()[1].State; state != PullCancelled {
+		t.Errorf("cancelled pull is %q", state)
+	}
+	if code := post(url.Values{"action": {"cancel"}, "id": {id}}); code != http.StatusNotFound {
+		t.Errorf("second cancel: status %d", code)
+	}
+}
+
+func TestSchedulesCalendar(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 9, 3, 0, 0, 0, ny)
+	daily := ScheduledPrompt{ID: 1, Session: "s", Prompt: "Summarize the news, briefly", At: "09:00", TimeZone: "America/New_York", zone: ny}
+	daily.Next = nextScheduledRun(now, daily.At, nil, ny)
+	once := ScheduledPrompt{ID: 2, Session: "s", Prompt: "once", At: "10:00", Once: true, zone: ny}
+	once.Next = nextScheduledRun(now, once.At, nil, ny)
+	done := ScheduledPrompt{ID: 3, Session: "s", Prompt: "done", At: "11:00", zone: ny, Finished: now}
+	ics := schedulesCalendar([]ScheduledPrompt{daily, once, done}, now)
+	if !strings.HasPrefix(ics, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n") || !strings.HasSuffix(ics, "END:VCALENDAR\r\n") {
+		t.Fatalf("not a calendar: %q", ics)
+	}
+	// Fourteen daily runs and the one-off. Clocks go forward on March 10,
+	// so from then on 09:00 is an hour earlier in UTC.
+	if n := strings.Count(ics, "BEGIN:VEVENT"); n != 15 {
+		t.Errorf("%d events, want 15", n)
+	}
+	for _, want := range []string{
+		"UID:schedule-1-20240309T140000Z@deepseek-app\r\n", "DTSTART:20240309T140000Z\r\n",
+		"DTSTART:20240310T130000Z\r\n", "DTSTART:20240309T150000Z\r\n",
+		"SUMMARY:Scheduled prompt 1\r\n", "Summarize the news\\, briefly",
+	} {
+		if !strings.Contains(ics, want) {
+			t.Errorf("calendar lacks %q", want)
+		}
+	}
+	if strings.Contains(ics, "Scheduled prompt 3") {
+		t.Error("finished schedule is in the calendar")
+	}
+
+	// Continuation lines carry a space and at most 74 octets, without
+	// splitting a character
+	for _, line := range []string{"DESCRIPTION:" + strings.Repeat("é", 100), "DESCRIPTION:" + strings.Repeat("x", 300)} {
+		var b strings.Builder
+		writeICSLine(&b, line)
+		folded := strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+		for i, l := range folded {
+			if len(l) > 75 || i > 0 && !strings.HasPrefix(l, " ") {
+				t.Errorf("line %d of %d octets: %q", i, len(l), l)
+			}
+		}
+		if got := strings.ReplaceAll(b.String(), "\r\n ", ""); got != line+"\r\n" {
+			t.Errorf("unfolds to %q", got)
+		}
+	}
+
+	// The feed is the admin's
+	app := newTestApp(t)
+	adminPassword = "pw"
+	defer func() { adminPassword = "" }()
+	resp, err := http.Get(app.server.URL + "/admin/schedules.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("feed without credentials: status %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodGet, app.server.URL+"/admin/schedules.ics", nil)
+	req.SetBasicAuth("admin", "pw")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/calendar; charset=utf-8" {
+		t.Errorf("feed: status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestNextScheduledRun(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, ny)
+	}
+	cases := []struct {
+		after time.Time
+		at    string
+		days  []time.Weekday
+		want  time.Time
+	}{
+		{at(3, 8, 8, 0), "09:00", nil, at(3, 8, 9, 0)},
+		{at(3, 8, 9, 0), "09:00", nil, at(3, 9, 9, 0)},
+		// 09:00 stays 09:00 across the change, though the day is shorter
+		{at(3, 9, 9, 0), "09:00", nil, at(3, 10, 9, 0)},
+		// 02:30 does not exist on March 10; it runs at 03:30
+		{at(3, 9, 12, 0), "02:30", nil, time.Date(2024, 3, 10, 3, 30, 0, 0, ny)},
+		// 01:30 happens twice on November 3; it runs once
+		{at(11, 2, 12, 0), "01:30", nil, at(11, 3, 1, 30)},
+		{at(11, 3, 1, 30).Add(30 * time.Minute), "01:30", nil, at(11, 4, 1, 30)},
+		// Friday evening, weekdays only: next Monday
+		{at(3, 8, 18, 0), "09:00", []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, at(3, 11, 9, 0)},
+	}
+	for _, c := range cases {
+		if got := nextScheduledRun(c.after, c.at, c.days, ny); !got.Equal(c.want) {
+			t.Errorf("next %s %v run after %v = %v, want %v", c.at, c.days, c.after, got, c.want)
+		}
+	}
+	if at(3, 10, 9, 0).Sub(at(3, 9, 9, 0)) != 23*time.Hour {
+		t.Error("test dates do not span the change")
+	}
+
+	days, err := parseWeekdays([]string{"mon", "Fri", "mon"})
+	if err != nil || len(days) != 2 || days[0] != time.Monday || days[1] != time.Friday {
+		t.Errorf("parseWeekdays = %v, %v", days, err)
+	}
+	if _, err := parseWeekdays([]string{"someday"}); err == nil {
+		t.Error("unknown weekday accepted")
+	}
+}
+
+func TestScheduledPrompts(t *testing.T) {
+	app := newTestApp(t)
+	defer func(list []*ScheduledPrompt) { scheduledPrompts = list }(scheduledPrompts)
+	scheduledPrompts = nil
+	app.ollama.SetChunks("Good morning!")
+	app.chat("hello")
+
+	post := func(client *http.Client, form url.Values) (int, string) {
+		t.Helper()
+		resp, err := client.PostForm(app.server.URL+"/schedules", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	for _, bad := range []url.Values{
+		{"action": {"schedule"}, "prompt": {"x"}, "at": {"25:00"}},
+		{"action": {"schedule"}, "prompt": {"x"}, "at": {"09:00"}, "time_zone": {"Moon/Tranquility"}},
+		{"action": {"schedule"}, "prompt": {"x"}, "at": {"09:00"}, "days": {"someday"}},
+		{"action": {"schedule"}, "prompt": {" "}, "at": {"09:00"}},
+		{"action": {"schedule"}, "prompt": {"x"}, "at": {"09:00"}, "conversation": {"9"}},
+	} {
+		if code, _ := post(app.client, bad); code != http.StatusBadRequest {
+			t.Errorf("%v: status %d", bad, code)
+		}
+	}
+
+	code, page := post(app.client, url.Values{"action": {"schedule"}, "prompt": {"Plan my day"}, "at": {"07:15"},
+		"time_zone": {"Asia/Tokyo"}, "days": {"mon", "wed"}})
+	if code != http.StatusOK || !strings.Contains(page, "07:15 Asia/Tokyo, Mon, Wed") || strings.Count(page, " JST<br>") != schedulePreviewRuns {
+		t.Fatalf("schedule page after adding (status %d): %s", code, page)
+	}
+	list := scheduleSnapshot("")
+	if len(list) != 1 || list[0].Next.Location().String() != "Asia/Tokyo" || list[0].Next.Hour() != 7 || list[0].Next.Minute() != 15 {
+		t.Fatalf("schedules = %+v", list)
+	}
+
+	// Another session neither sees nor cancels it
+	jar, _ := cookiejar.New(nil)
+	other := &http.Client{Jar: jar}
+	id := strconv.Itoa(list[0].ID)
+	if code, _ := post(other, url.Values{"action": {"cancel"}, "id": {id}}); code != http.StatusNotFound {
+		t.Errorf("cancel from another session: status %d", code)
+	}
+
+	// Once due, the prompt and its reply join the conversation
+	scheduleMut.Lock()
+	scheduledPrompts[0].Next = time.Now().Add(-time.Second)
+	scheduleMut.Unlock()
+	checkSchedules(time.Now())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := app.client.Get(app.server.URL + "/export/json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var export ConversationExport
+		json.NewDecoder(resp.Body).Decode(&export)
+		resp.Body.Close()
+		if n := len(export.Messages); n == 4 && export.Messages[2].Content == "Plan my day" && export.Messages[3].Content == "Good morning!" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("scheduled prompt not answered: %+v", export.Messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	list = scheduleSnapshot("")
+	if list[0].Runs != 1 || !list[0].Next.After(time.Now()) || list[0].Next.Weekday() != time.Monday && list[0].Next.Weekday() != time.Wednesday {
+		t.Errorf("after running: %+v", list[0])
+	}
+
+	// The admin page previews every session's schedules
+	adminPassword = "pw"
+	defer func() { adminPassword = "" }()
+	req, _ := http.NewRequest(http.MethodGet, app.server.URL+"/admin", nil)
+	req.SetBasicAuth("admin", "pw")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "Plan my day") || !strings.Contains(string(body), list[0].NextRuns[0].Format("Mon 2 Jan 2006 15:04 MST")) {
+		t.Errorf("admin page lacks the schedule: %s", body)
+	}
+
+	if code, _ := post(app.client, url.Values{"action": {"cancel"}, "id": {id}}); code != http.StatusOK {
+		t.Errorf("cancel: status %d", code)
+	}
+	if list := scheduleSnapshot(""); list[0].Finished.IsZero() || len(list[0].NextRuns) != 0 {
+		t.Errorf("cancelled schedule = %+v", list[0])
+	}
+
+	// A one-off runs once, and a schedule whose session is gone stops
+	p, err := schedulePrompt("no-such-session", 0, "hi", "09:00", nil, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduleMut.Lock()
+	p.Next = time.Now().Add(-time.Second)
+	scheduleMut.Unlock()
+	checkSchedules(time.Now())
+	if list := scheduleSnapshot(""); list[0].Runs != 1 || list[0].Finished.IsZero() || list[0].Error == "" {
+		t.Errorf("schedule of an expired session = %+v", list[0])
+	}
+}
+
+func TestURLPolicy(t *testing.T) {
+	p := URLPolicy{Schemes: []string{"http", "https"}, DenyHosts: []string{"evil.example"}, MaxRedirects: 1, MaxBytes: 10}
+	cases := map[string]bool{
+		"https://api.example.com/hook":   true,
+		"http://93.184.216.34/":          true,
+		"ftp://example.com/":             false,
+		"http://127.0.0.1:8080/":         false,
+		"http://[::1]/":                  false,
+		"http://10.1.2.3/":               false,
+		"http://169.254.169.254/latest/": false,
+		"http://0.0.0.0/":                false,
+		"http://cdn.evil.example/":       false,
+		"http://user:pw@example.com/":    false,
+	}
+	for raw, want := range cases {
+		u, _ := url.Parse(raw)
+		if err := p.checkURL(u); (err == nil) != want {
+			t.Errorf("%s: err = %v", raw, err)
+		}
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Write(bytes.Repeat([]byte("x"), 100))
+		case "/by-name":
+			http.Redirect(w, r, strings.Replace("http://"+r.Host, "127.0.0.1", "localhost", 1)+"/small", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer target.Close()
+
+	if _, err := p.client(time.Second).Get(target.URL + "/small"); !errors.Is(err, errBlockedURL) {
+		t.Errorf("loopback server: err = %v", err)
+	}
+	p.AllowHosts = []string{"127.0.0.1"}
+	get := func(path string) (string, error) {
+		resp, err := p.client(time.Second).Get(target.URL + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+	if body, err := get("/small"); err != nil || body != "ok" {
+		t.Errorf("allowed host: %q, %v", body, err)
+	}
+	if _, err := get("/big"); !errors.Is(err, errBlockedURL) {
+		t.Errorf("oversized body: err = %v", err)
+	}
+	if _, err := get("/by-name"); !errors.Is(err, errBlockedURL) {
+		t.Errorf("redirect off the allow list: err = %v", err)
+	}
+	if _, err := get("/loop"); !errors.Is(err, errBlockedURL) {
+		t.Errorf("redirect loop: err = %v", err)
+	}
+}
+
+func TestJobWebhook(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("Done", "!")
+
+	oldSecret, oldBackoff, oldPolicy := webhookSecret, webhookBackoff, fetchPolicy
+	webhookSecret, webhookBackoff = "s3cret", time.Millisecond
+	defer func() {
+		webhookSecret, webhookBackoff, fetchPolicy = oldSecret, oldBackoff, oldPolicy
+		webhookClient = fetchPolicy.client(webhookTimeout)
+	}()
+
+	// Loopback callbacks are refused unless the host is allowed
+	body := `{"messages": [{"role": "user", "content": "go"}], "callback_url": "http://127.0.0.1:9/hook"}`
+	resp, err := http.Post(app.server.URL+"/api/v1/jobs", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("loopback callback: status %d", resp.StatusCode)
+	}
+	fetchPolicy.AllowHosts = []string{"127.0.0.1"}
+	webhookClient = fetchPolicy.client(webhookTimeout)
+
+	delivered := make(chan *http.Request, 1)
+	var bodies [][]byte
+	attempts := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		delivered <- r
+	}))
+	defer hook.Close()
+
+	body = `{"messages": [{"role": "user", "content": "go"}], "callback_url": "` + hook.URL + `"}`
+	resp, err = http.Post(app.server.URL+"/api/v1/jobs", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job Job
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || job.Status != "queued" {
+		t.Fatalf("start: status %d, job %+v", resp.StatusCode, job)
+	}
+
+	select {
+	case r := <-delivered:
+		if want := webhookSignature(r.Header.Get("X-Webhook-Timestamp"), bodies[0]); r.Header.Get("X-Webhook-Signature") != want {
+			t.Errorf("signature = %q, want %q", r.Header.Get("X-Webhook-Signature"), want)
+		}
+		if !strings.Contains(string(bodies[0]), `"status":"completed"`) || !strings.Contains(string(bodies[0]), `"content":"Done!"`) {
+			t.Errorf("webhook body = %s", bodies[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+
+	resp, err = http.Get(app.server.URL + "/api/v1/jobs/" + job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if job.Status != "completed" || job.Message.Content != "Done!" {
+		t.Errorf("polled job = %+v", job)
+	}
+}
+
+func TestParseEvalDataset(t *testing.T) {
+	tests := []struct {
+		name, file, body string
+		want             int
+		err              string
+	}{
+		{"jsonl", "cases.jsonl", `{"prompt": "2+2?", "expected": "4"}` + "\n\n" + `{"question": "Capital of France?", "answer": "Paris"}`, 2, ""},
+		{"jsonl skips blank prompts", "cases.jsonl", `{"prompt": " ", "expected": "x"}` + "\n" + `{"prompt": "hi", "expected": "hello"}`, 1, ""},
+		{"jsonl bad line", "cases.jsonl", `{"prompt": "ok"}` + "\n" + `{"prompt": `, 0, "line 2"},
+		{"jsonl non-string field", "cases.jsonl", `{"prompt": 3}`, 0, "line 1"},
+		{"csv", "cases.CSV", "Question,Answer\n2+2?,4\n3+3?,6\n", 2, ""},
+		{"csv header only", "cases.csv", "prompt,expected\n", 0, "at least one case"},
+		{"csv missing column", "cases.csv", "prompt,notes\nhi,x\n", 0, "prompt and expected columns"},
+		{"csv ragged rows", "cases.csv", "prompt,expected\nhi\n", 0, "wrong number of fields"},
+		{"empty", "cases.jsonl", "", 0, "no cases"},
+		{"too many", "cases.jsonl", strings.Repeat(`{"prompt": "p", "expected": "e"}`+"\n", maxEvalCases+1), 0, "the limit is"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cases, err := parseEvalDataset(strings.NewReader(tt.body), tt.file)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cases) != tt.want {
+				t.Errorf("got %d cases, want %d: %+v", len(cases), tt.want, cases)
+			}
+		})
+	}
+}
+
+func TestJudgeAnswer(t *testing.T) {
+	app := newTestApp(t)
+	tests := []struct {
+		reply string
+		score int
+		err   string
+	}{
+		{`{"score": 5, "reasoning": "matches"}`, 5, ""},
+		{"  {\"score\": 1, \"reasoning\": \"wrong\"}\n", 1, ""},
+		{`{"score": 0, "reasoning": "?"}`, 0, "out-of-range score 0"},
+		{`{"score": 6, "reasoning": "?"}`, 0, "out-of-range score 6"},
+		{`{"score": "high"}`, 0, "invalid JSON"},
+		{`Score: 4`, 0, "invalid JSON"},
+	}
+	for _, tt := range tests {
+		app.ollama.SetChunks(tt.reply)
+		score, _, err := judgeAnswer(context.Background(), "judge", EvalCase{Prompt: "2+2?", Expected: "4"}, "4")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("reply %q: err = %v, want one containing %q", tt.reply, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || score != tt.score {
+			t.Errorf("reply %q: score = %d, err = %v; want %d", tt.reply, score, err, tt.score)
+		}
+	}
+
+	reqs := app.ollama.Requests()
+	if len(reqs) == 0 || reqs[0].Stream || reqs[0].Model != "judge" {
+		t.Errorf("judge requests = %+v", reqs)
+	}
+}
+
+func TestAgentsConversation(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunks("I **agree**")
+
+	form := url.Values{
+		"topic":        {"Tabs or spaces?"},
+		"turns":        {"3"},
+		"agent_name":   {"Ada", "Bob", ""},
+		"agent_model":  {"", "other-model", ""},
+		"agent_prompt": {"You like tabs.", "You like spaces.", ""},
+	}
+	resp, err := app.client.PostForm(app.server.URL+"/agents", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	page := string(body)
+	if resp.StatusCode != http.StatusOK || strings.Count(page, "I <strong>agree</strong>") != 3 || !strings.Contains(page, `href="/agents/1"`) {
+		t.Fatalf("status %d, page: %s", resp.StatusCode, page)
+	}
+
+	reqs := app.ollama.Requests()
+	if len(reqs) != 3 || reqs[0].Model != defaultModel || reqs[1].Model != "other-model" {
+		t.Fatalf("requests = %+v", reqs)
+	}
+	// Bob sees Ada's turn as an attributed user message; Ada sees her own
+	// earlier turn as an assistant message
+	if m := reqs[1].Messages[2]; m.Role != "user" || m.Content != "Ada: I **agree**" {
+		t.Errorf("Bob's view of Ada = %+v", m)
+	}
+	if m := reqs[2].Messages[2]; m.Role != "assistant" || m.Content != "I **agree**" {
+		t.Errorf("Ada's view of herself = %+v", m)
+	}
+
+	list, err := app.client.Get(app.server.URL + "/agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(list.Body)
+	list.Body.Close()
+	if !strings.Contains(string(body), "2 agents &middot; 3 turns") {
+		t.Errorf("conversation list: %s", body)
+	}
+
+	resp, err = app.client.PostForm(app.server.URL+"/agents", url.Values{
+		"topic": {"alone"}, "agent_name": {"Ada"}, "agent_prompt": {"You like tabs."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("one agent: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestScenarioRun(t *testing.T) {
+	app := newTestApp(t)
+	oldDir := scenarioDir
+	scenarioDir = t.TempDir()
+	defer func() { scenarioDir = oldDir; loadScenarios() }()
+	os.WriteFile(filepath.Join(scenarioDir, "haggle.yaml"), []byte(
+		"title: Haggle\nrole: You sell carpets.\nuser_role: Tourist\nopening: Welcome!\nmax_turns: 2\nrubric: [Politeness]\n"), 0o644)
+	if err := loadScenarios(); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(path string, form url.Values) (int, string) {
+		resp, err := app.client.PostForm(app.server.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := post("/scenarios/start", url.Values{"id": {"missing"}}); status != http.StatusNotFound {
+		t.Errorf("unknown scenario: status = %d, want 404", status)
+	}
+	status, body := post("/scenarios/start", url.Values{"id": {"haggle"}})
+	if status != http.StatusOK || !strings.Contains(body, "Welcome!") {
+		t.Fatalf("start: status %d, body: %s", status, body)
+	}
+
+	app.ollama.SetChunks("Ten dollars.")
+	post("/scenarios/run/1", url.Values{"prompt": {"How much?"}})
+	app.ollama.SetChunks("| Politeness | 4 |")
+	status, body = post("/scenarios/run/1", url.Values{"prompt": {"Five?"}})
+	if status != http.StatusOK || !strings.Contains(body, "Politeness") {
+		t.Fatalf("last turn: status %d, body: %s", status, body)
+	}
+
+	reqs := app.ollama.Requests()
+	if len(reqs) != 3 || reqs[0].Messages[0].Role != "system" || !strings.Contains(reqs[0].Messages[0].Content, "Tourist") {
+		t.Fatalf("requests = %+v", reqs)
+	}
+	if eval := reqs[2].Messages[0].Content; !strings.Contains(eval, "Tourist: Five?") || !strings.Contains(eval, "- Politeness") {
+		t.Errorf("evaluation prompt = %q", eval)
+	}
+
+	if status, _ := post("/scenarios/run/1", url.Values{"prompt": {"Deal?"}}); status != http.StatusConflict {
+		t.Errorf("finished run: status = %d, want 409", status)
+	}
+	list, err := app.client.Get(app.server.URL + "/scenarios")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, _ := io.ReadAll(list.Body)
+	list.Body.Close()
+	if !strings.Contains(string(listing), "evaluated") {
+		t.Errorf("runs list: %s", listing)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	fake := fakeollama.New()
+	defer fake.Close()
+	dir := t.TempDir()
+
+	post := func(client *http.Client, path, prompt string) (*http.Response, error) {
+		body, _ := json.Marshal(OllamaChatRequest{Model: "m", Stream: true, Messages: []Message{{Role: "user", Content: prompt}}})
+		return client.Post(fake.URL+path, "application/json", bytes.NewReader(body))
+	}
+	// Concatenated content of a streamed reply, in the order it arrived
+	content := func(resp *http.Response) string {
+		defer resp.Body.Close()
+		var out strings.Builder
+		sc := newChunkScanner(resp.Body)
+		for sc.Next() {
+			out.WriteString(sc.Chunk().Message.Content)
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	recorder := &http.Client{}
+	if err := configureReplay(recorder, dir, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, prompt := range []string{"count", "letters"} {
+		if prompt == "count" {
+			fake.SetChunks("one", " two", " three")
+		} else {
+			fake.SetChunks("a", "b", "c")
+		}
+		resp, err := post(recorder, "/api/chat", prompt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content(resp)
+	}
+	fixtures, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(fixtures) != 2 {
+		t.Fatalf("recorded %d fixtures, want 2", len(fixtures))
+	}
+	fake.Close()
+
+	replayer := &http.Client{}
+	if err := configureReplay(replayer, "", dir, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for prompt, want := range map[string]string{"count": "one two three", "letters": "abc"} {
+		resp, err := post(replayer, "/api/chat", prompt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := content(resp); got != want {
+			t.Errorf("replayed %q = %q, want %q", prompt, got, want)
+		}
+	}
+
+	// Unrecorded prompts get the first fixture for the endpoint by file
+	// name, which is the order Glob lists them in
+	first, err := loadFixture(fixtures[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := post(replayer, "/api/chat", "never recorded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	sc := newChunkScanner(strings.NewReader(first.Body))
+	for sc.Next() {
+		want.WriteString(sc.Chunk().Message.Content)
+	}
+	if got := content(resp); got != want.String() {
+		t.Errorf("fallback reply = %q, want %q from %s", got, want.String(), filepath.Base(fixtures[0]))
+	}
+
+	if _, err := post(replayer, "/api/embed", "count"); err == nil || !strings.Contains(err.Error(), "no fixture recorded") {
+		t.Errorf("unrecorded endpoint: err = %v", err)
+	}
+	if err := configureReplay(&http.Client{}, dir, dir, 0); err == nil {
+		t.Error("record and replay together should be refused")
+	}
+}
+
+func TestBenchServe(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.SetChunkDelay(5 * time.Millisecond)
+
+	var out bytes.Buffer
+	if err := runBench(&out, []string{"serve", "-url", app.server.URL, "-c", "3", "-n", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	report := out.String()
+	for _, want := range []string{"Requests:    6 (3 sessions x 2 prompts)", "Errors:      0 transport errors", "Status 303:  6"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+	// Four chunks at 5ms each: no reply can be faster than 20ms
+	m := regexp.MustCompile(`Latency min: (\S+)`).FindStringSubmatch(report)
+	if m == nil {
+		t.Fatalf("no latency in report:\n%s", report)
+	}
+	if min, err := time.ParseDuration(m[1]); err != nil || min < 20*time.Millisecond {
+		t.Errorf("min latency = %s (%v), want at least 20ms", m[1], err)
+	}
+
+	// Every session kept its own cookie, so each sent its whole history
+	if reqs := app.ollama.Requests(); len(reqs) != 6 {
+		t.Errorf("upstream got %d requests, want 6", len(reqs))
+	} else {
+		sessionMut.Lock()
+		n := len(sessions)
+		sessionMut.Unlock()
+		if n != 3 {
+			t.Errorf("bench used %d sessions, want 3", n)
+		}
+	}
+
+	if err := runBench(&out, []string{"serve", "-c", "0"}); err == nil {
+		t.Error("-c 0 should be rejected")
+	}
+	if err := runBench(&out, nil); err == nil {
+		t.Error("missing subcommand should be rejected")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 10; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[int]time.Duration{0: time.Millisecond, 50: 5 * time.Millisecond, 95: 10 * time.Millisecond, 100: 10 * time.Millisecond} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("p%d = %s, want %s", p, got, want)
+		}
+	}
+}
+
+func TestJournalDay(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("main chat stays separate")
+
+	app.ollama.SetChunks("Sounds like a good day.")
+	resp, err := app.client.PostForm(app.server.URL+"/journal/", url.Values{"prompt": {"Went hiking"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	today := time.Now().Format(journalDayLayout)
+	if resp.Request.URL.Path != "/journal/"+today || !strings.Contains(string(body), "Went hiking") ||
+		!strings.Contains(string(body), "Sounds like a good day.") {
+		t.Fatalf("after posting: %s %s", resp.Request.URL.Path, body)
+	}
+
+	reqs := app.ollama.Requests()
+	msgs := reqs[len(reqs)-1].Messages
+	if len(msgs) != 1 || !regexp.MustCompile(`^\[\d\d:\d\d\] Went hiking$`).MatchString(msgs[0].Content) {
+		t.Errorf("journal request messages = %+v", msgs)
+	}
+
+	index, err := app.client.Get(app.server.URL + "/journal?month=" + time.Now().Format(journalMonthLayout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(index.Body)
+	index.Body.Close()
+	if !strings.Contains(string(body), `<span class="entry-count">2</span>`) {
+		t.Errorf("month index does not count today's entries: %s", body)
+	}
+
+	bad, err := app.client.Get(app.server.URL + "/journal/not-a-date")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid date: status %d, want 400", bad.StatusCode)
+	}
+}
+
+func TestParseFlashcards(t *testing.T) {
+	tests := []struct {
+		name, reply string
+		count       int
+		want        []string // questions
+		err         bool
+	}{
+		{"valid", `{"cards": [{"question": "Q1", "answer": "A1"}, {"question": "Q2", "answer": "A2"}]}`, 10, []string{"Q1", "Q2"}, false},
+		{"trims and drops blanks", `{"cards": [{"question": "  Q1 ", "answer": " A1"}, {"question": "", "answer": "A"}, {"question": "Q", "answer": "  "}]}`, 10, []string{"Q1"}, false},
+		{"case-insensitive duplicates", `{"cards": [{"question": "What is Go?", "answer": "A"}, {"question": "what is go?", "answer": "B"}]}`, 10, []string{"What is Go?"}, false},
+		{"capped at count", `{"cards": [{"question": "Q1", "answer": "A"}, {"question": "Q2", "answer": "A"}, {"question": "Q3", "answer": "A"}]}`, 2, []string{"Q1", "Q2"}, false},
+		{"surrounding whitespace", "\n  {\"cards\": [{\"question\": \"Q\", \"answer\": \"A\"}]}\n", 10, []string{"Q"}, false},
+		{"not JSON", "Here are your flashcards: 1. Q - A", 10, nil, true},
+		{"truncated", `{"cards": [{"question": "Q1", "ans`, 10, nil, true},
+		{"markdown fenced", "```json\n{\"cards\": []}\n```", 10, nil, true},
+		{"wrong shape", `{"cards": {"question": "Q", "answer": "A"}}`, 10, nil, true},
+		{"wrong field type", `{"cards": [{"question": 1, "answer": "A"}]}`, 10, nil, true},
+		{"no cards", `{"cards": []}`, 10, nil, true},
+		{"missing cards", `{"deck": [{"question": "Q", "answer": "A"}]}`, 10, nil, true},
+		{"only blank cards", `{"cards": [{"question": " ", "answer": " "}]}`, 10, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cards, err := parseFlashcards(tt.reply, tt.count)
+			if tt.err {
+				if !errors.Is(err, errInvalidFlashcards) {
+					t.Fatalf("err = %v, want errInvalidFlashcards", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range cards {
+				if c.Answer != strings.TrimSpace(c.Answer) {
+					t.Errorf("answer not trimmed: %q", c.Answer)
+				}
+				got = append(got, c.Question)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("questions = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlashcardsExport(t *testing.T) {
+	app := newTestApp(t)
+	app.chat("teach me about tabs")
+	app.ollama.SetChunks(`{"cards": [{"question": "Tab\tor space?", "answer": "Line one\nline two"}]}`)
+
+	resp, err := app.client.PostForm(app.server.URL+"/flashcards", url.Values{"count": {"5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	reqs := app.ollama.Requests()
+	if last := reqs[len(reqs)-1]; len(last.Messages) != 1 || !strings.Contains(last.Messages[0].Content, "Create 5 study flashcards") ||
+		!strings.Contains(last.Messages[0].Content, "User: teach me about tabs") {
+		t.Errorf("flashcard request = %+v", last)
+	}
+
+	resp, err = app.client.Get(app.server.URL + "/flashcards/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "#separator:tab\n#html:false\nTab or space?\tLine one line two\n"; string(body) != want {
+		t.Errorf("export = %q, want %q", body, want)
+	}
+}
+
+func TestAdminCrossSite(t *testing.T) {
+	app := newTestApp(t)
+	adminPassword = "pw"
+	defer func() { adminPassword = "" }()
+
+	post := func(header http.Header) int {
+		req, _ := http.NewRequest(http.MethodPost, app.server.URL+"/admin/schedules", strings.NewReader("action=cancel&id=999"))
+		req.Header = header
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "pw")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, h := range []http.Header{
+		{"Origin": {"https://evil.example"}},
+		{"Origin": {"null"}},
+		{"Sec-Fetch-Site": {"cross-site"}, "Origin": {app.server.URL}},
+		{"Sec-Fetch-Site": {"same-site"}},
+	} {
+		if code := post(h); code != http.StatusForbidden {
+			t.Errorf("%v: status %d, want 403", h, code)
+		}
+	}
+	// The admin's own forms, and clients that are not browsers
+	for _, h := range []http.Header{{"Origin": {app.server.URL}}, {"Sec-Fetch-Site": {"same-origin"}}, {}} {
+		if code := post(h); code == http.StatusForbidden {
+			t.Errorf("%v: refused", h)
+		}
+	}
+
+	// Pages may be linked to from anywhere
+	req, _ := http.NewRequest(http.MethodGet, app.server.URL+"/admin", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	req.SetBasicAuth("admin", "pw")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("admin page linked from another site: status %d", resp.StatusCode)
+	}
+}
+
+func TestAdminDuplicates(t *testing.T) {
+	app := newTestApp(t)
+	adminPassword = "pw"
+	defer func() { adminPassword = "" }()
+
+	sessionMut.Lock()
+	sess := getSession("dup-session")
+	question := "How do I reverse a slice in Go?"
+	sess.append(Message{Role: "user", Content: question})
+	sess.append(Message{Role: "assistant", Content: "Swap elements from both ends."})
+	sess.append(Message{Role: "user", Content: "how do I  reverse a slice in go?"})
+	sess.createConversation("Imported")
+	sess.append(Message{Role: "user", Content: question})
+	sess.append(Message{Role: "assistant", Content: "Swap elements from both ends."})
+	sess.append(Message{Role: "assistant", Content: "Or use slices.Reverse."})
+	sess.createConversation("Other")
+	sess.append(Message{Role: "user", Content: "Something else entirely"})
+	pairs, repeats := findDuplicates(sessionHash(sess.id), sess.scanConversations(), 0.6)
+	sessionMut.Unlock()
+
+	if len(pairs) != 1 || pairs[0].Keep.ID != 0 || pairs[0].Drop.ID != 1 || math.Abs(pairs[0].Similarity-2.0/3) > 1e-9 {
+		t.Fatalf("duplicate conversations = %+v", pairs)
+	}
+	if len(repeats) != 1 || repeats[0].ID != 3 || repeats[0].Of != 1 || repeats[0].Similarity != 1 {
+		t.Fatalf("repeated messages = %+v", repeats)
+	}
+
+	do := func(method string, form url.Values) (int, string) {
+		req, _ := http.NewRequest(method, app.server.URL+"/admin/duplicates", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if method == http.MethodGet {
+			req, _ = http.NewRequest(method, app.server.URL+"/admin/duplicates?"+form.Encode(), nil)
+		}
+		req.SetBasicAuth("admin", "pw")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, _ := do(http.MethodGet, url.Values{"threshold": {"2"}}); code != http.StatusBadRequest {
+		t.Errorf("threshold above 1: status %d", code)
+	}
+	if code, page := do(http.MethodGet, url.Values{"threshold": {"0.6"}}); code != http.StatusOK || !strings.Contains(page, "#1 Imported (3 messages)") || !strings.Contains(page, "User #3: how do I reverse") {
+		t.Errorf("duplicates page: %d %s", code, page)
+	}
+	hash := sessionHash("dup-session")
+	if code, _ := do(http.MethodPost, url.Values{"action": {"merge"}, "session": {"nope"}, "keep": {"0"}, "drop": {"1"}}); code != http.StatusNotFound {
+		t.Errorf("unknown session: status %d", code)
+	}
+	if code, _ := do(http.MethodPost, url.Values{"action": {"merge"}, "session": {hash}, "keep": {"0"}, "drop": {"1"}}); code != http.StatusSeeOther {
+		t.Errorf("merge: status %d", code)
+	}
+	if code, _ := do(http.MethodPost, url.Values{"action": {"delete_message"}, "session": {hash}, "conversation": {"0"}, "id": {"3"}}); code != http.StatusSeeOther {
+		t.Errorf("delete message: status %d", code)
+	}
+
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	if sess.conversationIndex(1) >= 0 || sess.conversationIndex(2) < 0 {
+		t.Errorf("conversations after merge: %+v", sess.Conversations)
+	}
+	var got []string
+	for _, m := range projectHistory(sess.Events, 0) {
+		got = append(got, m.Content)
+	}
+	if want := []string{question, "Swap elements from both ends.", "Or use slices.Reverse."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged conversation = %q", got)
+	}
+}
+
+func TestStoredDuplicates(t *testing.T) {
+	app := newTestApp(t)
+	adminPassword = "pw"
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = db
+	defer func() {
+		adminPassword, store = "", memoryStore{}
+		db.Close()
+	}()
+
+	sessionMut.Lock()
+	sess := getSession("stored-dup-session")
+	sess.append(Message{Role: "user", Content: "What is the capital of France?"})
+	sess.append(Message{Role: "assistant", Content: "Paris."})
+	sess.createConversation("Imported")
+	sess.append(Message{Role: "user", Content: "What is the capital of France?"})
+	sess.append(Message{Role: "assistant", Content: "Paris."})
+	// Only in the store from here on
+	delete(sessions, "stored-dup-session")
+	sessionMut.Unlock()
+
+	pairs, _ := allDuplicates(0.8)
+	hash := sessionHash("stored-dup-session")
+	if len(pairs) != 1 || pairs[0].Session != hash || pairs[0].Similarity != 1 {
+		t.Fatalf("duplicate conversations = %+v", pairs)
+	}
+	sessionMut.Lock()
+	_, loaded := sessions["stored-dup-session"]
+	sessionMut.Unlock()
+	if loaded {
+		t.Error("scanning kept a stored session in memory")
+	}
+
+	form := url.Values{"action": {"merge"}, "session": {hash}, "keep": {"0"}, "drop": {"1"}}
+	req, _ := http.NewRequest(http.MethodPost, app.server.URL+"/admin/duplicates", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "pw")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("merge: status %d", resp.StatusCode)
+	}
+	if pairs, _ := allDuplicates(0.8); len(pairs) != 0 {
+		t.Errorf("after the merge: %+v", pairs)
+	}
+}
+
+func TestStoreMaintenance(t *testing.T) {
+	app := newTestApp(t)
+	adminPassword = "pw"
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = db
+	defer func() {
+		adminPassword, store = "", memoryStore{}
+		db.Close()
+	}()
+
+	image := strings.Repeat("A", 4096)
+	sessionMut.Lock()
+	kept := getSession("kept-session")
+	kept.append(Message{Role: "user", Content: "look", Images: []string{image}})
+	kept.append(Message{Role: "user", Content: "again", Images: []string{image}})
+	kept.undo()
+	kept.append(Message{Role: "user", Content: "gone later", Images: []string{image}})
+	kept.deleteMessage(kept.History[len(kept.History)-1].ID)
+	gone := getSession("stored-session")
+	gone.createConversation("Pictures")
+	gone.append(Message{Role: "user", Content: "cat", Images: []string{image, image}})
+	gone.deleteConversation(gone.Active)
+	// Only in the store from here on
+	delete(sessions, "stored-session")
+	sessionMut.Unlock()
+
+	report, err := runMaintenance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sessions != 2 || report.Images != 3 || report.ImageBytes != 3*4096 || report.StoreBefore == 0 || report.Reclaimed() != report.StoreBefore-report.StoreAfter {
+		t.Errorf("report = %+v", report)
+	}
+
+	images := func(id string) int {
+		events, _, _, err := db.Load(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, ev := range events {
+			if ev.Message != nil {
+				n += len(ev.Message.Images)
+			}
+		}
+		return n
+	}
+	// The shown message and the deleted one, which undo can bring back
+	if n := images("kept-session"); n != 2 {
+		t.Errorf("kept session has %d images", n)
+	}
+	if n := images("stored-session"); n != 0 {
+		t.Errorf("stored session has %d images", n)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, app.server.URL+"/admin/maintenance", nil)
+	req.SetBasicAuth("admin", "pw")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("maintenance: status %d", resp.StatusCode)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for lastMaintenanceReport() == nil || lastMaintenanceReport().Finished.Before(report.Finished) {
+		if time.Now().After(deadline) {
+			t.Fatal("maintenance run never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r := lastMaintenanceReport(); r.Images != 0 || r.Error != "" {
+		t.Errorf("second run = %+v", r)
+	}
+}
+
+func TestFallbackBackend(t *testing.T) {
+	app := newTestApp(t)
+	var (
+		mu   sync.Mutex
+		sent []OpenAIChatRequest
+		auth string
+	)
+	cloud := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var req OpenAIChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		sent, auth = append(sent, req), r.Header.Get("Authorization")
+		mu.Unlock()
+		if !req.Stream {
+			writeJSON(w, http.StatusOK, OpenAICompletion{Choices: []OpenAIChoice{{Message: &OpenAIReply{Role: "assistant", Content: "cloud answer"}}}})
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, piece := range []string{"from ", "the cloud"} {
+			b, _ := json.Marshal(OpenAICompletion{Choices: []OpenAIChoice{{Delta: &OpenAIReply{Content: piece}}}})
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer cloud.Close()
+	defer func(u, k, m string) { fallbackURL, fallbackKey, fallbackModel = u, k, m }(fallbackURL, fallbackKey, fallbackModel)
+	fallbackURL, fallbackKey = cloud.URL+"/v1", "sk-test"
+	label := "via " + strings.TrimPrefix(cloud.URL, "http://")
+
+	// Ollama answers while it can
+	app.ollama.SetChunks("local answer")
+	if _, body := app.chat("first"); !strings.Contains(body, "local answer") || strings.Contains(body, label) {
+		t.Errorf("local reply missing or labelled; body: %s", body)
+	}
+
+	// Down: the chat goes to the fallback, labelled
+	app.ollama.FailWith(http.StatusServiceUnavailable)
+	_, body := app.chat("second")
+	if !strings.Contains(body, "from the cloud") || !strings.Contains(body, label) {
+		t.Errorf("fallback reply missing or unlabelled; body: %s", body)
+	}
+	mu.Lock()
+	if len(sent) != 1 || !sent[0].Stream || auth != "Bearer sk-test" || sent[0].Model != defaultModel || len(sent[0].Messages) != 3 {
+		t.Errorf("fallback got %+v with %q", sent, auth)
+	}
+	mu.Unlock()
+
+	// Missing the model, with fallbackModel in its place
+	app.ollama.FailWith(http.StatusNotFound)
+	fallbackModel = "gpt-4o-mini"
+	resp, err := app.client.Post(app.server.URL+"/api/v1/chat", "application/json",
+		strings.NewReader(`{"session": true, "messages": [{"role": "user", "content": "third"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct{ Message Message }
+	json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if out.Message.Content != "cloud answer" || out.Message.Backend != strings.TrimPrefix(cloud.URL, "http://") {
+		t.Errorf("API reply = %+v", out.Message)
+	}
+	mu.Lock()
+	if last := sent[len(sent)-1]; last.Model != "gpt-4o-mini" || last.Stream {
+		t.Errorf("fallback got %+v", last)
+	}
+	mu.Unlock()
+
+	sessionMut.Lock()
+	var backends []string
+	for _, s := range sessions {
+		for _, m := range s.History {
+			if m.Role == "assistant" {
+				backends = append(backends, m.Backend)
+			}
+		}
+	}
+	sessionMut.Unlock()
+	host := strings.TrimPrefix(cloud.URL, "http://")
+	if !reflect.DeepEqual(backends, []string{"", host, host}) {
+		t.Errorf("reply backends = %q", backends)
+	}
+
+	// A fallback that stops answering times out like Ollama
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stalled.Close()
+	defer close(release)
+	defer func(d time.Duration) { fallbackClient.ReadTimeout = d }(fallbackClient.ReadTimeout)
+	fallbackURL, fallbackClient.ReadTimeout = stalled.URL+"/v1", 50*time.Millisecond
+	start := time.Now()
+	resp, err = app.client.Post(app.server.URL+"/api/v1/chat", "application/json",
+		strings.NewReader(`{"messages": [{"role": "user", "content": "fourth"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || time.Since(start) > 2*time.Second {
+		t.Errorf("stalled fallback: status %d after %v", resp.StatusCode, time.Since(start))
+	}
+}
+
+func TestFallbackCost(t *testing.T) {
+	app := newTestApp(t)
+	var calls atomic.Int64
+	cloud := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req OpenAIChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream {
+			writeJSON(w, http.StatusOK, OpenAICompletion{Choices: []OpenAIChoice{{Message: &OpenAIReply{Role: "assistant", Content: "cloud answer"}}}})
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		b, _ := json.Marshal(OpenAICompletion{Choices: []OpenAIChoice{{Delta: &OpenAIReply{Content: "from the cloud"}}}})
+		fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", b)
+	}))
+	defer cloud.Close()
+	defer func(u string) { fallbackURL = u }(fallbackURL)
+	fallbackURL = cloud.URL + "/v1"
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	configPath = path
+	t.Cleanup(func() { configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{} })
+	setConfig := func(yaml string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadFileConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app.ollama.FailWith(http.StatusServiceUnavailable)
+	// Enough chats fail to open the fake Ollama's circuit; later tests
+	// start closed
+	t.Cleanup(func() {
+		circuits.Lock()
+		circuits.byHost = map[string]*circuit{}
+		circuits.Unlock()
+	})
+
+	// Below the threshold: sent at once, with its cost next to the reply.
+	// 500 reply tokens at $10 per million is half a cent.
+	setConfig("fallback:\n  prices:\n    \"*\": {input: 2, output: 10}\n  confirm_above: 0.01\n")
+	status, body := app.chat("cheap")
+	if status != http.StatusOK || !strings.Contains(body, "from the cloud") || !strings.Contains(body, ", about $0.0") {
+		t.Errorf("cheap chat: status %d, body: %s", status, body)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("fallback called %d times, want 1", calls.Load())
+	}
+	sessionMut.Lock()
+	var costs []float64
+	for _, s := range sessions {
+		for _, m := range s.History {
+			if m.Role == "assistant" {
+				costs = append(costs, m.Cost)
+			}
+		}
+	}
+	sessionMut.Unlock()
+	if len(costs) != 1 || costs[0] <= 0 || costs[0] >= 0.01 {
+		t.Errorf("reply costs = %v", costs)
+	}
+
+	// Above it: nothing is sent until the page's confirmation comes back
+	setConfig("fallback:\n  prices:\n    \"*\": {input: 2, output: 10}\n  confirm_above: 0.001\n")
+	status, body = app.chat("dear")
+	if status != http.StatusPaymentRequired || !strings.Contains(body, `action="/chat/confirm"`) || !strings.Contains(body, "above the $0.0010") {
+		t.Errorf("dear chat: status %d, body: %s", status, body)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("fallback called before confirming")
+	}
+	resp, err := app.client.PostForm(app.server.URL+"/chat/confirm", url.Values{"confirm_cost": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || strings.Count(string(page), "<p>from the cloud</p>") != 2 || calls.Load() != 2 {
+		t.Errorf("confirmed chat: status %d, %d calls, body: %s", resp.StatusCode, calls.Load(), page)
+	}
+	// Nothing is left to confirm once answered
+	resp, err = app.client.PostForm(app.server.URL+"/chat/confirm", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("second confirmation: status %d, want 409", resp.StatusCode)
+	}
+
+	// Over the socket the reply ends in a confirm frame, and a confirm
+	// frame back answers the prompt
+	u, _ := url.Parse(app.server.URL)
+	header := http.Header{"Origin": {app.server.URL}}
+	for _, c := range app.client.Jar.Cookies(u) {
+		header.Add("Cookie", c.String())
+	}
+	conn, wsResp, err := websocket.DefaultDialer.Dial("ws://"+u.Host+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsResp.Body.Close()
+	defer conn.Close()
+	readUntil := func(types ...string) ChatFrame {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var f ChatFrame
+			if err := conn.ReadJSON(&f); err != nil {
+				t.Fatal(err)
+			}
+			for _, typ := range types {
+				if f.Type == typ {
+					return f
+				}
+			}
+		}
+	}
+	conn.WriteJSON(ChatFrame{Type: "prompt", Text: "dear again"})
+	if f := readUntil("confirm", "done", "error"); f.Type != "confirm" || !strings.Contains(f.Text, "needs confirming") {
+		t.Errorf("socket prompt ended with %+v", f)
+	}
+	conn.WriteJSON(ChatFrame{Type: "confirm"})
+	if f := readUntil("done", "error", "confirm"); f.Type != "done" || f.Cost <= 0 || calls.Load() != 3 {
+		t.Errorf("confirmed socket reply ended with %+v after %d calls", f, calls.Load())
+	}
+
+	// The API answers 402 unless the request confirms
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"messages": [{"role": "user", "content": "dear"}]}`, http.StatusPaymentRequired},
+		{`{"messages": [{"role": "user", "content": "dear"}], "confirm_cost": true}`, http.StatusOK},
+	} {
+		resp, err := app.client.Post(app.server.URL+"/api/v1/chat", "application/json", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("API %s: status %d, want %d", tc.body, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestOllamaClient(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		status []int
+		bodies []string
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		code := http.StatusOK
+		if len(status) > 0 {
+			code, status = status[0], status[1:]
+		}
+		mu.Unlock()
+		if r.URL.Path == "/stall" {
+			w.Write([]byte("first\n"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(code)
+	}))
+	defer upstream.Close()
+	client := &OllamaClient{HTTP: &http.Client{}, ReadTimeout: time.Second, Retries: 2, Backoff: time.Millisecond}
+	post := func(path string) (*http.Response, error) {
+		req, err := newOllamaRequest(context.Background(), "", map[string]string{"model": "m"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL, _ = url.Parse(upstream.URL + path)
+		return client.Do(req)
+	}
+	reset := func(codes ...int) {
+		mu.Lock()
+		status, bodies = codes, nil
+		mu.Unlock()
+	}
+
+	// Busy twice, then through, with the body sent every time
+	reset(http.StatusServiceUnavailable, http.StatusBadGateway)
+	resp, err := post("/api/chat")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("busy: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	if len(bodies) != 3 || bodies[2] != bodies[0] || !strings.Contains(bodies[2], `"model":"m"`) {
+		t.Errorf("busy: bodies %q", bodies)
+	}
+
+	// Out of retries, the last response is returned
+	reset(503, 503, 503, 503)
+	if resp, err = post("/api/chat"); err != nil || resp.StatusCode != http.StatusServiceUnavailable || len(bodies) != 3 {
+		t.Errorf("exhausted: %v %v after %d attempts", resp, err, len(bodies))
+	}
+	resp.Body.Close()
+
+	// Errors of Ollama's own are not retried
+	reset(http.StatusInternalServerError)
+	if resp, err = post("/api/chat"); err != nil || resp.StatusCode != http.StatusInternalServerError || len(bodies) != 1 {
+		t.Errorf("server error: %v %v after %d attempts", resp, err, len(bodies))
+	}
+	resp.Body.Close()
+
+	// A stream that stalls fails after ReadTimeout, without a retry
+	reset()
+	client.ReadTimeout = 100 * time.Millisecond
+	resp, err = post("/stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, errOllamaTimeout) || len(bodies) != 1 {
+		t.Errorf("stall: %v after %d attempts", err, len(bodies))
+	}
+
+	// Nothing listening: the connection is tried again, then the error returned
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	req, _ := http.NewRequest(http.MethodGet, dead.URL+"/api/tags", nil)
+	start := time.Now()
+	if _, err := client.Do(req); err == nil || !transientOllamaFailure(nil, err) {
+		t.Errorf("refused: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 3*time.Millisecond {
+		t.Errorf("refused: no backoff (%v)", elapsed)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	app := newTestApp(t)
+	defer func(n int, d time.Duration) { breakerFailures, breakerProbeInterval = n, d }(breakerFailures, breakerProbeInterval)
+	breakerFailures, breakerProbeInterval = 2, 50*time.Millisecond
+
+	// Ollama behind a switch that makes it unreachable
+	var down atomic.Bool
+	var calls atomic.Int64
+	target, _ := url.Parse(app.ollama.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			http.Error(w, "no route", http.StatusBadGateway)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	ollamaURL = upstream.URL
+
+	down.Store(true)
+	for i := 0; i < 2; i++ {
+		if status, _ := app.chat("anyone there?"); status != http.StatusBadGateway {
+			t.Fatalf("chat %d while down: status %d", i, status)
+		}
+	}
+	// Open: refused without a call, with the friendly page and JSON
+	before := calls.Load()
+	resp, err := app.client.PostForm(app.server.URL+"/chat", url.Values{"prompt": {"hello?"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" || !strings.Contains(string(body), "Model backend unavailable") {
+		t.Errorf("open circuit: status %d, body %s", resp.StatusCode, body)
+	}
+	resp, err = app.client.Post(app.server.URL+"/api/v1/chat", "application/json", strings.NewReader(`{"messages": [{"role": "user", "content": "hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apiErr APIError
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(apiErr.Error, "model backend unavailable") {
+		t.Errorf("open circuit API: status %d, %+v", resp.StatusCode, apiErr)
+	}
+	if n := calls.Load() - before; n > 1 {
+		// Only a probe may have reached Ollama
+		t.Errorf("%d calls reached Ollama with the circuit open", n)
+	}
+	if len(openCircuits()) != 1 {
+		t.Errorf("open circuits = %+v", openCircuits())
+	}
+
+	// A probe finds it back
+	app.ollama.SetChunks("back again")
+	down.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(openCircuits()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("circuit never closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status, body := app.chat("and now?"); status != http.StatusOK || !strings.Contains(body, "back again") {
+		t.Errorf("after recovery: status %d", status)
+	}
+}
+
+func TestOfflinePromptQueue(t *testing.T) {
+	app := newTestApp(t)
+	defer func(n int, d time.Duration) { breakerFailures, breakerProbeInterval = n, d }(breakerFailures, breakerProbeInterval)
+	breakerFailures, breakerProbeInterval = 1, 50*time.Millisecond
+	offlineQueue = true
+	defer func() { offlineQueue = false }()
+
+	var down atomic.Bool
+	target, _ := url.Parse(app.ollama.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "no route", http.StatusBadGateway)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	ollamaURL = upstream.URL
+	pending := func() int {
+		resp, err := app.client.Get(app.server.URL + "/chat/pending")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out struct{ Pending int }
+		json.NewDecoder(resp.Body).Decode(&out)
+		return out.Pending
+	}
+
+	down.Store(true)
+	app.chat("first, unanswered")
+	// Offline now: prompts are kept back, shown as pending
+	app.chat("queued one")
+	status, body := app.chat("queued two")
+	if status != http.StatusOK || strings.Count(body, `class="message user pending"`) != 2 || !strings.Contains(body, "queued two") {
+		t.Fatalf("queued: status %d; body: %s", status, body)
+	}
+	if n := pending(); n != 2 {
+		t.Errorf("pending = %d", n)
+	}
+
+	app.ollama.SetChunks("answered")
+	down.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("queued prompts never sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sessionMut.Lock()
+	var got []string
+	for _, s := range sessions {
+		for _, m := range s.History {
+			got = append(got, m.Role+": "+m.Content)
+		}
+	}
+	sessionMut.Unlock()
+	want := []string{"user: first, unanswered", "user: queued one", "assistant: answered", "user: queued two", "assistant: answered"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %q", got)
+	}
+	// The replies were asked for with the conversation as it stood
+	reqs := app.ollama.Requests()
+	if last := reqs[len(reqs)-1]; len(last.Messages) < 4 || last.Messages[len(last.Messages)-1].Content != "queued two" {
+		t.Errorf("last request = %+v", last.Messages)
+	}
+}
+
+func TestOfflineQueueWaitsForUnlock(t *testing.T) {
+	app := newTestApp(t)
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = db
+	defer func() {
+		store = memoryStore{}
+		db.Close()
+	}()
+	defer func(n int, d time.Duration) { breakerFailures, breakerProbeInterval = n, d }(breakerFailures, breakerProbeInterval)
+	breakerFailures, breakerProbeInterval = 1, 50*time.Millisecond
+	offlineQueue = true
+	defer func() { offlineQueue = false }()
+
+	var down atomic.Bool
+	target, _ := url.Parse(app.ollama.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "no route", http.StatusBadGateway)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	ollamaURL = upstream.URL
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	app.chat("before")
+	resp, err := app.client.PostForm(app.server.URL+"/privacy",
+		url.Values{"action": {"encrypt"}, "passphrase": {"correct horse"}, "confirm": {"correct horse"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	down.Store(true)
+	app.chat("first, unanswered")
+	app.chat("queued while locked")
+	queued := func() (n int) {
+		sessionMut.Lock()
+		defer sessionMut.Unlock()
+		for _, s := range sessions {
+			n += len(s.Pending)
+		}
+		return n
+	}
+	if n := queued(); n != 1 {
+		t.Fatalf("queued = %d", n)
+	}
+
+	// Ollama recovers while no request holds the key: the prompt stays queued
+	app.ollama.SetChunks("answered")
+	down.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for circuitFor(upstreamURL).allow() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("circuit never closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := queued(); n != 1 {
+		t.Errorf("queued while locked = %d, want 1", n)
+	}
+	for _, req := range app.ollama.Requests() {
+		if last := req.Messages[len(req.Messages)-1]; last.Content == "queued while locked" {
+			t.Error("prompt sent while the transcript was locked")
+		}
+	}
+
+	// The next request with the key unlocks it and the prompt is sent
+	for queued() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("queued prompt never sent after unlocking")
+		}
+		resp, err := app.client.Get(app.server.URL + "/chat/pending")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, body := app.chat("after")
+	if !strings.Contains(body, "queued while locked") || strings.Count(body, "<p>answered</p>") != 2 {
+		t.Errorf("queued prompt and reply missing after unlock: %s", body)
+	}
+}
+
+func TestPullMissingModel(t *testing.T) {
+	app := newTestApp(t)
+	app.ollama.RequireInstalled(true)
+	app.ollama.SetChunks("Hel", "lo")
+	if pullMissing {
+		t.Fatal("-pull-missing is on by default")
+	}
+	defer func(v bool) { pullMissing = v }(pullMissing)
+	pullMissing = true
+	t.Cleanup(func() { fileConfig = FileConfig{} })
+
+	// A model no list names is not pulled, even with -pull-missing
+	if status, _ := app.chat("unlisted"); status != http.StatusBadGateway || len(app.ollama.Pulls()) != 0 {
+		t.Errorf("unlisted model: status %d, pulls %q", status, app.ollama.Pulls())
+	}
+	if !pullListed(withTenant(context.Background(), &Tenant{Name: "acme", Models: []string{"other:1b"}}), "other:1b") {
+		t.Error("a model the tenant lists is not pulled")
+	}
+
+	fileConfig = FileConfig{Models: []string{defaultModel, "other:1b"}}
+	resp, err := app.client.PostForm(app.server.URL+"/chat/stream", url.Values{"prompt": {"hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	var content string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if data := strings.TrimPrefix(sc.Text(), "data: "); data != sc.Text() {
+			var c APIChatChunk
+			json.Unmarshal([]byte(data), &c)
+			if c.Status != "" {
+				statuses = append(statuses, c.Status)
+			}
+			content += c.Content
+		}
+	}
+	resp.Body.Close()
+	if content != "Hello" {
+		t.Errorf("reply after the pull = %q", content)
+	}
+	want := []string{"Downloading " + defaultModel + ": starting", "Downloading " + defaultModel + ": pulling manifest",
+		"Downloading " + defaultModel + ": layer 1, 0% of " + formatSize(200), "Downloading " + defaultModel + ": layer 1, 50% of " + formatSize(200),
+		"Downloading " + defaultModel + ": layer 1, 100% of " + formatSize(200), "Downloading " + defaultModel + ": success"}
+	if strings.Join(statuses, "\n") != strings.Join(want, "\n") {
+		t.Errorf("progress:\n%s\nwant:\n%s", strings.Join(statuses, "\n"), strings.Join(want, "\n"))
+	}
+	if pulls := app.ollama.Pulls(); len(pulls) != 1 || pulls[0] != defaultModel {
+		t.Fatalf("pulls = %q", pulls)
+	}
+
+	// Installed now, so the next chat goes straight through
+	if status, _ := app.chat("again"); status != http.StatusOK || len(app.ollama.Pulls()) != 1 {
+		t.Errorf("second chat: status %d, pulls %q", status, app.ollama.Pulls())
+	}
+
+	// Without -pull-missing the chat fails as before
+	pullMissing = false
+	api, err := app.client.Post(app.server.URL+"/api/v1/chat", "application/json",
+		strings.NewReader(`{"model": "other:1b", "messages": [{"role": "user", "content": "hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Body.Close()
+	if api.StatusCode != http.StatusBadGateway || len(app.ollama.Pulls()) != 1 {
+		t.Errorf("missing model without pulling: status %d, pulls %q", api.StatusCode, app.ollama.Pulls())
+	}
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	app := newTestApp(t)
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	configPath = path
+	t.Cleanup(func() { configPath, fileConfig, configModTime = "", FileConfig{}, time.Time{} })
+	setConfig := func(yaml string) error {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return loadFileConfig()
+	}
+	status := func(path string) int {
+		t.Helper()
+		resp, err := app.client.Get(app.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The test client is on 127.0.0.1
+	if err := setConfig("network:\n  deny: [10.0.0.0/8]\n  api:\n    allow: [192.0.2.0/24]\n  admin:\n    allow: [203.0.113.7]\n"); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int{"/": http.StatusOK, "/api/v1/models": http.StatusForbidden,
+		"/v1/models": http.StatusForbidden, "/admin": http.StatusForbidden, "/admin/pulls": http.StatusForbidden} {
+		if got := status(path); got != want {
+			t.Errorf("GET %s: status %d, want %d", path, got, want)
+		}
+	}
+
+	if err := setConfig("network:\n  api:\n    allow: [127.0.0.1, '::1']\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := status("/api/v1/models"); got != http.StatusOK {
+		t.Errorf("API from an allowed address: status %d", got)
+	}
+
+	// The admin pages answer only what the rules for every route let through
+	if err := setConfig("network:\n  deny: [127.0.0.0/8]\n  admin:\n    allow: [127.0.0.0/8]\n"); err != nil {
+		t.Fatal(err)
+	}
+	if status("/") != http.StatusForbidden || status("/admin") != http.StatusForbidden {
+		t.Error("denied address reached the chat or admin pages")
+	}
+
+	if err := setConfig("network:\n  allow: [localhost]\n"); err == nil {
+		t.Error("a host name was accepted as a network")
+	}
+	if status("/") != http.StatusForbidden {
+		t.Error("a bad config replaced the rules in effect")
+	}
+	for path, want := range map[string]string{"/admin": "admin", "/admin/pulls": "admin", "/administrator": "chat",
+		"/api/v1/chat": "api", "/v1/chat/completions": "api", "/graphql": "api", "/mcp": "api", "/chat": "chat", "/ws": "chat"} {
+		if got := routeGroup(path); got != want {
+			t.Errorf("routeGroup(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often the store is compacted and orphaned images pruned; 0 turns
+// the scheduled run off, leaving the admin button. Set by
+// -maintenance-interval.
+var maintenanceInterval = 24 * time.Hour
+
+// sessionLister is a store that can name every session it holds, so
+// maintenance can reach sessions not loaded since the server started
+type sessionLister interface {
+	SessionIDs() ([]string, error)
+}
+
+// IDs of every session: those in memory, then those only in the store when
+// it can list them
+func allSessionIDs() ([]string, error) {
+	sessionMut.Lock()
+	ids := make([]string, 0, len(sessions))
+	loaded := make(map[string]bool, len(sessions))
+	for id := range sessions {
+		ids = append(ids, id)
+		loaded[id] = true
+	}
+	sessionMut.Unlock()
+
+	lister, ok := store.(sessionLister)
+	if !ok {
+		return ids, nil
+	}
+	storeWrites.flush()
+	stored, err := lister.SessionIDs()
+	for _, id := range stored {
+		if !loaded[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, err
+}
+
+// compactingStore is a store that can give back space its deleted data
+// still takes, reporting its size in bytes before and after
+type compactingStore interface {
+	Compact() (before, after int64, err error)
+}
+
+// MaintenanceReport is what a maintenance run did
+type MaintenanceReport struct {
+	Started, Finished time.Time
+	Sessions          int   // sessions rewritten without their orphaned images
+	Images            int   // images pruned
+	ImageBytes        int64 // their base64 size
+	StoreBefore       int64 // store size before compacting; 0 when the store has no size
+	StoreAfter        int64
+	Error             string
+}
+
+// Bytes the run freed: what compaction gave back when the store has a
+// size, else the size of the pruned images
+func (r MaintenanceReport) Reclaimed() int64 {
+	switch {
+	case r.StoreBefore == 0:
+		return r.ImageBytes
+	case r.StoreBefore > r.StoreAfter:
+		return r.StoreBefore - r.StoreAfter
+	}
+	return 0
+}
+
+var (
+	maintenanceMut  sync.Mutex
+	lastMaintenance *MaintenanceReport
+)
+
+// The most recent maintenance run's report, if there was one
+func lastMaintenanceReport() *MaintenanceReport {
+	maintenanceMut.Lock()
+	defer maintenanceMut.Unlock()
+	if lastMaintenance == nil {
+		return nil
+	}
+	r := *lastMaintenance
+	return &r
+}
+
+// Drop the images of messages no one can see again: those in deleted
+// conversations, which cannot come back, and those whose adding was
+// undone. Deleted messages keep theirs, since undo restores them. Events
+// are changed in place; returns the images dropped and their size.
+func pruneOrphanedImages(events []MessageEvent) (n int, size int64) {
+	deleted := make(map[int]bool)
+	undone := make(map[int]bool)
+	for _, ev := range events {
+		switch ev.Type {
+		case EventConversationDeleted:
+			deleted[ev.Conversation] = true
+		case EventUndone:
+			undone[ev.Target] = true
+		}
+	}
+	for i, ev := range events {
+		if ev.Type != EventAdded || ev.Message == nil || len(ev.Message.Images) == 0 {
+			continue
+		}
+		if !deleted[ev.Conversation] && !undone[ev.Seq] {
+			continue
+		}
+		for _, img := range ev.Message.Images {
+			n++
+			size += int64(len(img))
+		}
+		msg := *ev.Message
+		msg.Images = nil
+		events[i].Message = &msg
+	}
+	return n, size
+}
+
+// Prune orphaned images from every session, in memory and, when the store
+// can list them, in the store, then compact the store. Encrypted sessions
+// are left alone, as their events are sealed.
+func runMaintenance(ctx context.Context) (MaintenanceReport, error) {
+	report := MaintenanceReport{Started: time.Now()}
+	prune := func(s *session) {
+		n, size := pruneOrphanedImages(s.Events)
+		if n == 0 {
+			return
+		}
+		report.Sessions++
+		report.Images += n
+		report.ImageBytes += size
+		storeWrites.flush()
+		if err := store.Replace(s.id, s.Events, s.LastActive); err != nil {
+			log.Printf("Maintenance store error: %v", err)
+		}
+	}
+
+	sessionMut.Lock()
+	for _, s := range sessions {
+		s.refresh()
+		if s.Transcript == nil {
+			prune(s)
+		}
+	}
+	sessionMut.Unlock()
+
+	if lister, ok := store.(sessionLister); ok {
+		ids, err := lister.SessionIDs()
+		if err != nil {
+			return report, err
+		}
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			// One at a time, so chats go on between them
+			sessionMut.Lock()
+			if _, loaded := sessions[id]; !loaded {
+				if s := loadSession(id); s != nil && s.Transcript == nil {
+					prune(s)
+				}
+			}
+			sessionMut.Unlock()
+		}
+	}
+
+	if c, ok := store.(compactingStore); ok {
+		before, after, err := c.Compact()
+		if err != nil {
+			return report, err
+		}
+		report.StoreBefore, report.StoreAfter = before, after
+	}
+	report.Finished = time.Now()
+	return report, nil
+}
+
+// Queue a maintenance run on the worker pool, keeping its report for the
+// admin page
+func submitMaintenance() error {
+	return submitTask("maintenance", "store compaction", func(ctx context.Context) error {
+		report, err := runMaintenance(ctx)
+		if err != nil {
+			report.Error = err.Error()
+			report.Finished = time.Now()
+		}
+		maintenanceMut.Lock()
+		lastMaintenance = &report
+		maintenanceMut.Unlock()
+		log.Printf("Maintenance: pruned %d images from %d sessions, reclaimed %s", report.Images, report.Sessions, formatSize(report.Reclaimed()))
+		return err
+	}, nil)
+}
+
+// Run maintenance every interval
+func startMaintenance(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := submitMaintenance(); err != nil {
+				log.Printf("Maintenance error: %v", err)
+			}
+		}
+	}()
+}
+
+// Admin button starting a maintenance run now, back to the admin page
+func adminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := submitMaintenance(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	redirect(w, r, "/admin", http.StatusSeeOther)
+}
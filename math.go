@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Fenced and inline code, where math delimiters are left alone
+	codeSpanRe = regexp.MustCompile("(?s)```.*?```|`[^`\n]+`")
+	// $$...$$ and \[...\]
+	displayMathRe = regexp.MustCompile(`(?s)\$\$(.+?)\$\$|\\\[(.+?)\\\]`)
+	// \(...\) and $...$ (no space just inside the dollars)
+	inlineMathRe = regexp.MustCompile(`\\\((.+?)\\\)|\$([^\s$](?:[^$\n]*[^\s$])?)\$`)
+	// Placeholder left in the markdown while it is rendered
+	mathPlaceholderRe = regexp.MustCompile(`MATHPH(\d+)X`)
+)
+
+// mathSegment is a TeX expression lifted out of the markdown
+type mathSegment struct {
+	tex     string
+	display bool
+}
+
+// Replace math outside code with placeholders so the markdown renderer
+// cannot mangle backslashes, underscores, or asterisks inside it.
+func extractMath(content string) (string, []mathSegment) {
+	var segments []mathSegment
+	var out strings.Builder
+
+	protect := func(text string) string {
+		text = displayMathRe.ReplaceAllStringFunc(text, func(m string) string {
+			sub := displayMathRe.FindStringSubmatch(m)
+			segments = append(segments, mathSegment{tex: strings.TrimSpace(sub[1] + sub[2]), display: true})
+			return fmt.Sprintf("MATHPH%dX", len(segments)-1)
+		})
+
+		var b strings.Builder
+		last := 0
+		for _, loc := range inlineMathRe.FindAllStringSubmatchIndex(text, -1) {
+			start, end := loc[0], loc[1]
+			// "$5 and $10" is currency, not math, and a stray "$" next to
+			// the match is an unbalanced "$$"
+			if text[start] == '$' && end < len(text) && (text[end] >= '0' && text[end] <= '9' || text[end] == '$') {
+				continue
+			}
+			if text[start] == '$' && start > 0 && text[start-1] == '$' {
+				continue
+			}
+			tex := ""
+			if loc[2] >= 0 {
+				tex = text[loc[2]:loc[3]]
+			} else {
+				tex = text[loc[4]:loc[5]]
+			}
+			segments = append(segments, mathSegment{tex: tex})
+			b.WriteString(text[last:start])
+			fmt.Fprintf(&b, "MATHPH%dX", len(segments)-1)
+			last = end
+		}
+		b.WriteString(text[last:])
+		return b.String()
+	}
+
+	last := 0
+	for _, loc := range codeSpanRe.FindAllStringIndex(content, -1) {
+		out.WriteString(protect(content[last:loc[0]]))
+		out.WriteString(content[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	out.WriteString(protect(content[last:]))
+
+	return out.String(), segments
+}
+
+// Swap placeholders in rendered HTML for escaped math elements that the
+// client-side KaTeX script typesets
+func restoreMath(rendered string, segments []mathSegment) string {
+	if len(segments) == 0 {
+		return rendered
+	}
+	return mathPlaceholderRe.ReplaceAllStringFunc(rendered, func(m string) string {
+		var i int
+		fmt.Sscanf(m, "MATHPH%dX", &i)
+		if i >= len(segments) {
+			return m
+		}
+		seg := segments[i]
+		class := "math math-inline"
+		if seg.display {
+			class = "math math-display"
+		}
+		return `<span class="` + class + `">` + html.EscapeString(seg.tex) + `</span>`
+	})
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAML file listing MCP (Model Context Protocol) servers to connect to
+var mcpConfigPath string
+
+const (
+	mcpProtocolVersion = "2024-11-05"
+	mcpStartTimeout    = 15 * time.Second
+	mcpCallTimeout     = 60 * time.Second
+	// Separates server and tool in the names offered to the model
+	mcpToolSeparator = "__"
+)
+
+// MCPServerConfig launches one MCP server speaking JSON-RPC over stdio
+type MCPServerConfig struct {
+	Name    string            `yaml:"name"`
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	Env     map[string]string `yaml:"env"`
+}
+
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+type mcpResource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	MimeType    string `json:"mimeType"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// rpcMessage is any JSON-RPC 2.0 frame: request, notification or response
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// mcpClient is a running MCP server process and the tools and resources it
+// offers
+type mcpClient struct {
+	name  string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan rpcMessage
+	closed  chan struct{}
+
+	tools     []mcpTool
+	resources []mcpResource
+}
+
+// Connected MCP servers, set up at startup
+var mcpClients []*mcpClient
+
+// Start every MCP server in the configuration file, if one was given
+func loadMCPServers() error {
+	if mcpConfigPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(mcpConfigPath)
+	if err != nil {
+		return err
+	}
+	var config struct {
+		Servers []MCPServerConfig `yaml:"servers"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %w", mcpConfigPath, err)
+	}
+
+	for _, sc := range config.Servers {
+		if sc.Name == "" || sc.Command == "" || strings.Contains(sc.Name, mcpToolSeparator) {
+			return fmt.Errorf("%s: MCP server needs a name (without %q) and a command", mcpConfigPath, mcpToolSeparator)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mcpStartTimeout)
+		c, err := startMCPClient(ctx, sc)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("MCP server %s: %w", sc.Name, err)
+		}
+		log.Printf("MCP server %s: %d tools, %d resources", sc.Name, len(c.tools), len(c.resources))
+		mcpClients = append(mcpClients, c)
+	}
+	return nil
+}
+
+// Launch a server, perform the initialize handshake, and list what it offers
+func startMCPClient(ctx context.Context, sc MCPServerConfig) (*mcpClient, error) {
+	cmd := exec.Command(sc.Command, sc.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range sc.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	c := &mcpClient{
+		name:    sc.Name,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan rpcMessage),
+		closed:  make(chan struct{}),
+	}
+	go c.readLoop(stdout)
+
+	var init struct {
+		Capabilities struct {
+			Tools     *struct{} `json:"tools"`
+			Resources *struct{} `json:"resources"`
+		} `json:"capabilities"`
+	}
+	err = c.call(ctx, "initialize", map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]string{"name": "deepseek-app", "version": "1.0"},
+	}, &init)
+	if err == nil {
+		err = c.notify("notifications/initialized")
+	}
+	if err == nil && init.Capabilities.Tools != nil {
+		err = c.listAll(ctx, "tools/list", "tools", &c.tools)
+	}
+	if err == nil && init.Capabilities.Resources != nil {
+		err = c.listAll(ctx, "resources/list", "resources", &c.resources)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Fetch every page of a list method, appending the items under key to out
+func (c *mcpClient) listAll(ctx context.Context, method, key string, out interface{}) error {
+	var all []json.RawMessage
+	cursor := ""
+	for {
+		params := map[string]string{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var page map[string]json.RawMessage
+		if err := c.call(ctx, method, params, &page); err != nil {
+			return err
+		}
+		var items []json.RawMessage
+		if raw, ok := page[key]; ok {
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return err
+			}
+		}
+		all = append(all, items...)
+		cursor = ""
+		if raw, ok := page["nextCursor"]; ok {
+			json.Unmarshal(raw, &cursor)
+		}
+		if cursor == "" {
+			break
+		}
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *mcpClient) write(msg rpcMessage) error {
+	msg.JSONRPC = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.stdin.Write(append(data, '\n'))
+	return err
+}
+
+func (c *mcpClient) notify(method string) error {
+	return c.write(rpcMessage{Method: method})
+}
+
+// Send a request and decode its result into out
+func (c *mcpClient) call(ctx context.Context, method string, params, out interface{}) error {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	ch := make(chan rpcMessage, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(rpcMessage{ID: &id, Method: method, Params: params}); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, out)
+	case <-c.closed:
+		return errors.New("MCP server exited")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Deliver responses to their callers. Server-sent requests are answered
+// with an empty result only for ping; everything else is unsupported.
+func (c *mcpClient) readLoop(stdout io.Reader) {
+	defer close(c.closed)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var msg rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf("MCP server %s sent invalid JSON: %v", c.name, err)
+			continue
+		}
+		switch {
+		case msg.ID != nil && msg.Method == "ping":
+			c.write(rpcMessage{ID: msg.ID, Result: json.RawMessage(`{}`)})
+		case msg.ID != nil && msg.Method != "":
+			c.write(rpcMessage{ID: msg.ID, Error: &rpcError{Code: -32601, Message: "method not found"}})
+		case msg.ID != nil:
+			c.mu.Lock()
+			ch := c.pending[*msg.ID]
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- msg
+			}
+		}
+	}
+}
+
+// Close stops the server process
+func (c *mcpClient) Close() error {
+	c.stdin.Close()
+	select {
+	case <-c.closed:
+	case <-time.After(2 * time.Second):
+		c.cmd.Process.Kill()
+	}
+	return c.cmd.Wait()
+}
+
+// Tools from every connected MCP server, named <server>__<tool>. Servers
+// with resources also get a <server>__read_resource tool.
+func mcpTools() []Tool {
+	var tools []Tool
+	for _, c := range mcpClients {
+		for _, t := range c.tools {
+			params := t.InputSchema
+			if len(params) == 0 {
+				params = json.RawMessage(`{"type": "object", "properties": {}}`)
+			}
+			tools = append(tools, Tool{Type: "function", Function: ToolFunction{
+				Name:        c.name + mcpToolSeparator + t.Name,
+				Description: t.Description,
+				Parameters:  params,
+			}})
+		}
+		if len(c.resources) == 0 {
+			continue
+		}
+
+		var desc strings.Builder
+		fmt.Fprintf(&desc, "Read a resource from %s. Available resources:", c.name)
+		uris := make([]string, 0, len(c.resources))
+		for _, res := range c.resources {
+			fmt.Fprintf(&desc, "\n- %s (%s)", res.URI, firstNonEmpty(res.Description, res.Name))
+			uris = append(uris, res.URI)
+		}
+		schema, _ := json.Marshal(map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"uri": map[string]interface{}{"type": "string", "enum": uris}},
+			"required":   []string{"uri"},
+		})
+		tools = append(tools, Tool{Type: "function", Function: ToolFunction{
+			Name:        c.name + mcpToolSeparator + "read_resource",
+			Description: desc.String(),
+			Parameters:  schema,
+		}})
+	}
+	return tools
+}
+
+// Run a tool call against the MCP server that owns it
+func callMCPTool(ctx context.Context, call ToolCall) string {
+	server, tool, ok := strings.Cut(call.Function.Name, mcpToolSeparator)
+	var client *mcpClient
+	for _, c := range mcpClients {
+		if ok && c.name == server {
+			client = c
+		}
+	}
+	if client == nil {
+		return toolError(fmt.Errorf("unknown tool %q", call.Function.Name))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mcpCallTimeout)
+	defer cancel()
+
+	args := call.Function.Arguments
+	if len(args) == 0 || string(args) == "null" {
+		args = json.RawMessage(`{}`)
+	}
+
+	if tool == "read_resource" && len(client.resources) > 0 {
+		var params struct {
+			URI string `json:"uri"`
+		}
+		if err := json.Unmarshal(args, &params); err != nil {
+			return toolError(err)
+		}
+		var result struct {
+			Contents []struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"contents"`
+		}
+		if err := client.call(ctx, "resources/read", params, &result); err != nil {
+			return toolError(err)
+		}
+		var out []string
+		for _, content := range result.Contents {
+			if content.Text != "" {
+				out = append(out, content.Text)
+			} else {
+				out = append(out, fmt.Sprintf("[binary content at %s]", content.URI))
+			}
+		}
+		return strings.Join(out, "\n\n")
+	}
+
+	var result struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+	if err := client.call(ctx, "tools/call", map[string]interface{}{"name": tool, "arguments": args}, &result); err != nil {
+		return toolError(err)
+	}
+	var out []string
+	for _, content := range result.Content {
+		if content.Type == "text" {
+			out = append(out, content.Text)
+		} else {
+			out = append(out, "["+content.Type+" content]")
+		}
+	}
+	text := strings.Join(out, "\n")
+	if result.IsError {
+		return "Error: " + text
+	}
+	return text
+}
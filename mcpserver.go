@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Bearer token MCP clients must present; the /mcp endpoint is off without it
+var mcpServerToken string
+
+const (
+	maxMCPRequestBytes   = 1 << 20
+	defaultMCPSearchHits = 10
+	mcpSnippetRadius     = 80
+)
+
+// mcpRequest is an incoming JSON-RPC frame. IDs may be numbers or strings.
+type mcpRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// Tools this app offers to MCP clients
+var mcpServerTools = []mcpTool{
+	{Name: "list_conversations", Description: "List stored conversations with their IDs and message counts",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {}}`)},
+	{Name: "get_conversation", Description: "Fetch every message of a conversation by ID",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {"id": {"type": "string"}}, "required": ["id"]}`)},
+	{Name: "search_conversations", Description: "Find messages containing all the words of a query, newest conversations first",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {"query": {"type": "string"}, "limit": {"type": "integer"}}, "required": ["query"]}`)},
+}
+
+// storedConversation is a conversation addressed across all sessions
+type storedConversation struct {
+	ID string // <session hash>/<dataset key>
+	DatasetConversation
+}
+
+// Short, stable stand-in for a session ID, so cookies are never exposed
+func sessionHash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Snapshot every conversation in a tenant's sessions, in memory or in the
+// store, most recently changed first. Stored sessions are loaded one at a
+// time and not kept in memory.
+func allConversations(t *Tenant) []storedConversation {
+	ids, err := allSessionIDs()
+	if err != nil {
+		log.Printf("MCP: listing stored sessions: %v", err)
+	}
+	var all []storedConversation
+	for _, id := range ids {
+		if !sessionInTenant(id, t) {
+			continue
+		}
+		sessionMut.Lock()
+		sess, ok := sessions[id]
+		if !ok {
+			sess = loadSession(id)
+		}
+		// Encrypted chats are only for their owner
+		if sess != nil && sess.Transcript == nil {
+			for _, conv := range datasetConversations(sess) {
+				conv.Messages = append([]Message(nil), conv.Messages...)
+				all = append(all, storedConversation{ID: sessionHash(id) + "/" + conv.Key, DatasetConversation: conv})
+			}
+		}
+		sessionMut.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].Updated.Equal(all[j].Updated) {
+			return all[i].Updated.After(all[j].Updated)
+		}
+		return all[i].ID < all[j].ID
+	})
+	return all
+}
+
+// MCP server over the Streamable HTTP transport: each POST carries one
+// JSON-RPC message and gets a JSON response. Clients see the conversations
+// of the tenant the request is for, by host or /t/<name>/ prefix, and of no
+// other.
+func mcpServerHandler(w http.ResponseWriter, r *http.Request) {
+	if mcpServerToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(mcpServerToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req mcpRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxMCPRequestBytes)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, mcpResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: &rpcError{Code: -32700, Message: "parse error"}})
+		return
+	}
+	// Notifications need no reply
+	if len(req.ID) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	result, rpcErr := handleMCPRequest(requestTenant(r), req)
+	writeJSON(w, http.StatusOK, mcpResponse{JSONRPC: "2.0", ID: req.ID, Result: result, Error: rpcErr})
+}
+
+func handleMCPRequest(t *Tenant, req mcpRequest) (interface{}, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}, "resources": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "deepseek-app", "version": "1.0"},
+		}, nil
+	case "ping":
+		return map[string]interface{}{}, nil
+	case "tools/list":
+		return map[string]interface{}{"tools": mcpServerTools}, nil
+	case "tools/call":
+		var p struct {
+			Name      string `json:"name"`
+			Arguments struct {
+				ID    string `json:"id"`
+				Query string `json:"query"`
+				Limit int    `json:"limit"`
+			} `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, &rpcError{Code: -32602, Message: "invalid params"}
+		}
+		text, err := runMCPServerTool(t, p.Name, p.Arguments.ID, p.Arguments.Query, p.Arguments.Limit)
+		if err != nil {
+			return map[string]interface{}{"isError": true, "content": []map[string]string{{"type": "text", "text": err.Error()}}}, nil
+		}
+		return map[string]interface{}{"content": []map[string]string{{"type": "text", "text": text}}}, nil
+	case "resources/list":
+		var resources []mcpResource
+		for _, conv := range allConversations(t) {
+			resources = append(resources, mcpResource{URI: "conversation://" + conv.ID, Name: conv.Title, MimeType: "text/markdown"})
+		}
+		return map[string]interface{}{"resources": resources}, nil
+	case "resources/read":
+		var p struct {
+			URI string `json:"uri"`
+		}
+		json.Unmarshal(req.Params, &p)
+		text, err := runMCPServerTool(t, "get_conversation", strings.TrimPrefix(p.URI, "conversation://"), "", 0)
+		if err != nil {
+			return nil, &rpcError{Code: -32002, Message: err.Error()}
+		}
+		return map[string]interface{}{"contents": []map[string]string{{"uri": p.URI, "mimeType": "text/markdown", "text": text}}}, nil
+	default:
+		return nil, &rpcError{Code: -32601, Message: "method not found"}
+	}
+}
+
+func runMCPServerTool(t *Tenant, name, id, query string, limit int) (string, error) {
+	convs := allConversations(t)
+	var b strings.Builder
+
+	switch name {
+	case "list_conversations":
+		for _, conv := range convs {
+			fmt.Fprintf(&b, "%s\t%s\t%d messages\n", conv.ID, conv.Title, len(conv.Messages))
+		}
+		if b.Len() == 0 {
+			return "No conversations stored.", nil
+		}
+	case "get_conversation":
+		for _, conv := range convs {
+			if conv.ID == id {
+				fmt.Fprintf(&b, "# %s\n\n", conv.Title)
+				for _, msg := range conv.Messages {
+					fmt.Fprintf(&b, "**%s:** %s\n\n", msg.Role, msg.Content)
+				}
+				return b.String(), nil
+			}
+		}
+		return "", fmt.Errorf("no conversation %q", id)
+	case "search_conversations":
+		words := strings.Fields(strings.ToLower(query))
+		if len(words) == 0 {
+			return "", fmt.Errorf("query is empty")
+		}
+		if limit <= 0 {
+			limit = defaultMCPSearchHits
+		}
+		hits := 0
+		for _, conv := range convs {
+			for _, msg := range conv.Messages {
+				if hits < limit && containsAll(strings.ToLower(msg.Content), words) {
+					fmt.Fprintf(&b, "[%s] %s: %s\n", conv.ID, msg.Role, snippet(msg.Content, words[0]))
+					hits++
+				}
+			}
+		}
+		if hits == 0 {
+			return "No matches.", nil
+		}
+	default:
+		return "", fmt.Errorf("unknown tool %q", name)
+	}
+	return b.String(), nil
+}
+
+func containsAll(s string, words []string) bool {
+	for _, w := range words {
+		if !strings.Contains(s, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// A short excerpt of s around the first occurrence of word
+func snippet(s, word string) string {
+	i := strings.Index(strings.ToLower(s), word)
+	if i < 0 {
+		i = 0
+	}
+	start, end := i-mcpSnippetRadius, i+len(word)+mcpSnippetRadius
+	if start < 0 {
+		start = 0
+	}
+	if end > len(s) {
+		end = len(s)
+	}
+	// Don't cut a character in half
+	for start > 0 && !utf8.RuneStart(s[start]) {
+		start--
+	}
+	for end < len(s) && !utf8.RuneStart(s[end]) {
+		end++
+	}
+	out := strings.Join(strings.Fields(s[start:end]), " ")
+	if start > 0 {
+		out = "..." + out
+	}
+	if end < len(s) {
+		out += "..."
+	}
+	return out
+}
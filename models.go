@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Pull configured models that are missing from Ollama at startup
+var autoPull bool
+
+// Models the server is configured to use
+func configuredModels() []string {
+	return []string{defaultModel}
+}
+
+// Ollama names untagged models ":latest"
+func fullModelName(name string) string {
+	if !strings.Contains(name, ":") {
+		return name + ":latest"
+	}
+	return name
+}
+
+// Check every Ollama host has the configured models, pulling missing ones
+// when pull is set. It returns the models still missing, as "host: model".
+func ensureModels(ctx context.Context, models []string, pull bool) ([]string, error) {
+	var missing []string
+	for _, host := range upstreams() {
+		hostCtx := withUpstream(ctx, host)
+		installed, err := ollamaListModels(hostCtx)
+		if err != nil {
+			return nil, fmt.Errorf("listing models on %s: %w", host, err)
+		}
+		have := make(map[string]bool, len(installed))
+		for _, m := range installed {
+			have[fullModelName(m.Name)] = true
+		}
+
+		for _, model := range models {
+			if have[fullModelName(model)] {
+				continue
+			}
+			if !pull {
+				missing = append(missing, host+": "+model)
+				continue
+			}
+			log.Printf("Pulling %s on %s", model, host)
+			if err := guardedPull(hostCtx, model, pullLogger(model)); err != nil {
+				return missing, err
+			}
+			log.Printf("Pulled %s on %s", model, host)
+		}
+	}
+	return missing, nil
+}
+
+// Log pull progress when the status changes and at every 10% of a layer
+func pullLogger(model string) func(PullProgress) {
+	var lastStatus string
+	lastTenth := -1
+	return func(p PullProgress) {
+		if p.Status != lastStatus {
+			lastStatus, lastTenth = p.Status, -1
+			if p.Total == 0 {
+				log.Printf("Pull %s: %s", model, p.Status)
+			}
+		}
+		if p.Total > 0 {
+			if tenth := int(p.Completed * 10 / p.Total); tenth > lastTenth {
+				lastTenth = tenth
+				log.Printf("Pull %s: %s %d%% of %d MB", model, p.Status, tenth*10, p.Total>>20)
+			}
+		}
+	}
+}
+
+// Verify the configured models at startup. Problems are logged rather than
+// fatal, since Ollama may simply not be up yet.
+func checkModels() {
+	missing, err := ensureModels(context.Background(), configuredModels(), autoPull)
+	if err != nil {
+		log.Printf("Model check: %v", err)
+		return
+	}
+	for _, m := range missing {
+		log.Printf("Model check: %s is not installed; pull it or start with -pull", m)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Initial line buffer; most Ollama chunks are well under this
+	chunkBufferBytes = 4 << 10
+	// Longest chunk line accepted before the stream is abandoned
+	maxChunkBytes = 1 << 20
+)
+
+var errChunkTooLarge = fmt.Errorf("ollama stream chunk exceeds %d bytes", maxChunkBytes)
+
+// ChunkError reports a stream line that is not a valid chunk
+type ChunkError struct {
+	Line int
+	Err  error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("ollama stream line %d: %v", e.Line, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error { return e.Err }
+
+// chunkScanner reads Ollama's NDJSON stream one line at a time, reusing a
+// single line buffer rather than letting json.Decoder grow its own.
+//
+//	sc := newChunkScanner(resp.Body)
+//	for sc.Next() {
+//		use(sc.Chunk())
+//	}
+//	if err := sc.Err(); err != nil { ... }
+type chunkScanner struct {
+	sc      *bufio.Scanner
+	line    int
+	partial bool // the last line read had no trailing newline
+	chunk   OllamaChatResponse
+	err     error
+}
+
+func newChunkScanner(r io.Reader) *chunkScanner {
+	s := &chunkScanner{sc: bufio.NewScanner(r)}
+	s.sc.Buffer(make([]byte, chunkBufferBytes), maxChunkBytes)
+	s.sc.Split(s.splitLines)
+	return s
+}
+
+// Like bufio.ScanLines, but remembers whether the stream ended mid-line
+func (s *chunkScanner) splitLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	s.partial = atEOF && token != nil && bytes.IndexByte(data[:advance], '\n') < 0
+	return advance, token, err
+}
+
+// Next decodes the next chunk, skipping blank lines. It returns false at
+// the end of the stream or on error. A final line cut off mid-chunk, as
+// when Ollama drops the connection, ends the stream without an error.
+func (s *chunkScanner) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	for s.sc.Scan() {
+		s.line++
+		line := bytes.TrimSpace(s.sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		s.chunk = OllamaChatResponse{}
+		if err := json.Unmarshal(line, &s.chunk); err != nil {
+			if s.partial {
+				return false
+			}
+			s.err = &ChunkError{Line: s.line, Err: err}
+			return false
+		}
+		return true
+	}
+	if err := s.sc.Err(); errors.Is(err, bufio.ErrTooLong) {
+		s.err = &ChunkError{Line: s.line + 1, Err: errChunkTooLarge}
+	} else {
+		s.err = err
+	}
+	return false
+}
+
+// Chunk returns the chunk decoded by the last call to Next. It is
+// overwritten by the next call.
+func (s *chunkScanner) Chunk() *OllamaChatResponse { return &s.chunk }
+
+// Err returns the first error that stopped the scan, if any
+func (s *chunkScanner) Err() error { return s.err }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/peer"
+)
+
+// NetworkConfig limits the addresses the server answers. Its own rules
+// apply to every route; api and admin add their own for those routes, so
+// the admin pages can be held to a network the chat is not.
+type NetworkConfig struct {
+	NetworkRules `yaml:",inline"`
+	API          NetworkRules `yaml:"api"`   // the JSON, OpenAI, GraphQL, MCP and gRPC APIs
+	Admin        NetworkRules `yaml:"admin"` // /admin pages
+}
+
+// NetworkRules are CIDR blocks, or single addresses, a request's address
+// must be in and must not be in
+type NetworkRules struct {
+	Allow []string `yaml:"allow"` // when set, only these
+	Deny  []string `yaml:"deny"`  // refused even when allowed
+
+	allow, deny []*net.IPNet
+}
+
+// Parse the rules' blocks, failing on the first that is neither a CIDR
+// block nor an address
+func (n *NetworkRules) parse() error {
+	var err error
+	if n.allow, err = parseNetworks(n.Allow); err != nil {
+		return err
+	}
+	n.deny, err = parseNetworks(n.Deny)
+	return err
+}
+
+func parseNetworks(blocks []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(blocks))
+	for _, b := range blocks {
+		if !strings.Contains(b, "/") {
+			ip := net.ParseIP(b)
+			if ip == nil {
+				return nil, fmt.Errorf("network: %q is not an address or CIDR block", b)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, block, err := net.ParseCIDR(b)
+		if err != nil {
+			return nil, fmt.Errorf("network: %q is not an address or CIDR block", b)
+		}
+		out = append(out, block)
+	}
+	return out, nil
+}
+
+func (n *NetworkConfig) check() error {
+	for _, rules := range []*NetworkRules{&n.NetworkRules, &n.API, &n.Admin} {
+		if err := rules.parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the rules let an address through. An address that does not
+// parse passes only rules that neither allow nor deny anything.
+func (n NetworkRules) admits(ip net.IP) bool {
+	if ip == nil {
+		return len(n.allow) == 0 && len(n.deny) == 0
+	}
+	for _, block := range n.deny {
+		if block.Contains(ip) {
+			return false
+		}
+	}
+	if len(n.allow) == 0 {
+		return true
+	}
+	for _, block := range n.allow {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The route group a path belongs to: "admin", "api" or "chat"
+func routeGroup(path string) string {
+	switch {
+	case path == "/admin" || strings.HasPrefix(path, "/admin/"):
+		return "admin"
+	case strings.HasPrefix(path, "/api/"), strings.HasPrefix(path, "/v1/"), strings.HasPrefix(path, "/chains/"),
+		path == "/graphql", path == "/mcp":
+		return "api"
+	}
+	return "chat"
+}
+
+// Whether the config lets an address reach a route group
+func networkAllowed(group string, ip net.IP) bool {
+	n := currentFileConfig().Network
+	if !n.admits(ip) {
+		return false
+	}
+	switch group {
+	case "admin":
+		return n.Admin.admits(ip)
+	case "api":
+		return n.API.admits(ip)
+	}
+	return true
+}
+
+// Refuse requests from addresses the network section of the config keeps
+// out of their route group, with 403 Forbidden. It runs inside
+// tenantMiddleware, so a tenant's paths are grouped as the server's.
+func networkPolicyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !networkAllowed(routeGroup(r.URL.Path), net.ParseIP(clientAddr(r))) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Whether a gRPC call's peer may use the API
+func grpcNetworkAllowed(ctx context.Context) bool {
+	var ip net.IP
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	return networkAllowed("api", ip)
+}
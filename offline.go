@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// PendingPrompt is a chat message taken while Ollama was unreachable. It
+// joins its conversation, with the reply, once Ollama answers again.
+type PendingPrompt struct {
+	Conversation int
+	Message      Message
+	Queued       time.Time
+}
+
+// Whether chat prompts are queued while Ollama is unreachable, rather than
+// refused with the circuit breaker's error
+var offlineQueue = false
+
+// Returned by a live reply's prepare step when the prompt was queued
+var errPromptQueued = errors.New("the model is unreachable; the message will be sent when it is back")
+
+// Whether the Ollama host a chat request would go to is known to be
+// unreachable, its circuit being open. With a fallback backend it never is.
+func ollamaOffline(ctx context.Context, req OllamaChatRequest) bool {
+	if fallbackURL != "" {
+		return false
+	}
+	u, err := url.Parse(upstreamFor(withAffinity(ctx, conversationKey(req))))
+	return err == nil && circuitFor(u).allow() != nil
+}
+
+// Queue a prompt for the active conversation instead of sending it when
+// Ollama is unreachable, or when earlier prompts are still queued, so they
+// go out in order. Reports whether it was queued, never with -offline-queue
+// off. Callers must hold sessionMut.
+func (s *session) queueIfOffline(msg Message) bool {
+	if !offlineQueue {
+		return false
+	}
+	if sessionMessageLimit > 0 && s.messageCount()+len(s.Pending) >= sessionMessageLimit {
+		// Not queued past the session's limit; appending it is refused
+		return false
+	}
+	if len(s.Pending) == 0 {
+		req := s.conversationRequest(s.Active, append(s.History[:len(s.History):len(s.History)], msg))
+		if !ollamaOffline(withTenant(context.Background(), sessionTenant(s.id)), req) {
+			return false
+		}
+	}
+	s.Pending = append(s.Pending, PendingPrompt{Conversation: s.Active, Message: msg, Queued: time.Now()})
+	s.LastActive = time.Now()
+	go sendPending(s.id)
+	return true
+}
+
+// Whether an error means Ollama could not be reached, rather than that it
+// failed the request
+func unreachable(err error) bool {
+	return errors.Is(err, errBackendUnavailable) || errors.Is(err, errOllamaTimeout) || transientOllamaFailure(nil, err)
+}
+
+// Queued prompts of a conversation, oldest first. Callers must hold
+// sessionMut.
+func (s *session) pendingIn(conv int) []PendingPrompt {
+	var out []PendingPrompt
+	for _, p := range s.Pending {
+		if p.Conversation == conv {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Send every session's queued prompts, once an Ollama host answers again
+func resumePendingPrompts() {
+	sessionMut.Lock()
+	var ids []string
+	for id, s := range sessions {
+		if len(s.Pending) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sessionMut.Unlock()
+	for _, id := range ids {
+		go sendPending(id)
+	}
+}
+
+// Send a session's queued prompts in order, each answered with its
+// conversation as it stands then. A prompt joins the conversation together
+// with its reply, and leaves the queue only once both are recorded; the
+// first that fails stays queued, with those after it, for the next
+// recovery. An encrypted session's prompts wait while its transcript is
+// locked, since nothing can be recorded then, and its transcript is held
+// open while one is answered.
+func sendPending(id string) {
+	sessionMut.Lock()
+	s := getSession(id)
+	if s.sendingPending {
+		sessionMut.Unlock()
+		return
+	}
+	s.sendingPending = true
+	sessionMut.Unlock()
+	defer func() {
+		sessionMut.Lock()
+		getSession(id).sendingPending = false
+		sessionMut.Unlock()
+	}()
+
+	for {
+		sessionMut.Lock()
+		s := getSession(id)
+		if len(s.Pending) == 0 {
+			sessionMut.Unlock()
+			return
+		}
+		if s.transcriptLocked() {
+			// Sent once the transcript is unlocked again
+			sessionMut.Unlock()
+			return
+		}
+		p := s.Pending[0]
+		if s.conversationIndex(p.Conversation) < 0 {
+			// Deleted while the prompt waited
+			s.Pending = s.Pending[1:]
+			sessionMut.Unlock()
+			continue
+		}
+		history := s.History
+		if p.Conversation != s.Active {
+			history = projectHistory(s.Events, p.Conversation)
+		}
+		chatReq := s.conversationRequest(p.Conversation, append(history[:len(history):len(history)], p.Message))
+		ctx, done := s.trackGeneration(withTenant(withPriority(context.Background(), priorityInteractive), sessionTenant(id)))
+		if s.Transcript != nil {
+			s.Transcript.holders++
+		}
+		sessionMut.Unlock()
+
+		reply, err := ollamaComplete(ctx, chatReq)
+		stopped := ctx.Err() != nil
+		done()
+		if err != nil && !stopped && unreachable(err) {
+			log.Printf("Queued prompt not sent yet: %v", err)
+			sessionMut.Lock()
+			getSession(id).releasePending()
+			sessionMut.Unlock()
+			return
+		} else if err != nil && !stopped {
+			// Ollama is back but failed the prompt; it joins the chat unanswered
+			log.Printf("Queued prompt error: %v", err)
+		}
+		sessionMut.Lock()
+		s = getSession(id)
+		if s.transcriptLocked() {
+			sessionMut.Unlock()
+			return
+		}
+		if err := s.appendTo(p.Conversation, p.Message); err != nil {
+			log.Printf("Queued prompt dropped: %v", err)
+		} else if reply != "" {
+			s.appendTo(p.Conversation, assistantReply(ctx, reply))
+		}
+		s.Pending = s.Pending[1:]
+		s.releasePending()
+		sessionMut.Unlock()
+	}
+}
+
+// Let go of the transcript sendPending held open while answering a prompt.
+// Callers must hold sessionMut.
+func (s *session) releasePending() {
+	if s.Transcript != nil {
+		s.releaseTranscript()
+	}
+}
+
+// GET /chat/pending: how many prompts of the conversation shown are still
+// queued, so the page can reload once they have been answered
+func pendingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := getSessionID(w, r)
+	sessionMut.Lock()
+	s := getSession(sessionID)
+	n := len(s.pendingIn(s.Active))
+	sessionMut.Unlock()
+	writeJSON(w, http.StatusOK, map[string]int{"pending": n})
+}
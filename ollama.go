@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Send a non-streaming chat request and return the assistant's reply.
+// Used for background work such as summaries, where nothing is shown to
+// the user until the reply is complete.
+func ollamaComplete(ctx context.Context, chatReq OllamaChatRequest) (string, error) {
+	msg, err := ollamaChat(ctx, chatReq)
+	return msg.Content, err
+}
+
+// Send a non-streaming chat request and return the whole assistant
+// message, including any tool calls
+func ollamaChat(ctx context.Context, chatReq OllamaChatRequest) (Message, error) {
+	chatReq.Stream = false
+	ctx = prepareChat(ctx, &chatReq)
+	req, err := newOllamaRequest(ctx, "/api/chat", chatReq)
+	if err != nil {
+		return Message{}, err
+	}
+
+	resp, err := ollamaDo(req)
+	if err != nil {
+		return Message{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Message{}, fmt.Errorf("ollama returned status %d", resp.StatusCode)
+	}
+
+	var out OllamaChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return Message{}, err
+	}
+	return out.Message, nil
+}
+
+// Send a streaming chat request, calling onChunk with each piece of content
+// as it arrives, and return the full reply. A stream that ends without a
+// done marker returns what was received so far.
+func ollamaStream(ctx context.Context, chatReq OllamaChatRequest, onChunk func(string)) (string, error) {
+	chatReq.Stream = true
+	ctx = prepareChat(ctx, &chatReq)
+	req, err := newOllamaRequest(ctx, "/api/chat", chatReq)
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	resp, err := ollamaDo(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ollama returned status %d", resp.StatusCode)
+	}
+
+	var reply strings.Builder
+	sc := newChunkScanner(resp.Body)
+	for sc.Next() {
+		chunk := sc.Chunk()
+		if reply.Len() == 0 && chunk.Message.Content != "" {
+			recordTTFT(time.Since(start))
+		}
+		reply.WriteString(chunk.Message.Content)
+		if onChunk != nil && chunk.Message.Content != "" {
+			onChunk(chunk.Message.Content)
+		}
+		if chunk.Done {
+			break
+		}
+	}
+	return reply.String(), sc.Err()
+}
+
+// OllamaModel is an installed model as listed by /api/tags
+type OllamaModel struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// List the models installed in Ollama
+func ollamaListModels(ctx context.Context) ([]OllamaModel, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamFor(ctx)+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ollamaClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama returned status %d", resp.StatusCode)
+	}
+
+	var out struct {
+		Models []OllamaModel `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out.Models, nil
+}
+
+// Compute one embedding vector per input with /api/embed
+func ollamaEmbed(ctx context.Context, model string, input []string) ([][]float32, error) {
+	req, err := newOllamaRequest(ctx, "/api/embed", map[string]interface{}{"model": model, "input": input})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ollamaDo(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama returned status %d", resp.StatusCode)
+	}
+
+	var out struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out.Embeddings, nil
+}
+
+// PullProgress is one status line of a model download
+type PullProgress struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Download a model with /api/pull, reporting each progress line
+func ollamaPull(ctx context.Context, model string, onProgress func(PullProgress)) error {
+	req, err := newOllamaRequest(ctx, "/api/pull", map[string]interface{}{"model": model, "stream": true})
+	if err != nil {
+		return err
+	}
+	resp, err := ollamaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ollama returned status %d", resp.StatusCode)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var p PullProgress
+		if err := dec.Decode(&p); err == io.EOF {
+			return fmt.Errorf("pull of %s ended before it succeeded", model)
+		} else if err != nil {
+			return err
+		}
+		if p.Error != "" {
+			return fmt.Errorf("pull of %s: %s", model, p.Error)
+		}
+		if onProgress != nil {
+			onProgress(p)
+		}
+		if p.Status == "success" {
+			return nil
+		}
+	}
+}
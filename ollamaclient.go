@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// How long connecting to Ollama may take, how long it may go without
+// sending anything once asked (which covers loading the model), and how
+// many more times a request is tried after a transient failure; set by
+// -ollama-connect-timeout, -ollama-read-timeout and -ollama-retries
+var (
+	ollamaConnectTimeout = 5 * time.Second
+	ollamaReadTimeout    = 5 * time.Minute
+	ollamaRetries        = 2
+)
+
+// Delay before the first retry, doubled for each one after
+var ollamaBackoff = 500 * time.Millisecond
+
+// Idle connections kept to each Ollama host, so concurrent streams reuse
+// them rather than dialling anew
+const ollamaIdleConnsPerHost = 32
+
+var errOllamaTimeout = errors.New("ollama timed out")
+
+// OllamaClient sends requests to Ollama over reused connections. A
+// response that stalls for ReadTimeout fails, and requests that fail
+// before Ollama answers, or that it turns away as busy, are retried with
+// backoff. Responses already streaming are never retried. Hosts that keep
+// failing have their circuit opened (see circuit).
+type OllamaClient struct {
+	HTTP        *http.Client
+	ReadTimeout time.Duration // 0 for none
+	Retries     int
+	Backoff     time.Duration
+}
+
+// HTTP client used for all Ollama calls
+var ollamaClient = newOllamaClient()
+
+// A client with the -ollama-* settings
+func newOllamaClient() *OllamaClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: ollamaConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.MaxIdleConnsPerHost = ollamaIdleConnsPerHost
+	return &OllamaClient{
+		HTTP:        &http.Client{Transport: transport},
+		ReadTimeout: ollamaReadTimeout,
+		Retries:     ollamaRetries,
+		Backoff:     ollamaBackoff,
+	}
+}
+
+// Do sends the request, retrying transient failures. A body that cannot be
+// replayed through GetBody is copied first so retries can send it again.
+func (c *OllamaClient) Do(req *http.Request) (*http.Response, error) {
+	cb := circuitFor(req.URL)
+	if err := cb.allow(); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	done := trackLoad(req.URL.Host)
+	resp, err := c.do(req)
+	if req.Context().Err() == nil {
+		cb.record(err == nil && !transientOllamaFailure(resp, nil), c.HTTP)
+	}
+	if err != nil {
+		done()
+		return nil, err
+	}
+	resp.Body = &loadBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+func (c *OllamaClient) do(req *http.Request) (*http.Response, error) {
+	if c.Retries > 0 && req.Body != nil && req.GetBody == nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(req)
+		if attempt >= c.Retries || req.Context().Err() != nil || !transientOllamaFailure(resp, err) {
+			return resp, err
+		}
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("Ollama %s failed (attempt %d/%d): %v", req.URL.Path, attempt+1, c.Retries+1, err)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(c.Backoff << attempt):
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// One attempt, failing once Ollama sends nothing for ReadTimeout
+func (c *OllamaClient) send(req *http.Request) (*http.Response, error) {
+	if c.ReadTimeout <= 0 {
+		return c.HTTP.Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	b := &timeoutBody{timeout: c.ReadTimeout, cancel: cancel}
+	b.timer = time.AfterFunc(c.ReadTimeout, b.expire)
+	resp, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		b.timer.Stop()
+		cancel()
+		if b.timedOut.Load() {
+			err = b.err()
+		}
+		return nil, err
+	}
+	b.ReadCloser = resp.Body
+	resp.Body = b
+	return resp, nil
+}
+
+// Whether a failed attempt may succeed if tried again: the connection
+// failed before Ollama answered, or Ollama or a proxy in front of it said
+// it was busy or unreachable
+func transientOllamaFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		var op *net.OpError
+		return (errors.As(err, &op) && op.Op == "dial") ||
+			errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// timeoutBody cancels its response once nothing has been read from it for
+// timeout
+type timeoutBody struct {
+	io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	timedOut atomic.Bool
+}
+
+func (b *timeoutBody) expire() {
+	b.timedOut.Store(true)
+	b.cancel()
+}
+
+func (b *timeoutBody) err() error {
+	return fmt.Errorf("%w: nothing received for %v", errOllamaTimeout, b.timeout)
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && b.timedOut.Load() {
+		err = b.err()
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The OpenAI chat completions wire format, so OpenAI SDKs can use this
+// server as their base URL (http://host:8080/v1). Requests go through the
+// service layer like the JSON API's.
+
+// OpenAIChatRequest is the body of POST /v1/chat/completions
+type OpenAIChatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []OpenAIMessage `json:"messages"`
+	Stream      bool            `json:"stream"`
+	Temperature *float64        `json:"temperature"`
+	TopP        *float64        `json:"top_p"`
+	MaxTokens   *int            `json:"max_tokens"`
+	Seed        *int            `json:"seed"`
+	Stop        json.RawMessage `json:"stop"` // a string or a list
+}
+
+// OpenAIMessage content is a string or a list of text and image_url parts
+type OpenAIMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+	Name    string          `json:"name,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL struct {
+		URL string `json:"url"`
+	} `json:"image_url"`
+}
+
+// OpenAIChoice is one reply, whole or as a streamed delta
+type OpenAIChoice struct {
+	Index        int          `json:"index"`
+	Message      *OpenAIReply `json:"message,omitempty"`
+	Delta        *OpenAIReply `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+// OpenAIReply is a choice's message, or the part of it a chunk adds
+type OpenAIReply struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+}
+
+// OpenAICompletion is a chat.completion or chat.completion.chunk object
+type OpenAICompletion struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []OpenAIChoice `json:"choices"`
+}
+
+// Write an error in OpenAI's format
+func writeOpenAIError(w http.ResponseWriter, status int, msg string) {
+	kind := "server_error"
+	if status < 500 {
+		kind = "invalid_request_error"
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"message": msg, "type": kind, "code": nil},
+	})
+}
+
+// Translate OpenAI messages, turning content parts into text and images
+func (req OpenAIChatRequest) messages() ([]Message, error) {
+	out := make([]Message, 0, len(req.Messages))
+	for i, m := range req.Messages {
+		msg := Message{Role: m.Role, Name: m.Name}
+		if m.Role == "developer" {
+			msg.Role = "system"
+		}
+		var text string
+		var parts []openAIContentPart
+		switch {
+		case len(m.Content) == 0 || string(m.Content) == "null":
+		case json.Unmarshal(m.Content, &text) == nil:
+			msg.Content = text
+		case json.Unmarshal(m.Content, &parts) == nil:
+			var texts []string
+			for _, p := range parts {
+				switch p.Type {
+				case "text":
+					texts = append(texts, p.Text)
+				case "image_url":
+					// Only inline images; the server fetches nothing
+					_, data, ok := strings.Cut(p.ImageURL.URL, ";base64,")
+					if !ok || !strings.HasPrefix(p.ImageURL.URL, "data:") {
+						return nil, fmt.Errorf("%w: message %d: images must be base64 data URLs", errInvalidRequest, i)
+					}
+					msg.Images = append(msg.Images, data)
+				default:
+					return nil, fmt.Errorf("%w: message %d: unsupported content part %q", errInvalidRequest, i, p.Type)
+				}
+			}
+			msg.Content = strings.Join(texts, "\n")
+		default:
+			return nil, fmt.Errorf("%w: message %d: content must be a string or a list of parts", errInvalidRequest, i)
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+// Map the sampling fields onto Ollama's options
+func (req OpenAIChatRequest) options() (map[string]interface{}, error) {
+	opts := map[string]interface{}{}
+	if req.Temperature != nil {
+		opts["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		opts["top_p"] = *req.TopP
+	}
+	if req.MaxTokens != nil {
+		opts["num_predict"] = *req.MaxTokens
+	}
+	if req.Seed != nil {
+		opts["seed"] = *req.Seed
+	}
+	if len(req.Stop) > 0 && string(req.Stop) != "null" {
+		var one string
+		var many []string
+		if json.Unmarshal(req.Stop, &one) == nil {
+			many = []string{one}
+		} else if json.Unmarshal(req.Stop, &many) != nil {
+			return nil, fmt.Errorf("%w: stop must be a string or a list of strings", errInvalidRequest)
+		}
+		opts["stop"] = many
+	}
+	if len(opts) == 0 {
+		return nil, nil
+	}
+	return opts, nil
+}
+
+// POST /v1/chat/completions. Streamed replies are chat.completion.chunk
+// events ending with "data: [DONE]".
+func openAIChatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req OpenAIChatRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestBytes)).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	params, err := req.params(r.Context())
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	serveOpenAIChat(w, r, params, req.Stream)
+}
+
+func (req OpenAIChatRequest) params(ctx context.Context) (ChatParams, error) {
+	messages, err := req.messages()
+	if err != nil {
+		return ChatParams{}, err
+	}
+	opts, err := req.options()
+	if err != nil {
+		return ChatParams{}, err
+	}
+	params := ChatParams{Model: req.Model, Messages: messages, Options: opts}
+	return params, params.validate(ctx)
+}
+
+func serveOpenAIChat(w http.ResponseWriter, r *http.Request, params ChatParams, stream bool) {
+	writeOptionNotices(w, params.Notices)
+	completion := OpenAICompletion{ID: "chatcmpl-" + strings.ReplaceAll(newRunID(), "-", ""),
+		Object: "chat.completion", Created: time.Now().Unix(), Model: params.Model}
+	stop := "stop"
+
+	ctx := withAnswerLabel(r.Context())
+	if !stream {
+		msg, err := serviceChat(ctx, params)
+		if err != nil {
+			log.Printf("OpenAI chat error: %v", err)
+			writeOpenAIError(w, apiErrorStatus(err), err.Error())
+			return
+		}
+		rememberOpenAIChat(r, params.Messages, msg)
+		completion.Choices = []OpenAIChoice{{Message: &OpenAIReply{Role: "assistant", Content: msg.Content}, FinishReason: &stop}}
+		writeJSON(w, http.StatusOK, completion)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	completion.Object = "chat.completion.chunk"
+	send := func(data []byte) {
+		w.Write([]byte("data: "))
+		w.Write(data)
+		w.Write([]byte("\n\n"))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	sendChoice := func(choice OpenAIChoice) {
+		completion.Choices = []OpenAIChoice{choice}
+		b, _ := json.Marshal(completion)
+		send(b)
+	}
+
+	sendChoice(OpenAIChoice{Delta: &OpenAIReply{Role: "assistant"}})
+	reply, err := serviceStreamChat(ctx, params, func(chunk string) {
+		sendChoice(OpenAIChoice{Delta: &OpenAIReply{Content: chunk}})
+	})
+	if err != nil {
+		log.Printf("OpenAI chat stream error: %v", err)
+		if errors.Is(err, r.Context().Err()) {
+			return
+		}
+		b, _ := json.Marshal(map[string]interface{}{"error": map[string]interface{}{"message": err.Error(), "type": "server_error"}})
+		send(b)
+		return
+	}
+	rememberOpenAIChat(r, params.Messages, assistantReply(ctx, reply))
+	sendChoice(OpenAIChoice{Delta: &OpenAIReply{}, FinishReason: &stop})
+	send([]byte("[DONE]"))
+}
+
+// OpenAI clients send the whole conversation every time. Those that keep
+// the session cookie have the newest message and the reply added to their
+// session's history, so the exchange shows in the page and is stored.
+func rememberOpenAIChat(r *http.Request, messages []Message, reply Message) {
+	sessionID, ok := cookieSessionID(r)
+	if !ok {
+		return
+	}
+	last := messages[len(messages)-1]
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	sess := getSession(sessionID)
+	if last.Role == "user" {
+		if err := sess.append(last); err != nil {
+			log.Printf("OpenAI chat not kept in session %s: %v", sessionHash(sessionID), err)
+			return
+		}
+	}
+	sess.append(reply)
+}
+
+// GET /v1/models: the installed models as an OpenAI model list
+func openAIModelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	models, err := serviceListModels(r.Context())
+	if err != nil {
+		log.Printf("OpenAI models error: %v", err)
+		writeOpenAIError(w, apiErrorStatus(err), err.Error())
+		return
+	}
+	data := make([]map[string]interface{}, 0, len(models))
+	for _, m := range models {
+		data = append(data, map[string]interface{}{"id": m.Name, "object": "model", "created": m.ModifiedAt.Unix(), "owned_by": "ollama"})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"object": "list", "data": data})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Parses replies for plain text, with the GFM syntax models commonly use
+var plainTextMarkdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// Tags left out of plain text, such as a reasoning model's <think>
+var htmlTagRe = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+
+// A reply's markdown as plain text to paste into a ticket or an email:
+// emphasis, headings and fences are dropped, lists keep their bullets and
+// numbers, code is indented, and links show their address.
+func plainText(markdown string) string {
+	src := []byte(markdown)
+	doc := plainTextMarkdown.Parser().Parse(text.NewReader(src))
+	var b strings.Builder
+	writePlainBlocks(&b, doc, src, "")
+	return strings.TrimSpace(b.String())
+}
+
+// Write the block children of n, each line led by prefix
+func writePlainBlocks(b *strings.Builder, n ast.Node, src []byte, prefix string) {
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch c := c.(type) {
+		case *ast.Paragraph, *ast.Heading:
+			writePlainLines(b, prefix, plainInline(c, src))
+			b.WriteString("\n")
+		case *ast.TextBlock:
+			writePlainLines(b, prefix, plainInline(c, src))
+		case *ast.CodeBlock, *ast.FencedCodeBlock:
+			writePlainLines(b, prefix+"    ", strings.TrimRight(blockText(c, src), "\n"))
+			b.WriteString("\n")
+		case *ast.HTMLBlock:
+			if s := strings.TrimSpace(htmlTagRe.ReplaceAllString(blockText(c, src), "")); s != "" {
+				writePlainLines(b, prefix, s)
+				b.WriteString("\n")
+			}
+		case *ast.Blockquote:
+			writePlainBlocks(b, c, src, prefix+"> ")
+		case *ast.List:
+			n := c.Start
+			for item := c.FirstChild(); item != nil; item = item.NextSibling() {
+				marker := "- "
+				if c.IsOrdered() {
+					marker = fmt.Sprintf("%d. ", n)
+					n++
+				}
+				var sub strings.Builder
+				writePlainBlocks(&sub, item, src, "")
+				lines := strings.Split(strings.TrimRight(sub.String(), "\n"), "\n")
+				for i, line := range lines {
+					lead := strings.Repeat(" ", len(marker))
+					if i == 0 {
+						lead = marker
+					}
+					b.WriteString(strings.TrimRight(prefix+lead+line, " ") + "\n")
+				}
+			}
+			b.WriteString("\n")
+		case *east.Table:
+			for row := c.FirstChild(); row != nil; row = row.NextSibling() {
+				var cells []string
+				for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+					cells = append(cells, plainInline(cell, src))
+				}
+				b.WriteString(prefix + strings.Join(cells, " | ") + "\n")
+			}
+			b.WriteString("\n")
+		case *ast.ThematicBreak:
+		default:
+			writePlainBlocks(b, c, src, prefix)
+		}
+	}
+}
+
+func writePlainLines(b *strings.Builder, prefix, s string) {
+	for _, line := range strings.Split(s, "\n") {
+		b.WriteString(strings.TrimRight(prefix+line, " ") + "\n")
+	}
+}
+
+// The raw lines of a code or HTML block
+func blockText(n ast.Node, src []byte) string {
+	var b strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		b.Write(seg.Value(src))
+	}
+	return b.String()
+}
+
+// The text of an inline run, without markup
+func plainInline(n ast.Node, src []byte) string {
+	var b strings.Builder
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch c := c.(type) {
+		case *ast.Text:
+			v := c.Value(src)
+			if _, code := n.(*ast.CodeSpan); !code {
+				v = util.ResolveNumericReferences(util.ResolveEntityNames(util.UnescapePunctuations(v)))
+			}
+			b.Write(v)
+			switch {
+			case c.HardLineBreak():
+				b.WriteString("\n")
+			case c.SoftLineBreak():
+				b.WriteString(" ")
+			}
+		case *ast.String:
+			b.Write(c.Value)
+		case *ast.Link:
+			label := plainInline(c, src)
+			b.WriteString(label)
+			if dest := string(c.Destination); dest != label {
+				b.WriteString(" (" + dest + ")")
+			}
+		case *ast.AutoLink:
+			b.Write(c.URL(src))
+		case *ast.RawHTML:
+		case *east.TaskCheckBox:
+			if c.IsChecked {
+				b.WriteString("[x] ")
+			} else {
+				b.WriteString("[ ] ")
+			}
+		default:
+			b.WriteString(plainInline(c, src))
+		}
+	}
+	return b.String()
+}
+
+// A conversation as plain text, each message led by its speaker
+func plainTranscript(export ConversationExport) string {
+	var b strings.Builder
+	b.WriteString(export.Title + "\n")
+	for _, m := range export.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			continue
+		}
+		speaker := titleCase(m.Role)
+		if m.Name != "" {
+			speaker = m.Name
+		}
+		content := strings.TrimSpace(m.Content)
+		if m.Role == "assistant" {
+			content = plainText(content)
+		}
+		if strings.Contains(content, "\n") {
+			fmt.Fprintf(&b, "\n%s:\n%s\n", speaker, content)
+		} else {
+			fmt.Fprintf(&b, "\n%s: %s\n", speaker, content)
+		}
+	}
+	return b.String()
+}
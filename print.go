@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Longest a PDF conversion may take
+const pdfTimeout = time.Minute
+
+// Command line of an HTML-to-PDF converter that reads HTML on stdin and
+// writes the PDF to stdout, such as "wkhtmltopdf --quiet - -" or
+// "weasyprint - -". PDF export is off when it is empty.
+var pdfCommand string
+
+var errPDFNotConfigured = errors.New("PDF export is not configured")
+
+// PrintPage holds data for the print-friendly transcript, which is also
+// the source of PDF exports
+type PrintPage struct {
+	Title    string
+	Exported time.Time
+	History  []MessageView
+	L        Localizer
+}
+
+// Render a conversation for paper, with replies as formatted on the page
+func printTranscript(export ConversationExport, times map[int]time.Time, l Localizer) ([]byte, error) {
+	page := PrintPage{Title: export.Title, Exported: export.Exported, L: l}
+	for i, m := range export.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			continue
+		}
+		v := MessageView{Message: m, Index: i, Time: times[m.ID]}
+		if m.Role == "assistant" {
+			v.HTML = markdownHTML(m.Content)
+		}
+		page.History = append(page.History, v)
+	}
+	tmpl, err := loadedTemplates("")
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&b, "print.html", page); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Convert a printed transcript to PDF with the configured converter
+func htmlToPDF(ctx context.Context, html []byte) ([]byte, error) {
+	args := strings.Fields(pdfCommand)
+	if len(args) == 0 {
+		return nil, errPDFNotConfigured
+	}
+	ctx, cancel := context.WithTimeout(ctx, pdfTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var out, stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(html), &out, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	if out.Len() == 0 {
+		return nil, fmt.Errorf("%s wrote no PDF", args[0])
+	}
+	return out.Bytes(), nil
+}
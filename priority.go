@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Priority classes for Ollama generations; lower values go first
+type priority int
+
+const (
+	priorityInteractive priority = iota // people waiting in the web UI
+	priorityAPI                         // API clients
+	priorityBatch                       // background tasks
+)
+
+var priorityNames = map[string]priority{
+	"interactive": priorityInteractive,
+	"api":         priorityAPI,
+	"batch":       priorityBatch,
+}
+
+func (p priority) String() string {
+	for name, v := range priorityNames {
+		if v == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// UnmarshalYAML reads a class by name
+func (p *priority) UnmarshalYAML(value *yaml.Node) error {
+	v, ok := priorityNames[value.Value]
+	if !ok {
+		return fmt.Errorf("unknown priority %q (want interactive, api or batch)", value.Value)
+	}
+	*p = v
+	return nil
+}
+
+type priorityKey struct{}
+
+// Tag a context with the priority of the generations made under it
+func withPriority(ctx context.Context, p priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// The context's priority. Untagged contexts belong to background work.
+func priorityFrom(ctx context.Context) priority {
+	if p, ok := ctx.Value(priorityKey{}).(priority); ok {
+		return p
+	}
+	return priorityBatch
+}
+
+// Optional YAML file assigning priorities to API keys
+var apiKeysPath string
+
+// APIKey is a client identified by a bearer token
+type APIKey struct {
+	Name     string   `yaml:"name"`
+	Key      string   `yaml:"key"`
+	Priority priority `yaml:"priority"`
+	// Tenant the key is for; it is refused outside it. Empty for requests
+	// outside any tenant.
+	Tenant string `yaml:"tenant"`
+}
+
+// Known API keys, by token
+var apiKeys = map[string]APIKey{}
+
+// Load the API key file, if one was given
+func loadAPIKeys() error {
+	apiKeys = map[string]APIKey{}
+	if apiKeysPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(apiKeysPath)
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		Keys []APIKey `yaml:"keys"`
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", apiKeysPath, err)
+	}
+	for _, k := range cfg.Keys {
+		if k.Key == "" {
+			return fmt.Errorf("%s: key %q has no token", apiKeysPath, k.Name)
+		}
+		apiKeys[k.Key] = k
+	}
+	return nil
+}
+
+// Priority for an API caller's Authorization header; unknown or missing
+// keys get the api class
+func apiKeyPriority(authorization string) priority {
+	if k, ok := apiKeys[strings.TrimPrefix(authorization, "Bearer ")]; ok {
+		return k.Priority
+	}
+	return priorityAPI
+}
+
+// Paths served to programs rather than people
+var apiPathPrefixes = []string{"/api/", "/v1/", "/graphql", "/chains/", "/mcp"}
+
+// Tag each request's context with its priority class: API routes by key,
+// everything else as interactive
+func priorityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := priorityInteractive
+		for _, prefix := range apiPathPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				p = apiKeyPriority(r.Header.Get("Authorization"))
+				break
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(withPriority(r.Context(), p)))
+	})
+}
+
+// Generations sent to Ollama at once; 0 sends everything straight through.
+// Match it to OLLAMA_NUM_PARALLEL so queued work waits here, in priority
+// order, rather than in Ollama's FIFO queue.
+var ollamaSlots int
+
+// generationQueue hands out Ollama slots, most urgent class first and in
+// arrival order within a class. Running generations are never interrupted;
+// a waiting interactive request simply takes the next free slot.
+type generationQueue struct {
+	mu      sync.Mutex
+	active  int
+	waiting waiterHeap
+	seq     int
+}
+
+type waiter struct {
+	priority priority
+	seq      int
+	ready    chan struct{}
+	granted  bool
+	index    int
+}
+
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return w
+}
+
+var generations = &generationQueue{}
+
+// Wait for a slot. Every successful acquire must be paired with release.
+func (q *generationQueue) acquire(ctx context.Context, p priority) error {
+	q.mu.Lock()
+	if ollamaSlots <= 0 || (q.active < ollamaSlots && len(q.waiting) == 0) {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+	q.seq++
+	w := &waiter{priority: p, seq: q.seq, ready: make(chan struct{})}
+	heap.Push(&q.waiting, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		if w.granted {
+			// The slot arrived as we gave up; pass it on
+			q.mu.Unlock()
+			q.release()
+		} else {
+			heap.Remove(&q.waiting, w.index)
+			q.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// Free a slot, handing it to the most urgent waiter
+func (q *generationQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) > 0 {
+		w := heap.Pop(&q.waiting).(*waiter)
+		w.granted = true
+		close(w.ready)
+		return
+	}
+	q.active--
+}
+
+// Generations running and waiting, for the admin page
+func (q *generationQueue) stats() (active int, waiting map[string]int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting = map[string]int{}
+	for _, w := range q.waiting {
+		waiting[w.priority.String()]++
+	}
+	return q.active, waiting
+}
+
+// Send a generation request to Ollama once a slot is free; the slot is
+// held until the response body is closed. While the host's circuit is
+// open it fails at once, without waiting for a slot. With a fallback
+// backend, chats Ollama cannot answer go there instead; without one, a
+// chat for a model Ollama lacks waits while it is pulled.
+func ollamaDo(req *http.Request) (*http.Response, error) {
+	var body []byte
+	chat := strings.HasSuffix(req.URL.Path, "/api/chat")
+	fallback := fallbackURL != "" && chat
+	if fallback || (chat && pullMissing) {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	}
+	resp, err := sendOllama(req, body, fallback)
+	if err == nil && chat && !fallback && pullMissing && resp.StatusCode == http.StatusNotFound {
+		return pullAndResend(req, body, resp)
+	}
+	return resp, err
+}
+
+// ollamaDo for a request whose body, when fallback is set, is body
+func sendOllama(req *http.Request, body []byte, fallback bool) (*http.Response, error) {
+	if err := circuitFor(req.URL).allow(); err != nil {
+		req.Body.Close()
+		if fallback {
+			return fallbackDo(req.Context(), body)
+		}
+		return nil, err
+	}
+	if err := generations.acquire(req.Context(), priorityFrom(req.Context())); err != nil {
+		return nil, err
+	}
+	resp, err := ollamaClient.Do(req)
+	if fallback && req.Context().Err() == nil && needsFallback(resp, err) {
+		if err == nil {
+			resp.Body.Close()
+			log.Printf("Ollama returned status %d; sending the chat to %s", resp.StatusCode, fallbackName())
+		} else {
+			log.Printf("Ollama error: %v; sending the chat to %s", err, fallbackName())
+		}
+		generations.release()
+		return fallbackDo(req.Context(), body)
+	}
+	if err != nil {
+		generations.release()
+		return nil, err
+	}
+	resp.Body = &slotBody{ReadCloser: resp.Body}
+	return resp, nil
+}
+
+// slotBody releases its generation slot when closed
+type slotBody struct {
+	io.ReadCloser
+	once sync.Once
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(generations.release)
+	return err
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Directory holding prompt template definitions (*.yaml)
+var promptDir = "prompts"
+
+// PromptTemplate is a reusable prompt with {{.var}} placeholders and the
+// regression tests that guard it
+type PromptTemplate struct {
+	ID       string       `yaml:"id"`
+	Title    string       `yaml:"title"`
+	System   string       `yaml:"system"`
+	Template string       `yaml:"template"`
+	Tests    []PromptTest `yaml:"tests"`
+
+	tmpl *template.Template
+}
+
+// PromptTest fills a template's variables and checks the model's output
+type PromptTest struct {
+	Name   string            `yaml:"name"`
+	Vars   map[string]string `yaml:"vars"`
+	Assert []PromptAssertion `yaml:"assert"`
+}
+
+// PromptAssertion is one check on the output; exactly one field is set
+type PromptAssertion struct {
+	Contains    string `yaml:"contains,omitempty"`
+	NotContains string `yaml:"not_contains,omitempty"`
+	Regex       string `yaml:"regex,omitempty"`
+	MaxLength   int    `yaml:"max_length,omitempty"`
+	MinLength   int    `yaml:"min_length,omitempty"`
+}
+
+// PromptTestResult is the outcome of one test against one model
+type PromptTestResult struct {
+	Template string
+	Test     string
+	Model    string
+	Output   string
+	Failures []string
+	Error    string
+}
+
+// Passed reports whether the model's output met every assertion
+func (r PromptTestResult) Passed() bool {
+	return r.Error == "" && len(r.Failures) == 0
+}
+
+// Prompt templates loaded at startup, keyed by ID
+var promptTemplates = map[string]*PromptTemplate{}
+
+// Load every prompt template from the prompt directory. A missing directory
+// just means no templates are offered.
+func loadPromptTemplates() error {
+	paths, err := filepath.Glob(filepath.Join(promptDir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]*PromptTemplate, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var pt PromptTemplate
+		if err := yaml.Unmarshal(data, &pt); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if pt.ID == "" {
+			pt.ID = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		pt.tmpl, err = template.New(pt.ID).Option("missingkey=error").Parse(pt.Template)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for i, a := range flattenAssertions(pt.Tests) {
+			if a.Regex != "" {
+				if _, err := regexp.Compile(a.Regex); err != nil {
+					return fmt.Errorf("%s: assertion %d: %w", path, i+1, err)
+				}
+			}
+		}
+		loaded[pt.ID] = &pt
+	}
+
+	promptTemplates = loaded
+	return nil
+}
+
+func flattenAssertions(tests []PromptTest) []PromptAssertion {
+	var all []PromptAssertion
+	for _, t := range tests {
+		all = append(all, t.Assert...)
+	}
+	return all
+}
+
+func sortedPromptTemplates() []*PromptTemplate {
+	list := make([]*PromptTemplate, 0, len(promptTemplates))
+	for _, pt := range promptTemplates {
+		list = append(list, pt)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Render fills the template's variables
+func (pt *PromptTemplate) Render(vars map[string]string) (string, error) {
+	var b strings.Builder
+	if err := pt.tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Messages builds the chat request messages for the given variables
+func (pt *PromptTemplate) Messages(vars map[string]string) ([]Message, error) {
+	prompt, err := pt.Render(vars)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []Message
+	if pt.System != "" {
+		msgs = append(msgs, Message{Role: "system", Content: pt.System})
+	}
+	return append(msgs, Message{Role: "user", Content: prompt}), nil
+}
+
+// Run a template's tests against each model
+func runPromptTests(ctx context.Context, pt *PromptTemplate, models []string) []PromptTestResult {
+	var results []PromptTestResult
+	for _, model := range models {
+		for _, test := range pt.Tests {
+			res := PromptTestResult{Template: pt.ID, Test: test.Name, Model: model}
+			msgs, err := pt.Messages(test.Vars)
+			if err == nil {
+				res.Output, err = ollamaComplete(ctx, OllamaChatRequest{Model: model, Messages: msgs})
+			}
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Failures = checkAssertions(res.Output, test.Assert)
+			}
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+// Describe every assertion the output fails
+func checkAssertions(output string, asserts []PromptAssertion) []string {
+	var failures []string
+	lower := strings.ToLower(output)
+	for _, a := range asserts {
+		switch {
+		case a.Contains != "" && !strings.Contains(lower, strings.ToLower(a.Contains)):
+			failures = append(failures, fmt.Sprintf("expected output to contain %q", a.Contains))
+		case a.NotContains != "" && strings.Contains(lower, strings.ToLower(a.NotContains)):
+			failures = append(failures, fmt.Sprintf("expected output not to contain %q", a.NotContains))
+		case a.Regex != "" && !regexp.MustCompile(a.Regex).MatchString(output):
+			failures = append(failures, fmt.Sprintf("expected output to match /%s/", a.Regex))
+		case a.MaxLength > 0 && len(output) > a.MaxLength:
+			failures = append(failures, fmt.Sprintf("output is %d bytes, max %d", len(output), a.MaxLength))
+		case a.MinLength > 0 && len(output) < a.MinLength:
+			failures = append(failures, fmt.Sprintf("output is %d bytes, min %d", len(output), a.MinLength))
+		}
+	}
+	return failures
+}
+
+// PromptsPage holds data for the prompt templates page
+type PromptsPage struct {
+	Templates []*PromptTemplate
+	Models    string
+	Selected  string
+	Results   []PromptTestResult
+	Passed    int
+	Error     string
+}
+
+// List prompt templates, and on POST run their tests against the chosen
+// models
+func promptsHandler(w http.ResponseWriter, r *http.Request) {
+	page := PromptsPage{Templates: sortedPromptTemplates(), Models: defaultModelFor(r.Context())}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		page.Models = r.FormValue("models")
+		page.Selected = r.FormValue("template")
+		models := splitList(page.Models)
+		if len(models) == 0 {
+			models = []string{defaultModelFor(r.Context())}
+		}
+		for _, model := range models {
+			if err := checkModelAllowed(r.Context(), model); err != nil {
+				page.Error = err.Error()
+				renderPageStatus(w, r, http.StatusBadRequest, "prompts.html", page)
+				return
+			}
+		}
+		for _, pt := range page.Templates {
+			if page.Selected == "" || page.Selected == pt.ID {
+				page.Results = append(page.Results, runPromptTests(r.Context(), pt, models)...)
+			}
+		}
+		for _, res := range page.Results {
+			if res.Passed() {
+				page.Passed++
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	renderPage(w, r, "prompts.html", page)
+}
+
+// Split a comma-separated list, dropping blanks
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Run prompt template tests from the command line, e.g. in CI:
+// "prompts test -models llama3,qwen2 summarize". Exits non-zero on failure.
+// "prompts import" brings prompts in from Open WebUI.
+func runPromptsCommand(args []string) error {
+	if len(args) > 0 && args[0] == "import" {
+		return runPromptsImport(args[1:])
+	}
+	if len(args) == 0 || args[0] != "test" {
+		return fmt.Errorf("usage: %s prompts test|import [flags] [args...]", os.Args[0])
+	}
+
+	fs := flag.NewFlagSet("prompts test", flag.ExitOnError)
+	models := fs.String("models", defaultModel, "comma-separated models to test against")
+	fs.StringVar(&promptDir, "dir", promptDir, "directory of prompt template YAML files")
+	fs.StringVar(&ollamaURL, "ollama", ollamaURL, "Ollama base URL")
+	fs.Parse(args[1:])
+
+	if err := loadPromptTemplates(); err != nil {
+		return err
+	}
+
+	ids := fs.Args()
+	if len(ids) == 0 {
+		for _, pt := range sortedPromptTemplates() {
+			ids = append(ids, pt.ID)
+		}
+	}
+
+	failed := 0
+	total := 0
+	for _, id := range ids {
+		pt, ok := promptTemplates[id]
+		if !ok {
+			return fmt.Errorf("unknown prompt template %q", id)
+		}
+		for _, res := range runPromptTests(context.Background(), pt, splitList(*models)) {
+			total++
+			status := "PASS"
+			if !res.Passed() {
+				status = "FAIL"
+				failed++
+			}
+			fmt.Printf("%s  %s / %s [%s]\n", status, res.Template, res.Test, res.Model)
+			if res.Error != "" {
+				fmt.Printf("      error: %s\n", res.Error)
+			}
+			for _, f := range res.Failures {
+				fmt.Printf("      %s\n", f)
+			}
+		}
+	}
+
+	fmt.Printf("%d/%d passed\n", total-failed, total)
+	if failed > 0 {
+		return fmt.Errorf("%d prompt tests failed", failed)
+	}
+	return nil
+}
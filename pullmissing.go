@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Pull a model a chat asks for when its Ollama host does not have it, then
+// answer the chat; set by -pull-missing. Only models the config or the
+// chat's tenant lists by name are pulled. With a fallback backend the chat
+// goes there instead.
+var pullMissing = false
+
+var errModelPull = errors.New("the model is not installed and could not be pulled")
+
+// PullUpdate is the progress of a model download a chat is waiting for
+type PullUpdate struct {
+	Model   string `json:"model"`
+	Status  string `json:"status"`
+	Layer   int    `json:"layer,omitempty"`   // of the layers started so far, in order
+	Percent int    `json:"percent,omitempty"` // of the current layer
+	Total   int64  `json:"total,omitempty"`   // bytes in the current layer
+}
+
+// The update as shown in place of the reply it holds up
+func (u PullUpdate) String() string {
+	if u.Total == 0 {
+		return fmt.Sprintf("Downloading %s: %s", u.Model, u.Status)
+	}
+	return fmt.Sprintf("Downloading %s: layer %d, %d%% of %s", u.Model, u.Layer, u.Percent, formatSize(u.Total))
+}
+
+type pullWatcherKey struct{}
+
+// Report downloads of missing models that a context's chat waits for
+func withPullProgress(ctx context.Context, watch func(PullUpdate)) context.Context {
+	return context.WithValue(ctx, pullWatcherKey{}, watch)
+}
+
+// demandPull is a download of a model chats are waiting for. Chats that
+// find the same model missing on the same host wait for it rather than
+// start their own.
+type demandPull struct {
+	done chan struct{}
+	err  error
+
+	mu       sync.Mutex
+	last     PullUpdate
+	layers   map[string]int
+	watchers map[int]func(PullUpdate)
+	next     int
+}
+
+var demandPulls = struct {
+	sync.Mutex
+	byKey map[string]*demandPull
+}{byKey: map[string]*demandPull{}}
+
+// Ollama answered a chat with 404: when that is because it lacks the
+// model, pull it on the same host and send the chat again. Any other 404
+// is returned as it came.
+func pullAndResend(req *http.Request, body []byte, resp *http.Response) (*http.Response, error) {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	var ollamaErr struct {
+		Error string `json:"error"`
+	}
+	var chat struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(msg, &ollamaErr)
+	json.Unmarshal(body, &chat)
+	if chat.Model == "" || !strings.Contains(ollamaErr.Error, "not found") || !pullListed(req.Context(), chat.Model) {
+		resp.Body = io.NopCloser(bytes.NewReader(msg))
+		return resp, nil
+	}
+
+	base := strings.TrimSuffix(req.URL.Scheme+"://"+req.URL.Host+req.URL.Path, "/api/chat")
+	watch, _ := req.Context().Value(pullWatcherKey{}).(func(PullUpdate))
+	if err := waitForPull(req.Context(), base, chat.Model, watch); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	retry.Body = io.NopCloser(bytes.NewReader(body))
+	retry.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	return sendOllama(retry, body, false)
+}
+
+// Whether a missing model may be pulled for a chat: the config's models,
+// or the models of the tenant ctx is for, name it. An empty list allows
+// chats any model but pulls none.
+func pullListed(ctx context.Context, model string) bool {
+	lists := [][]string{currentFileConfig().Models}
+	if t := tenantFrom(ctx); t != nil {
+		lists = append(lists, t.Models)
+	}
+	for _, list := range lists {
+		for _, m := range list {
+			if fullModelName(m) == fullModelName(model) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Pull a model on the Ollama host at base, or join the pull of it already
+// running there, reporting progress to watch until it is installed or ctx
+// ends. The pull itself carries on when ctx ends, for the next chat.
+func waitForPull(ctx context.Context, base, model string, watch func(PullUpdate)) error {
+	key := base + "\x00" + fullModelName(model)
+	demandPulls.Lock()
+	p, ok := demandPulls.byKey[key]
+	if !ok {
+		p = &demandPull{done: make(chan struct{}), layers: map[string]int{}, watchers: map[int]func(PullUpdate){},
+			last: PullUpdate{Model: model, Status: "starting"}}
+		demandPulls.byKey[key] = p
+		go p.run(base, model, key)
+	}
+	demandPulls.Unlock()
+
+	if watch != nil {
+		p.mu.Lock()
+		id := p.next
+		p.next++
+		p.watchers[id] = watch
+		watch(p.last)
+		p.mu.Unlock()
+		// No updates once the chat has stopped waiting
+		defer func() {
+			p.mu.Lock()
+			delete(p.watchers, id)
+			p.mu.Unlock()
+		}()
+	}
+
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *demandPull) run(base, model, key string) {
+	log.Printf("Chat asked for %s, which %s does not have; pulling it", model, base)
+	err := guardedPull(withUpstream(context.Background(), base), model, p.update)
+	if err != nil {
+		log.Printf("Pull of %s on %s failed: %v", model, base, err)
+		p.err = fmt.Errorf("%w: %s: %v", errModelPull, model, err)
+	} else {
+		log.Printf("Pulled %s on %s", model, base)
+	}
+	demandPulls.Lock()
+	delete(demandPulls.byKey, key)
+	demandPulls.Unlock()
+	close(p.done)
+}
+
+// Pass a progress line on to the waiting chats when the status, layer or
+// whole percentage changes
+func (p *demandPull) update(pp PullProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u := PullUpdate{Model: p.last.Model, Status: pp.Status, Total: pp.Total}
+	if pp.Digest != "" && pp.Total > 0 {
+		if _, ok := p.layers[pp.Digest]; !ok {
+			p.layers[pp.Digest] = len(p.layers) + 1
+		}
+		u.Layer = p.layers[pp.Digest]
+		u.Percent = int(pp.Completed * 100 / pp.Total)
+	} else {
+		u.Total = 0
+	}
+	if u == p.last {
+		return
+	}
+	p.last = u
+	for _, watch := range p.watchers {
+		watch(u)
+	}
+}
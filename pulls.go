@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the scheduler looks for pulls whose window has opened, and how
+// much of a rate-limited download is fetched in one go before pausing; vars
+// so tests can shorten them
+var (
+	pullCheckInterval = time.Minute
+	pullBurst         = 30 * time.Second
+)
+
+const pullWindowLayout = "15:04"
+
+// Scheduled pull states
+const (
+	PullWaiting   = "waiting"
+	PullRunning   = "pulling"
+	PullPaused    = "paused"
+	PullDone      = "done"
+	PullFailed    = "failed"
+	PullCancelled = "cancelled"
+)
+
+// ScheduledPull is a model download that only runs inside a daily window
+type ScheduledPull struct {
+	ID        int
+	Model     string
+	Start     string // "15:04" local time
+	End       string // before Start for a window spanning midnight
+	LimitKBps int    // average download rate; 0 is unlimited
+	State     string
+	Completed int64 // bytes of the current layer
+	Total     int64
+	Error     string
+	Created   time.Time
+	Finished  time.Time
+
+	cancel context.CancelFunc
+}
+
+var (
+	scheduledPulls []*ScheduledPull // oldest first
+	nextPullID     int
+	pullMut        sync.Mutex
+	pullsOnce      sync.Once
+)
+
+// Whether now falls in the daily window from start to end, and when the
+// current window closes
+func inPullWindow(now time.Time, start, end string) (bool, time.Time) {
+	s, err1 := time.Parse(pullWindowLayout, start)
+	e, err2 := time.Parse(pullWindowLayout, end)
+	if err1 != nil || err2 != nil {
+		return false, time.Time{}
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	from := midnight.Add(time.Duration(s.Hour())*time.Hour + time.Duration(s.Minute())*time.Minute)
+	to := midnight.Add(time.Duration(e.Hour())*time.Hour + time.Duration(e.Minute())*time.Minute)
+	if !to.After(from) {
+		// Spans midnight: either in last night's window or tonight's
+		if now.Before(to) {
+			return true, to
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	return !now.Before(from) && now.Before(to), to
+}
+
+// Queue a model download for its window
+func schedulePull(model, start, end string, limitKBps int) error {
+	if model == "" {
+		return errors.New("model is required")
+	}
+	if _, err := time.Parse(pullWindowLayout, start); err != nil {
+		return fmt.Errorf("start time %q is not HH:MM", start)
+	}
+	if _, err := time.Parse(pullWindowLayout, end); err != nil {
+		return fmt.Errorf("end time %q is not HH:MM", end)
+	}
+	if start == end {
+		return errors.New("the window must not be empty")
+	}
+	if limitKBps < 0 {
+		return errors.New("the bandwidth limit must not be negative")
+	}
+	pullsOnce.Do(func() { go pullScheduler() })
+
+	pullMut.Lock()
+	nextPullID++
+	scheduledPulls = append(scheduledPulls, &ScheduledPull{ID: nextPullID, Model: model, Start: start, End: end,
+		LimitKBps: limitKBps, State: PullWaiting, Created: time.Now()})
+	pullMut.Unlock()
+	checkPulls(time.Now())
+	return nil
+}
+
+// Stop a scheduled pull; one that is downloading is interrupted, and Ollama
+// keeps what it has for a later pull of the same model
+func cancelPull(id int) bool {
+	pullMut.Lock()
+	defer pullMut.Unlock()
+	for _, p := range scheduledPulls {
+		if p.ID == id && p.Finished.IsZero() {
+			if p.cancel != nil {
+				p.cancel()
+			}
+			p.State = PullCancelled
+			p.Finished = time.Now()
+			return true
+		}
+	}
+	return false
+}
+
+func pullScheduler() {
+	for now := range time.Tick(pullCheckInterval) {
+		checkPulls(now)
+	}
+}
+
+// Start every waiting pull whose window is open
+func checkPulls(now time.Time) {
+	pullMut.Lock()
+	defer pullMut.Unlock()
+	for _, p := range scheduledPulls {
+		if p.State != PullWaiting {
+			continue
+		}
+		open, closes := inPullWindow(now, p.Start, p.End)
+		if !open {
+			continue
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), closes)
+		p.State, p.cancel = PullRunning, cancel
+		go runScheduledPull(ctx, p)
+	}
+}
+
+func runScheduledPull(ctx context.Context, p *ScheduledPull) {
+	var err error
+	for _, host := range upstreams() {
+		if err = rateLimitedPull(withUpstream(ctx, host), p); err != nil {
+			break
+		}
+	}
+
+	pullMut.Lock()
+	defer pullMut.Unlock()
+	p.cancel()
+	p.cancel = nil
+	switch {
+	case p.State == PullCancelled:
+	case errors.Is(err, context.DeadlineExceeded):
+		// The window closed; carry on in the next one
+		p.State = PullWaiting
+		log.Printf("Scheduled pull of %s paused until its next window", p.Model)
+	case err != nil:
+		p.State, p.Error, p.Finished = PullFailed, err.Error(), time.Now()
+		log.Printf("Scheduled pull of %s failed: %v", p.Model, err)
+	default:
+		p.State, p.Error, p.Finished = PullDone, "", time.Now()
+		log.Printf("Scheduled pull of %s finished", p.Model)
+	}
+}
+
+// Pull a model, holding its average rate to the pull's limit. Ollama can't
+// throttle a download, so it is fetched in bursts of pullBurst at full speed
+// and interrupted, then resumed once the average has fallen back to the
+// limit; Ollama keeps partial layers between attempts.
+func rateLimitedPull(ctx context.Context, p *ScheduledPull) error {
+	limit := int64(p.LimitKBps) << 10
+	budget := int64(float64(limit) * pullBurst.Seconds())
+	seen := make(map[string]int64) // bytes of each layer already counted
+	for {
+		burstCtx, stop := context.WithCancel(ctx)
+		began := time.Now()
+		var fetched int64
+		err := guardedPull(burstCtx, p.Model, func(progress PullProgress) {
+			if progress.Completed > seen[progress.Digest] {
+				fetched += progress.Completed - seen[progress.Digest]
+				seen[progress.Digest] = progress.Completed
+			}
+			pullMut.Lock()
+			p.Completed, p.Total = progress.Completed, progress.Total
+			pullMut.Unlock()
+			if limit > 0 && fetched >= budget {
+				stop()
+			}
+		})
+		burstOver := burstCtx.Err() != nil
+		stop()
+		if err == nil || ctx.Err() != nil || !burstOver {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		wait := time.Duration(fetched*int64(time.Second)/limit) - time.Since(began)
+		pullMut.Lock()
+		if p.State == PullRunning {
+			p.State = PullPaused
+		}
+		pullMut.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		pullMut.Lock()
+		if p.State == PullPaused {
+			p.State = PullRunning
+		}
+		pullMut.Unlock()
+	}
+}
+
+// Copies of the scheduled pulls, newest first
+func pullSnapshot() []ScheduledPull {
+	pullMut.Lock()
+	defer pullMut.Unlock()
+	list := make([]ScheduledPull, 0, len(scheduledPulls))
+	for i := len(scheduledPulls) - 1; i >= 0; i-- {
+		p := *scheduledPulls[i]
+		p.cancel = nil
+		list = append(list, p)
+	}
+	return list
+}
+
+// Admin form for scheduled pulls: action=schedule (model, start, end,
+// limit in KB/s) or action=cancel (id), back to the admin page
+func adminPullsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "schedule":
+		limit := 0
+		if s := strings.TrimSpace(r.FormValue("limit")); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, "Invalid bandwidth limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		if err := schedulePull(strings.TrimSpace(r.FormValue("model")), r.FormValue("start"), r.FormValue("end"), limit); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "cancel":
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		if !cancelPull(id) {
+			http.Error(w, "No such pending pull", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests that start a generation when POSTed, and so count against the
+// configured rate limit
+var rateLimitedPaths = []string{
+	"/chat", "/history", "/journal", "/flashcards", "/scenarios/", "/agents", "/evals", "/prompts", "/voice",
+	"/api/v1/chat", "/api/v1/history", "/api/v1/jobs", "/api/v1/voice", "/v1/chat/completions", "/graphql", "/chains/",
+}
+
+// Paths under rateLimitedPaths that start no generation
+var rateLimitExempt = []string{"/chat/stop"}
+
+// A client's token bucket; tokens refill continuously at its limit's rate
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+var rateLimiter = struct {
+	sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}{buckets: map[string]*rateBucket{}}
+
+// Take a token from the client's bucket under the configured rate limit.
+// When it is empty, wait is how long until the next one.
+func allowGeneration(client string, now time.Time) (ok bool, wait time.Duration) {
+	return takeToken(client, currentFileConfig().RateLimit, now)
+}
+
+// Take a token from the bucket under key, which refills at limit
+func takeToken(key string, limit RateLimit, now time.Time) (ok bool, wait time.Duration) {
+	if limit.PerMinute <= 0 {
+		return true, 0
+	}
+	perSecond := func(l RateLimit) float64 { return float64(l.PerMinute) / 60 }
+
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+	if now.Sub(rateLimiter.swept) > time.Minute {
+		// Forget buckets that have filled up again
+		for k, b := range rateLimiter.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*perSecond(b.limit) >= float64(b.limit.Burst) {
+				delete(rateLimiter.buckets, k)
+			}
+		}
+		rateLimiter.swept = now
+	}
+	b, found := rateLimiter.buckets[key]
+	if !found {
+		b = &rateBucket{tokens: float64(limit.Burst), last: now}
+		rateLimiter.buckets[key] = b
+	}
+	b.limit = limit
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond(limit))
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond(limit) * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Who a request is from for rate limiting: its API key when that is one
+// of apiKeys, or else its address. A made-up key gets no bucket of its own.
+func rateLimitClient(r *http.Request) string {
+	if k, ok := apiKeys[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]; ok {
+		return "key:" + k.Key
+	}
+	return "addr:" + clientAddr(r)
+}
+
+// The address a request came from, without its port
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Answer generation requests over the configured rate, or over the quota
+// of the tenant they are for, with 429 Too Many Requests and a Retry-After
+// header
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !rateLimited(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := allowRequest(rateLimitClient(r), requestTenant(r), time.Now()); !ok {
+			writeRateLimited(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Take a token from the client's bucket, then from the quota of tenant t
+// unless it is nil
+func allowRequest(client string, t *Tenant, now time.Time) (ok bool, wait time.Duration) {
+	if ok, wait := allowGeneration(client, now); !ok {
+		return false, wait
+	}
+	if t != nil {
+		return takeToken("tenant:"+t.Name, t.RateLimit, now)
+	}
+	return true, 0
+}
+
+func rateLimited(path string) bool {
+	return matchesPath(path, rateLimitedPaths)
+}
+
+// Whether a path is one of paths or below one, leaving out rateLimitExempt
+func matchesPath(path string, paths []string) bool {
+	for _, p := range rateLimitExempt {
+		if path == p {
+			return false
+		}
+	}
+	for _, p := range paths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func retrySeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+func rateLimitMessage(wait time.Duration) string {
+	return fmt.Sprintf("rate limit exceeded; retry in %d seconds", retrySeconds(wait))
+}
+
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(wait)))
+	writeAPIError(w, http.StatusTooManyRequests, rateLimitMessage(wait))
+}
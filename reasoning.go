@@ -0,0 +1,118 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+)
+
+// Reasoning models such as deepseek-r1 think aloud between these tags
+// before they answer
+const (
+	thinkOpen  = "<think>"
+	thinkClose = "</think>"
+)
+
+// Split a reply into the model's reasoning and its answer. A <think> that
+// is never closed, as when a reply is cut off, makes the rest reasoning; a
+// </think> with no opening tag, which some chat templates leave out, closes
+// reasoning that began with the reply.
+func splitReasoning(reply string) (reasoning, answer string) {
+	before, rest := "", reply
+	if i := strings.Index(rest, thinkOpen); i >= 0 {
+		before, rest = rest[:i], rest[i+len(thinkOpen):]
+	} else if !strings.Contains(rest, thinkClose) {
+		return "", reply
+	}
+	j := strings.Index(rest, thinkClose)
+	if j < 0 {
+		return strings.TrimSpace(rest), strings.TrimSpace(before)
+	}
+	return strings.TrimSpace(rest[:j]), strings.TrimSpace(before + rest[j+len(thinkClose):])
+}
+
+// Split the reasoning off an assistant message, unless that was done
+// already
+func withReasoning(m Message) Message {
+	if m.Role == "assistant" && m.Reasoning == "" {
+		m.Reasoning, m.Content = splitReasoning(m.Content)
+	}
+	return m
+}
+
+// Collapsed block showing rendered reasoning above a reply
+func reasoningDetails(rendered string) template.HTML {
+	if rendered == "" {
+		return ""
+	}
+	return template.HTML(`<details class="reasoning"><summary>Reasoning</summary>` + rendered + `</details>`)
+}
+
+// reasoningStream sorts the chunks of a streamed reply into reasoning and
+// answer as they arrive. A tag split across chunks is held back until the
+// next chunk shows whether it is one. Unlike splitReasoning, a </think>
+// with no opening tag is not recognised, as the text before it has already
+// gone out as answer.
+type reasoningStream struct {
+	thinking         bool
+	pending          string
+	reasoned, answer bool // whether any of each has been sent
+}
+
+// Split the next chunk into its reasoning and answer parts
+func (s *reasoningStream) next(chunk string) (reasoning, answer string) {
+	text := s.pending + chunk
+	s.pending = ""
+	var r, a strings.Builder
+	emit := func(part string) {
+		if s.thinking {
+			if !s.reasoned {
+				part = strings.TrimLeft(part, " \t\r\n")
+			}
+			s.reasoned = s.reasoned || part != ""
+			r.WriteString(part)
+		} else {
+			if !s.answer {
+				part = strings.TrimLeft(part, " \t\r\n")
+			}
+			s.answer = s.answer || part != ""
+			a.WriteString(part)
+		}
+	}
+	for text != "" {
+		tag := thinkOpen
+		if s.thinking {
+			tag = thinkClose
+		}
+		i := strings.Index(text, tag)
+		if i < 0 {
+			keep := tagPrefixLen(text, tag)
+			s.pending = text[len(text)-keep:]
+			emit(text[:len(text)-keep])
+			break
+		}
+		emit(text[:i])
+		text = text[i+len(tag):]
+		s.thinking = !s.thinking
+	}
+	return r.String(), a.String()
+}
+
+// What was held back at the end of the stream
+func (s *reasoningStream) flush() (reasoning, answer string) {
+	text := s.pending
+	s.pending = ""
+	if s.thinking {
+		return text, ""
+	}
+	return "", text
+}
+
+// Length of the longest end of text that tag starts with
+func tagPrefixLen(text, tag string) int {
+	for n := len(tag) - 1; n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
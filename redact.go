@@ -0,0 +1,32 @@
+package main
+
+import "regexp"
+
+// redactionRule replaces every match of a pattern with a fixed label
+type redactionRule struct {
+	Label   string
+	Pattern *regexp.Regexp
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	ipPattern    = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+)
+
+// Personal data and secrets scrubbed from exported datasets. Order matters:
+// keys and emails are matched before the looser phone pattern.
+var redactionRules = []redactionRule{
+	{"[KEY]", regexp.MustCompile(`\b(?:sk|pk|ghp|gho|xox[abp])[-_][A-Za-z0-9_-]{16,}\b`)},
+	{"[EMAIL]", emailPattern},
+	{"[IP]", ipPattern},
+	{"[CARD]", regexp.MustCompile(`\b(?:\d[ -]?){13,16}\b`)},
+	{"[PHONE]", regexp.MustCompile(`\+?\(?\d{2,4}\)?[ .-]?\d{3,4}[ .-]?\d{3,4}\b`)},
+}
+
+// Replace personal data and secrets in s with placeholder labels
+func redact(s string) string {
+	for _, rule := range redactionRules {
+		s = rule.Pattern.ReplaceAllString(s, rule.Label)
+	}
+	return s
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Longest a single Redis command may take; a var so tests can shorten it
+var redisTimeout = 5 * time.Second
+
+// redisStore keeps each session as two keys, so several server instances
+// behind a load balancer can share them: session:<id>:events, a list of the
+// log's events as JSON, and session:<id>:active, the last activity in Unix
+// nanoseconds. Both expire sessionLifetime after the last change, matching
+// the cookie. Each write is announced on sessionChangesChannel, so the
+// other instances know to reload the session rather than check every
+// request. Changes announced while an instance is disconnected go unseen.
+type redisStore struct {
+	client   *redis.Client
+	changes  *redis.PubSub
+	instance string // tells this instance's announcements from others'
+}
+
+// Channel of "<instance> <session ID>" messages, one per write
+const sessionChangesChannel = "session-changes"
+
+func openRedisStore(url string) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	s := &redisStore{client: redis.NewClient(opts), instance: generateSessionID()}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		s.client.Close()
+		return nil, err
+	}
+	s.changes = s.client.Subscribe(ctx, sessionChangesChannel)
+	if _, err := s.changes.Receive(ctx); err != nil {
+		s.client.Close()
+		return nil, err
+	}
+	go s.watch()
+	return s, nil
+}
+
+// Mark sessions other instances change until the store is closed
+func (s *redisStore) watch() {
+	for msg := range s.changes.Channel() {
+		instance, id, ok := strings.Cut(msg.Payload, " ")
+		if ok && instance != s.instance {
+			sessionChanged(id)
+		}
+	}
+}
+
+func redisKeys(id string) (events, active string) {
+	return "session:" + id + ":events", "session:" + id + ":active"
+}
+
+func (s *redisStore) Load(id string) ([]MessageEvent, time.Time, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	eventsKey, activeKey := redisKeys(id)
+
+	active, err := s.client.Get(ctx, activeKey).Int64()
+	if err == redis.Nil {
+		return nil, time.Time{}, false, nil
+	} else if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	items, err := s.client.LRange(ctx, eventsKey, 0, -1).Result()
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	events := make([]MessageEvent, len(items))
+	for i, item := range items {
+		if err := json.Unmarshal([]byte(item), &events[i]); err != nil {
+			return nil, time.Time{}, false, err
+		}
+		if events[i].Message != nil {
+			events[i].Message.ID = events[i].MessageID
+		}
+	}
+	return events, time.Unix(0, active), true, nil
+}
+
+func (s *redisStore) Append(id string, ev MessageEvent, lastActive time.Time) error {
+	return s.write(id, false, []MessageEvent{ev}, lastActive)
+}
+
+func (s *redisStore) Replace(id string, events []MessageEvent, lastActive time.Time) error {
+	return s.write(id, true, events, lastActive)
+}
+
+// Add events to a session's log atomically, after clearing the log when
+// replace is set, and restart both keys' expiry
+func (s *redisStore) write(id string, replace bool, events []MessageEvent, lastActive time.Time) error {
+	items := make([]interface{}, len(events))
+	for i, ev := range events {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		items[i] = b
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	eventsKey, activeKey := redisKeys(id)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if replace {
+			pipe.Del(ctx, eventsKey)
+		}
+		if len(items) > 0 {
+			pipe.RPush(ctx, eventsKey, items...)
+		}
+		pipe.Set(ctx, activeKey, strconv.FormatInt(lastActive.UnixNano(), 10), sessionLifetime)
+		pipe.Expire(ctx, eventsKey, sessionLifetime)
+		pipe.Publish(ctx, sessionChangesChannel, s.instance+" "+id)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	eventsKey, activeKey := redisKeys(id)
+	if err := s.client.Del(ctx, eventsKey, activeKey).Err(); err != nil {
+		return err
+	}
+	return s.client.Publish(ctx, sessionChangesChannel, s.instance+" "+id).Err()
+}
+
+// Redis expires sessions by itself
+func (s *redisStore) Expire(time.Time) error { return nil }
+
+// Number of events stored for a session, so a copy cached by this instance
+// can tell when another instance has added to it
+func (s *redisStore) Length(id string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	eventsKey, _ := redisKeys(id)
+	n, err := s.client.LLen(ctx, eventsKey).Result()
+	return int(n), err
+}
+
+func (s *redisStore) SessionIDs() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	var ids []string
+	iter := s.client.Scan(ctx, 0, "session:*:events", 0).Iterator()
+	for iter.Next(ctx) {
+		key := strings.TrimSuffix(strings.TrimPrefix(iter.Val(), "session:"), ":events")
+		ids = append(ids, key)
+	}
+	return ids, iter.Err()
+}
+
+// Failed logins are counted in login:<key>, which expires with its window
+func (s *redisStore) AddLoginFailure(key string, window time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := s.client.Incr(ctx, "login:"+key).Result()
+	if err == nil && n == 1 {
+		err = s.client.Expire(ctx, "login:"+key, window).Err()
+	}
+	return int(n), err
+}
+
+func (s *redisStore) LoginFailures(key string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := s.client.Get(ctx, "login:"+key).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (s *redisStore) ClearLoginFailures(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return s.client.Del(ctx, "login:"+key).Err()
+}
+
+func (s *redisStore) Close() error {
+	s.changes.Close()
+	return s.client.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+
+	"github.com/russross/blackfriday/v2"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// Renderer turns a model's markdown output into HTML
+type Renderer interface {
+	Render(markdown string) string
+}
+
+// Active renderer, chosen with the -renderer flag
+var renderer Renderer = blackfridayRenderer{}
+
+// Names accepted by newRenderer
+const rendererNames = "blackfriday, goldmark, plain"
+
+// Look up a renderer by name
+func newRenderer(name string) (Renderer, error) {
+	switch name {
+	case "", "blackfriday":
+		return blackfridayRenderer{}, nil
+	case "goldmark":
+		return newGoldmarkRenderer(), nil
+	case "plain":
+		return plainRenderer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown renderer %q (want one of: %s)", name, rendererNames)
+	}
+}
+
+// blackfridayRenderer renders markdown with blackfriday's common extensions
+type blackfridayRenderer struct{}
+
+func (blackfridayRenderer) Render(markdown string) string {
+	return string(blackfriday.Run([]byte(markdown)))
+}
+
+// goldmarkRenderer renders CommonMark plus GFM tables, task lists,
+// strikethrough, autolinks, and footnotes
+type goldmarkRenderer struct {
+	md goldmark.Markdown
+}
+
+func newGoldmarkRenderer() goldmarkRenderer {
+	return goldmarkRenderer{md: goldmark.New(
+		goldmark.WithExtensions(extension.GFM, extension.Footnote),
+	)}
+}
+
+func (g goldmarkRenderer) Render(markdown string) string {
+	var buf bytes.Buffer
+	if err := g.md.Convert([]byte(markdown), &buf); err != nil {
+		log.Printf("Markdown render error: %v", err)
+		return html.EscapeString(markdown)
+	}
+	return buf.String()
+}
+
+// plainRenderer shows the raw text, escaped, with no markdown formatting
+type plainRenderer struct{}
+
+func (plainRenderer) Render(markdown string) string {
+	return html.EscapeString(markdown)
+}
+
+// Clean up the response content and render it to sanitized HTML, leaving
+// out any reasoning still inline in it
+func cleanResponse(content string) string {
+	_, content = splitReasoning(content)
+	content, math := extractMath(content)
+	return string(sanitizeHTML(highlightCode(markDiagrams(restoreMath(renderer.Render(content), math)))))
+}
+
+// Render a reply and the reasoning before it, to sanitized HTML. Replies
+// stored before reasoning was split off still carry it inline.
+func renderReply(m Message) (html, reasoning string) {
+	m = withReasoning(m)
+	if m.Reasoning != "" {
+		reasoning = cleanResponse(m.Reasoning)
+	}
+	return cleanResponse(m.Content), reasoning
+}
+
+// Rendered HTML for a history message and its reasoning, kept while its
+// content and the sanitizer policy are unchanged
+type renderedMessage struct {
+	content, reasoning string
+	html, thoughts     string
+	policy             int
+}
+
+// Cached HTML for a message and its reasoning, if they were rendered from
+// the same content under the current policy. Callers must hold sessionMut.
+func (s *session) cachedRender(m Message) (html, reasoning string, ok bool) {
+	c, ok := s.rendered[m.ID]
+	if !ok || c.content != m.Content || c.reasoning != m.Reasoning || c.policy != currentHTMLPolicyVersion() {
+		return "", "", false
+	}
+	return c.html, c.thoughts, true
+}
+
+// Remember a message's HTML, rendered under the given policy version.
+// Callers must hold sessionMut.
+func (s *session) cacheRender(m Message, html, reasoning string, policy int) {
+	if s.rendered == nil {
+		s.rendered = make(map[int]renderedMessage)
+	}
+	s.rendered[m.ID] = renderedMessage{content: m.Content, reasoning: m.Reasoning, html: html, thoughts: reasoning, policy: policy}
+}
+
+// Fill in the HTML of assistant messages and, unless the user hides it,
+// their reasoning, rendering markdown only for messages not already in the
+// session's cache. Rendering runs without sessionMut held, so a long chat
+// does not block other sessions.
+func renderHistory(sessionID string, views []MessageView) {
+	var misses []int
+	reasoning := make([]string, len(views))
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	hide := sess.HideReasoning
+	for i, v := range views {
+		if v.Role != "assistant" {
+			continue
+		}
+		if html, thoughts, ok := sess.cachedRender(v.Message); ok {
+			views[i].HTML, reasoning[i] = template.HTML(html), thoughts
+		} else {
+			misses = append(misses, i)
+		}
+	}
+	sessionMut.Unlock()
+
+	if len(misses) > 0 {
+		policy := currentHTMLPolicyVersion()
+		for _, i := range misses {
+			html, thoughts := renderReply(views[i].Message)
+			views[i].HTML, reasoning[i] = template.HTML(html), thoughts
+		}
+
+		sessionMut.Lock()
+		sess = getSession(sessionID)
+		for _, i := range misses {
+			sess.cacheRender(views[i].Message, string(views[i].HTML), reasoning[i], policy)
+		}
+		sessionMut.Unlock()
+	}
+
+	if !hide {
+		for i := range views {
+			views[i].ReasoningHTML = reasoningDetails(reasoning[i])
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fixture is one recorded Ollama exchange stored on disk
+type Fixture struct {
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	Request     json.RawMessage `json:"request,omitempty"`
+	Status      int             `json:"status"`
+	ContentType string          `json:"content_type"`
+	Body        string          `json:"body"`
+}
+
+// recordTransport passes requests through to the real upstream and saves
+// each response (including streamed bodies) as a fixture file.
+type recordTransport struct {
+	dir  string
+	next http.RoundTripper
+}
+
+// replayTransport answers requests from fixture files without touching the
+// network. Streamed bodies are replayed line by line with an optional delay.
+type replayTransport struct {
+	dir   string
+	delay time.Duration
+}
+
+// Wrap the Ollama client transport for record or replay mode
+func configureReplay(client *http.Client, recordDir, replayDir string, delay time.Duration) error {
+	switch {
+	case recordDir != "" && replayDir != "":
+		return fmt.Errorf("record and replay modes are mutually exclusive")
+	case recordDir != "":
+		if err := os.MkdirAll(recordDir, 0o755); err != nil {
+			return err
+		}
+		next := client.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		client.Transport = &recordTransport{dir: recordDir, next: next}
+		log.Printf("Recording Ollama responses to %s", recordDir)
+	case replayDir != "":
+		if _, err := os.Stat(replayDir); err != nil {
+			return err
+		}
+		client.Transport = &replayTransport{dir: replayDir, delay: delay}
+		log.Printf("Replaying Ollama responses from %s", replayDir)
+	}
+	return nil
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	fx := Fixture{
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	if json.Valid(reqBody) {
+		fx.Request = reqBody
+	}
+	path := filepath.Join(t.dir, fixtureKey(req.Method, req.URL.Path, reqBody)+".json")
+	resp.Body = &recordingBody{ReadCloser: resp.Body, fixture: fx, path: path}
+	return resp, nil
+}
+
+// recordingBody captures everything read from the upstream body and writes
+// the fixture when the body is closed.
+type recordingBody struct {
+	io.ReadCloser
+	buf     bytes.Buffer
+	fixture Fixture
+	path    string
+	once    sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.fixture.Body = b.buf.String()
+		data, mErr := json.MarshalIndent(b.fixture, "", "  ")
+		if mErr != nil {
+			log.Printf("Record error: %v", mErr)
+			return
+		}
+		if wErr := os.WriteFile(b.path, data, 0o644); wErr != nil {
+			log.Printf("Record error: %v", wErr)
+			return
+		}
+		log.Printf("Recorded fixture %s", b.path)
+	})
+	return err
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fixtureKey(req.Method, req.URL.Path, reqBody)
+	fx, err := loadFixture(filepath.Join(t.dir, key+".json"))
+	if os.IsNotExist(err) {
+		fx, err = t.fallback(req.Method, req.URL.Path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("replay %s %s: %w", req.Method, req.URL.Path, err)
+	}
+
+	var body io.ReadCloser = io.NopCloser(strings.NewReader(fx.Body))
+	if t.delay > 0 {
+		body = &delayedBody{r: bufio.NewReader(strings.NewReader(fx.Body)), delay: t.delay, done: req.Context().Done()}
+	}
+
+	header := make(http.Header)
+	if fx.ContentType != "" {
+		header.Set("Content-Type", fx.ContentType)
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", fx.Status, http.StatusText(fx.Status)),
+		StatusCode: fx.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       body,
+		Request:    req,
+	}, nil
+}
+
+// fallback picks the first fixture (by file name) recorded for the same
+// endpoint, so that prompts typed during UI work still get a reply.
+func (t *replayTransport) fallback(method, path string) (*Fixture, error) {
+	names, err := filepath.Glob(filepath.Join(t.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fx, err := loadFixture(name)
+		if err != nil {
+			continue
+		}
+		if fx.Method == method && fx.Path == path {
+			log.Printf("Replay: no exact fixture, using %s", filepath.Base(name))
+			return fx, nil
+		}
+	}
+	return nil, fmt.Errorf("no fixture recorded")
+}
+
+// delayedBody releases one line at a time to mimic a live stream
+type delayedBody struct {
+	r       *bufio.Reader
+	delay   time.Duration
+	done    <-chan struct{}
+	pending []byte
+}
+
+func (b *delayedBody) Read(p []byte) (int, error) {
+	if len(b.pending) == 0 {
+		line, err := b.r.ReadBytes('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		select {
+		case <-time.After(b.delay):
+		case <-b.done:
+			return 0, io.ErrUnexpectedEOF
+		}
+		b.pending = line
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+func (b *delayedBody) Close() error { return nil }
+
+func loadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fx Fixture
+	if err := json.Unmarshal(data, &fx); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if fx.Status == 0 {
+		fx.Status = http.StatusOK
+	}
+	return &fx, nil
+}
+
+// Read and restore the request body so it can still be sent upstream
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// Hash the request so identical prompts map to the same fixture. JSON bodies
+// are canonicalised first so field order does not matter.
+func fixtureKey(method, path string, body []byte) string {
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		if canon, err := json.Marshal(v); err == nil {
+			body = canon
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
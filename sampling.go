@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Model options a conversation can set for its chats, with the range each
+// takes; the integer ones are sent as whole numbers
+var generationOptions = []struct {
+	Name     string
+	Integer  bool
+	Min, Max float64
+}{
+	{"temperature", false, 0, math.Inf(1)},
+	{"top_p", false, 0, 1},
+	{"top_k", true, 0, math.Inf(1)},
+	{"seed", true, math.Inf(-1), math.Inf(1)},
+	{"num_predict", true, -2, math.Inf(1)}, // -1 is no limit, -2 fills the context
+}
+
+// Names of the options a conversation can set, for the page
+func generationOptionNames() []string {
+	names := make([]string, len(generationOptions))
+	for i, o := range generationOptions {
+		names[i] = o.Name
+	}
+	return names
+}
+
+// Check options a conversation is to use: only known ones, each a number
+// in its range. Nil for none.
+func cleanGenerationOptions(opts map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(opts))
+	for name, v := range opts {
+		n, ok := optionNumber(v)
+		i := generationOptionIndex(name)
+		switch {
+		case i < 0:
+			return nil, fmt.Errorf("%w: unknown option %q", errInvalidRequest, name)
+		case !ok:
+			return nil, fmt.Errorf("%w: %s must be a number", errInvalidRequest, name)
+		case n < generationOptions[i].Min || n > generationOptions[i].Max:
+			return nil, fmt.Errorf("%w: %s is out of range", errInvalidRequest, name)
+		case generationOptions[i].Integer && n != math.Trunc(n):
+			return nil, fmt.Errorf("%w: %s must be a whole number", errInvalidRequest, name)
+		case generationOptions[i].Integer:
+			out[name] = int(n)
+		default:
+			out[name] = n
+		}
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+func generationOptionIndex(name string) int {
+	for i, o := range generationOptions {
+		if o.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Options from the page's form, one field per option; blank ones are left
+// to the model
+func generationOptionsFromForm(r *http.Request) (map[string]interface{}, error) {
+	opts := map[string]interface{}{}
+	for _, o := range generationOptions {
+		v := strings.TrimSpace(r.FormValue(o.Name))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s must be a number", errInvalidRequest, o.Name)
+		}
+		opts[o.Name] = n
+	}
+	return cleanGenerationOptions(opts)
+}
+
+// An option's value as the page's form shows it; empty when the model's
+// default is used
+func (c ConversationInfo) Option(name string) string {
+	v, ok := c.Options[name]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// Set the model options a conversation's chats use; none leaves them to
+// the model. Callers must hold sessionMut.
+func (s *session) setConversationOptions(id int, opts map[string]interface{}) error {
+	if s.conversationIndex(id) < 0 {
+		return errUnknownConversation
+	}
+	opts, err := cleanGenerationOptions(opts)
+	if err != nil {
+		return err
+	}
+	var content string
+	if opts != nil {
+		b, _ := json.Marshal(opts)
+		content = string(b)
+	}
+	s.recordIn(id, MessageEvent{Type: EventConversationOptions, Content: content})
+	return nil
+}
+
+// A conversation's options under those a request sets itself. Callers
+// must hold sessionMut.
+func (s *session) withConversationOptions(conv int, opts map[string]interface{}) map[string]interface{} {
+	i := s.conversationIndex(conv)
+	if i < 0 || len(s.Conversations[i].Options) == 0 {
+		return opts
+	}
+	out := make(map[string]interface{}, len(opts)+len(s.Conversations[i].Options))
+	for k, v := range s.Conversations[i].Options {
+		out[k] = v
+	}
+	for k, v := range opts {
+		out[k] = v
+	}
+	return out
+}
+
+// The request for a chat of a conversation: the default model, the
+// conversation's options, and its messages with its system prompt and
+// summary. Callers must
+// hold sessionMut.
+func (s *session) conversationRequest(conv int, messages []Message) OllamaChatRequest {
+	return OllamaChatRequest{Model: tenantModel(sessionTenant(s.id)), Messages: s.conversationMessages(conv, messages),
+		Options: s.withConversationOptions(conv, nil)}
+}
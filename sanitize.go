@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/net/html"
+)
+
+// What rendered model output may contain: the usual markdown elements, plus
+// the classes the math, diagram, footnote and code highlighting markup
+// relies on. Scripts, event handlers, styles and javascript: links are
+// removed. The config's html.allow adds elements and attributes on top.
+var (
+	htmlPolicyMut sync.RWMutex
+	htmlPolicy    = newHTMLPolicy(nil)
+	htmlAllow     map[string][]string
+	// Bumped whenever the policy changes, so HTML cleaned under an older
+	// one is cleaned again
+	htmlPolicyVersion int
+)
+
+// Names config files may use for elements and attributes
+var htmlNameRe = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// Elements and attributes no allowlist may let through: they run script,
+// load other pages, or restyle the app around the reply
+var (
+	forbiddenElements = map[string]bool{
+		"script": true, "style": true, "iframe": true, "frame": true, "frameset": true, "object": true,
+		"embed": true, "applet": true, "base": true, "link": true, "meta": true, "form": true, "svg": true, "math": true,
+	}
+	forbiddenAttrs = map[string]bool{"style": true, "srcdoc": true, "formaction": true, "action": true, "xmlns": true}
+)
+
+// Check an html.allow section of the config: element names each with the
+// attributes they may carry, "*" for attributes allowed on any element
+func checkHTMLAllow(allow map[string][]string) error {
+	for el, attrs := range allow {
+		if el != "*" && (!htmlNameRe.MatchString(el) || forbiddenElements[el]) {
+			return fmt.Errorf("html.allow: element %q may not be allowed", el)
+		}
+		for _, a := range attrs {
+			if !htmlNameRe.MatchString(a) || forbiddenAttrs[a] || strings.HasPrefix(a, "on") {
+				return fmt.Errorf("html.allow.%s: attribute %q may not be allowed", el, a)
+			}
+		}
+	}
+	return nil
+}
+
+func newHTMLPolicy(allow map[string][]string) *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	for el, attrs := range allow {
+		if el == "*" {
+			p.AllowAttrs(attrs...).Globally()
+			continue
+		}
+		p.AllowElements(el)
+		if len(attrs) > 0 {
+			p.AllowAttrs(attrs...).OnElements(el)
+		}
+	}
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(math math-inline|math math-display|mermaid|language-[\w+-]+)$`)).OnElements("span", "pre", "code")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^hl-[a-z0-9]+$`)).OnElements("span")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^footnote(s|-ref|-backref)?$`)).OnElements("a", "div", "sup", "li")
+	p.AllowAttrs("id").Matching(regexp.MustCompile(`^fn(ref)?:[\w-]+$`)).OnElements("sup", "li")
+	// GFM task list boxes
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	return p
+}
+
+// Sanitize HTML from outside the app, such as rendered model output, so it
+// can be written into a page unescaped
+func sanitizeHTML(s string) template.HTML {
+	htmlPolicyMut.RLock()
+	p := htmlPolicy
+	htmlPolicyMut.RUnlock()
+	return template.HTML(p.Sanitize(s))
+}
+
+var (
+	// Elements dropped with their content, to the end of the text when
+	// left open, as markdown renderers pass them through
+	rawTextElementRe = regexp.MustCompile(`(?is)<(?:script|style)\b[^>]*>.*?(?:</(?:script|style)\s*>|$)`)
+	// A single HTML tag or comment; autolinks such as <https://...> and
+	// <me@example.com> are not tags
+	markdownTagRe = regexp.MustCompile(`(?s)<!--.*?-->|</?[a-zA-Z][a-zA-Z0-9-]*(?:\s[^>]*)?/?>`)
+)
+
+// Clean the raw HTML in a reply's markdown before it is stored, so the
+// JSON API and the exports never hand out script. Only what no allowlist
+// may let through is removed, leaving the markdown around it as written;
+// the configured allowlist is applied when the reply is rendered, so
+// allowing an element later shows it in replies already stored.
+func sanitizeMarkdown(content string) string {
+	if !strings.Contains(content, "<") {
+		return content
+	}
+	clean := func(text string) string {
+		text = rawTextElementRe.ReplaceAllString(text, "")
+		return markdownTagRe.ReplaceAllStringFunc(text, cleanStoredTag)
+	}
+
+	var out strings.Builder
+	last := 0
+	for _, loc := range codeSpanRe.FindAllStringIndex(content, -1) {
+		out.WriteString(clean(content[last:loc[0]]))
+		out.WriteString(content[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	out.WriteString(clean(content[last:]))
+	return out.String()
+}
+
+// Clean one tag of stored markdown: comments and forbidden elements go,
+// and so do event handlers, forbidden attributes and links to script
+func cleanStoredTag(tag string) string {
+	z := html.NewTokenizer(strings.NewReader(tag))
+	z.Next()
+	tok := z.Token()
+	if tok.Type != html.StartTagToken && tok.Type != html.EndTagToken && tok.Type != html.SelfClosingTagToken {
+		return ""
+	}
+	if forbiddenElements[tok.Data] {
+		return ""
+	}
+	attrs := tok.Attr[:0]
+	for _, a := range tok.Attr {
+		if forbiddenAttrs[a.Key] || strings.HasPrefix(a.Key, "on") || scriptURL(a.Val) {
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	tok.Attr = attrs
+	return tok.String()
+}
+
+// Whether an attribute value is a URL that runs script when followed.
+// Browsers ignore whitespace and control characters in the scheme.
+func scriptURL(v string) bool {
+	v = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, v))
+	return strings.HasPrefix(v, "javascript:") || strings.HasPrefix(v, "vbscript:") || strings.HasPrefix(v, "data:text/html")
+}
+
+// Replace the extra elements and attributes replies may use. HTML cleaned
+// under the previous policy is cleaned again when next shown.
+func setHTMLAllow(allow map[string][]string) {
+	htmlPolicyMut.Lock()
+	defer htmlPolicyMut.Unlock()
+	if (len(allow) == 0 && len(htmlAllow) == 0) || reflect.DeepEqual(allow, htmlAllow) {
+		return
+	}
+	htmlPolicy, htmlAllow = newHTMLPolicy(allow), allow
+	htmlPolicyVersion++
+}
+
+func currentHTMLPolicyVersion() int {
+	htmlPolicyMut.RLock()
+	defer htmlPolicyMut.RUnlock()
+	return htmlPolicyVersion
+}
+
+// Render markdown for a template, sanitized
+func markdownHTML(content string) template.HTML {
+	return template.HTML(cleanResponse(content))
+}
+
+// Capitalise the first letter of a word such as a message role
+func titleCase(s string) string {
+	r, n := utf8.DecodeRuneInString(s)
+	if n == 0 {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[n:]
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Directory holding scenario definitions (*.yaml)
+var scenarioDir = "scenarios"
+
+// Scenario is a roleplay exercise defined in YAML
+type Scenario struct {
+	ID          string   `yaml:"id"`
+	Title       string   `yaml:"title"`
+	Description string   `yaml:"description"`
+	Role        string   `yaml:"role"`      // system prompt for the character the model plays
+	UserRole    string   `yaml:"user_role"` // who the user is playing
+	Opening     string   `yaml:"opening"`   // optional first line from the model
+	MaxTurns    int      `yaml:"max_turns"` // user turns before evaluation
+	Rubric      []string `yaml:"rubric"`    // criteria the final evaluation scores
+}
+
+// ScenarioRun is a conversation played through a scenario. It is kept apart
+// from the main chat history and ends with an evaluation message.
+type ScenarioRun struct {
+	ID         int
+	Scenario   Scenario
+	History    []Message
+	Turns      int
+	Started    time.Time
+	Updated    time.Time // when the last message was added
+	Finished   bool
+	Evaluation string
+}
+
+// Copy of a run that is safe to read while a turn is being played. Callers
+// must hold sessionMut.
+func (run *ScenarioRun) snapshot() *ScenarioRun {
+	copied := *run
+	copied.History = append([]Message(nil), run.History...)
+	return &copied
+}
+
+// ScenarioPage holds data for the scenario templates
+type ScenarioPage struct {
+	Scenarios []Scenario
+	Runs      []*ScenarioRun
+	Run       *ScenarioRun
+	History   []MessageView
+	L         Localizer
+}
+
+// Scenarios loaded at startup, keyed by ID
+var scenarios = map[string]Scenario{}
+
+// Load every scenario definition from the scenario directory. A missing
+// directory just means no scenarios are offered.
+func loadScenarios() error {
+	paths, err := filepath.Glob(filepath.Join(scenarioDir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]Scenario, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var sc Scenario
+		if err := yaml.Unmarshal(data, &sc); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if sc.ID == "" {
+			sc.ID = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		if sc.Role == "" {
+			return fmt.Errorf("%s: scenario %q has no role", path, sc.ID)
+		}
+		if sc.MaxTurns <= 0 {
+			sc.MaxTurns = 5
+		}
+		if sc.UserRole == "" {
+			sc.UserRole = "User"
+		}
+		loaded[sc.ID] = sc
+	}
+
+	scenarios = loaded
+	log.Printf("Loaded %d scenarios from %s", len(loaded), scenarioDir)
+	return nil
+}
+
+func sortedScenarios() []Scenario {
+	list := make([]Scenario, 0, len(scenarios))
+	for _, sc := range scenarios {
+		list = append(list, sc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Title < list[j].Title })
+	return list
+}
+
+// Scenario routes:
+//
+//	GET  /scenarios            list scenarios and past runs
+//	POST /scenarios/start      start a run (id=<scenario>)
+//	GET  /scenarios/run/<n>    show a run
+//	POST /scenarios/run/<n>    play the next turn
+func scenariosHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scenarios"), "/")
+	sessionID := getSessionID(w, r)
+
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		sessionMut.Lock()
+		sess := getSession(sessionID)
+		var runs []*ScenarioRun
+		for _, run := range sess.Scenarios {
+			runs = append(runs, run.snapshot())
+		}
+		l := sess.localizer(r)
+		sessionMut.Unlock()
+		renderPage(w, r, "scenarios.html", ScenarioPage{Scenarios: sortedScenarios(), Runs: runs, L: l})
+	case path == "start" && r.Method == http.MethodPost:
+		startScenario(w, r, sessionID)
+	case strings.HasPrefix(path, "run/"):
+		var id int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(path, "run/"), "%d", &id); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			playScenarioTurn(w, r, sessionID, id)
+			return
+		}
+		showScenarioRun(w, r, sessionID, id)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func startScenario(w http.ResponseWriter, r *http.Request, sessionID string) {
+	sc, ok := scenarios[r.FormValue("id")]
+	if !ok {
+		http.Error(w, "Unknown scenario", http.StatusNotFound)
+		return
+	}
+
+	run := &ScenarioRun{
+		Scenario: sc,
+		History:  []Message{{Role: "system", Content: scenarioSystemPrompt(sc)}},
+		Started:  time.Now(),
+	}
+	run.Updated = run.Started
+	if sc.Opening != "" {
+		run.History = append(run.History, Message{Role: "assistant", Content: sc.Opening})
+	}
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	run.ID = len(sess.Scenarios) + 1
+	sess.Scenarios = append(sess.Scenarios, run)
+	sessionMut.Unlock()
+
+	redirect(w, r, fmt.Sprintf("/scenarios/run/%d", run.ID), http.StatusSeeOther)
+}
+
+func scenarioSystemPrompt(sc Scenario) string {
+	return fmt.Sprintf("%s\n\nStay in character for the whole conversation. The user is playing: %s. "+
+		"Keep each reply to a single conversational turn.", strings.TrimSpace(sc.Role), sc.UserRole)
+}
+
+// Look up a run by ID. Callers must hold sessionMut.
+func findScenarioRun(sess *session, id int) *ScenarioRun {
+	if id < 1 || id > len(sess.Scenarios) {
+		return nil
+	}
+	return sess.Scenarios[id-1]
+}
+
+func showScenarioRun(w http.ResponseWriter, r *http.Request, sessionID string, id int) {
+	sessionMut.Lock()
+	run := findScenarioRun(getSession(sessionID), id)
+	var page ScenarioPage
+	if run != nil {
+		page.Run = run.snapshot()
+		for i, msg := range run.History {
+			if msg.Role != "system" {
+				page.History = append(page.History, MessageView{Message: msg, Index: i})
+			}
+		}
+	}
+	sessionMut.Unlock()
+
+	if page.Run == nil {
+		http.NotFound(w, r)
+		return
+	}
+	renderPage(w, r, "scenario.html", page)
+}
+
+// Record the user's turn, get the character's reply, and evaluate the run
+// once the turn limit is reached
+func playScenarioTurn(w http.ResponseWriter, r *http.Request, sessionID string, id int) {
+	userMessage, err := readUserMessage(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), submissionStatus(err))
+		return
+	}
+
+	sessionMut.Lock()
+	run := findScenarioRun(getSession(sessionID), id)
+	if run == nil || run.Finished {
+		sessionMut.Unlock()
+		http.Error(w, "Scenario run is not active", http.StatusConflict)
+		return
+	}
+	run.History = append(run.History, userMessage)
+	run.Updated = time.Now()
+	run.Turns++
+	history := append([]Message(nil), run.History...)
+	finished := run.Turns >= run.Scenario.MaxTurns
+	sc := run.Scenario
+	sessionMut.Unlock()
+
+	reply, err := ollamaComplete(r.Context(), OllamaChatRequest{Model: defaultModelFor(r.Context()), Messages: history})
+	if err != nil {
+		writeOllamaError(w, r, http.StatusBadGateway, err)
+		log.Printf("Scenario Ollama error: %v", err)
+		return
+	}
+	history = append(history, Message{Role: "assistant", Content: reply})
+
+	var evaluation string
+	if finished {
+		evaluation, err = evaluateScenario(r, sc, history)
+		if err != nil {
+			writeOllamaError(w, r, http.StatusBadGateway, err)
+			log.Printf("Scenario evaluation error: %v", err)
+			return
+		}
+	}
+
+	sessionMut.Lock()
+	run.History = append(run.History, Message{Role: "assistant", Content: reply})
+	run.Updated = time.Now()
+	if finished {
+		run.Finished = true
+		run.Evaluation = evaluation
+	}
+	sessionMut.Unlock()
+
+	redirect(w, r, fmt.Sprintf("/scenarios/run/%d", id), http.StatusSeeOther)
+}
+
+// Ask the model, out of character, to grade the user against the rubric
+func evaluateScenario(r *http.Request, sc Scenario, history []Message) (string, error) {
+	var transcript strings.Builder
+	for _, msg := range history {
+		switch msg.Role {
+		case "user":
+			fmt.Fprintf(&transcript, "%s: %s\n\n", sc.UserRole, msg.Content)
+		case "assistant":
+			fmt.Fprintf(&transcript, "Character: %s\n\n", msg.Content)
+		}
+	}
+
+	rubric := "overall performance"
+	if len(sc.Rubric) > 0 {
+		rubric = "\n- " + strings.Join(sc.Rubric, "\n- ")
+	}
+	prompt := fmt.Sprintf("You are an impartial evaluator. The transcript below is a \"%s\" roleplay in which the user played %s. "+
+		"Score the user from 1 to 5 on each of these criteria: %s\n\n"+
+		"Give a markdown table of scores with one-line justifications, then two or three concrete suggestions.\n\nTranscript:\n%s",
+		sc.Title, sc.UserRole, rubric, transcript.String())
+
+	return ollamaComplete(r.Context(), OllamaChatRequest{
+		Model:    defaultModelFor(r.Context()),
+		Messages: []Message{{Role: "user", Content: prompt}},
+	})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the scheduler looks for prompts that are due; a var so tests
+// can shorten it
+var scheduleCheckInterval = 30 * time.Second
+
+const scheduleTimeLayout = "15:04"
+
+// Runs of each schedule shown ahead on the schedule pages
+const schedulePreviewRuns = 3
+
+// Weekday names the schedule forms use, Sunday first as time.Weekday
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ScheduledPrompt is a prompt sent into one of a session's conversations at
+// a time of day, on chosen weekdays, until cancelled or, for a one-off,
+// once it has run. The time is on the wall clock of the schedule's own
+// time zone, so it stays put when daylight saving time starts or ends.
+type ScheduledPrompt struct {
+	ID           int
+	Session      string // ID of the session it belongs to
+	Conversation int
+	Prompt       string
+	At           string         // "15:04" in TimeZone
+	Days         []time.Weekday // every day when empty
+	Once         bool
+	TimeZone     string // IANA name; empty for server time
+	Created      time.Time
+	LastRun      time.Time
+	Runs         int
+	Error        string    // why it stopped, when it could not run
+	Finished     time.Time // when it ran for the last time or was cancelled
+	Next         time.Time // next run, in the schedule's time zone
+	// The next schedulePreviewRuns runs, set in snapshots
+	NextRuns []time.Time
+
+	zone *time.Location
+}
+
+var (
+	scheduledPrompts []*ScheduledPrompt // oldest first
+	nextScheduleID   int
+	scheduleMut      sync.Mutex
+	schedulesOnce    sync.Once
+)
+
+// Whether a schedule with the given days runs on a weekday
+func runsOn(days []time.Weekday, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// The first run after t of a prompt scheduled at a wall clock time on days,
+// in loc. A repeated hour, when the clocks go back, runs once. A time the
+// clocks skip going forward runs as far past the gap as it was into it,
+// so 02:30 runs at 03:30.
+func nextScheduledRun(after time.Time, at string, days []time.Weekday, loc *time.Location) time.Time {
+	clock, err := time.Parse(scheduleTimeLayout, at)
+	if err != nil {
+		return time.Time{}
+	}
+	want := clock.Hour()*60 + clock.Minute()
+	local := after.In(loc)
+	for d := 0; d <= 7; d++ {
+		if d == 0 && local.Hour()*60+local.Minute() >= want {
+			continue
+		}
+		y, m, day := local.AddDate(0, 0, d).Date()
+		t := time.Date(y, m, day, clock.Hour(), clock.Minute(), 0, 0, loc)
+		if got := t.Hour()*60 + t.Minute(); got != want {
+			// In a gap, which time.Date resolves with the offset after it
+			t = t.Add(time.Duration((want-got+24*60)%(24*60)) * time.Minute)
+		}
+		if t.After(after) && runsOn(days, t.Weekday()) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// The next n runs of a schedule, none once it has finished
+func (p *ScheduledPrompt) nextRuns(n int) []time.Time {
+	var out []time.Time
+	for next := p.Next; !next.IsZero() && len(out) < n; next = nextScheduledRun(next, p.At, p.Days, p.zone) {
+		out = append(out, next)
+		if p.Once {
+			break
+		}
+	}
+	return out
+}
+
+// Parse weekday names from a schedule form; none means every day
+func parseWeekdays(names []string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, name := range names {
+		i := 0
+		for i < len(weekdayNames) && weekdayNames[i] != strings.ToLower(strings.TrimSpace(name)) {
+			i++
+		}
+		if i == len(weekdayNames) {
+			return nil, fmt.Errorf("unknown weekday %q", name)
+		}
+		if len(days) == 0 || !runsOn(days, time.Weekday(i)) {
+			days = append(days, time.Weekday(i))
+		}
+	}
+	return days, nil
+}
+
+// Schedule a prompt for a session's conversation, at a time of day in an
+// IANA time zone or, when zone is empty, server time
+func schedulePrompt(sessionID string, conv int, prompt, at string, days []time.Weekday, once bool, zone string) (*ScheduledPrompt, error) {
+	prompt = strings.TrimSpace(prompt)
+	if prompt == "" {
+		return nil, errors.New("prompt is required")
+	}
+	if len(prompt) > maxFieldBytes {
+		return nil, fmt.Errorf("prompt exceeds %d bytes", maxFieldBytes)
+	}
+	if _, err := time.Parse(scheduleTimeLayout, at); err != nil {
+		return nil, fmt.Errorf("time %q is not HH:MM", at)
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", zone)
+	}
+	if zone == "" {
+		loc = time.Local
+	}
+	schedulesOnce.Do(func() { go promptScheduler() })
+
+	now := time.Now()
+	p := &ScheduledPrompt{Session: sessionID, Conversation: conv, Prompt: prompt, At: at, Days: days, Once: once,
+		TimeZone: zone, zone: loc, Created: now, Next: nextScheduledRun(now, at, days, loc)}
+	scheduleMut.Lock()
+	nextScheduleID++
+	p.ID = nextScheduleID
+	scheduledPrompts = append(scheduledPrompts, p)
+	scheduleMut.Unlock()
+	return p, nil
+}
+
+// Stop a schedule, of the given session unless that is empty
+func cancelSchedule(id int, sessionID string) bool {
+	scheduleMut.Lock()
+	defer scheduleMut.Unlock()
+	for _, p := range scheduledPrompts {
+		if p.ID == id && p.Finished.IsZero() && (sessionID == "" || p.Session == sessionID) {
+			p.Finished, p.Next = time.Now(), time.Time{}
+			return true
+		}
+	}
+	return false
+}
+
+// Point a rotated session's schedules at its new ID
+func moveSchedules(from, to string) {
+	scheduleMut.Lock()
+	defer scheduleMut.Unlock()
+	for _, p := range scheduledPrompts {
+		if p.Session == from {
+			p.Session = to
+		}
+	}
+}
+
+func promptScheduler() {
+	for now := range time.Tick(scheduleCheckInterval) {
+		checkSchedules(now)
+	}
+}
+
+// Send every prompt that is due, working out each one's next run first so
+// a slow reply cannot make it run twice
+func checkSchedules(now time.Time) {
+	var due []ScheduledPrompt
+	scheduleMut.Lock()
+	for _, p := range scheduledPrompts {
+		if !p.Finished.IsZero() || p.Next.IsZero() || p.Next.After(now) {
+			continue
+		}
+		p.LastRun = now
+		p.Runs++
+		if p.Once {
+			p.Finished, p.Next = now, time.Time{}
+		} else {
+			p.Next = nextScheduledRun(now, p.At, p.Days, p.zone)
+		}
+		due = append(due, *p)
+	}
+	scheduleMut.Unlock()
+
+	for _, p := range due {
+		if err := runSchedule(p); err != nil {
+			log.Printf("Scheduled prompt %d stopped: %v", p.ID, err)
+			scheduleMut.Lock()
+			for _, q := range scheduledPrompts {
+				if q.ID == p.ID {
+					q.Error, q.Next = err.Error(), time.Time{}
+					if q.Finished.IsZero() {
+						q.Finished = now
+					}
+				}
+			}
+			scheduleMut.Unlock()
+		}
+	}
+}
+
+// Queue a scheduled prompt in its session, to be answered in order with
+// any prompts already waiting there, as prompts taken while Ollama was
+// unreachable are. It fails once the session or conversation is gone.
+func runSchedule(p ScheduledPrompt) error {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	id := p.Session
+	if moved, ok := rotatedSessions[id]; ok {
+		id = moved
+	}
+	if _, ok := sessions[id]; !ok {
+		s := loadSession(id)
+		if s == nil {
+			return errors.New("its session has expired")
+		}
+		sessions[id] = s
+		enforceSessionCaps(s)
+	}
+	s := getSession(id)
+	if s.conversationIndex(p.Conversation) < 0 {
+		return errUnknownConversation
+	}
+	s.Pending = append(s.Pending, PendingPrompt{Conversation: p.Conversation, Message: Message{Role: "user", Content: p.Prompt}, Queued: time.Now()})
+	go sendPending(id)
+	return nil
+}
+
+// Copies of the schedules, of one session or, when sessionID is empty,
+// all of them, newest first
+func scheduleSnapshot(sessionID string) []ScheduledPrompt {
+	scheduleMut.Lock()
+	defer scheduleMut.Unlock()
+	var list []ScheduledPrompt
+	for i := len(scheduledPrompts) - 1; i >= 0; i-- {
+		p := *scheduledPrompts[i]
+		if sessionID != "" && p.Session != sessionID {
+			continue
+		}
+		p.NextRuns = p.nextRuns(schedulePreviewRuns)
+		list = append(list, p)
+	}
+	return list
+}
+
+// SessionHash identifies the schedule's session on the admin page without
+// giving away its ID
+func (p ScheduledPrompt) SessionHash() string {
+	return sessionHash(p.Session)
+}
+
+// DayNames lists the weekdays a schedule runs on
+func (p ScheduledPrompt) DayNames() string {
+	if len(p.Days) == 0 {
+		return "every day"
+	}
+	names := make([]string, len(p.Days))
+	for i, d := range p.Days {
+		names[i] = titleCase(weekdayNames[d])
+	}
+	return strings.Join(names, ", ")
+}
+
+// SchedulesPage is the data for schedules.html
+type SchedulesPage struct {
+	Schedules     []ScheduledPrompt
+	Conversations []ConversationInfo
+	Active        int
+	TimeZone      string // the session's, the default for new schedules
+	Weekdays      []string
+	Error         string
+}
+
+// Schedule page: GET lists the session's scheduled prompts with their next
+// runs; POST action=schedule (prompt, at, days, once, time_zone,
+// conversation) or action=cancel (id)
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	page := func() SchedulesPage {
+		sessionMut.Lock()
+		defer sessionMut.Unlock()
+		s := getSession(sessionID)
+		return SchedulesPage{Schedules: scheduleSnapshot(sessionID), Conversations: append([]ConversationInfo(nil), s.Conversations...),
+			Active: s.Active, TimeZone: s.TimeZone, Weekdays: weekdayNames}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		renderPage(w, r, "schedules.html", page())
+	case http.MethodPost:
+		var err error
+		switch r.FormValue("action") {
+		case "schedule":
+			err = scheduleFromForm(r, sessionID)
+		case "cancel":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			if !cancelSchedule(id, sessionID) {
+				http.Error(w, "No such schedule", http.StatusNotFound)
+				return
+			}
+		default:
+			err = errors.New("unknown schedule action")
+		}
+		if err != nil {
+			data := page()
+			data.Error = err.Error()
+			renderPageStatus(w, r, http.StatusBadRequest, "schedules.html", data)
+			return
+		}
+		redirect(w, r, "/schedules", http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func scheduleFromForm(r *http.Request, sessionID string) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	days, err := parseWeekdays(r.Form["days"])
+	if err != nil {
+		return err
+	}
+	sessionMut.Lock()
+	s := getSession(sessionID)
+	conv := s.Active
+	if v := r.FormValue("conversation"); v != "" {
+		conv, _ = strconv.Atoi(v)
+	}
+	known := s.conversationIndex(conv) >= 0
+	sessionMut.Unlock()
+	if !known {
+		return errUnknownConversation
+	}
+	_, err = schedulePrompt(sessionID, conv, r.FormValue("prompt"), r.FormValue("at"), days, r.FormValue("once") != "",
+		strings.TrimSpace(r.FormValue("time_zone")))
+	return err
+}
+
+// Admin form for scheduled prompts: action=cancel (id), back to the admin
+// page
+func adminSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("action") != "cancel" {
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	if !cancelSchedule(id, "") {
+		http.Error(w, "No such schedule", http.StatusNotFound)
+		return
+	}
+	redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// The API service layer. The HTTP JSON API and the gRPC server both
+// translate their requests into these calls, so validation, defaults and
+// Ollama access behave the same whichever protocol a client uses.
+
+const maxEmbeddingInputs = 256
+
+// Invalid API requests; transports map these to 400 / InvalidArgument
+var errInvalidRequest = errors.New("invalid request")
+
+// ChatParams is a transport-neutral chat request
+type ChatParams struct {
+	Model    string
+	Messages []Message
+	Options  map[string]interface{} // passed to Ollama within the configured limits
+	// Set by validate: how the option limits changed Options, for the caller
+	Notices []string
+}
+
+// Apply defaults and check the request is one Ollama can answer
+func (p *ChatParams) validate(ctx context.Context) error {
+	if p.Model == "" {
+		p.Model = defaultModelFor(ctx)
+	}
+	if err := checkModelAllowed(ctx, p.Model); err != nil {
+		return err
+	}
+	var notices []string
+	p.Options, notices = limitOptions(p.Options)
+	p.Notices = append(p.Notices, notices...)
+	if len(p.Messages) == 0 {
+		return fmt.Errorf("%w: messages are required", errInvalidRequest)
+	}
+	for i, m := range p.Messages {
+		switch m.Role {
+		case "system", "user", "assistant", "tool":
+		default:
+			return fmt.Errorf("%w: message %d has unknown role %q", errInvalidRequest, i, m.Role)
+		}
+	}
+	return nil
+}
+
+// Chat returns the model's complete reply
+func serviceChat(ctx context.Context, p ChatParams) (Message, error) {
+	if err := p.validate(ctx); err != nil {
+		return Message{}, err
+	}
+	reply, err := ollamaComplete(ctx, OllamaChatRequest{Model: p.Model, Messages: p.Messages, Options: p.Options})
+	if err != nil {
+		return Message{}, err
+	}
+	return assistantReply(ctx, reply), nil
+}
+
+// Stream the model's reply to onChunk, returning the full text
+func serviceStreamChat(ctx context.Context, p ChatParams, onChunk func(string)) (string, error) {
+	if err := p.validate(ctx); err != nil {
+		return "", err
+	}
+	return ollamaStream(ctx, OllamaChatRequest{Model: p.Model, Messages: p.Messages, Options: p.Options}, onChunk)
+}
+
+// List the installed models the config allows
+func serviceListModels(ctx context.Context) ([]OllamaModel, error) {
+	models, err := ollamaListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allowed := models[:0]
+	for _, m := range models {
+		if modelAllowed(ctx, m.Name) {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed, nil
+}
+
+// Embed each input with the given model
+func serviceEmbeddings(ctx context.Context, model string, input []string) ([][]float32, error) {
+	if model == "" {
+		model = defaultModelFor(ctx)
+	}
+	if err := checkModelAllowed(ctx, model); err != nil {
+		return nil, err
+	}
+	if len(input) == 0 {
+		return nil, fmt.Errorf("%w: input is required", errInvalidRequest)
+	}
+	if len(input) > maxEmbeddingInputs {
+		return nil, fmt.Errorf("%w: at most %d inputs per request", errInvalidRequest, maxEmbeddingInputs)
+	}
+	return ollamaEmbed(ctx, model, input)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// session is the server-side state behind one session cookie
+type session struct {
+	id          string
+	fingerprint string // hash of the User-Agent the session is bound to
+
+	// Append-only log of chat changes, and the active conversation's
+	// history projected from it. History must only change through record.
+	Events        []MessageEvent
+	History       []Message
+	nextMessageID int
+	LastActive    time.Time // when the chat last changed
+	lastSeen      time.Time // when a request last used the session
+	stale         bool      // another instance has changed the stored log
+	oldIDs        []string  // IDs it had before rotations, in rotatedSessions
+
+	// Named conversations, oldest first, and the one the chat continues
+	Conversations []ConversationInfo
+	Active        int
+
+	// Rendered HTML of history messages, keyed by message ID
+	rendered map[int]renderedMessage
+
+	// Reply being generated for the /ws chat socket, and the number of
+	// replies started so far (their IDs)
+	live        *liveReply
+	liveReplies int
+
+	// Other replies in progress, by a running count, for /chat/stop
+	generations    map[int]context.CancelFunc
+	lastGeneration int
+
+	// Prompts taken while Ollama was unreachable, oldest first, and whether
+	// they are being sent
+	Pending        []PendingPrompt
+	sendingPending bool
+
+	// Focus mode: summarise the conversation once it goes idle or is closed
+	Focus bool
+	// By conversation, ID of the newest message covered by its last
+	// summary, or of the last message before the focus session started
+	SummarizedID map[int]int
+
+	// Journal mode: one conversation per day, keyed by "2006-01-02", and
+	// when each day's last message was added
+	Journal        map[string][]Message
+	JournalUpdated map[string]time.Time
+
+	// Most recently generated flashcard deck
+	Flashcards []Flashcard
+
+	// Roleplay scenario runs, oldest first; run IDs are 1-based indexes
+	Scenarios []*ScenarioRun
+
+	// Multi-agent conversations, oldest first; IDs are 1-based indexes
+	Agents []*AgentConversation
+
+	// Set when the chat log is encrypted with the user's passphrase
+	Transcript *transcriptLock
+
+	// Variables MCP tools can use, sealed with the -vars-key cipher
+	Variables map[string][]byte
+
+	// Judge-scored evaluation runs, oldest first; IDs are 1-based indexes
+	Evals []*EvalRun
+
+	// Tokens of the read-only links to shared conversations, by
+	// conversation ID
+	Shared map[int]string
+
+	// How pages format times and numbers, from /settings: a locale tag,
+	// empty to follow the browser, and an IANA time zone, empty for the
+	// server's
+	Locale   string
+	TimeZone string
+
+	// Leave out the collapsed reasoning shown above replies
+	HideReasoning bool
+}
+
+// Sessions in use, loaded from the session store on first access
+var (
+	sessions   = make(map[string]*session)
+	sessionMut sync.Mutex
+)
+
+// Refuse session cookies sent by a User-Agent other than the one the
+// session started with; set by -session-bind-ua
+var bindSessionUA bool
+
+// Old IDs of rotated sessions and the IDs they moved to, so work started
+// under an old ID, such as a reply still generating, lands in the session.
+// Cookies with an old ID are not accepted. Entries go when their session
+// leaves memory.
+var rotatedSessions = map[string]string{}
+
+// Look up a session, creating it on first use. Callers must hold sessionMut.
+func getSession(id string) *session {
+	if moved, ok := rotatedSessions[id]; ok {
+		id = moved
+	}
+	s, ok := sessions[id]
+	if !ok {
+		if s = loadSession(id); s == nil {
+			s = &session{id: id, LastActive: time.Now()}
+			s.project()
+		}
+		sessions[id] = s
+		enforceSessionCaps(s)
+	} else if s.stale {
+		s.refresh()
+	}
+	return s
+}
+
+// Whether a session ID from a cookie may be used: the server must have
+// issued it and still have it, in memory or in the store, and with
+// bindSessionUA the request must come from the same User-Agent. A session
+// loaded from the store is bound to the first User-Agent seen after the
+// load. Callers must hold sessionMut.
+func acceptSession(id string, r *http.Request) bool {
+	s, ok := sessions[id]
+	if !ok {
+		if s = loadSession(id); s == nil {
+			return false
+		}
+		sessions[id] = s
+		enforceSessionCaps(s)
+	}
+	fingerprint := sessionFingerprint(r)
+	if s.fingerprint == "" {
+		s.fingerprint = fingerprint
+	}
+	if bindSessionUA && s.fingerprint != fingerprint {
+		return false
+	}
+	s.lastSeen = time.Now()
+	return true
+}
+
+func sessionFingerprint(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.UserAgent()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// The session ID a request's cookie carries, when it is accepted
+func cookieSessionID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookieName(tenantName(requestTenant(r))))
+	if err != nil || strings.Contains(cookie.Value, "/") {
+		// A slash would reach into another tenant's sessions
+		return "", false
+	}
+	id := scopedSessionID(r, cookie.Value)
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	return id, acceptSession(id, r)
+}
+
+// Start a session with a fresh ID and send its cookie
+func newSession(w http.ResponseWriter, r *http.Request) string {
+	id := scopedSessionID(r, generateSessionID())
+	sessionMut.Lock()
+	s := getSession(id)
+	s.fingerprint, s.lastSeen = sessionFingerprint(r), time.Now()
+	sessionMut.Unlock()
+	setSessionCookie(w, id)
+	return id
+}
+
+func setSessionCookie(w http.ResponseWriter, id string) {
+	tenant, _, _ := strings.Cut(id, "/")
+	if tenant == id {
+		tenant = ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName(tenant),
+		Value:    cookieValue(id),
+		Expires:  time.Now().Add(sessionLifetime),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Move a session to a fresh ID when what its cookie grants changes, such
+// as on unlocking an encrypted transcript, so an ID planted or seen before
+// is of no use. The old ID is dropped from memory and the store. Returns
+// the ID the session now has; the old one if the store could not be
+// updated.
+func rotateSession(w http.ResponseWriter, r *http.Request, oldID string) string {
+	newID := scopedSessionID(r, generateSessionID())
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	s := getSession(oldID)
+	oldID = s.id
+	events := s.Events
+	if s.Transcript != nil {
+		events = s.Transcript.sealed
+	}
+	storeWrites.flush()
+	if err := store.Replace(newID, events, s.LastActive); err != nil {
+		log.Printf("Session rotation error: %v", err)
+		return oldID
+	}
+	if err := store.Delete(oldID); err != nil {
+		log.Printf("Session rotation error: %v", err)
+	}
+	delete(sessions, oldID)
+	s.id = newID
+	s.fingerprint = sessionFingerprint(r)
+	sessions[newID] = s
+	s.oldIDs = append(s.oldIDs, oldID)
+	for _, old := range s.oldIDs {
+		rotatedSessions[old] = newID
+	}
+	moveSchedules(oldID, newID)
+	setSessionCookie(w, newID)
+	return newID
+}
+
+// Take a session out of memory, together with its share links and the old
+// IDs that lead to it. Callers must hold sessionMut.
+func (s *session) forget() {
+	s.unshareAll()
+	delete(sessions, s.id)
+	for _, old := range s.oldIDs {
+		delete(rotatedSessions, old)
+	}
+	s.oldIDs = nil
+}
+
+// Append a message to the active conversation and mark the session
+// active, as appendTo. Callers must hold sessionMut.
+func (s *session) append(msg Message) error {
+	return s.appendTo(s.Active, msg)
+}
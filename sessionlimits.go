@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Caps on what sessions may hold in memory, so many visitors cannot run
+// the server out of it; 0 for no cap. Past maxSessions sessions or
+// maxMessages messages in all their logs, the least recently used
+// sessions are evicted. A session holding sessionMessageLimit messages
+// takes no more prompts. Set by -max-sessions, -max-messages and
+// -session-messages.
+var (
+	maxSessions         int
+	maxMessages         int
+	sessionMessageLimit int
+)
+
+// Returned for a prompt or import to a session holding sessionMessageLimit
+// messages
+var errSessionFull = errors.New("session full")
+
+// Counts of sessions evicted and prompts refused since the server started,
+// for the admin page and logs
+var sessionEvictions struct {
+	idle, lru, refused atomic.Int64
+}
+
+// SessionMemory is what sessions hold in memory, for the admin page
+type SessionMemory struct {
+	Sessions, Messages       int
+	MaxSessions, MaxMessages int
+	SessionMessageLimit      int
+	EvictedIdle, EvictedLRU  int64
+	Refused                  int64 // prompts refused for a full session
+}
+
+func sessionMemory() SessionMemory {
+	sessionMut.Lock()
+	m := SessionMemory{Sessions: len(sessions), MaxSessions: maxSessions, MaxMessages: maxMessages, SessionMessageLimit: sessionMessageLimit}
+	for _, s := range sessions {
+		m.Messages += s.nextMessageID
+	}
+	sessionMut.Unlock()
+	m.EvictedIdle, m.EvictedLRU = sessionEvictions.idle.Load(), sessionEvictions.lru.Load()
+	m.Refused = sessionEvictions.refused.Load()
+	return m
+}
+
+// Whether a session has a reply generating, prompts queued or an unlocked
+// transcript in use, and so must stay in memory. Callers must hold sessionMut.
+func (s *session) busy() bool {
+	return s.live != nil || len(s.generations) > 0 || len(s.Pending) > 0 || (s.Transcript != nil && s.Transcript.holders > 0)
+}
+
+// When a request last used or changed the session
+func (s *session) lastUsed() time.Time {
+	if s.lastSeen.After(s.LastActive) {
+		return s.lastSeen
+	}
+	return s.LastActive
+}
+
+// Take a session out of memory, and out of the store as well with
+// discardIdleSessions. Callers must hold sessionMut.
+func evictSession(id string, s *session) error {
+	if discardIdleSessions {
+		storeWrites.flush()
+		if err := store.Delete(id); err != nil {
+			return err
+		}
+	}
+	s.forget()
+	return nil
+}
+
+// Set while evictOverCaps runs, so new sessions and messages start it at
+// most once at a time
+var capsEnforcing atomic.Bool
+
+// Evict sessions in the background when those in memory may be past
+// maxSessions or maxMessages. Only the cheap check runs here, on every new
+// session and message; the scan and sort are left to evictOverCaps, which
+// spares keep. Callers must hold sessionMut.
+func enforceSessionCaps(keep *session) {
+	if maxSessions <= 0 && maxMessages <= 0 {
+		return
+	}
+	if maxMessages <= 0 && len(sessions) <= maxSessions {
+		return
+	}
+	if capsEnforcing.CompareAndSwap(false, true) {
+		go evictOverCaps(keep.id)
+	}
+}
+
+// Evict the least recently used sessions, other than keep, until those in
+// memory are within maxSessions and maxMessages. sessionMut is held only to
+// list the sessions and to evict them, not while they are sorted; a session
+// used since it was listed stays.
+func evictOverCaps(keep string) {
+	defer capsEnforcing.Store(false)
+	type candidate struct {
+		id       string
+		s        *session
+		lastUsed time.Time
+	}
+	sessionMut.Lock()
+	count, total := len(sessions), 0
+	candidates := make([]candidate, 0, len(sessions))
+	for id, s := range sessions {
+		total += s.nextMessageID
+		if id != keep && !s.busy() {
+			candidates = append(candidates, candidate{id, s, s.lastUsed()})
+		}
+	}
+	sessionMut.Unlock()
+	over := func() bool {
+		return (maxSessions > 0 && count > maxSessions) || (maxMessages > 0 && total > maxMessages)
+	}
+	if !over() {
+		return
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed.Before(candidates[j].lastUsed) })
+
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	n := 0
+	for _, c := range candidates {
+		if !over() {
+			break
+		}
+		if sessions[c.id] != c.s || c.s.busy() || c.s.lastUsed().After(c.lastUsed) {
+			continue
+		}
+		if err := evictSession(c.id, c.s); err != nil {
+			log.Printf("Session eviction error: %v", err)
+			continue
+		}
+		count--
+		total -= c.s.nextMessageID
+		n++
+	}
+	if n > 0 {
+		sessionEvictions.lru.Add(int64(n))
+		log.Printf("Evicted %d least recently used sessions to stay within the memory caps", n)
+	}
+}
+
+// Messages in the session's conversations
+func (s *session) messageCount() int {
+	n := len(s.History)
+	for _, c := range s.Conversations {
+		if c.ID != s.Active {
+			n += len(projectHistory(s.Events, c.ID))
+		}
+	}
+	return n
+}
+
+// An errSessionFull error when adding n messages would take the session
+// past sessionMessageLimit. Callers must hold sessionMut.
+func (s *session) checkMessageLimit(n int) error {
+	if sessionMessageLimit <= 0 {
+		return nil
+	}
+	if held := s.messageCount(); held+n > sessionMessageLimit {
+		sessionEvictions.refused.Add(1)
+		return fmt.Errorf("%w: this session holds %d messages, the most allowed is %d; delete a conversation to make room",
+			errSessionFull, held, sessionMessageLimit)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Newest messages listed in a shared conversation's feed
+const maxFeedEntries = 50
+
+var errEncryptedShare = errors.New("an encrypted chat can't be shared")
+
+// Sessions by the tokens of their read-only conversation links. Links live
+// as long as the session stays in memory. Guarded by sessionMut.
+var shareLinks = map[string]*session{}
+
+// Give a conversation a read-only link, keeping the one it has, and return
+// its token. Callers must hold sessionMut.
+func (s *session) shareConversation(id int) (string, error) {
+	if s.conversationIndex(id) < 0 {
+		return "", errUnknownConversation
+	}
+	if s.Transcript != nil {
+		return "", errEncryptedShare
+	}
+	if token := s.Shared[id]; token != "" {
+		return token, nil
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if s.Shared == nil {
+		s.Shared = make(map[int]string)
+	}
+	s.Shared[id] = token
+	shareLinks[token] = s
+	return token, nil
+}
+
+// Revoke a conversation's read-only link, if it has one. Callers must hold
+// sessionMut.
+func (s *session) unshareConversation(id int) {
+	if token, ok := s.Shared[id]; ok {
+		delete(shareLinks, token)
+		delete(s.Shared, id)
+	}
+}
+
+// Revoke all of a session's links, as when it is forgotten. Callers must
+// hold sessionMut.
+func (s *session) unshareAll() {
+	for id := range s.Shared {
+		s.unshareConversation(id)
+	}
+}
+
+// The session and conversation a link token opens. Callers must hold
+// sessionMut.
+func sharedConversation(token string) (*session, int, bool) {
+	s, ok := shareLinks[token]
+	if !ok || s.Transcript != nil {
+		return nil, 0, false
+	}
+	for id, t := range s.Shared {
+		if t == token {
+			return s, id, true
+		}
+	}
+	return nil, 0, false
+}
+
+// SharedPage holds data for a shared conversation's read-only page
+type SharedPage struct {
+	Title   string
+	Token   string
+	History []MessageView
+	L       Localizer
+}
+
+// Atom feed of a shared conversation, RFC 4287
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// When each message of a conversation last changed: added, edited or
+// regenerated, by message ID
+func messageUpdates(events []MessageEvent, conv int) map[int]time.Time {
+	updated := make(map[int]time.Time)
+	for _, ev := range events {
+		switch ev.Type {
+		case EventAdded, EventEdited, EventRegenerated:
+			if ev.Conversation == conv {
+				updated[ev.MessageID] = ev.Time
+			}
+		}
+	}
+	return updated
+}
+
+// A conversation's messages as feed entries, newest first. Replies carry
+// their rendered HTML, other messages their text.
+func feedEntries(history []Message, updated map[int]time.Time, base string) ([]atomEntry, time.Time) {
+	var entries []atomEntry
+	var newest time.Time
+	for i := len(history) - 1; i >= 0 && len(entries) < maxFeedEntries; i-- {
+		m := history[i]
+		if m.Role != "user" && m.Role != "assistant" {
+			continue
+		}
+		at := updated[m.ID]
+		if at.After(newest) {
+			newest = at
+		}
+		title := strings.Join(strings.Fields(m.Content), " ")
+		if r := []rune(title); len(r) > 80 {
+			title = string(r[:80]) + "…"
+		}
+		content := atomContent{Type: "text", Body: m.Content}
+		if m.Role == "assistant" {
+			content = atomContent{Type: "html", Body: string(markdownHTML(m.Content))}
+		}
+		link := base + "#message-" + strconv.Itoa(m.ID)
+		entries = append(entries, atomEntry{Title: titleCase(m.Role) + ": " + title, ID: link,
+			Updated: at.UTC().Format(time.RFC3339), Link: atomLink{Href: link}, Content: content})
+	}
+	return entries, newest
+}
+
+// GET /shared/<token>: a shared conversation, read only, and
+// /shared/<token>/atom its Atom feed
+func sharedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, format, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/shared/"), "/")
+	if format != "" && format != "atom" {
+		http.NotFound(w, r)
+		return
+	}
+
+	sessionMut.Lock()
+	sess, conv, ok := sharedConversation(token)
+	var title string
+	var history []Message
+	var updated map[int]time.Time
+	if ok {
+		title = sess.Conversations[sess.conversationIndex(conv)].Title
+		history = projectHistory(sess.Events, conv)
+		updated = messageUpdates(sess.Events, conv)
+	}
+	sessionMut.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if format == "" {
+		page := SharedPage{Title: title, Token: token, L: requestLocalizer(r)}
+		for i, m := range history {
+			if m.Role == "user" || m.Role == "assistant" {
+				page.History = append(page.History, MessageView{Message: m, Index: i, Time: updated[m.ID]})
+			}
+		}
+		renderPage(w, r, "shared.html", page)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	base := scheme + "://" + r.Host + "/shared/" + token
+	entries, newest := feedEntries(history, updated, base)
+	if newest.IsZero() {
+		newest = time.Now()
+	}
+	feed := atomFeed{Title: title, ID: base, Updated: newest.UTC().Format(time.RFC3339),
+		Author: atomAuthor{Name: "DeepSeek chat"}, Entries: entries,
+		Links: []atomLink{{Rel: "self", Type: "application/atom+xml", Href: base + "/atom"}, {Rel: "alternate", Type: "text/html", Href: base}}}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Printf("Atom feed error: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// How long a shutdown waits for requests and replies still generating
+// before stopping them; set by -shutdown-timeout
+var shutdownTimeout = 30 * time.Second
+
+// Time stopped replies get to save what they have, after shutdownTimeout
+const stopGrace = 2 * time.Second
+
+// Serve HTTP on lis until a signal arrives on stop, then shut down: new
+// connections are refused, requests in progress and replies still
+// generating for the chat socket get shutdownTimeout to finish, and any
+// left are stopped so their partial text is saved. The session store is
+// closed by the caller.
+func runServer(srv *http.Server, lis net.Listener, stop <-chan os.Signal) error {
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(lis) }()
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stop:
+		log.Printf("Received %v; shutting down, waiting up to %v for requests in progress", sig, shutdownTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	grpcStopped := stopGRPCServer(ctx)
+	err := srv.Shutdown(ctx)
+	if !waitForGenerations(ctx) {
+		log.Printf("Stopping the replies still generating")
+		stopAllGenerations()
+		grace, cancel := context.WithTimeout(context.Background(), stopGrace)
+		defer cancel()
+		waitForGenerations(grace)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		srv.Close()
+		err = nil
+	}
+	<-grpcStopped
+	if e := <-served; !errors.Is(e, http.ErrServerClosed) {
+		return e
+	}
+	return err
+}
+
+// Wait until no generation holds or waits for an Ollama slot, such as a
+// reply for the chat socket, which outlives its request. Reports whether
+// that happened before ctx ended.
+func waitForGenerations(ctx context.Context) bool {
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		active, waiting := generations.stats()
+		for _, n := range waiting {
+			active += n
+		}
+		if active == 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-tick.C:
+		}
+	}
+}
+
+// Cancel every session's replies in progress, which keeps their partial
+// text as when the user stops them
+func stopAllGenerations() {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	for _, s := range sessions {
+		if s.live != nil {
+			s.live.cancel()
+		}
+		for _, cancel := range s.generations {
+			cancel()
+		}
+	}
+}
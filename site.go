@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SiteMessage is a message of a conversation page in a site export
+type SiteMessage struct {
+	MessageView
+	ImageFiles []string // attachments, relative to the page
+}
+
+// SiteConversation is one page of a site export
+type SiteConversation struct {
+	Title    string
+	File     string // page file name in the bundle
+	Messages []SiteMessage
+	Exported time.Time
+	L        Localizer
+}
+
+// SiteIndex is the front page of a site export, listing its conversations
+type SiteIndex struct {
+	Conversations []SiteConversation
+	Exported      time.Time
+	L             Localizer
+}
+
+// File extensions for image attachments by detected type
+var siteImageTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// The conversations to export, by ID in the order given; all of them when
+// none are. Callers must hold sessionMut.
+func (s *session) siteConversations(ids []int) ([]SiteConversation, map[string][]byte, error) {
+	if len(ids) == 0 {
+		for _, c := range s.Conversations {
+			ids = append(ids, c.ID)
+		}
+	}
+	var convs []SiteConversation
+	images := make(map[string][]byte)
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		i := s.conversationIndex(id)
+		if i < 0 {
+			return nil, nil, errUnknownConversation
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		conv := SiteConversation{Title: s.Conversations[i].Title,
+			File: fmt.Sprintf("%d-%s.html", id, exportFileName(s.Conversations[i].Title))}
+		times := messageTimes(s.Events, id)
+		for n, m := range projectHistory(s.Events, id) {
+			if m.Role != "user" && m.Role != "assistant" {
+				continue
+			}
+			msg := SiteMessage{MessageView: MessageView{Message: m, Index: n, Time: times[m.ID]}}
+			if m.Role == "assistant" {
+				msg.HTML = markdownHTML(m.Content)
+			}
+			for k, img := range m.Images {
+				data, err := base64.StdEncoding.DecodeString(img)
+				ext, ok := siteImageTypes[http.DetectContentType(data)]
+				if err != nil || !ok {
+					continue // not an image a browser shows
+				}
+				name := fmt.Sprintf("assets/images/%d-%d-%d%s", id, m.ID, k, ext)
+				images[name] = data
+				msg.ImageFiles = append(msg.ImageFiles, name)
+			}
+			conv.Messages = append(conv.Messages, msg)
+		}
+		convs = append(convs, conv)
+	}
+	return convs, images, nil
+}
+
+// Write a site export: an index page, a page per conversation, the style
+// sheet and the other assets, by path in the bundle. The pages run no
+// scripts, so the bundle can be published on any static host.
+func writeSite(w *zip.Writer, tmpl *template.Template, index SiteIndex, assets map[string][]byte) error {
+	css, err := os.ReadFile(filepath.Join(staticDir, "style.css"))
+	if err != nil {
+		return err
+	}
+	assets["assets/style.css"] = css
+
+	create := func(name string) (io.Writer, error) {
+		return w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: index.Exported})
+	}
+	page := func(name, tmplName string, data interface{}) error {
+		f, err := create(name)
+		if err != nil {
+			return err
+		}
+		return tmpl.ExecuteTemplate(f, tmplName, data)
+	}
+	if err := page("index.html", "site_index.html", index); err != nil {
+		return err
+	}
+	for _, c := range index.Conversations {
+		if err := page(c.File, "site_conversation.html", c); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(assets))
+	for name := range assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, err := create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(assets[name]); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// GET /export/site: download chosen conversations as a static website in a
+// zip, from repeated ?conversation= IDs, or every conversation without any
+func siteExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := getSessionID(w, r)
+	var ids []int
+	for _, v := range r.URL.Query()["conversation"] {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	convs, images, err := sess.siteConversations(ids)
+	index := SiteIndex{Conversations: convs, Exported: time.Now(), L: sess.localizer(r)}
+	sessionMut.Unlock()
+	if err != nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	for i := range index.Conversations {
+		index.Conversations[i].Exported, index.Conversations[i].L = index.Exported, index.L
+	}
+
+	tmpl, err := loadedTemplates("")
+	if err != nil {
+		http.Error(w, "Error rendering the export", http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="conversations-site.zip"`)
+	// Headers are sent with the first file, so a failure can only be logged
+	if err := writeSite(zip.NewWriter(w), tmpl, index, images); err != nil {
+		log.Printf("Site export error: %v", err)
+	}
+}
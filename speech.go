@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+const maxVoiceClipBytes = 10 << 20
+
+// Speech services speaking the OpenAI audio API, e.g. a local whisper or
+// piper server. Leaving ttsURL empty disables spoken replies.
+var (
+	sttURL   string
+	sttModel = "whisper-1"
+	ttsURL   string
+	ttsModel = "tts-1"
+	ttsVoice = "alloy"
+
+	speechClient = &http.Client{}
+)
+
+var errSpeechNotConfigured = errors.New("speech-to-text service is not configured")
+
+// VoiceReply is the response of the voice API
+type VoiceReply struct {
+	Transcript string `json:"transcript"`
+	Reply      string `json:"reply"`
+	Audio      string `json:"audio,omitempty"` // base64
+	AudioType  string `json:"audio_type,omitempty"`
+}
+
+// POST /api/v1/voice: a short audio clip (multipart field "audio") in,
+// its transcript and the model's reply out. With speak=true the reply is
+// also synthesised to speech. Each call is a single stateless turn.
+func voiceAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if sttURL == "" {
+		writeAPIError(w, http.StatusServiceUnavailable, errSpeechNotConfigured.Error())
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxVoiceClipBytes)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		writeAPIError(w, submissionStatus(classifyBodyError(err)), "expected a multipart upload with an audio field")
+		return
+	}
+	file, header, err := r.FormFile("audio")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "audio field is required")
+		return
+	}
+	defer file.Close()
+
+	transcript, err := transcribe(r.Context(), file, header.Filename)
+	if err != nil {
+		log.Printf("Transcription error: %v", err)
+		writeAPIError(w, http.StatusBadGateway, "transcription failed")
+		return
+	}
+	out := VoiceReply{Transcript: transcript}
+	if transcript == "" {
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+
+	model := r.FormValue("model")
+	if model == "" {
+		model = defaultModelFor(r.Context())
+	}
+	reply, err := ollamaComplete(r.Context(), OllamaChatRequest{
+		Model:    model,
+		Messages: []Message{{Role: "user", Content: transcript}},
+	})
+	if err != nil {
+		log.Printf("Voice API Ollama error: %v", err)
+		writeAPIError(w, http.StatusBadGateway, "error communicating with Ollama")
+		return
+	}
+	out.Reply = strings.TrimSpace(thinkBlock.ReplaceAllString(reply, ""))
+
+	if r.FormValue("speak") == "true" && ttsURL != "" {
+		audio, contentType, err := synthesize(r.Context(), speakable(out.Reply))
+		if err != nil {
+			log.Printf("Speech synthesis error: %v", err)
+			writeAPIError(w, http.StatusBadGateway, "speech synthesis failed")
+			return
+		}
+		out.Audio = base64.StdEncoding.EncodeToString(audio)
+		out.AudioType = contentType
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// Send a clip to the speech-to-text service
+func transcribe(ctx context.Context, audio io.Reader, filename string) (string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("model", sttModel)
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, audio); err != nil {
+		return "", err
+	}
+	mw.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(sttURL, "/")+"/v1/audio/transcriptions", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := speechClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("speech-to-text service returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// Turn text into speech with the text-to-speech service
+func synthesize(ctx context.Context, text string) ([]byte, string, error) {
+	reqJSON, err := json.Marshal(map[string]string{"model": ttsModel, "voice": ttsVoice, "input": text})
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(ttsURL, "/")+"/v1/audio/speech", bytes.NewReader(reqJSON))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := speechClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("text-to-speech service returned status %d", resp.StatusCode)
+	}
+
+	audio, err := io.ReadAll(io.LimitReader(resp.Body, maxVoiceClipBytes))
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "audio/mpeg"
+	}
+	return audio, contentType, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id          TEXT PRIMARY KEY,
+	created_at  INTEGER NOT NULL,
+	last_active INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS messages (
+	session_id   TEXT    NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+	seq          INTEGER NOT NULL,
+	type         TEXT    NOT NULL,
+	created_at   INTEGER NOT NULL,
+	message_id   INTEGER NOT NULL DEFAULT 0,
+	message      TEXT,
+	content      TEXT    NOT NULL DEFAULT '',
+	target       INTEGER NOT NULL DEFAULT 0,
+	conversation INTEGER NOT NULL DEFAULT 0,
+	reasoning    TEXT    NOT NULL DEFAULT '',
+	cost         REAL    NOT NULL DEFAULT 0,
+	backend      TEXT    NOT NULL DEFAULT '',
+	PRIMARY KEY (session_id, seq)
+);
+CREATE INDEX IF NOT EXISTS sessions_last_active ON sessions(last_active);
+CREATE TABLE IF NOT EXISTS login_failures (
+	key   TEXT PRIMARY KEY,
+	count INTEGER NOT NULL,
+	ends  INTEGER NOT NULL
+);
+`
+
+// sqliteStore keeps sessions and their chat logs in a SQLite file: one
+// sessions row each, and one messages row per history event. Times are
+// Unix nanoseconds.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		return nil, errors.New("sqlite session store needs a file, e.g. sqlite:sessions.db")
+	}
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// One writer at a time; SQLite would lock anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// Files from before conversations, before reasoning was kept apart from
+	// replies, or before fallback costs and backends, lack the columns
+	for _, column := range []string{"conversation INTEGER NOT NULL DEFAULT 0", "reasoning TEXT NOT NULL DEFAULT ''",
+		"cost REAL NOT NULL DEFAULT 0", "backend TEXT NOT NULL DEFAULT ''"} {
+		if _, err := db.Exec(`ALTER TABLE messages ADD COLUMN ` + column); err != nil &&
+			!strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Load(id string) ([]MessageEvent, time.Time, bool, error) {
+	var lastActive int64
+	err := s.db.QueryRow(`SELECT last_active FROM sessions WHERE id = ?`, id).Scan(&lastActive)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, false, nil
+	} else if err != nil {
+		return nil, time.Time{}, false, err
+	}
+
+	rows, err := s.db.Query(`SELECT seq, type, created_at, message_id, message, content, target, conversation, reasoning, cost, backend
+		FROM messages WHERE session_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	defer rows.Close()
+	var events []MessageEvent
+	for rows.Next() {
+		var ev MessageEvent
+		var created int64
+		var msg sql.NullString
+		if err := rows.Scan(&ev.Seq, &ev.Type, &created, &ev.MessageID, &msg, &ev.Content, &ev.Target, &ev.Conversation, &ev.Reasoning, &ev.Cost, &ev.Backend); err != nil {
+			return nil, time.Time{}, false, err
+		}
+		ev.Time = time.Unix(0, created)
+		if msg.Valid {
+			ev.Message = new(Message)
+			if err := json.Unmarshal([]byte(msg.String), ev.Message); err != nil {
+				return nil, time.Time{}, false, err
+			}
+			ev.Message.ID = ev.MessageID
+		}
+		events = append(events, ev)
+	}
+	return events, time.Unix(0, lastActive), true, rows.Err()
+}
+
+func (s *sqliteStore) Append(id string, ev MessageEvent, lastActive time.Time) error {
+	return s.write(id, false, []MessageEvent{ev}, lastActive)
+}
+
+func (s *sqliteStore) Replace(id string, events []MessageEvent, lastActive time.Time) error {
+	return s.write(id, true, events, lastActive)
+}
+
+// Add events to a session's log in one transaction, after clearing the log
+// when replace is set
+func (s *sqliteStore) write(id string, replace bool, events []MessageEvent, lastActive time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO sessions (id, created_at, last_active) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET last_active = excluded.last_active`,
+		id, time.Now().UnixNano(), lastActive.UnixNano()); err != nil {
+		return err
+	}
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM messages WHERE session_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	for _, ev := range events {
+		var msg sql.NullString
+		if ev.Message != nil {
+			b, err := json.Marshal(ev.Message)
+			if err != nil {
+				return err
+			}
+			msg = sql.NullString{String: string(b), Valid: true}
+		}
+		if _, err := tx.Exec(`INSERT INTO messages (session_id, seq, type, created_at, message_id, message, content, target, conversation, reasoning, cost, backend)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, ev.Seq, ev.Type, ev.Time.UnixNano(), ev.MessageID, msg, ev.Content, ev.Target, ev.Conversation, ev.Reasoning, ev.Cost, ev.Backend); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqliteStore) Expire(cutoff time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM sessions WHERE last_active < ?`, cutoff.UnixNano()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM login_failures WHERE ends < ?`, time.Now().UnixNano())
+	return err
+}
+
+func (s *sqliteStore) SessionIDs() ([]string, error) {
+	rows, err := s.db.Query(`SELECT id FROM sessions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Rebuild the file without the pages deleted rows left free
+func (s *sqliteStore) Compact() (before, after int64, err error) {
+	if before, err = s.size(); err != nil {
+		return 0, 0, err
+	}
+	if _, err := s.db.Exec(`VACUUM`); err != nil {
+		return 0, 0, err
+	}
+	after, err = s.size()
+	return before, after, err
+}
+
+// Size of the database in bytes
+func (s *sqliteStore) size() (int64, error) {
+	var pages, pageSize int64
+	if err := s.db.QueryRow(`PRAGMA page_count`).Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := s.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pages * pageSize, nil
+}
+
+func (s *sqliteStore) AddLoginFailure(key string, window time.Duration) (int, error) {
+	now := time.Now()
+	var n int
+	err := s.db.QueryRow(`INSERT INTO login_failures (key, count, ends) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN ends < ? THEN 1 ELSE count + 1 END,
+			ends = CASE WHEN ends < ? THEN excluded.ends ELSE ends END
+		RETURNING count`, key, now.Add(window).UnixNano(), now.UnixNano(), now.UnixNano()).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) LoginFailures(key string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT count FROM login_failures WHERE key = ? AND ends >= ?`, key, time.Now().UnixNano()).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (s *sqliteStore) ClearLoginFailures(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_failures WHERE key = ?`, key)
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
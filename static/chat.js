@@ -0,0 +1,302 @@
+// Stream chat replies into the page as they are generated. The form still
+// posts to /chat when scripts are off. With them, prompts go over the /ws
+// WebSocket, which also carries Stop and Retry and resumes a reply after a
+// dropped connection; browsers without WebSockets post to /chat/stream
+// (server-sent events), stop it with /chat/stop, and reload when the reply
+// is complete.
+document.addEventListener("DOMContentLoaded", function () {
+    // Path prefix of a tenant served under /t/<name>, else empty
+    var base = document.body.dataset.base || "";
+    var form = document.querySelector('form[action="' + base + '/chat"]');
+    var history = document.querySelector(".chat-history");
+    if (!form || !history || !window.fetch || !window.TextDecoder) {
+        return;
+    }
+    var prompt = form.querySelector("textarea[name=prompt]");
+    var send = form.querySelector("button[type=submit]");
+
+    function addMessage(role, label, text) {
+        var div = document.createElement("div");
+        div.className = "message " + role;
+        var strong = document.createElement("strong");
+        strong.textContent = label;
+        var content = document.createElement("div");
+        content.className = "content streaming";
+        content.textContent = text;
+        div.appendChild(strong);
+        div.appendChild(content);
+        history.appendChild(div);
+        div.scrollIntoView();
+        return content;
+    }
+
+    // Prompts queued while the model is unreachable: reload once some have
+    // been answered, unless the user is writing the next one
+    var polling = false;
+    function watchPending() {
+        if (polling) {
+            return;
+        }
+        polling = true;
+        setInterval(function () {
+            var shown = history.querySelectorAll(".message.pending").length;
+            fetch(base + "/chat/pending").then(function (resp) { return resp.json(); }).then(function (p) {
+                if (p.pending < shown && prompt.value === "") {
+                    location.reload();
+                }
+            });
+        }, 5000);
+    }
+    if (history.querySelector(".message.pending")) {
+        watchPending();
+    }
+
+    function lastReply() {
+        var replies = history.querySelectorAll(".message.assistant .content");
+        return replies.length ? replies[replies.length - 1] : null;
+    }
+
+    // What a reply waits for, such as a model download, shown in its place
+    // until the first token
+    function showStatus(el, text) {
+        el.textContent = text;
+        el.classList.add("status");
+    }
+
+    // Dollars as the server shows them: more places below a cent
+    function formatCost(dollars) {
+        return "$" + dollars.toFixed(dollars < 0.01 ? 4 : 2);
+    }
+
+    function clearStatus(el) {
+        if (el.classList.contains("status")) {
+            el.textContent = "";
+            el.classList.remove("status");
+        }
+    }
+
+    if (window.WebSocket) {
+        useSocket();
+    } else {
+        useEventStream();
+    }
+
+    function useSocket() {
+        var socket = null;
+        var reply = null;   // element the current reply streams into
+        var replyID = 0;    // live reply being shown
+        var received = 0;   // tokens of it shown so far
+        var busy = false;
+
+        var stop = document.createElement("button");
+        stop.type = "button";
+        stop.textContent = "Stop";
+        var retry = document.createElement("button");
+        retry.type = "button";
+        retry.textContent = "Retry";
+        form.appendChild(stop);
+        form.appendChild(retry);
+
+        function setBusy(b) {
+            busy = b;
+            send.disabled = b;
+            retry.disabled = b;
+            stop.disabled = !b;
+        }
+        setBusy(false);
+
+        function connect() {
+            var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+            socket = new WebSocket(scheme + location.host + base + "/ws");
+            socket.onopen = function () {
+                // Pick up a reply still being generated, from where we were
+                socket.send(JSON.stringify({type: "resume", reply: busy ? replyID : 0, from: received}));
+            };
+            socket.onclose = function () {
+                setTimeout(connect, 1000);
+            };
+            socket.onmessage = function (e) {
+                var f = JSON.parse(e.data);
+                if (f.type === "user") {
+                    addMessage("user", "User", f.text);
+                    start(f.reply, addMessage("assistant", "Assistant", ""));
+                } else if (f.type === "pending") {
+                    addMessage("user pending", "User (pending)", f.text).className = "content";
+                    watchPending();
+                } else if (f.type === "retry") {
+                    var el = lastReply() || addMessage("assistant", "Assistant", "");
+                    el.textContent = "";
+                    el.className = "content streaming";
+                    start(f.reply, el);
+                } else if (f.type === "status") {
+                    if (f.reply !== replyID || !reply) {
+                        start(f.reply, addMessage("assistant", "Assistant", ""));
+                    }
+                    showStatus(reply, f.text);
+                } else if (f.type === "token") {
+                    if (f.reply !== replyID || !reply) {
+                        start(f.reply, addMessage("assistant", "Assistant", ""));
+                    }
+                    clearStatus(reply);
+                    reply.textContent += f.text;
+                    received++;
+                    reply.scrollIntoView(false);
+                } else if (f.type === "done" || f.type === "cancelled") {
+                    if (reply) {
+                        reply.className = "content";
+                        reply.innerHTML = f.html;
+                        var label = reply.previousElementSibling;
+                        var via = label.querySelector(".message-backend");
+                        if (via) {
+                            via.remove();
+                        }
+                        if (f.backend) {
+                            via = document.createElement("span");
+                            via.className = "message-backend";
+                            via.textContent = "via " + f.backend + (f.cost ? ", about " + formatCost(f.cost) : "");
+                            label.appendChild(document.createTextNode(" "));
+                            label.appendChild(via);
+                        }
+                    }
+                    finish();
+                } else if (f.type === "error") {
+                    var target = reply || addMessage("assistant", "Assistant", "");
+                    target.className = "content error";
+                    target.textContent = f.error;
+                    finish();
+                } else if (f.type === "confirm") {
+                    var held = reply || addMessage("assistant", "Assistant", "");
+                    held.className = "content error";
+                    held.textContent = "Not sent: " + f.text + ".";
+                    finish();
+                    if (window.confirm("The model backend isn't answering, and " + f.text + ". Send it anyway?")) {
+                        socket.send(JSON.stringify({type: "confirm"}));
+                    }
+                }
+            };
+        }
+
+        function start(id, el) {
+            replyID = id;
+            received = 0;
+            reply = el;
+            setBusy(true);
+        }
+
+        function finish() {
+            reply = null;
+            setBusy(false);
+        }
+
+        form.addEventListener("submit", function (e) {
+            if (form.querySelector("input[type=file]").files.length) {
+                return; // attachments go through the normal form post
+            }
+            e.preventDefault();
+            if (socket.readyState === WebSocket.OPEN && !busy) {
+                socket.send(JSON.stringify({type: "prompt", text: prompt.value}));
+                prompt.value = "";
+            }
+        });
+        stop.addEventListener("click", function () {
+            socket.send(JSON.stringify({type: "cancel"}));
+        });
+        retry.addEventListener("click", function () {
+            socket.send(JSON.stringify({type: "retry"}));
+        });
+
+        connect();
+    }
+
+    function useEventStream() {
+        // Stop goes to /chat/stop; the stream then ends with what was generated
+        var stop = document.createElement("button");
+        stop.type = "button";
+        stop.textContent = "Stop";
+        stop.disabled = true;
+        form.appendChild(stop);
+        stop.addEventListener("click", function () {
+            fetch(base + "/chat/stop", {method: "POST"});
+        });
+
+        form.addEventListener("submit", function (e) {
+            e.preventDefault();
+            var data = new FormData(form);
+            send.disabled = true;
+            stop.disabled = false;
+            addMessage("user", "User", data.get("prompt"));
+            var reply = addMessage("assistant", "Assistant", "");
+
+            fetch(base + "/chat/stream", {method: "POST", body: data, headers: {"Accept": "text/event-stream"}})
+                .then(function (resp) {
+                    if (!resp.ok) {
+                        return resp.text().then(function (text) { throw new Error(text); });
+                    }
+                    var reader = resp.body.getReader();
+                    var decoder = new TextDecoder();
+                    var buffered = "";
+
+                    function read() {
+                        return reader.read().then(function (result) {
+                            if (result.done) {
+                                location.reload();
+                                return;
+                            }
+                            buffered += decoder.decode(result.value, {stream: true});
+                            var events = buffered.split("\n\n");
+                            buffered = events.pop();
+                            events.forEach(function (ev) {
+                                if (ev.indexOf("data: ") !== 0) {
+                                    return;
+                                }
+                                var msg = JSON.parse(ev.slice(6));
+                                if (msg.error) {
+                                    throw new Error(msg.error);
+                                }
+                                if (msg.status) {
+                                    showStatus(reply, msg.status);
+                                    return;
+                                }
+                                if (msg.content) {
+                                    clearStatus(reply);
+                                }
+                                reply.textContent += msg.content || "";
+                                reply.scrollIntoView(false);
+                            });
+                            return read();
+                        });
+                    }
+                    return read();
+                })
+                .catch(function (err) {
+                    reply.className = "content error";
+                    reply.textContent = err.message;
+                    send.disabled = false;
+                    stop.disabled = true;
+                });
+        });
+    }
+});
+
+// "Copy as text" links put the plain-text transcript on the clipboard;
+// without the clipboard API they open it instead
+document.addEventListener("DOMContentLoaded", function () {
+    if (!navigator.clipboard || !window.fetch) {
+        return;
+    }
+    document.querySelectorAll("a.copy-transcript").forEach(function (link) {
+        link.addEventListener("click", function (e) {
+            e.preventDefault();
+            fetch(link.href, { credentials: "same-origin" })
+                .then(function (resp) {
+                    if (!resp.ok) {
+                        throw new Error("status " + resp.status);
+                    }
+                    return resp.text();
+                })
+                .then(function (text) { return navigator.clipboard.writeText(text); })
+                .then(function () { link.textContent = "Copied"; })
+                .catch(function () { window.location = link.href; });
+        });
+    });
+});
@@ -0,0 +1,17 @@
+// Typeset math spans produced by the server with the locally served KaTeX.
+// Without KaTeX installed the TeX source is left visible as-is.
+document.addEventListener("DOMContentLoaded", function () {
+    if (!window.katex) {
+        return;
+    }
+    document.querySelectorAll(".math").forEach(function (el) {
+        try {
+            katex.render(el.textContent, el, {
+                displayMode: el.classList.contains("math-display"),
+                throwOnError: false
+            });
+        } catch (e) {
+            console.warn("KaTeX failed to render", e);
+        }
+    });
+});
@@ -0,0 +1,20 @@
+// Render <pre class="mermaid"> blocks with the locally served mermaid
+// library. Blocks that fail to parse keep their source text.
+document.addEventListener("DOMContentLoaded", function () {
+    if (!window.mermaid) {
+        return;
+    }
+    mermaid.initialize({ startOnLoad: false, securityLevel: "strict" });
+    document.querySelectorAll("pre.mermaid").forEach(function (el, i) {
+        var source = el.textContent;
+        mermaid.render("mermaid-diagram-" + i, source).then(function (result) {
+            var diagram = document.createElement("div");
+            diagram.className = "mermaid-diagram";
+            diagram.innerHTML = result.svg;
+            el.replaceWith(diagram);
+        }).catch(function (e) {
+            el.classList.add("mermaid-error");
+            el.title = "Diagram could not be rendered: " + e;
+        });
+    });
+});
@@ -0,0 +1,108 @@
+// Hands-free voice loop: the browser's speech recognition turns speech into
+// a transcript, the server streams the reply over a WebSocket, and each
+// finished sentence is spoken. Listening resumes once speaking ends.
+document.addEventListener("DOMContentLoaded", function () {
+    var Recognition = window.SpeechRecognition || window.webkitSpeechRecognition;
+    var status = document.getElementById("voice-status");
+    var toggle = document.getElementById("voice-toggle");
+    var log = document.getElementById("voice-log");
+    var base = document.body.dataset.base || "";
+
+    if (!Recognition || !window.speechSynthesis || !window.WebSocket) {
+        status.textContent = "This browser does not support speech recognition and synthesis.";
+        toggle.disabled = true;
+        return;
+    }
+
+    var active = false;
+    var thinking = false;
+    var socket = null;
+    var reply = null;
+    var recognition = new Recognition();
+    recognition.lang = navigator.language || "en-US";
+    recognition.interimResults = false;
+
+    function addMessage(role, text) {
+        var div = document.createElement("div");
+        div.className = "message " + role;
+        div.textContent = text;
+        log.appendChild(div);
+        div.scrollIntoView();
+        return div;
+    }
+
+    function listen() {
+        if (active && !thinking && !speechSynthesis.speaking) {
+            status.textContent = "Listening...";
+            try {
+                recognition.start();
+            } catch (e) {
+                // Already listening
+            }
+        }
+    }
+
+    function speak(text) {
+        var utterance = new SpeechSynthesisUtterance(text);
+        utterance.onend = listen;
+        speechSynthesis.speak(utterance);
+    }
+
+    function connect() {
+        var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+        socket = new WebSocket(scheme + location.host + base + "/voice/ws");
+        socket.onopen = listen;
+        socket.onclose = function () {
+            if (active) {
+                status.textContent = "Connection lost, reconnecting...";
+                setTimeout(connect, 1000);
+            }
+        };
+        socket.onmessage = function (e) {
+            var ev = JSON.parse(e.data);
+            if (ev.type === "chunk") {
+                reply = reply || addMessage("assistant", "");
+                reply.textContent += ev.text;
+            } else if (ev.type === "sentence") {
+                status.textContent = "Speaking...";
+                speak(ev.text);
+            } else if (ev.type === "done" || ev.type === "error") {
+                if (ev.error) {
+                    addMessage("error", ev.error);
+                }
+                thinking = false;
+                reply = null;
+                listen();
+            }
+        };
+    }
+
+    recognition.onresult = function (e) {
+        var text = e.results[e.results.length - 1][0].transcript.trim();
+        if (text && socket && socket.readyState === WebSocket.OPEN) {
+            addMessage("user", text);
+            thinking = true;
+            status.textContent = "Thinking...";
+            socket.send(JSON.stringify({type: "transcript", text: text}));
+        }
+    };
+    recognition.onend = function () {
+        // Recognition stops after each phrase or a stretch of silence
+        setTimeout(listen, 250);
+    };
+
+    toggle.addEventListener("click", function () {
+        active = !active;
+        toggle.textContent = active ? "Stop" : "Start";
+        if (active) {
+            connect();
+        } else {
+            recognition.stop();
+            speechSynthesis.cancel();
+            if (socket) {
+                socket.close();
+            }
+            status.textContent = "Stopped.";
+        }
+    });
+});
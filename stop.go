@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Make ctx stoppable through /chat/stop for the session's generations
+// outside the /ws chat socket, whose live reply has its own cancel, and
+// route it to the session's tenant's Ollama hosts, noting which backend
+// answers. The
+// returned func must be called once the generation ends. Callers must hold
+// sessionMut.
+func (s *session) trackGeneration(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(withAnswerLabel(withTenant(ctx, sessionTenant(s.id))))
+	if s.generations == nil {
+		s.generations = make(map[int]context.CancelFunc)
+	}
+	s.lastGeneration++
+	id := s.lastGeneration
+	s.generations[id] = cancel
+	return ctx, func() {
+		cancel()
+		sessionMut.Lock()
+		delete(s.generations, id)
+		sessionMut.Unlock()
+	}
+}
+
+// Cancel every generation running for the session, returning how many
+// there were. Callers must hold sessionMut.
+func (s *session) stopGenerations() int {
+	n := len(s.generations)
+	for _, cancel := range s.generations {
+		cancel()
+	}
+	if s.live != nil && !s.live.isDone() {
+		s.live.cancel()
+		n++
+	}
+	return n
+}
+
+// POST /chat/stop: halt the session's replies in progress. Each keeps what
+// was generated so far. Answers {"stopped": n}.
+func chatStopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sessionID := getSessionID(w, r)
+	sessionMut.Lock()
+	n := getSession(sessionID).stopGenerations()
+	sessionMut.Unlock()
+	writeJSON(w, http.StatusOK, map[string]int{"stopped": n})
+}
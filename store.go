@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifetime of the session cookie; sessions idle this long are forgotten
+var sessionLifetime = 24 * time.Hour
+
+// How often expired sessions are swept; a var so tests can shorten it
+var sessionReapInterval = time.Hour
+
+// How long a session may go unused before it leaves memory; 0 for
+// sessionLifetime. Set by -session-idle.
+var sessionIdleTimeout time.Duration
+
+// Whether a session leaving memory for being idle is deleted from the store
+// as well, rather than kept there until sessionLifetime and loaded again on
+// its next request; set by -session-evict
+var discardIdleSessions bool
+
+// SessionStore keeps each session's chat log beyond the in-memory sessions
+// map, so history survives a restart. Only the chat is stored; journal,
+// scenario and other mode state stays in memory.
+type SessionStore interface {
+	// Load a session's event log and last activity; ok is false when the
+	// store has no such session
+	Load(id string) (events []MessageEvent, lastActive time.Time, ok bool, err error)
+	// Save an event appended to a session's log
+	Append(id string, ev MessageEvent, lastActive time.Time) error
+	// Rewrite a session's whole log
+	Replace(id string, events []MessageEvent, lastActive time.Time) error
+	// Drop one session, such as the old ID of a rotated one
+	Delete(id string) error
+	// Drop sessions last active before cutoff
+	Expire(cutoff time.Time) error
+	Close() error
+}
+
+// The configured store; the in-memory default keeps nothing extra
+var store SessionStore = memoryStore{}
+
+// memoryStore leaves sessions to the sessions map alone
+type memoryStore struct{}
+
+func (memoryStore) Load(string) ([]MessageEvent, time.Time, bool, error) {
+	return nil, time.Time{}, false, nil
+}
+func (memoryStore) Append(string, MessageEvent, time.Time) error    { return nil }
+func (memoryStore) Replace(string, []MessageEvent, time.Time) error { return nil }
+func (memoryStore) Delete(string) error                             { return nil }
+func (memoryStore) Expire(time.Time) error                          { return nil }
+func (memoryStore) Close() error                                    { return nil }
+
+// sharedStore is a store other server instances write to as well, so a
+// session cached here may fall behind it. Such a store calls
+// sessionChanged when another instance writes to a session.
+type sharedStore interface {
+	// Number of events stored for a session
+	Length(id string) (int, error)
+}
+
+// An event recorded for a session and not yet saved, with the store it
+// goes to
+type pendingWrite struct {
+	store      SessionStore
+	id         string
+	ev         MessageEvent
+	lastActive time.Time
+}
+
+// writeQueue saves recorded events in order on a goroutine of its own, so
+// requests holding sessionMut do not wait on the store
+type writeQueue struct {
+	mu      sync.Mutex
+	writes  []pendingWrite
+	writing bool
+	drained *sync.Cond
+}
+
+var storeWrites = newWriteQueue()
+
+func newWriteQueue() *writeQueue {
+	q := &writeQueue{}
+	q.drained = sync.NewCond(&q.mu)
+	return q
+}
+
+// Queue an event to be appended to a session's stored log
+func (q *writeQueue) add(id string, ev MessageEvent, lastActive time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.writes = append(q.writes, pendingWrite{store: store, id: id, ev: ev, lastActive: lastActive})
+	if !q.writing {
+		q.writing = true
+		go q.run()
+	}
+}
+
+// Save queued events, oldest first, until none are left
+func (q *writeQueue) run() {
+	q.mu.Lock()
+	for len(q.writes) > 0 {
+		batch := q.writes
+		q.writes = nil
+		q.mu.Unlock()
+		for _, w := range batch {
+			if err := w.store.Append(w.id, w.ev, w.lastActive); err != nil {
+				log.Printf("Session store error: %v", err)
+			}
+		}
+		q.mu.Lock()
+	}
+	q.writing = false
+	q.drained.Broadcast()
+	q.mu.Unlock()
+}
+
+// Wait until every queued event is saved, as before the store is read or
+// rewritten
+func (q *writeQueue) flush() {
+	q.mu.Lock()
+	for q.writing {
+		q.drained.Wait()
+	}
+	q.mu.Unlock()
+}
+
+// Mark a session another instance has written to, so its next request
+// catches up with the store
+func sessionChanged(id string) {
+	sessionMut.Lock()
+	if s, ok := sessions[id]; ok {
+		s.stale = true
+	}
+	sessionMut.Unlock()
+}
+
+// Open the store named by -session-store: "memory", "sqlite:<path>" or a
+// redis:// URL
+func openSessionStore(spec string) (SessionStore, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "memory":
+		return memoryStore{}, nil
+	case "sqlite":
+		return openSQLiteStore(arg)
+	case "redis", "rediss":
+		return openRedisStore(spec)
+	}
+	return nil, fmt.Errorf("unknown session store %q", spec)
+}
+
+// Rebuild a session from its stored log. Callers must hold sessionMut.
+func loadSession(id string) *session {
+	storeWrites.flush()
+	events, lastActive, ok, err := store.Load(id)
+	if err != nil {
+		log.Printf("Session load error: %v", err)
+	}
+	if !ok {
+		return nil
+	}
+	if lock := storedTranscriptLock(events); lock != nil {
+		// Stays sealed until a request brings the key
+		return &session{id: id, Transcript: lock, LastActive: lastActive}
+	}
+	s := &session{id: id, Events: events, LastActive: lastActive}
+	s.project()
+	for _, ev := range events {
+		if ev.MessageID > s.nextMessageID {
+			s.nextMessageID = ev.MessageID
+		}
+	}
+	return s
+}
+
+// Catch up with events another instance has stored for the session. Mode
+// state that is not stored, such as the journal, stays as it is. Callers
+// must hold sessionMut.
+func (s *session) refresh() {
+	shared, ok := store.(sharedStore)
+	if !ok {
+		return
+	}
+	s.stale = false
+	storeWrites.flush()
+	n, err := shared.Length(s.id)
+	if err != nil {
+		log.Printf("Session store error: %v", err)
+		return
+	}
+	stored := len(s.Events)
+	if s.Transcript != nil {
+		stored = len(s.Transcript.sealed)
+	}
+	if n == stored {
+		return
+	}
+	fresh := loadSession(s.id)
+	if fresh == nil {
+		return
+	}
+
+	s.LastActive = fresh.LastActive
+	if lock := fresh.Transcript; lock != nil {
+		old := s.Transcript
+		s.Transcript, s.Events, s.History, s.Conversations, s.rendered = lock, nil, nil, nil, nil
+		if old != nil && old.key != nil {
+			// Still serving a request with the key: decrypt the new log
+			if err := s.unlockTranscript(old.key); err != nil {
+				log.Printf("Session refresh error: %v", err)
+				return
+			}
+			lock.holders = old.holders
+		}
+		return
+	}
+	s.Events, s.History, s.nextMessageID, s.rendered = fresh.Events, fresh.History, fresh.nextMessageID, nil
+	s.Conversations, s.Active = fresh.Conversations, fresh.Active
+}
+
+// Periodically forget sessions whose cookie has expired, in memory and in
+// the store, and move idle ones out of memory
+func startSessionReaper() {
+	go func() {
+		for range time.Tick(sessionReapInterval) {
+			now := time.Now()
+			idle := sessionIdleTimeout
+			if idle <= 0 {
+				idle = sessionLifetime
+			}
+			if n := evictIdleSessions(now.Add(-idle)); n > 0 {
+				log.Printf("Evicted %d idle sessions", n)
+			}
+			reapSessions(now.Add(-sessionLifetime))
+		}
+	}()
+}
+
+// Drop sessions neither used nor changed since cutoff from memory,
+// returning how many. Their chat stays in the store unless
+// discardIdleSessions is set; mode state such as the journal and share
+// links is lost. Sessions with a reply or an unlocked transcript in use
+// stay.
+func evictIdleSessions(cutoff time.Time) int {
+	sessionMut.Lock()
+	defer sessionMut.Unlock()
+	n := 0
+	for id, sess := range sessions {
+		if sess.lastUsed().After(cutoff) || sess.busy() {
+			continue
+		}
+		if err := evictSession(id, sess); err != nil {
+			log.Printf("Session eviction error: %v", err)
+			continue
+		}
+		n++
+	}
+	sessionEvictions.idle.Add(int64(n))
+	return n
+}
+
+func reapSessions(cutoff time.Time) {
+	sessionMut.Lock()
+	for _, sess := range sessions {
+		if sess.LastActive.Before(cutoff) && sess.live == nil {
+			sess.forget()
+		}
+	}
+	sessionMut.Unlock()
+	if err := store.Expire(cutoff); err != nil {
+		log.Printf("Session expiry error: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// GFM table delimiter row, e.g. "| --- | :---: |"
+	tableDelimiterRe = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+	// Inline markdown stripped from exported cells
+	cellMarkupRe = regexp.MustCompile("\\*\\*|__|`|~~")
+)
+
+// Append a CSV download link after every rendered table, under the page's
+// base path. Tables are numbered in document order, matching extractTables.
+func addTableLinks(rendered, base string, messageIndex int) string {
+	if !strings.Contains(rendered, "</table>") {
+		return rendered
+	}
+	parts := strings.Split(rendered, "</table>")
+	var b strings.Builder
+	for i, part := range parts {
+		b.WriteString(part)
+		if i == len(parts)-1 {
+			break
+		}
+		fmt.Fprintf(&b, `</table><a class="table-csv" href="%s/export/table?message=%d&amp;table=%d" download>Download CSV</a>`, template.HTMLEscapeString(base), messageIndex, i)
+	}
+	return b.String()
+}
+
+// Extract GFM pipe tables from markdown, skipping fenced code blocks.
+// Each table is returned as rows of cells, header row first.
+func extractTables(markdown string) [][][]string {
+	lines := strings.Split(markdown, "\n")
+	var tables [][][]string
+	inFence := false
+
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+			continue
+		}
+		if inFence || !strings.Contains(lines[i], "|") || i+1 >= len(lines) {
+			continue
+		}
+		if !strings.Contains(lines[i+1], "-") || !tableDelimiterRe.MatchString(lines[i+1]) {
+			continue
+		}
+
+		table := [][]string{splitTableRow(lines[i])}
+		i += 2
+		for ; i < len(lines); i++ {
+			if strings.TrimSpace(lines[i]) == "" || !strings.Contains(lines[i], "|") {
+				break
+			}
+			table = append(table, splitTableRow(lines[i]))
+		}
+		i--
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// Split a table row on unescaped pipes and clean up each cell
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, cleanCell(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, cleanCell(cell.String()))
+}
+
+func cleanCell(s string) string {
+	return strings.TrimSpace(cellMarkupRe.ReplaceAllString(s, ""))
+}
+
+// Quote a cell a spreadsheet would take for a formula, such as
+// =HYPERLINK(...), so opening the download cannot run what a model wrote.
+// Plain numbers such as -5 are left as they are.
+func csvSafeCell(cell string) string {
+	if cell == "" || !strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return cell
+	}
+	if _, err := strconv.ParseFloat(cell, 64); err == nil {
+		return cell
+	}
+	return "'" + cell
+}
+
+// Download one table from an assistant message as CSV
+func tableExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	msgIndex, err1 := strconv.Atoi(r.URL.Query().Get("message"))
+	tableIndex, err2 := strconv.Atoi(r.URL.Query().Get("table"))
+	if err1 != nil || err2 != nil || msgIndex < 0 || tableIndex < 0 {
+		http.Error(w, "Invalid message or table index", http.StatusBadRequest)
+		return
+	}
+
+	sessionID := getSessionID(w, r)
+	sessionMut.Lock()
+	history := getSession(sessionID).History
+	var content string
+	found := msgIndex < len(history) && history[msgIndex].Role == "assistant"
+	if found {
+		content = history[msgIndex].Content
+	}
+	sessionMut.Unlock()
+
+	if !found {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	tables := extractTables(content)
+	if tableIndex >= len(tables) {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="table-%d-%d.csv"`, msgIndex, tableIndex))
+	rows := tables[tableIndex]
+	for _, row := range rows {
+		for i, cell := range row {
+			row[i] = csvSafeCell(cell)
+		}
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(rows); err != nil {
+		log.Printf("CSV export error: %v", err)
+	}
+}
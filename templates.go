@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+)
+
+// Directory holding the HTML templates
+var templateDir = "templates"
+
+// Directory of operator changes to the templates, kept apart so upgrades
+// leave them alone. Each file replaces the one of the same name, and each
+// {{define}} in it the block of the same name; empty for none.
+var templateOverlayDir string
+
+var errTemplatesNotLoaded = errors.New("templates not loaded")
+
+// Template state: parsed once at startup, or on every request in dev mode.
+// Pages served under a base path, such as a tenant's /t/<name>, use a set
+// of their own, parsed on first use, whose links start with it.
+var (
+	templates     *template.Template
+	baseTemplates = map[string]*template.Template{}
+	templateMut   sync.RWMutex
+	devMode       bool
+)
+
+// Functions available to every template. None passes text through
+// unescaped without sanitizing it: markdown renders and sanitizes, and
+// sanitize cleans HTML from elsewhere.
+var templateFuncs = template.FuncMap{
+	"title":    titleCase,
+	"markdown": markdownHTML,
+	"sanitize": sanitizeHTML,
+	"asset":    assetURL,
+	"hasAsset": hasAsset,
+	"size":     formatSize,
+	"cost":     formatCost,
+	// Whether conversations can be exported as PDF
+	"pdfExport": func() bool { return pdfCommand != "" },
+	// Model options a conversation can set
+	"generationOptions": generationOptionNames,
+	// Models the config allows, to suggest in model fields; empty for any
+	"allowedModels": func() []string { return currentFileConfig().Models },
+	"list": func(items ...interface{}) []interface{} {
+		return items
+	},
+	// Path prefix for links within the server, replaced in each set
+	"base": func() string { return "" },
+}
+
+// fallbackTemplate is used when the real templates fail to parse or execute,
+// so the conversation stays readable while the template is being fixed. It
+// is always given PageData; other pages show the notice alone.
+var fallbackTemplate = template.Must(template.New("fallback").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Chat</title></head>
+<body>
+<p><em>The page template could not be rendered; showing a plain view.</em></p>
+{{range .History}}<div><strong>{{.Role}}</strong><pre>{{.Content}}</pre></div>{{end}}
+<form method="POST" action="/chat"><textarea name="prompt" required></textarea><button type="submit">Send</button></form>
+</body>
+</html>`))
+
+// Parse all templates and make them the active set
+func loadTemplates() error {
+	tmpl, err := parseTemplates("")
+	if err != nil {
+		return err
+	}
+	templateMut.Lock()
+	templates, baseTemplates = tmpl, map[string]*template.Template{}
+	templateMut.Unlock()
+	return nil
+}
+
+// Parse all templates, with links under base
+func parseTemplates(base string) (*template.Template, error) {
+	funcs := template.FuncMap{"base": func() string { return base }}
+	tmpl, err := template.New("").Funcs(templateFuncs).Funcs(funcs).ParseGlob(templateDir + "/*.html")
+	if err != nil || templateOverlayDir == "" {
+		return tmpl, err
+	}
+	overlays, err := filepath.Glob(filepath.Join(templateOverlayDir, "*.html"))
+	if err != nil || len(overlays) == 0 {
+		return tmpl, err
+	}
+	return tmpl.ParseFiles(overlays...)
+}
+
+// Current template set for pages under base; re-parsed from disk in dev
+// mode
+func currentTemplates(base string) (*template.Template, error) {
+	if devMode {
+		return parseTemplates(base)
+	}
+	templateMut.RLock()
+	tmpl, parsed := templates, baseTemplates[base]
+	templateMut.RUnlock()
+	if base == "" || tmpl == nil {
+		return tmpl, nil
+	}
+	if parsed != nil {
+		return parsed, nil
+	}
+	// The first page under base since the templates were loaded
+	parsed, err := parseTemplates(base)
+	if err != nil {
+		return nil, err
+	}
+	templateMut.Lock()
+	baseTemplates[base] = parsed
+	templateMut.Unlock()
+	return parsed, nil
+}
+
+// Current template set for pages under base, or an error if there is none
+// to render with
+func loadedTemplates(base string) (*template.Template, error) {
+	tmpl, err := currentTemplates(base)
+	if err == nil && tmpl == nil {
+		err = errTemplatesNotLoaded
+	}
+	return tmpl, err
+}
+
+// Render a named template into the response, its links under the request's
+// base path. Template failures fall back to a built-in plain page instead
+// of panicking, as long as nothing has been sent to the client yet.
+func renderPage(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	renderPageStatus(w, r, http.StatusOK, name, data)
+}
+
+// Render a named template with a non-200 status code
+func renderPageStatus(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	tmpl, err := loadedTemplates(basePath(r.Context()))
+	if err != nil {
+		log.Printf("Template error: %v", err)
+		renderFallback(w, data)
+		return
+	}
+
+	// Output is written out in chunks, so a long history is never held as
+	// one rendered page in memory.
+	fw := &flushingWriter{w: w, status: status}
+	cw := bufio.NewWriterSize(fw, 16<<10)
+	err = tmpl.ExecuteTemplate(cw, name, data)
+	if err == nil {
+		err = cw.Flush()
+	}
+	if err != nil {
+		log.Printf("Template error: %v", err)
+		if !fw.wrote {
+			renderFallback(w, data)
+		}
+	}
+}
+
+func renderFallback(w http.ResponseWriter, data interface{}) {
+	w.WriteHeader(http.StatusInternalServerError)
+	page, _ := data.(PageData)
+	if err := fallbackTemplate.Execute(w, page); err != nil {
+		log.Printf("Fallback template error: %v", err)
+	}
+}
+
+// flushingWriter pushes every write straight to the client, sending the
+// status code with the first write
+type flushingWriter struct {
+	w      http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	if !f.wrote {
+		f.w.WriteHeader(f.status)
+	}
+	f.wrote = true
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Tenant is a namespace served from the same server, with chats, API keys,
+// models and quota of its own. Requests are for a tenant when their host's
+// first label is its name (acme.chat.example.com), the host is one of its
+// hosts, or the path starts with /t/<name>/. Its sessions are stored under
+// IDs starting with "<name>/", so neither side can open the other's.
+type Tenant struct {
+	Name string `yaml:"-"` // the key it is configured under
+	// Hosts beyond <name>.<domain> that serve the tenant
+	Hosts []string `yaml:"hosts"`
+	// Models the tenant may use, within the server's models; any of those
+	// when empty
+	Models []string `yaml:"models"`
+	// Generations the whole tenant may start, on top of each client's limit
+	RateLimit RateLimit `yaml:"rate_limit"`
+	Branding  Branding  `yaml:"branding"`
+	// Ollama hosts the tenant's chats go to, each conversation sticking to
+	// one; the server's when empty
+	Ollama []string `yaml:"ollama"`
+	// Model for chats that name none; the server's when empty
+	DefaultModel string `yaml:"default_model"`
+}
+
+// Branding is how the chat page presents itself
+type Branding struct {
+	Title  string `yaml:"title"`
+	Accent string `yaml:"accent"` // heading colour, as #rgb or #rrggbb
+}
+
+// Title of the chat page for requests outside any tenant
+const defaultTitle = "DeepSeek-R1:1.5B Chat"
+
+// Path prefix naming the tenant, as /t/<name>/
+const tenantPathPrefix = "/t/"
+
+var (
+	tenantNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	accentRe     = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+)
+
+// Check the configured tenants, naming each after its key
+func checkTenants(tenants map[string]*Tenant) error {
+	hosts := make(map[string]string)
+	for name, t := range tenants {
+		if !tenantNameRe.MatchString(name) {
+			return fmt.Errorf("tenants: %q is not a valid name; use lowercase letters, digits and dashes", name)
+		}
+		if t == nil {
+			t = &Tenant{}
+			tenants[name] = t
+		}
+		t.Name = name
+		if err := t.RateLimit.check(); err != nil {
+			return fmt.Errorf("tenants.%s: %w", name, err)
+		}
+		if t.Branding.Accent != "" && !accentRe.MatchString(t.Branding.Accent) {
+			return fmt.Errorf("tenants.%s: branding.accent must be a colour such as #0a7", name)
+		}
+		if t.DefaultModel != "" && !modelInList(t.Models, t.DefaultModel) {
+			return fmt.Errorf("tenants.%s: default_model %s is not in its models", name, t.DefaultModel)
+		}
+		for i, u := range t.Ollama {
+			parsed, err := url.Parse(u)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("tenants.%s: ollama host %q is not an http(s) URL", name, u)
+			}
+			t.Ollama[i] = strings.TrimSuffix(u, "/")
+		}
+		for i, h := range t.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := hosts[h]; ok {
+				return fmt.Errorf("tenants.%s: host %s is also %s's", name, h, other)
+			}
+			hosts[h], t.Hosts[i] = name, h
+		}
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+// Tag a context with the tenant its requests are for
+func withTenant(ctx context.Context, t *Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// The context's tenant; nil outside any
+func tenantFrom(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return t
+}
+
+// The tenant a request is for; nil outside any
+func requestTenant(r *http.Request) *Tenant {
+	return tenantFrom(r.Context())
+}
+
+// The tenant a request names by path prefix or host, and the path within
+// it. ok is false when the path names a tenant that does not exist.
+func resolveTenant(r *http.Request) (t *Tenant, path string, ok bool) {
+	tenants := currentFileConfig().Tenants
+	if strings.HasPrefix(r.URL.Path, tenantPathPrefix) {
+		name, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, tenantPathPrefix), "/")
+		if t = tenants[name]; t == nil {
+			return nil, r.URL.Path, false
+		}
+		return t, "/" + path, true
+	}
+	if len(tenants) == 0 {
+		return nil, r.URL.Path, true
+	}
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, t := range tenants {
+		for _, h := range t.Hosts {
+			if h == host {
+				return t, r.URL.Path, true
+			}
+		}
+	}
+	if label, domain, found := strings.Cut(host, "."); found && domain != "" {
+		return tenants[label], r.URL.Path, true
+	}
+	return nil, r.URL.Path, true
+}
+
+// Tag each request with its tenant, taking the /t/<name> prefix off the
+// path. Prefixes naming no tenant are not found, and API keys given to
+// one tenant are refused everywhere else.
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, path, ok := resolveTenant(r)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if k, found := apiKeys[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]; found && k.Tenant != tenantName(t) {
+			writeAPIError(w, http.StatusForbidden, "this API key belongs to another tenant")
+			return
+		}
+		if t == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := withTenant(r.Context(), t)
+		if strings.HasPrefix(r.URL.Path, tenantPathPrefix) {
+			ctx = withBasePath(ctx, tenantPathPrefix+t.Name)
+		}
+		r = r.WithContext(ctx)
+		if path != r.URL.Path {
+			u := *r.URL
+			u.Path, u.RawPath = path, ""
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type basePathKey struct{}
+
+// Tag a context with the path prefix its request came under, such as
+// /t/acme for a tenant named by path
+func withBasePath(ctx context.Context, base string) context.Context {
+	return context.WithValue(ctx, basePathKey{}, base)
+}
+
+// The path prefix a request came under, which its pages' links and its
+// redirects keep; empty for none
+func basePath(ctx context.Context) string {
+	base, _ := ctx.Value(basePathKey{}).(string)
+	return base
+}
+
+// http.Redirect to a path under the request's base path, so a tenant
+// named by path stays in it
+func redirect(w http.ResponseWriter, r *http.Request, path string, code int) {
+	http.Redirect(w, r, basePath(r.Context())+path, code)
+}
+
+// A tenant's name; empty outside any
+func tenantName(t *Tenant) string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// The ID a session cookie's value stands for in the request's tenant, so
+// the same value names different sessions in different tenants
+func scopedSessionID(r *http.Request, id string) string {
+	if t := requestTenant(r); t != nil {
+		return t.Name + "/" + id
+	}
+	return id
+}
+
+// Name of the session cookie in a tenant, so a browser can hold one for
+// each tenant it visits by path prefix; session_id outside any
+func sessionCookieName(tenant string) string {
+	if tenant == "" {
+		return "session_id"
+	}
+	return "session_id_" + tenant
+}
+
+// The tenant a session belongs to, from its ID; nil outside any
+func sessionTenant(id string) *Tenant {
+	name, _, found := strings.Cut(id, "/")
+	if !found {
+		return nil
+	}
+	return currentFileConfig().Tenants[name]
+}
+
+// Whether a session belongs to a tenant, or to none when t is nil
+func sessionInTenant(id string, t *Tenant) bool {
+	name, _, found := strings.Cut(id, "/")
+	if t == nil {
+		return !found
+	}
+	return found && name == t.Name
+}
+
+// The model for a tenant's chats that name none
+func tenantModel(t *Tenant) string {
+	if t != nil && t.DefaultModel != "" {
+		return t.DefaultModel
+	}
+	return defaultModel
+}
+
+// The model for chats under ctx that name none
+func defaultModelFor(ctx context.Context) string {
+	return tenantModel(tenantFrom(ctx))
+}
+
+// The value the cookie of a session carries: its ID without the tenant
+func cookieValue(id string) string {
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+// How the chat page presents itself to a request
+func requestBranding(r *http.Request) Branding {
+	b := Branding{Title: defaultTitle}
+	if t := requestTenant(r); t != nil {
+		if t.Branding.Title != "" {
+			b.Title = t.Branding.Title
+		}
+		b.Accent = t.Branding.Accent
+	}
+	return b
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Rounds of tool calls allowed before the model must answer
+const maxToolRounds = 8
+
+// Tool describes a function the model may call, in Ollama's format
+type Tool struct {
+	Type     string       `json:"type"` // always "function"
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction is a tool's name, purpose and JSON schema for its arguments
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// ToolCall is a model's request to run a tool
+type ToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// Runs a tool call and returns its output for the model
+type toolRunner func(ctx context.Context, call ToolCall) string
+
+// Chat with tools available: each time the model asks for tools they are
+// run and their output sent back, until it gives a plain answer
+func completeWithTools(ctx context.Context, chatReq OllamaChatRequest, run toolRunner) (string, error) {
+	messages := append([]Message(nil), chatReq.Messages...)
+	for round := 0; ; round++ {
+		chatReq.Messages = messages
+		if round == maxToolRounds {
+			// Out of rounds: ask for an answer with what it has
+			chatReq.Tools = nil
+		}
+
+		msg, err := ollamaChat(ctx, chatReq)
+		if err != nil {
+			return "", err
+		}
+		if len(msg.ToolCalls) == 0 {
+			return msg.Content, nil
+		}
+
+		messages = append(messages, msg)
+		for _, call := range msg.ToolCalls {
+			log.Printf("Tool call %s %s", call.Function.Name, call.Function.Arguments)
+			messages = append(messages, Message{Role: "tool", ToolName: call.Function.Name, Content: run(ctx, call)})
+		}
+	}
+}
+
+// Describe a tool failure to the model rather than aborting the chat
+func toolError(err error) string {
+	return fmt.Sprintf("Error: %v", err)
+}
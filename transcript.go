@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Event types of an encrypted chat log: the first entry holds the key's
+// salt and a check value, and every later one wraps a sealed event
+const (
+	EventEncrypted = "encrypted"
+	EventSealed    = "sealed"
+)
+
+const (
+	transcriptKeyCookie = "transcript_key"
+	// Sealed with the key so a wrong one is noticed before decrypting
+	transcriptCheck = "transcript-key-check"
+	minPassphrase   = 8
+)
+
+var (
+	errWrongPassphrase = errors.New("wrong passphrase")
+	errShortPassphrase = errors.New("passphrases must be at least 8 characters")
+)
+
+// transcriptLock is how an encrypted session's chat log is sealed. Only
+// the sealed log is kept; the plaintext exists while a request that brought
+// the key is being served.
+type transcriptLock struct {
+	Salt  []byte
+	Check []byte
+
+	sealed  []MessageEvent // the log as stored
+	key     []byte         // nil while locked
+	holders int            // requests being served with the key
+}
+
+// PrivacyPage holds data for the privacy template
+type PrivacyPage struct {
+	Encrypted bool
+	Error     string
+}
+
+// Slow on purpose, so stolen sealed logs resist guessing
+func deriveTranscriptKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, 1, 64<<10, 4, 32)
+}
+
+func transcriptSeal(key, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func transcriptOpen(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errWrongPassphrase
+	}
+	n := gcm.NonceSize()
+	return gcm.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+// Wrap an event for the stored log; seq is its place in that log
+func sealEvent(key []byte, ev MessageEvent, seq int) (MessageEvent, error) {
+	plain, err := json.Marshal(ev)
+	if err != nil {
+		return MessageEvent{}, err
+	}
+	sealed, err := transcriptSeal(key, plain)
+	if err != nil {
+		return MessageEvent{}, err
+	}
+	return MessageEvent{Seq: seq, Type: EventSealed, Time: ev.Time, Content: base64.StdEncoding.EncodeToString(sealed)}, nil
+}
+
+func openEvent(key []byte, sealed MessageEvent) (MessageEvent, error) {
+	var ev MessageEvent
+	b, err := base64.StdEncoding.DecodeString(sealed.Content)
+	if err != nil {
+		return ev, err
+	}
+	plain, err := transcriptOpen(key, b)
+	if err != nil {
+		return ev, err
+	}
+	if err := json.Unmarshal(plain, &ev); err != nil {
+		return ev, err
+	}
+	if ev.Message != nil {
+		ev.Message.ID = ev.MessageID
+	}
+	return ev, nil
+}
+
+// The lock described by the first event of a stored log, if it is sealed
+func storedTranscriptLock(events []MessageEvent) *transcriptLock {
+	if len(events) == 0 || events[0].Type != EventEncrypted {
+		return nil
+	}
+	salt, check, _ := strings.Cut(events[0].Content, ".")
+	lock := &transcriptLock{sealed: events}
+	lock.Salt, _ = base64.StdEncoding.DecodeString(salt)
+	lock.Check, _ = base64.StdEncoding.DecodeString(check)
+	return lock
+}
+
+// Seal the session's existing log with a passphrase and keep it sealed
+// from now on. Callers must hold sessionMut.
+func (s *session) encryptTranscript(passphrase string) ([]byte, error) {
+	if len(passphrase) < minPassphrase {
+		return nil, errShortPassphrase
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := deriveTranscriptKey(passphrase, salt)
+	check, err := transcriptSeal(key, []byte(transcriptCheck))
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &transcriptLock{Salt: salt, Check: check, key: key}
+	lock.sealed = []MessageEvent{{Seq: 1, Type: EventEncrypted, Time: time.Now(),
+		Content: base64.StdEncoding.EncodeToString(salt) + "." + base64.StdEncoding.EncodeToString(check)}}
+	for _, ev := range s.Events {
+		sealed, err := sealEvent(key, ev, len(lock.sealed)+1)
+		if err != nil {
+			return nil, err
+		}
+		lock.sealed = append(lock.sealed, sealed)
+	}
+	storeWrites.flush()
+	if err := store.Replace(s.id, lock.sealed, s.LastActive); err != nil {
+		return nil, err
+	}
+	s.Transcript = lock
+	return key, nil
+}
+
+// Check a key against the lock
+func (l *transcriptLock) verify(key []byte) bool {
+	plain, err := transcriptOpen(key, l.Check)
+	return err == nil && subtle.ConstantTimeCompare(plain, []byte(transcriptCheck)) == 1
+}
+
+// Decrypt the log into the session for one more request. Callers must hold
+// sessionMut.
+func (s *session) unlockTranscript(key []byte) error {
+	l := s.Transcript
+	if l.key != nil {
+		if subtle.ConstantTimeCompare(l.key, key) != 1 {
+			return errWrongPassphrase
+		}
+		l.holders++
+		return nil
+	}
+	if !l.verify(key) {
+		return errWrongPassphrase
+	}
+
+	var events []MessageEvent
+	for _, sealed := range l.sealed[1:] {
+		ev, err := openEvent(key, sealed)
+		if err != nil {
+			return err
+		}
+		events = append(events, ev)
+	}
+	s.Events, s.rendered = events, nil
+	s.project()
+	for _, ev := range events {
+		if ev.MessageID > s.nextMessageID {
+			s.nextMessageID = ev.MessageID
+		}
+	}
+	l.key = key
+	l.holders++
+	if len(s.Pending) > 0 {
+		// Prompts queued while it was locked can be recorded now; hold it
+		// open until they are, as the request may finish first
+		l.holders++
+		go func(id string) {
+			sendPending(id)
+			sessionMut.Lock()
+			getSession(id).releasePending()
+			sessionMut.Unlock()
+		}(s.id)
+	}
+	return nil
+}
+
+// Whether the session's transcript is encrypted and no request holds its
+// key, so its events cannot be read or recorded. Callers must hold
+// sessionMut.
+func (s *session) transcriptLocked() bool {
+	return s.Transcript != nil && s.Transcript.key == nil
+}
+
+// Drop the plaintext once no request is using it. Callers must hold
+// sessionMut.
+func (s *session) releaseTranscript() {
+	l := s.Transcript
+	if l.holders--; l.holders > 0 || s.live != nil {
+		return
+	}
+	l.holders = 0
+	s.Events, s.History, s.Conversations, s.rendered = nil, nil, nil, nil
+	l.key = nil
+}
+
+// Queue an event of an encrypted session to be stored, sealed. Callers
+// must hold sessionMut.
+func (s *session) storeSealed(ev MessageEvent) error {
+	l := s.Transcript
+	sealed, err := sealEvent(l.key, ev, len(l.sealed)+1)
+	if err != nil {
+		return err
+	}
+	l.sealed = append(l.sealed, sealed)
+	storeWrites.add(s.id, sealed, s.LastActive)
+	return nil
+}
+
+// Serve requests of encrypted sessions only with their key: the log is
+// decrypted for the request and dropped again afterwards. Without the key
+// pages redirect to /privacy, and the JSON API answers 423 Locked.
+func transcriptMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/static/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sessionID, ok := cookieSessionID(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sessionMut.Lock()
+		sess := getSession(sessionID)
+		if sess.Transcript == nil {
+			sessionMut.Unlock()
+			next.ServeHTTP(w, r)
+			return
+		}
+		err := errWrongPassphrase
+		if c, cerr := r.Cookie(transcriptKeyCookie); cerr == nil {
+			if key, derr := base64.RawURLEncoding.DecodeString(c.Value); derr == nil {
+				err = sess.unlockTranscript(key)
+			}
+		}
+		sessionMut.Unlock()
+
+		if err != nil {
+			if r.URL.Path == "/privacy" {
+				next.ServeHTTP(w, r)
+			} else if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") {
+				redirect(w, r, "/privacy", http.StatusSeeOther)
+			} else {
+				writeAPIError(w, http.StatusLocked, "conversation is encrypted; unlock it at /privacy")
+			}
+			return
+		}
+		defer func() {
+			sessionMut.Lock()
+			sess.releaseTranscript()
+			sessionMut.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func setTranscriptKey(w http.ResponseWriter, key []byte) {
+	// A browser-session cookie: the key is forgotten when the browser closes
+	http.SetCookie(w, &http.Cookie{
+		Name:     transcriptKeyCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(key),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Transcript encryption settings: action=encrypt (passphrase, confirm)
+// seals the chat, action=unlock (passphrase) opens it in this browser and
+// action=lock forgets the key again
+func privacyHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+
+	sessionMut.Lock()
+	encrypted := getSession(sessionID).Transcript != nil
+	sessionMut.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		renderPage(w, r, "privacy.html", PrivacyPage{Encrypted: encrypted})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	passphrase := r.FormValue("passphrase")
+	var key []byte
+	var err error
+	switch r.FormValue("action") {
+	case "encrypt":
+		if encrypted {
+			err = errors.New("this conversation is already encrypted")
+		} else if passphrase != r.FormValue("confirm") {
+			err = errors.New("the passphrases do not match")
+		} else {
+			sessionMut.Lock()
+			key, err = getSession(sessionID).encryptTranscript(passphrase)
+			sessionMut.Unlock()
+		}
+	case "unlock":
+		sessionMut.Lock()
+		lock := getSession(sessionID).Transcript
+		sessionMut.Unlock()
+		account := "transcript:" + sessionHash(sessionID)
+		if lock == nil {
+			err = errors.New("this conversation is not encrypted")
+		} else if !loginAllowed(w, r, account) {
+			return
+		} else if key = deriveTranscriptKey(passphrase, lock.Salt); !lock.verify(key) {
+			loginFailed(r, account)
+			err = errWrongPassphrase
+		} else {
+			loginSucceeded(r, account)
+		}
+	case "lock":
+		http.SetCookie(w, &http.Cookie{Name: transcriptKeyCookie, Path: "/", MaxAge: -1})
+		rotateSession(w, r, sessionID)
+		redirect(w, r, "/privacy", http.StatusSeeOther)
+		return
+	default:
+		err = errors.New("unknown action")
+	}
+	if err != nil {
+		if !errors.Is(err, errWrongPassphrase) && !errors.Is(err, errShortPassphrase) {
+			log.Printf("Transcript encryption error: %v", err)
+		}
+		renderPageStatus(w, r, http.StatusBadRequest, "privacy.html", PrivacyPage{Encrypted: encrypted, Error: err.Error()})
+		return
+	}
+	// The cookie now opens the transcript: give it an ID no one has seen
+	rotateSession(w, r, sessionID)
+	setTranscriptKey(w, key)
+	redirect(w, r, "/", http.StatusSeeOther)
+}
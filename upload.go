@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Upper bound on a whole chat submission, prompt plus attachments
+	maxChatBodyBytes = 64 << 20
+	// Largest plain (non-file, non-prompt) form field accepted in multipart
+	maxFieldBytes = 64 << 10
+)
+
+// Largest prompt or attachment accepted in multipart, and the bytes of one
+// kept in memory while it uploads before it spills to a temp file in
+// uploadSpillDir (the system's when empty); vars so tests can lower them
+var (
+	maxPartBytes    = 16 << 20
+	partMemoryLimit = 1 << 20
+	uploadSpillDir  string
+)
+
+var (
+	errPromptTooLarge      = errors.New("prompt too large")
+	errEmptyPrompt         = errors.New("prompt is required")
+	errUnsupportedUpload   = errors.New("unsupported attachment type")
+	errMalformedSubmission = errors.New("malformed form submission")
+	errUploadStorage       = errors.New("could not store the upload")
+)
+
+// spillBuffer keeps small writes in memory and moves to a temp file once
+// the in-memory limit is exceeded
+type spillBuffer struct {
+	mem   bytes.Buffer
+	file  *os.File
+	limit int
+	size  int64
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.mem.Len()+len(p) > b.limit {
+		f, err := os.CreateTemp(uploadSpillDir, "chat-upload-*")
+		if err != nil {
+			log.Printf("Upload spill error: %v", err)
+			return 0, errUploadStorage
+		}
+		if _, err := f.Write(b.mem.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			log.Printf("Upload spill error: %v", err)
+			return 0, errUploadStorage
+		}
+		b.mem.Reset()
+		b.file = f
+	}
+	if b.file != nil {
+		n, err := b.file.Write(p)
+		b.size += int64(n)
+		if err != nil {
+			log.Printf("Upload spill error: %v", err)
+			return n, errUploadStorage
+		}
+		return n, nil
+	}
+	n, err := b.mem.Write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// Reader reads the buffered content from the start, from the temp file if
+// there is one. Each call starts over, ending the reader before it.
+func (b *spillBuffer) Reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.mem.Bytes()), nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Upload spill error: %v", err)
+		return nil, errUploadStorage
+	}
+	return b.file, nil
+}
+
+// Close discards the temp file, if one was created
+func (b *spillBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// Read a prompt or attachment part, at most maxPartBytes of it, into a
+// spillBuffer: a slow upload of a large part holds a temp file rather than
+// memory until it is complete. The caller closes the buffer.
+func readPart(part io.Reader) (*spillBuffer, error) {
+	buf := &spillBuffer{limit: partMemoryLimit}
+	n, err := io.Copy(buf, io.LimitReader(part, int64(maxPartBytes)+1))
+	switch {
+	case errors.Is(err, errUploadStorage):
+	case err != nil:
+		err = classifyBodyError(err)
+	case n > int64(maxPartBytes):
+		err = errPromptTooLarge
+	}
+	if err != nil {
+		buf.Close()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Add a part read by readPart to the message: the prompt, an image or a
+// text file. It is streamed from its buffer into the message, base64
+// encoding images on the way, so a spilled part is never also held in
+// memory whole before it is added.
+func (msg *Message) addPart(prompt, attachments *strings.Builder, filename string, buf *spillBuffer) error {
+	r, err := buf.Reader()
+	if err != nil {
+		return err
+	}
+	if filename == "" {
+		prompt.Reset()
+		prompt.Grow(int(buf.size))
+		return copyPart(prompt, r)
+	}
+	if buf.size == 0 {
+		// Empty file input submitted with the form
+		return nil
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return errUploadStorage
+	}
+	if strings.HasPrefix(http.DetectContentType(head[:n]), "image/") {
+		var encoded strings.Builder
+		encoded.Grow(base64.StdEncoding.EncodedLen(int(buf.size)))
+		enc := base64.NewEncoder(base64.StdEncoding, &encoded)
+		if err := copyPart(enc, io.MultiReader(bytes.NewReader(head[:n]), r)); err != nil {
+			return err
+		}
+		enc.Close()
+		msg.Images = append(msg.Images, encoded.String())
+		return nil
+	}
+
+	// Text goes in without its trailing newlines, once it is known to be
+	// UTF-8 throughout
+	if r, err = buf.Reader(); err != nil {
+		return err
+	}
+	valid, length, err := scanText(r)
+	if err != nil {
+		return errUploadStorage
+	}
+	if !valid {
+		return fmt.Errorf("%w: %s", errUnsupportedUpload, filename)
+	}
+	if r, err = buf.Reader(); err != nil {
+		return err
+	}
+	fmt.Fprintf(attachments, "\n\n--- %s ---\n```\n", filename)
+	if err := copyPart(attachments, io.LimitReader(r, length)); err != nil {
+		return err
+	}
+	attachments.WriteString("\n```")
+	return nil
+}
+
+// Copy a buffered part, reporting a failed read of its temp file as
+// errUploadStorage
+func copyPart(w io.Writer, r io.Reader) error {
+	if _, err := io.Copy(w, r); err != nil {
+		log.Printf("Upload spill error: %v", err)
+		return errUploadStorage
+	}
+	return nil
+}
+
+// Whether text read from r is valid UTF-8, and its length without trailing
+// newlines
+func scanText(r io.Reader) (valid bool, length int64, err error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	for {
+		c, size, err := br.ReadRune()
+		if err == io.EOF {
+			return true, length, nil
+		} else if err != nil {
+			return false, 0, err
+		}
+		if c == utf8.RuneError && size == 1 {
+			return false, 0, nil
+		}
+		offset += int64(size)
+		if c != '\n' {
+			length = offset
+		}
+	}
+}
+
+// Read the user's message from either a urlencoded or a multipart form.
+// Multipart bodies are parsed part by part, each bounded by maxPartBytes,
+// spilled to disk past partMemoryLimit and streamed into the message.
+func readUserMessage(w http.ResponseWriter, r *http.Request) (Message, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxChatBodyBytes)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if err := r.ParseForm(); err != nil {
+			return Message{}, classifyBodyError(err)
+		}
+		prompt := r.PostFormValue("prompt")
+		if strings.TrimSpace(prompt) == "" {
+			return Message{}, errEmptyPrompt
+		}
+		return Message{Role: "user", Content: prompt}, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return Message{}, errMalformedSubmission
+	}
+
+	// Other small fields stay reachable through r.FormValue
+	r.Form = r.URL.Query()
+	r.PostForm = url.Values{}
+
+	msg := Message{Role: "user"}
+	var prompt, attachments strings.Builder
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Message{}, classifyBodyError(err)
+		}
+
+		name, filename := part.FormName(), part.FileName()
+		if name != "prompt" && filename == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldBytes))
+			part.Close()
+			if err != nil {
+				return Message{}, classifyBodyError(err)
+			}
+			r.Form.Add(name, string(value))
+			r.PostForm.Add(name, string(value))
+			continue
+		}
+
+		buf, err := readPart(part)
+		part.Close()
+		if err != nil {
+			return Message{}, err
+		}
+		err = msg.addPart(&prompt, &attachments, filename, buf)
+		buf.Close()
+		if err != nil {
+			return Message{}, err
+		}
+	}
+
+	msg.Content = prompt.String() + attachments.String()
+	if strings.TrimSpace(msg.Content) == "" && len(msg.Images) == 0 {
+		return Message{}, errEmptyPrompt
+	}
+	return msg, nil
+}
+
+// Map body read failures onto the submission errors handlers report
+func classifyBodyError(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return errPromptTooLarge
+	}
+	return errMalformedSubmission
+}
+
+// HTTP status for a readUserMessage error
+func submissionStatus(err error) int {
+	switch {
+	case errors.Is(err, errPromptTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedUpload):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errUploadStorage):
+		return http.StatusInternalServerError
+	case errors.Is(err, errSessionFull):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusBadRequest
+	}
+}
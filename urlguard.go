@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Rules for every request the server makes to a URL a user supplied, such
+// as job callbacks; set from flags
+var fetchPolicy = URLPolicy{
+	Schemes:      []string{"http", "https"},
+	MaxRedirects: 3,
+	MaxBytes:     1 << 20,
+}
+
+var errBlockedURL = errors.New("URL not allowed")
+
+// URLPolicy limits where user-supplied URLs may point. Hosts match exactly
+// or as a parent domain ("example.com" covers "api.example.com").
+type URLPolicy struct {
+	Schemes      []string
+	AllowHosts   []string // when set, only these hosts
+	DenyHosts    []string
+	AllowPrivate bool // loopback, private, link-local and similar addresses
+	MaxRedirects int
+	MaxBytes     int64 // response body limit
+}
+
+func hostMatches(host string, patterns []string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, p := range patterns {
+		p = strings.TrimPrefix(strings.ToLower(p), "*.")
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a URL's scheme and host before anything is sent to it
+func (p URLPolicy) checkURL(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	ok := false
+	for _, s := range p.Schemes {
+		ok = ok || s == scheme
+	}
+	if !ok {
+		return fmt.Errorf("%w: scheme %q", errBlockedURL, u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("%w: no host", errBlockedURL)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in URL", errBlockedURL)
+	}
+	if hostMatches(host, p.DenyHosts) || (len(p.AllowHosts) > 0 && !hostMatches(host, p.AllowHosts)) {
+		return fmt.Errorf("%w: host %s", errBlockedURL, host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(host, ip)
+	}
+	return nil
+}
+
+// Addresses that reach the server itself or its private network. Hosts on
+// the allow list may use them, so an internal service can be let through
+// on purpose.
+func (p URLPolicy) checkIP(host string, ip net.IP) error {
+	if p.AllowPrivate || hostMatches(host, p.AllowHosts) {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s is a private address", errBlockedURL, ip)
+	}
+	return nil
+}
+
+// An HTTP client enforcing the policy: every request and redirect is
+// checked, the address is checked again when connecting (so DNS can't be
+// rebound past the check), and response bodies are cut off at MaxBytes
+func (p URLPolicy) client(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		dialer := &net.Dialer{Timeout: timeout, Control: func(_, address string, _ syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return p.checkIP(host, net.ParseIP(ip))
+		}}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: guardedTransport{transport, p},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > p.MaxRedirects {
+				return fmt.Errorf("%w: more than %d redirects", errBlockedURL, p.MaxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// guardedTransport checks each request's URL and limits its response size
+type guardedTransport struct {
+	http.RoundTripper
+	policy URLPolicy
+}
+
+func (t guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policy.checkURL(req.URL); err != nil {
+		return nil, err
+	}
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || t.policy.MaxBytes <= 0 {
+		return resp, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, left: t.policy.MaxBytes}
+	return resp, nil
+}
+
+// limitedBody fails reads once more than its limit has been read
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.left -= int64(n); b.left < 0 {
+		return n + int(b.left), fmt.Errorf("%w: response larger than the size limit", errBlockedURL)
+	}
+	return n, err
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	maxVariables     = 32
+	maxVariableBytes = 4 << 10
+)
+
+// Passphrase the variable encryption key is derived from; without one a
+// random key is made at startup, which is enough since sessions live in
+// memory anyway
+var variablesPassphrase string
+
+var (
+	variablesAEAD cipher.AEAD
+
+	// Variable names look like environment variables
+	variableName = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+	// ${NAME} in a tool argument is replaced by the variable's value
+	variableRef = regexp.MustCompile(`\$\{([A-Z_][A-Z0-9_]*)\}`)
+
+	errBadVariableName  = errors.New("variable names use capital letters, digits and underscores, like API_URL")
+	errTooManyVariables = fmt.Errorf("at most %d variables are allowed", maxVariables)
+	errVariableTooLarge = fmt.Errorf("variable values are limited to %d bytes", maxVariableBytes)
+)
+
+// VariablesPage holds data for the variables template
+type VariablesPage struct {
+	Names []string
+	Error string
+}
+
+// Set up the cipher that variable values are sealed with
+func loadVariablesKey() error {
+	key := make([]byte, 32)
+	if variablesPassphrase != "" {
+		sum := sha256.Sum256([]byte(variablesPassphrase))
+		key = sum[:]
+	} else if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	variablesAEAD, err = cipher.NewGCM(block)
+	return err
+}
+
+// Encrypt a value, bound to its name so sealed values can't be swapped
+func sealVariable(name, value string) ([]byte, error) {
+	nonce := make([]byte, variablesAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return variablesAEAD.Seal(nonce, nonce, []byte(value), []byte(name)), nil
+}
+
+func openVariable(name string, sealed []byte) (string, error) {
+	n := variablesAEAD.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("sealed variable is too short")
+	}
+	plain, err := variablesAEAD.Open(nil, sealed[:n], sealed[n:], []byte(name))
+	return string(plain), err
+}
+
+// Store a variable for the session's conversation. Callers must hold
+// sessionMut.
+func (s *session) setVariable(name, value string) error {
+	if !variableName.MatchString(name) {
+		return errBadVariableName
+	}
+	if len(value) > maxVariableBytes {
+		return errVariableTooLarge
+	}
+	if _, ok := s.Variables[name]; !ok && len(s.Variables) >= maxVariables {
+		return errTooManyVariables
+	}
+	sealed, err := sealVariable(name, value)
+	if err != nil {
+		return err
+	}
+	if s.Variables == nil {
+		s.Variables = make(map[string][]byte)
+	}
+	s.Variables[name] = sealed
+	return nil
+}
+
+// Decrypted variables of a session. Callers must hold sessionMut.
+func (s *session) variables() map[string]string {
+	vars := make(map[string]string, len(s.Variables))
+	for name, sealed := range s.Variables {
+		value, err := openVariable(name, sealed)
+		if err != nil {
+			log.Printf("Variable %s could not be decrypted: %v", name, err)
+			continue
+		}
+		vars[name] = value
+	}
+	return vars
+}
+
+func variableNames(vars map[string]string) []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Names of a session's variables, sorted. Callers must hold sessionMut.
+func (s *session) variableNames() []string {
+	names := make([]string, 0, len(s.Variables))
+	for name := range s.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Settings for the conversation's tool variables: GET lists their names,
+// POST action=set (name, value) or action=delete (name) changes one.
+// Values are never shown again once saved.
+func variablesHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+
+	switch r.Method {
+	case http.MethodGet:
+		sessionMut.Lock()
+		names := getSession(sessionID).variableNames()
+		sessionMut.Unlock()
+		renderPage(w, r, "variables.html", VariablesPage{Names: names})
+	case http.MethodPost:
+		name := strings.TrimSpace(r.FormValue("name"))
+		var err error
+		sessionMut.Lock()
+		sess := getSession(sessionID)
+		switch r.FormValue("action") {
+		case "set":
+			err = sess.setVariable(name, r.FormValue("value"))
+		case "delete":
+			delete(sess.Variables, name)
+		default:
+			err = errors.New("unknown variables action")
+		}
+		names := sess.variableNames()
+		sessionMut.Unlock()
+
+		if err != nil {
+			renderPageStatus(w, r, http.StatusBadRequest, "variables.html", VariablesPage{Names: names, Error: err.Error()})
+			return
+		}
+		redirect(w, r, "/variables", http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Tell the model which variables its tools can use, without their values
+func variablesNote(vars map[string]string) Message {
+	refs := make([]string, 0, len(vars))
+	for _, name := range variableNames(vars) {
+		refs = append(refs, "${"+name+"}")
+	}
+	return Message{Role: "system", Content: "These variables are available to tools: " + strings.Join(refs, ", ") +
+		". Write them exactly like that in tool arguments and they are filled in when the tool runs; their values are not shown to you."}
+}
+
+// Wrap a tool runner so ${NAME} references in string arguments are filled
+// in from vars, and any value echoed back in the tool's output is masked
+// again before the model sees it
+func withVariables(run toolRunner, vars map[string]string) toolRunner {
+	if len(vars) == 0 {
+		return run
+	}
+	return func(ctx context.Context, call ToolCall) string {
+		var args interface{}
+		if err := json.Unmarshal(call.Function.Arguments, &args); err == nil {
+			if expanded, err := json.Marshal(expandVariables(args, vars)); err == nil {
+				call.Function.Arguments = expanded
+			}
+		}
+		out := run(ctx, call)
+		for _, name := range variableNames(vars) {
+			if value := vars[name]; value != "" {
+				out = strings.ReplaceAll(out, value, "${"+name+"}")
+			}
+		}
+		return out
+	}
+}
+
+// Replace variable references in every string of a decoded JSON value
+func expandVariables(v interface{}, vars map[string]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return variableRef.ReplaceAllStringFunc(v, func(ref string) string {
+			if value, ok := vars[ref[2:len(ref)-1]]; ok {
+				return value
+			}
+			return ref
+		})
+	case []interface{}:
+		for i := range v {
+			v[i] = expandVariables(v[i], vars)
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = expandVariables(v[k], vars)
+		}
+	}
+	return v
+}
+
+// The messages and tool runner for a tool-enabled chat in a session
+func toolChat(sessionID string, history []Message) ([]Message, toolRunner) {
+	sessionMut.Lock()
+	vars := getSession(sessionID).variables()
+	sessionMut.Unlock()
+	if len(vars) == 0 {
+		return history, callMCPTool
+	}
+	messages := append([]Message{variablesNote(vars)}, history...)
+	return messages, withVariables(callMCPTool, vars)
+}
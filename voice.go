@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxVoiceMessageBytes = 64 << 10
+	// Reply chunks queued for a voice socket before the generation waits
+	voiceSocketBuffer = 256
+	// Longest a voice reply may keep generating, with or without a listener
+	voiceReplyTimeout = 5 * time.Minute
+)
+
+var errSlowVoiceClient = errors.New("voice client stopped reading; disconnected")
+
+// Only same-origin pages may open the socket (the upgrader's default check)
+var voiceUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+// VoiceEvent is one WebSocket frame of the voice loop. The browser sends
+// {"type": "transcript"}; the server answers with "chunk" frames for the
+// display, "sentence" frames ready to speak, then "done" or "error".
+type VoiceEvent struct {
+	Type  string `json:"type"`
+	Text  string `json:"text,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	unclosedThink  = regexp.MustCompile(`(?s)<think>.*$`)
+	markdownMarks  = regexp.MustCompile("(?m)^#{1,6}\\s+|^\\s*[-*+]\\s+|^\\s*\\d+\\.\\s+|[*_`~]+|!?\\[([^\\]]*)\\]\\([^)]*\\)")
+	sentenceEnding = regexp.MustCompile(`[.!?](?:\s|$)|\n\n`)
+)
+
+// Render the voice assistant page
+func voicePageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	getSessionID(w, r)
+	renderPage(w, r, "voice.html", nil)
+}
+
+// Run the hands-free loop: each transcript the browser recognises is added
+// to the chat history, the reply is streamed back, and complete sentences
+// are sent separately so speech can start before the reply finishes
+func voiceSocketHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	conn, err := voiceUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Voice upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxVoiceMessageBytes)
+
+	for {
+		var in VoiceEvent
+		if err := conn.ReadJSON(&in); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Voice read error: %v", err)
+			}
+			return
+		}
+		text := strings.TrimSpace(in.Text)
+		if in.Type != "transcript" || text == "" {
+			continue
+		}
+		if err := voiceTurn(r, conn, sessionID, text); err != nil {
+			log.Printf("Voice write error: %v", err)
+			return
+		}
+	}
+}
+
+// Answer one transcript, streaming the reply over the socket. The reply is
+// read from Ollama and saved to the history independently of the socket, so
+// a browser that stops reading is disconnected instead of stalling the
+// generation.
+func voiceTurn(r *http.Request, conn *websocket.Conn, sessionID, text string) error {
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	if err := sess.append(Message{Role: "user", Content: text}); err != nil {
+		sessionMut.Unlock()
+		return conn.WriteJSON(VoiceEvent{Type: "error", Error: err.Error()})
+	}
+	chatReq, conv := sess.conversationRequest(sess.Active, append([]Message(nil), sess.History...)), sess.Active
+	sessionMut.Unlock()
+
+	hub := newTokenHub()
+	socket := hub.Subscribe(voiceSocketBuffer, waitForSubscriber)
+	go func() {
+		// Not the request's context: an evicted client must not cut the reply short
+		ctx, cancel := context.WithTimeout(withAnswerLabel(withTenant(withPriority(context.Background(), priorityFrom(r.Context())), requestTenant(r))), voiceReplyTimeout)
+		defer cancel()
+		reply, err := ollamaStream(ctx, chatReq, hub.Publish)
+		if err == nil {
+			sessionMut.Lock()
+			getSession(sessionID).appendTo(conv, assistantReply(ctx, reply))
+			sessionMut.Unlock()
+		}
+		hub.Close(reply, err)
+	}()
+
+	var writeErr error
+	send := func(ev VoiceEvent) {
+		if writeErr == nil {
+			if writeErr = conn.WriteJSON(ev); writeErr != nil {
+				socket.Leave()
+			}
+		}
+	}
+
+	// spoken is an offset into the raw reply, since the speakable text of a
+	// partial reply can shrink once a link or reasoning block completes
+	var streamed strings.Builder
+	spoken := 0
+	for chunk := range socket.C {
+		streamed.WriteString(chunk)
+		send(VoiceEvent{Type: "chunk", Text: chunk})
+
+		pending := streamed.String()[spoken:]
+		if loc := lastSentenceEnd(pending); loc > 0 {
+			if text := strings.TrimSpace(speakable(pending[:loc])); text != "" {
+				send(VoiceEvent{Type: "sentence", Text: text})
+			}
+			spoken += loc
+		}
+	}
+
+	reply, err := socket.Result()
+	if socket.Evicted() {
+		return errSlowVoiceClient
+	}
+	if err != nil {
+		log.Printf("Voice Ollama error: %v", err)
+		send(VoiceEvent{Type: "error", Error: ollamaErrorText(err)})
+		return writeErr
+	}
+
+	if rest := strings.TrimSpace(speakable(reply[spoken:])); rest != "" {
+		send(VoiceEvent{Type: "sentence", Text: rest})
+	}
+	send(VoiceEvent{Type: "done"})
+	return writeErr
+}
+
+// Reduce a (possibly partial) markdown reply to the text worth reading
+// aloud: no reasoning block and no formatting characters
+func speakable(reply string) string {
+	s := thinkBlock.ReplaceAllString(reply, "")
+	s = unclosedThink.ReplaceAllString(s, "")
+	return markdownMarks.ReplaceAllString(s, "$1")
+}
+
+// Offset just past the last complete sentence in s that is not inside a
+// reasoning block or an unfinished link, or 0 if there is none
+func lastSentenceEnd(s string) int {
+	locs := sentenceEnding.FindAllStringIndex(s, -1)
+	for i := len(locs) - 1; i >= 0; i-- {
+		if end := locs[i][1]; settled(s[:end]) {
+			return end
+		}
+	}
+	return 0
+}
+
+// Whether a prefix of a reply reads the same however the reply continues:
+// every <think> is closed and every bracket and parenthesis is matched
+func settled(s string) bool {
+	return strings.Count(s, "<think>") == strings.Count(s, "</think>") &&
+		strings.Count(s, "[") == strings.Count(s, "]") &&
+		strings.Count(s, "(") == strings.Count(s, ")")
+}
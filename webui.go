@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Open WebUI keeps its chats and prompts in a SQLite file, webui.db
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// A chat as Open WebUI exports and stores it: a row whose chat column holds
+// the conversation. ollama-webui, its earlier name, exported the inner
+// object alone.
+type webUIChat struct {
+	webUIChatBody
+	Chat      *webUIChatBody `json:"chat"`
+	CreatedAt float64        `json:"created_at"`
+}
+
+type webUIChatBody struct {
+	Title     string  `json:"title"`
+	Timestamp float64 `json:"timestamp"`
+	// Every message by ID, answers that were regenerated included;
+	// currentId is the last message of the branch shown
+	History struct {
+		Messages  map[string]webUIMessage `json:"messages"`
+		CurrentID string                  `json:"currentId"`
+	} `json:"history"`
+	Messages []webUIMessage `json:"messages"` // the branch shown, in older exports
+}
+
+type webUIMessage struct {
+	ID        string  `json:"id"`
+	ParentID  string  `json:"parentId"`
+	Role      string  `json:"role"`
+	Content   string  `json:"content"`
+	Timestamp float64 `json:"timestamp"`
+	Files     []struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	} `json:"files"`
+	Images []string `json:"images"`
+}
+
+func (c webUIChat) body() webUIChatBody {
+	if c.Chat != nil {
+		if c.Chat.Title == "" {
+			c.Chat.Title = c.Title
+		}
+		return *c.Chat
+	}
+	return c.webUIChatBody
+}
+
+func (c webUIChat) isChat() bool {
+	b := c.body()
+	return c.Chat != nil || b.History.Messages != nil
+}
+
+// The conversation along the branch shown, without empty messages
+func (c webUIChat) conversation() importedConversation {
+	b := c.body()
+	conv := importedConversation{Title: b.Title, Created: webUITime(c.CreatedAt)}
+	if conv.Created.IsZero() {
+		conv.Created = webUITime(b.Timestamp)
+	}
+
+	msgs := b.Messages
+	if all := b.History.Messages; len(all) > 0 {
+		msgs = nil
+		for id := b.History.CurrentID; id != "" && len(msgs) <= len(all); id = all[id].ParentID {
+			m, ok := all[id]
+			if !ok {
+				break
+			}
+			msgs = append(msgs, m)
+		}
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+		if len(msgs) == 0 {
+			for _, m := range all {
+				msgs = append(msgs, m)
+			}
+			sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Timestamp < msgs[j].Timestamp })
+		}
+	}
+
+	for _, m := range msgs {
+		var images []string
+		for _, f := range m.Files {
+			if img, ok := dataURLImage(f.URL); ok && f.Type == "image" {
+				images = append(images, img)
+			}
+		}
+		for _, u := range m.Images {
+			if img, ok := dataURLImage(u); ok {
+				images = append(images, img)
+			}
+		}
+		if strings.TrimSpace(m.Content) == "" && len(images) == 0 {
+			continue
+		}
+		conv.Messages = append(conv.Messages, importedMessage{
+			Message: Message{Role: m.Role, Content: m.Content, Images: images},
+			Time:    webUITime(m.Timestamp),
+		})
+	}
+	return conv
+}
+
+// Open WebUI times are Unix seconds, except chat timestamps from
+// ollama-webui, which are milliseconds
+func webUITime(t float64) time.Time {
+	if t > 1e11 {
+		t /= 1000
+	}
+	return unixSeconds(t)
+}
+
+// The base64 data of an image data: URL
+func dataURLImage(u string) (string, bool) {
+	head, data, ok := strings.Cut(u, ";base64,")
+	if !ok || !strings.HasPrefix(head, "data:image/") || data == "" {
+		return "", false
+	}
+	return data, true
+}
+
+// Read an Open WebUI or ollama-webui chat export: a list of chats, or one.
+// ok is false when data is some other kind of export.
+func parseWebUIExport(data []byte) (convs []importedConversation, ok bool) {
+	var list []webUIChat
+	if len(data) > 0 && data[0] == '[' {
+		if json.Unmarshal(data, &list) != nil {
+			return nil, false
+		}
+	} else {
+		var c webUIChat
+		if json.Unmarshal(data, &c) != nil {
+			return nil, false
+		}
+		list = []webUIChat{c}
+	}
+	if len(list) == 0 {
+		return nil, false
+	}
+	for _, c := range list {
+		if !c.isChat() {
+			return nil, false
+		}
+		convs = append(convs, c.conversation())
+	}
+	sort.SliceStable(convs, func(i, j int) bool { return convs[i].Created.Before(convs[j].Created) })
+	return convs, true
+}
+
+// Open a copy of an uploaded webui.db. The caller closes the database and
+// removes the file.
+func openWebUIDatabase(data []byte) (*sql.DB, string, error) {
+	f, err := os.CreateTemp("", "webui-*.db")
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		var db *sql.DB
+		if db, err = sql.Open("sqlite", f.Name()); err == nil {
+			return db, f.Name(), nil
+		}
+	}
+	os.Remove(f.Name())
+	return nil, "", err
+}
+
+// Rows of an Open WebUI table as column name to text, so the columns that
+// vary between versions can be looked up by name
+func webUIRows(db *sql.DB, table string) ([]map[string]string, error) {
+	rows, err := db.Query(`SELECT * FROM ` + table)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not an Open WebUI database: %v", errInvalidRequest, err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var out []map[string]string
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(cols))
+		for i, c := range cols {
+			row[c] = vals[i].String
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+// Read the chats of an uploaded Open WebUI database, oldest first
+func readWebUIDatabase(data []byte) ([]importedConversation, error) {
+	db, path, err := openWebUIDatabase(data)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	defer db.Close()
+	rows, err := webUIRows(db, "chat")
+	if err != nil {
+		return nil, err
+	}
+	var convs []importedConversation
+	for _, row := range rows {
+		var body webUIChatBody
+		if json.Unmarshal([]byte(row["chat"]), &body) != nil {
+			continue
+		}
+		c := webUIChat{Chat: &body}
+		c.Title = row["title"]
+		created := row["created_at"]
+		if created == "" {
+			created = row["timestamp"]
+		}
+		c.CreatedAt, _ = strconv.ParseFloat(created, 64)
+		convs = append(convs, c.conversation())
+	}
+	sort.SliceStable(convs, func(i, j int) bool { return convs[i].Created.Before(convs[j].Created) })
+	return convs, nil
+}
+
+// A saved prompt from Open WebUI, run there by typing its command
+type webUIPrompt struct {
+	Command string `json:"command"`
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+// Open WebUI variables such as {{CLIPBOARD}} or {{topic | text}}
+var webUIVariableRe = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*(\|[^{}]*)?\}\}`)
+
+// Turn an Open WebUI prompt into a prompt template, its variables into
+// template placeholders
+func (p webUIPrompt) template() (*PromptTemplate, error) {
+	id := strings.Trim(fileNameUnsafeRe.ReplaceAllString(strings.ToLower(p.Command), "-"), "-")
+	if id == "" {
+		return nil, fmt.Errorf("prompt %q has no command", p.Title)
+	}
+	pt := &PromptTemplate{ID: id, Title: p.Title, Template: webUIVariableRe.ReplaceAllString(p.Content, "{{.$1}}")}
+	if pt.Title == "" {
+		pt.Title = p.Command
+	}
+	if _, err := template.New(id).Parse(pt.Template); err != nil {
+		return nil, fmt.Errorf("prompt %s: %w", p.Command, err)
+	}
+	return pt, nil
+}
+
+// Read the prompts of an Open WebUI database or prompt export
+func readWebUIPrompts(data []byte) ([]webUIPrompt, error) {
+	if !bytes.HasPrefix(data, sqliteHeader) {
+		var prompts []webUIPrompt
+		if err := json.Unmarshal(data, &prompts); err != nil {
+			return nil, errors.New("not an Open WebUI database or prompt export")
+		}
+		return prompts, nil
+	}
+	db, path, err := openWebUIDatabase(data)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	defer db.Close()
+	rows, err := webUIRows(db, "prompt")
+	if err != nil {
+		return nil, err
+	}
+	var prompts []webUIPrompt
+	for _, row := range rows {
+		prompts = append(prompts, webUIPrompt{Command: row["command"], Title: row["title"], Content: row["content"]})
+	}
+	return prompts, nil
+}
+
+// Write Open WebUI prompts into the prompt directory as templates:
+// "prompts import webui.db". Templates already there are left alone.
+func runPromptsImport(args []string) error {
+	fs := flag.NewFlagSet("prompts import", flag.ExitOnError)
+	fs.StringVar(&promptDir, "dir", promptDir, "directory of prompt template YAML files")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: %s prompts import [-dir prompts] webui.db|prompts.json...", os.Args[0])
+	}
+	if err := os.MkdirAll(promptDir, 0o755); err != nil {
+		return err
+	}
+
+	written := 0
+	for _, file := range fs.Args() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		prompts, err := readWebUIPrompts(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		for _, p := range prompts {
+			pt, err := p.template()
+			if err != nil {
+				fmt.Printf("skipped: %v\n", err)
+				continue
+			}
+			path := filepath.Join(promptDir, pt.ID+".yaml")
+			if _, err := os.Stat(path); err == nil {
+				fmt.Printf("skipped: %s already exists\n", path)
+				continue
+			}
+			out, err := yaml.Marshal(struct {
+				Title    string `yaml:"title,omitempty"`
+				Template string `yaml:"template"`
+			}{pt.Title, pt.Template})
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, out, 0o644); err != nil {
+				return err
+			}
+			fmt.Printf("wrote %s\n", path)
+			written++
+		}
+	}
+	fmt.Printf("%d prompts imported\n", written)
+	return nil
+}
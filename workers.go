@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Background task runner settings, set from flags before the first task
+var (
+	workerCount  = 4
+	taskAttempts = 3
+	taskTimeout  = 10 * time.Minute
+)
+
+const (
+	taskQueueSize = 256
+	// Finished tasks kept for the admin page
+	maxTaskHistory = 200
+)
+
+// Delay before each retry, multiplied by the attempt number; a var so
+// tests can shorten it
+var taskBackoff = 2 * time.Second
+
+var errQueueFull = errors.New("background queue is full")
+
+// Task states
+const (
+	TaskQueued   = "queued"
+	TaskRunning  = "running"
+	TaskRetrying = "retrying"
+	TaskDone     = "done"
+	TaskFailed   = "failed"
+)
+
+// Task is one unit of background work: a summary, an eval run, an async
+// completion
+type Task struct {
+	ID          int
+	Kind        string
+	Description string
+	State       string
+	Attempts    int
+	Error       string
+	Queued      time.Time
+	Started     time.Time
+	Finished    time.Time
+
+	run  func(context.Context) error
+	done func(error)
+}
+
+var (
+	taskQueue   = make(chan *Task, taskQueueSize)
+	taskList    []*Task // oldest first
+	nextTaskID  int
+	taskMut     sync.Mutex
+	workersOnce sync.Once
+)
+
+// Queue work for the worker pool. run is retried up to taskAttempts times;
+// done, if set, gets the final error. Work already queued or running with
+// the same kind and description is not queued twice.
+func submitTask(kind, description string, run func(context.Context) error, done func(error)) error {
+	workersOnce.Do(startWorkers)
+
+	taskMut.Lock()
+	defer taskMut.Unlock()
+	for _, t := range taskList {
+		if t.Kind == kind && t.Description == description && t.Finished.IsZero() {
+			return nil
+		}
+	}
+
+	nextTaskID++
+	t := &Task{ID: nextTaskID, Kind: kind, Description: description, State: TaskQueued, Queued: time.Now(), run: run, done: done}
+	select {
+	case taskQueue <- t:
+	default:
+		return errQueueFull
+	}
+	taskList = append(taskList, t)
+	pruneTasks()
+	return nil
+}
+
+// Forget the oldest finished tasks past maxTaskHistory. Callers must hold
+// taskMut.
+func pruneTasks() {
+	excess := len(taskList) - maxTaskHistory
+	kept := taskList[:0]
+	for _, t := range taskList {
+		if excess > 0 && !t.Finished.IsZero() {
+			excess--
+			continue
+		}
+		kept = append(kept, t)
+	}
+	taskList = kept
+}
+
+func startWorkers() {
+	n := workerCount
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		go func() {
+			for t := range taskQueue {
+				runTask(t)
+			}
+		}()
+	}
+	log.Printf("Started %d background workers", n)
+}
+
+func runTask(t *Task) {
+	taskMut.Lock()
+	t.State = TaskRunning
+	t.Started = time.Now()
+	taskMut.Unlock()
+
+	var err error
+	for attempt := 1; attempt <= taskAttempts; attempt++ {
+		taskMut.Lock()
+		t.Attempts = attempt
+		taskMut.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), taskTimeout)
+		err = t.run(ctx)
+		cancel()
+		if err == nil || errors.Is(err, errInvalidRequest) || attempt == taskAttempts {
+			break
+		}
+
+		log.Printf("Task %d (%s) failed (attempt %d/%d): %v", t.ID, t.Kind, attempt, taskAttempts, err)
+		taskMut.Lock()
+		t.State = TaskRetrying
+		t.Error = err.Error()
+		taskMut.Unlock()
+		time.Sleep(taskBackoff * time.Duration(attempt))
+		taskMut.Lock()
+		t.State = TaskRunning
+		taskMut.Unlock()
+	}
+
+	taskMut.Lock()
+	t.Finished = time.Now()
+	if err != nil {
+		t.State = TaskFailed
+		t.Error = err.Error()
+	} else {
+		t.State = TaskDone
+		t.Error = ""
+	}
+	taskMut.Unlock()
+
+	if err != nil {
+		log.Printf("Task %d (%s) failed: %v", t.ID, t.Kind, err)
+	}
+	if t.done != nil {
+		t.done(err)
+	}
+}
+
+// Copies of the known tasks, newest first, and the queue depth
+func taskSnapshot() ([]Task, int) {
+	taskMut.Lock()
+	defer taskMut.Unlock()
+	list := make([]Task, 0, len(taskList))
+	for i := len(taskList) - 1; i >= 0; i-- {
+		list = append(list, *taskList[i])
+	}
+	return list, len(taskQueue)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const maxChatFrameBytes = 1 << 20
+
+// Only same-origin pages may open the socket (the upgrader's default check)
+var chatUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+var errReplyInProgress = errors.New("a reply is already being generated")
+
+// ChatFrame is one WebSocket frame on /ws. The browser sends "prompt"
+// (text), "cancel", "retry" (regenerate the last reply), "confirm" (answer
+// the last prompt, or regenerate the last reply, whatever the fallback
+// charges) and "resume" (reply, from) after reconnecting. The server sends
+// "user" when a prompt is accepted, "status" (text) while the reply waits,
+// as for a model download, "token" frames numbered by seq, then "done" or
+// "cancelled" with the rendered reply as html, "confirm" (text) when the
+// fallback's estimated cost needs confirming, or "error".
+type ChatFrame struct {
+	Type  string `json:"type"`
+	Text  string `json:"text,omitempty"`
+	HTML  string `json:"html,omitempty"`
+	Reply int    `json:"reply,omitempty"` // live reply ID within the session
+	Seq   int    `json:"seq,omitempty"`
+	From  int    `json:"from,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Fallback backend that answered, and its estimated cost, on the frame
+	// ending a reply
+	Backend string  `json:"backend,omitempty"`
+	Cost    float64 `json:"cost,omitempty"`
+}
+
+// liveReply is a reply being generated for a session. Its tokens are kept
+// until the next reply starts, so a socket that reconnects can pick up where
+// it left off.
+type liveReply struct {
+	id     int
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	tokens    []string
+	done      bool
+	cancelled bool
+	content   string // final (or partial, if cancelled) reply
+	backend   string // fallback backend that answered, if any
+	cost      float64
+	status    string // what the reply waits for, such as a model download
+	err       error
+	changed   chan struct{}
+}
+
+func (l *liveReply) add(token string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = append(l.tokens, token)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *liveReply) setStatus(status string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.status = status
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *liveReply) finish(reply Message, cancelled bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.done, l.cancelled, l.err = true, cancelled, err
+	l.content, l.backend, l.cost = reply.Content, reply.Backend, reply.Cost
+	close(l.changed)
+}
+
+// Tokens from index i on, the status while there are none, and a channel
+// closed when there is more to read
+func (l *liveReply) since(i int) (tokens []string, status string, done bool, changed <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if i < len(l.tokens) {
+		tokens = append(tokens, l.tokens[i:]...)
+	}
+	if len(l.tokens) == 0 {
+		status = l.status
+	}
+	return tokens, status, l.done, l.changed
+}
+
+// Start generating a reply in the background, under a context with base's
+// values. prepare runs with sessionMut held and returns the request to
+// answer; save stores the finished (or cancelled, partial) reply and is
+// also called with sessionMut held.
+func startLiveReply(base context.Context, sessionID string, prepare func(*session) (OllamaChatRequest, error), save func(*session, Message)) (*liveReply, error) {
+	sessionMut.Lock()
+	sess := getSession(sessionID)
+	if sess.live != nil && !sess.live.isDone() {
+		sessionMut.Unlock()
+		return nil, errReplyInProgress
+	}
+	chatReq, err := prepare(sess)
+	if err != nil {
+		sessionMut.Unlock()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(withAnswerLabel(withTenant(withPriority(base, priorityInteractive), sessionTenant(sessionID))))
+	sess.liveReplies++
+	l := &liveReply{id: sess.liveReplies, cancel: cancel, changed: make(chan struct{})}
+	sess.live = l
+	sessionMut.Unlock()
+	ctx = withPullProgress(ctx, func(u PullUpdate) { l.setStatus(u.String()) })
+
+	go func() {
+		defer cancel()
+		reply, err := ollamaStream(ctx, chatReq, l.add)
+		cancelled := ctx.Err() != nil
+		if cancelled {
+			err = nil
+		}
+		msg := assistantReply(ctx, reply)
+		if err != nil {
+			log.Printf("Ollama API error: %v", err)
+		} else if reply != "" {
+			sessionMut.Lock()
+			save(getSession(sessionID), msg)
+			sessionMut.Unlock()
+		}
+		l.finish(msg, cancelled, err)
+	}()
+	return l, nil
+}
+
+func (l *liveReply) isDone() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.done
+}
+
+// Carry a chat over one WebSocket: prompts in, tokens out, with cancel,
+// retry, and resume after a dropped connection. Generation runs
+// independently of the socket, tied to the session cookie.
+func chatSocketHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := getSessionID(w, r)
+	client, tenant := rateLimitClient(r), requestTenant(r)
+	conn, err := chatUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Chat socket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxChatFrameBytes)
+
+	incoming := make(chan ChatFrame)
+	go func() {
+		defer close(incoming)
+		for {
+			var f ChatFrame
+			if err := conn.ReadJSON(&f); err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.Printf("Chat socket read error: %v", err)
+				}
+				return
+			}
+			incoming <- f
+		}
+	}()
+
+	var watching *liveReply
+	sent, shown := 0, ""
+	for {
+		var changed <-chan struct{}
+		if watching != nil {
+			tokens, status, done, ch := watching.since(sent)
+			if status != shown && !done {
+				if err := conn.WriteJSON(ChatFrame{Type: "status", Text: status, Reply: watching.id}); err != nil {
+					return
+				}
+				shown = status
+			}
+			for _, tok := range tokens {
+				if err := conn.WriteJSON(ChatFrame{Type: "token", Text: tok, Reply: watching.id, Seq: sent}); err != nil {
+					return
+				}
+				sent++
+			}
+			if done {
+				sessionMut.Lock()
+				hide := getSession(sessionID).HideReasoning
+				sessionMut.Unlock()
+				if err := conn.WriteJSON(finalFrame(watching, hide)); err != nil {
+					return
+				}
+				watching = nil
+			} else {
+				changed = ch
+			}
+		}
+
+		select {
+		case f, ok := <-incoming:
+			if !ok {
+				return
+			}
+			// Each frame counts against the rate limit, but for cancel,
+			// which like /chat/stop starts nothing
+			if f.Type != "cancel" {
+				if ok, wait := allowRequest(client, tenant, time.Now()); !ok {
+					if err := conn.WriteJSON(ChatFrame{Type: "error", Error: rateLimitMessage(wait)}); err != nil {
+						return
+					}
+					continue
+				}
+			}
+			l, reply := handleChatFrame(sessionID, f)
+			if reply.Type != "" {
+				if err := conn.WriteJSON(reply); err != nil {
+					return
+				}
+			}
+			if l != nil {
+				watching, sent, shown = l, 0, ""
+				if f.Type == "resume" && f.From > 0 {
+					sent = f.From
+				}
+			}
+		case <-changed:
+		}
+	}
+}
+
+// Act on one frame from the browser. It returns the live reply to stream,
+// if any, and a frame to send first.
+func handleChatFrame(sessionID string, f ChatFrame) (*liveReply, ChatFrame) {
+	switch f.Type {
+	case "prompt":
+		text := strings.TrimSpace(f.Text)
+		if text == "" {
+			return nil, ChatFrame{Type: "error", Error: errEmptyPrompt.Error()}
+		}
+		var conv int
+		l, err := startLiveReply(context.Background(), sessionID, func(s *session) (OllamaChatRequest, error) {
+			if s.queueIfOffline(Message{Role: "user", Content: text}) {
+				return OllamaChatRequest{}, errPromptQueued
+			}
+			if err := s.append(Message{Role: "user", Content: text}); err != nil {
+				return OllamaChatRequest{}, err
+			}
+			conv = s.Active
+			return s.conversationRequest(conv, s.History), nil
+		}, func(s *session, reply Message) {
+			s.appendTo(conv, reply)
+		})
+		if err == errPromptQueued {
+			return nil, ChatFrame{Type: "pending", Text: text}
+		} else if err != nil {
+			return nil, ChatFrame{Type: "error", Error: err.Error()}
+		}
+		return l, ChatFrame{Type: "user", Text: text, Reply: l.id}
+
+	case "retry":
+		var id int
+		l, err := startLiveReply(context.Background(), sessionID, func(s *session) (OllamaChatRequest, error) {
+			last := len(s.History) - 1
+			if last < 0 || s.History[last].Role != "assistant" {
+				return OllamaChatRequest{}, errors.New("there is no reply to retry")
+			}
+			id = s.History[last].ID
+			return s.conversationRequest(s.Active, append([]Message(nil), s.History[:last]...)), nil
+		}, func(s *session, reply Message) {
+			s.regenerateMessage(id, reply)
+		})
+		if err != nil {
+			return nil, ChatFrame{Type: "error", Error: err.Error()}
+		}
+		return l, ChatFrame{Type: "retry", Reply: l.id}
+
+	case "confirm":
+		// The reply the fallback's cost held back: to the last prompt, or
+		// in place of the last reply when that was a retry
+		var id, conv int
+		l, err := startLiveReply(withCostConfirmed(context.Background()), sessionID, func(s *session) (OllamaChatRequest, error) {
+			last := len(s.History) - 1
+			if last < 0 {
+				return OllamaChatRequest{}, errors.New("there is nothing to confirm")
+			}
+			conv = s.Active
+			if s.History[last].Role != "assistant" {
+				return s.conversationRequest(conv, s.History), nil
+			}
+			id = s.History[last].ID
+			return s.conversationRequest(conv, append([]Message(nil), s.History[:last]...)), nil
+		}, func(s *session, reply Message) {
+			if id != 0 {
+				s.regenerateMessage(id, reply)
+			} else {
+				s.appendTo(conv, reply)
+			}
+		})
+		if err != nil {
+			return nil, ChatFrame{Type: "error", Error: err.Error()}
+		}
+		return l, ChatFrame{Type: "retry", Reply: l.id}
+
+	case "cancel":
+		sessionMut.Lock()
+		if l := getSession(sessionID).live; l != nil {
+			l.cancel()
+		}
+		sessionMut.Unlock()
+
+	case "resume":
+		// Reply 0 means "whatever is still running", e.g. after a page load
+		sessionMut.Lock()
+		l := getSession(sessionID).live
+		sessionMut.Unlock()
+		if l != nil && (l.id == f.Reply || f.Reply == 0 && !l.isDone()) {
+			return l, ChatFrame{}
+		}
+	}
+	return nil, ChatFrame{}
+}
+
+// The frame that ends a live reply, with its reasoning above it unless
+// hidden
+func finalFrame(l *liveReply, hideReasoning bool) ChatFrame {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var costErr *CostError
+	if errors.As(l.err, &costErr) {
+		return ChatFrame{Type: "confirm", Reply: l.id, Text: costErr.Error()}
+	}
+	if l.err != nil {
+		return ChatFrame{Type: "error", Reply: l.id, Error: ollamaErrorText(l.err)}
+	}
+	html, reasoning := renderReply(Message{Role: "assistant", Content: l.content})
+	if !hideReasoning {
+		html = string(reasoningDetails(reasoning)) + html
+	}
+	if l.cancelled {
+		return ChatFrame{Type: "cancelled", Reply: l.id, HTML: html, Backend: l.backend, Cost: l.cost}
+	}
+	return ChatFrame{Type: "done", Reply: l.id, HTML: html, Backend: l.backend, Cost: l.cost}
+}